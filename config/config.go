@@ -1,20 +1,67 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
 	remote "github.com/shima-park/agollo/viper-remote"
 	"github.com/spf13/viper"
 	"gopa/model"
 	CONST "gopa/pkg/constvar"
 	"gopkg.in/yaml.v2"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var Conf *model.SysConfig
+// active 当前生效的配置，读取时不加锁
+var active atomic.Value
+
+// loaded 一次加载的结果
+type loaded struct {
+	conf     *model.SysConfig
+	source   string
+	loadedAt time.Time
+	// pending 配置源中已经修改、但需要重启才能生效的配置段
+	pending []string
+}
+
+var (
+	// reloadMu 保证同一时间只有一次重新加载
+	reloadMu sync.Mutex
+	hooks    []func(old, next *model.SysConfig)
+)
 
 func GetConfig() *model.SysConfig {
-	return Conf
+	if l, ok := active.Load().(*loaded); ok {
+		return l.conf
+	}
+	return nil
+}
+
+// LoadedAt 返回当前配置加载的时间和来源
+func LoadedAt() (time.Time, string) {
+	if l, ok := active.Load().(*loaded); ok {
+		return l.loadedAt, l.source
+	}
+	return time.Time{}, ""
+}
+
+// PendingRestart 返回已经修改、需要重启才能生效的配置段
+func PendingRestart() []string {
+	if l, ok := active.Load().(*loaded); ok {
+		return l.pending
+	}
+	return nil
+}
+
+// OnReload 注册配置重新加载后的回调，old和next为加载前后生效的配置
+func OnReload(fn func(old, next *model.SysConfig)) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	hooks = append(hooks, fn)
 }
 
 func SetConfig() error {
@@ -23,7 +70,7 @@ func SetConfig() error {
 		if err := FetchApolloConfig(
 			os.Getenv("APOLLO_ADDR"),
 			os.Getenv("APOLLO_APPID"),
-			os.Getenv("APOLLO_NAMESPACE")+"."+CONST.ApolloConfigType,
+			apolloNamespace(),
 			CONST.ApolloConfigType); err != nil {
 			return err
 		}
@@ -36,33 +83,87 @@ func SetConfig() error {
 	return nil
 }
 
-func FetchLocalConfig(path string) error{
-	absPath, err := filepath.Abs(path)
+// FetchLocalConfig 读取并校验本地的配置文件
+func FetchLocalConfig(path string) error {
+	config, absPath, err := readLocalConfig(path)
 	if err != nil {
 		return err
 	}
-	fmt.Println("dir: ", absPath)
-	fmt.Println("Base: ", filepath.Base(path))
-	var config model.SysConfig
-	f, err := os.Open(absPath)
-	if err := yaml.NewDecoder(f).Decode(&config); err != nil {
-		return err
-	}
-	Conf = &config
-	fmt.Println(Conf)
+	fmt.Println("config file: ", absPath)
+	active.Store(&loaded{conf: config, source: absPath, loadedAt: time.Now()})
 	return nil
 }
 
+// FetchApolloConfig 从Apollo读取配置，用环境变量覆盖后校验
 func FetchApolloConfig(addr string, appID string, namespace string, configType string) error {
 	var config model.SysConfig
 	if err := initApolloConfig(&config, addr, appID, namespace, configType); err != nil {
 		return err
 	}
-	Conf = &config
-	fmt.Println("Configuration is: ", Conf.LdapClient.Host)
+	if err := applyEnv(&config); err != nil {
+		return err
+	}
+	if err := Validate(&config); err != nil {
+		return err
+	}
+	active.Store(&loaded{conf: &config, source: "apollo:" + namespace, loadedAt: time.Now()})
+	fmt.Println("Configuration is loaded from apollo namespace", namespace)
 	return nil
 }
 
+// readLocalConfig 读取本地的配置文件并校验
+func readLocalConfig(path string) (*model.SysConfig, string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := ioutil.ReadFile(absPath)
+	if err != nil {
+		return nil, absPath, err
+	}
+	config, err := decodeLocalConfig(data)
+	return config, absPath, err
+}
+
+// decodeLocalConfig 解析YAML配置，用环境变量覆盖后校验，未知的配置项视为错误
+func decodeLocalConfig(data []byte) (*model.SysConfig, error) {
+	var config model.SysConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, err
+	}
+	if err := applyEnv(&config); err != nil {
+		return nil, err
+	}
+	if err := Validate(&config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// decodeApolloConfig 解析Apollo推送的配置，用环境变量覆盖后校验
+func decodeApolloConfig(data []byte, configType string) (*model.SysConfig, error) {
+	v := viper.New()
+	v.SetConfigType(configType)
+	if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	var config model.SysConfig
+	if err := v.Unmarshal(&config); err != nil {
+		return nil, err
+	}
+	if err := applyEnv(&config); err != nil {
+		return nil, err
+	}
+	if err := Validate(&config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+func apolloNamespace() string {
+	return os.Getenv("APOLLO_NAMESPACE") + "." + CONST.ApolloConfigType
+}
+
 // init apollo config
 func initApolloConfig(cfg interface{}, addr string, appID string, namespace string, configType string) error {
 	remote.SetAppID(appID)
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"gopa/model"
+
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix 覆盖配置的环境变量的前缀
+const EnvPrefix = "GOPA_"
+
+// fileSuffix 环境变量加上该后缀时，值为保存配置值的文件路径，如Kubernetes或Docker挂载的secret
+const fileSuffix = "_FILE"
+
+// overrideEnv 用环境变量覆盖配置项。环境变量的名称为GOPA_加上配置项在YAML中的路径，
+// 路径各段由驼峰转为大写下划线并用下划线连接，如mysql.password对应GOPA_MYSQL_PASSWORD，
+// ldapClient.bindPassword对应GOPA_LDAP_CLIENT_BIND_PASSWORD。
+// 名称加上_FILE后缀时从该文件读取值，文件末尾的换行会被去掉。
+// 优先级为环境变量、_FILE文件、配置文件或Apollo。
+// 字符串直接使用环境变量的值，其他类型按YAML解析，如列表写作[ldap,local]
+func overrideEnv(c *model.SysConfig, lookup func(string) (string, bool), readFile func(string) ([]byte, error)) error {
+	var errs ValidationError
+	walkEnv(reflect.ValueOf(c).Elem(), strings.TrimSuffix(EnvPrefix, "_"), "", func(field reflect.Value, name, path string) {
+		value, ok := lookup(name)
+		if !ok {
+			file, fileOK := lookup(name + fileSuffix)
+			if !fileOK {
+				return
+			}
+			data, err := readFile(file)
+			if err != nil {
+				errs = append(errs, FieldError{Field: path, Message: fmt.Sprintf("read %s%s: %v", name, fileSuffix, err)})
+				return
+			}
+			value = strings.TrimRight(string(data), "\r\n")
+		}
+		if err := setField(field, value); err != nil {
+			errs = append(errs, FieldError{Field: path, Message: fmt.Sprintf("invalid %s: %v", name, err)})
+		}
+	})
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// walkEnv 遍历结构体中可以覆盖的配置项，name为对应的环境变量名，path为YAML中的路径
+func walkEnv(v reflect.Value, name, path string, fn func(field reflect.Value, name, path string)) {
+	if v.Kind() != reflect.Struct {
+		fn(v, name, path)
+		return
+	}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if key == "-" {
+			continue
+		}
+		if key == "" {
+			key = field.Name
+		}
+		fieldPath := key
+		if path != "" {
+			fieldPath = path + "." + key
+		}
+		walkEnv(v.Field(i), name+"_"+envName(key), fieldPath, fn)
+	}
+}
+
+// setField 把环境变量的值写入配置项
+func setField(field reflect.Value, value string) error {
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+	parsed := reflect.New(field.Type())
+	if err := yaml.UnmarshalStrict([]byte(value), parsed.Interface()); err != nil {
+		return err
+	}
+	field.Set(parsed.Elem())
+	return nil
+}
+
+// envName 把驼峰的配置项名称转为大写下划线，如bindPassword转为BIND_PASSWORD，syncInitRoleID转为SYNC_INIT_ROLE_ID
+func envName(key string) string {
+	runes := []rune(key)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// applyEnv 用进程的环境变量覆盖配置
+func applyEnv(c *model.SysConfig) error {
+	return overrideEnv(c, os.LookupEnv, ioutil.ReadFile)
+}
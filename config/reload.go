@@ -0,0 +1,183 @@
+package config
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"gopa/model"
+	CONST "gopa/pkg/constvar"
+)
+
+// reloadDelay 配置文件变化后等待的时间，编辑器保存或ConfigMap更新时会连续产生多个事件
+const reloadDelay = 500 * time.Millisecond
+
+// Reporter 接收重新加载的结果，通常写入runtime日志
+type Reporter func(message string, success bool)
+
+// Watch 监听本地配置文件或Apollo命名空间，配置变化时校验并应用可以热加载的配置段。
+// 校验失败的配置不会生效
+func Watch(report Reporter) error {
+	if os.Getenv("APP_ENV") == CONST.ConfigOnline {
+		return watchApollo(os.Getenv("APOLLO_ADDR"), apolloNamespace(), CONST.ApolloConfigType, report)
+	}
+	return watchLocal(*cfg, report)
+}
+
+// Reload 用next替换当前的配置。只有可以热加载的配置段会生效，
+// 其他配置段的修改记录为需要重启
+func Reload(next *model.SysConfig, source string) []string {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	current, _ := active.Load().(*loaded)
+	if current == nil {
+		active.Store(&loaded{conf: next, source: source, loadedAt: time.Now()})
+		return nil
+	}
+	merged, pending := mergeReloadable(current.conf, next)
+	active.Store(&loaded{conf: merged, source: source, loadedAt: time.Now(), pending: pending})
+	for _, hook := range hooks {
+		hook(current.conf, merged)
+	}
+	return pending
+}
+
+// mergeReloadable 返回在old的基础上应用next中可以热加载的配置段后的配置，
+// 以及next中修改了、但需要重启才能生效的配置段
+func mergeReloadable(old, next *model.SysConfig) (*model.SysConfig, []string) {
+	merged := *old
+	merged.Log = next.Log
+	merged.LdapClient = next.LdapClient
+	merged.Notify = next.Notify
+	merged.Webhook = next.Webhook
+	merged.Auth.Providers = next.Auth.Providers
+	merged.Auth.OIDC = next.Auth.OIDC
+	merged.Auth.AdminProjects = next.Auth.AdminProjects
+
+	var pending []string
+	restart := []struct {
+		name      string
+		old, next interface{}
+	}{
+		{"service", old.Service, next.Service},
+		{"gorm", old.Gorm, next.Gorm},
+		{"mysql", old.MySql, next.MySql},
+		{"opa", old.Opa, next.Opa},
+		{"mongo", old.Mongo, next.Mongo},
+		{"auth.lockout", old.Auth.Lockout, next.Auth.Lockout},
+		{"auth.mfa", old.Auth.MFA, next.Auth.MFA},
+	}
+	for _, section := range restart {
+		if !reflect.DeepEqual(section.old, section.next) {
+			pending = append(pending, section.name)
+		}
+	}
+	return &merged, pending
+}
+
+// watchLocal 监听配置文件所在的目录。编辑器和Kubernetes的ConfigMap会通过重命名替换文件，
+// 所以不直接监听文件，而是在目录有变化时比较文件内容
+func watchLocal(path string, report Reporter) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(absPath)); err != nil {
+		watcher.Close()
+		return err
+	}
+	last := fileHash(absPath)
+	go func() {
+		defer watcher.Close()
+		var timer <-chan time.Time
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				timer = time.After(reloadDelay)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				report(err.Error(), false)
+			case <-timer:
+				timer = nil
+				hash := fileHash(absPath)
+				if hash == last {
+					continue
+				}
+				last = hash
+				next, _, err := readLocalConfig(absPath)
+				if err != nil {
+					report(fmt.Sprintf("config %s not reloaded: %v", absPath, err), false)
+					continue
+				}
+				reported(report, absPath, Reload(next, absPath))
+			}
+		}
+	}()
+	return nil
+}
+
+// apolloProvider 实现viper.RemoteProvider，用于监听Apollo命名空间
+type apolloProvider struct {
+	endpoint  string
+	namespace string
+}
+
+func (p apolloProvider) Provider() string      { return "apollo" }
+func (p apolloProvider) Endpoint() string      { return p.endpoint }
+func (p apolloProvider) Path() string          { return p.namespace }
+func (p apolloProvider) SecretKeyring() string { return "" }
+
+// watchApollo 监听Apollo命名空间的推送
+func watchApollo(addr, namespace, configType string, report Reporter) error {
+	if viper.RemoteConfig == nil {
+		return fmt.Errorf("config: apollo remote provider is not registered")
+	}
+	responses, _ := viper.RemoteConfig.WatchChannel(apolloProvider{endpoint: addr, namespace: namespace})
+	source := "apollo:" + namespace
+	go func() {
+		for resp := range responses {
+			if resp.Error != nil {
+				report(resp.Error.Error(), false)
+				continue
+			}
+			next, err := decodeApolloConfig(resp.Value, configType)
+			if err != nil {
+				report(fmt.Sprintf("config %s not reloaded: %v", source, err), false)
+				continue
+			}
+			reported(report, source, Reload(next, source))
+		}
+	}()
+	return nil
+}
+
+func reported(report Reporter, source string, pending []string) {
+	report("config reloaded from "+source, true)
+	if len(pending) > 0 {
+		report(fmt.Sprintf("config sections %v changed in %s and need a restart to take effect", pending, source), false)
+	}
+}
+
+// fileHash 返回文件内容的摘要，读取失败时返回空字符串
+func fileHash(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
@@ -0,0 +1,176 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"gopa/model"
+)
+
+// FieldError 一个配置项的错误，Field为该配置项在YAML中的路径，如ldapClient.port
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError 配置校验发现的全部错误
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, fe := range e {
+		messages = append(messages, fe.Error())
+	}
+	return "invalid config: " + strings.Join(messages, "; ")
+}
+
+// tablePrefixPattern 表名前缀直接拼接在表名前，只允许不需要转义的字符
+var tablePrefixPattern = regexp.MustCompile(`^[A-Za-z0-9_]*$`)
+
+// validator 收集配置项的错误
+type validator struct {
+	errs ValidationError
+}
+
+func (v *validator) check(ok bool, field, format string, args ...interface{}) {
+	if !ok {
+		v.errs = append(v.errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+func (v *validator) required(value, field string) {
+	v.check(value != "", field, "is required")
+}
+
+func (v *validator) nonNegative(value int, field string) {
+	v.check(value >= 0, field, "must not be negative, got %d", value)
+}
+
+func (v *validator) port(value int, field string) {
+	v.check(value > 0 && value < 65536, field, "must be a port between 1 and 65535, got %d", value)
+}
+
+func (v *validator) oneOf(value, field string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.check(false, field, "must be one of %s, got %q", strings.Join(allowed, ", "), value)
+}
+
+func (v *validator) url(value, field string) {
+	u, err := url.Parse(value)
+	v.check(err == nil && u.Scheme != "" && u.Host != "", field, "must be an absolute URL, got %q", value)
+}
+
+// Validate 校验配置，返回的ValidationError列出全部有问题的配置项。
+// 可选的取值与各模块中的常量一致，这里不引用这些模块以避免循环依赖
+func Validate(c *model.SysConfig) error {
+	v := &validator{}
+
+	v.required(c.Service.Addr, "service.addr")
+	v.oneOf(c.Service.Runmode, "service.runmode", "", "debug", "release", "test")
+	v.oneOf(c.Service.JwtAlgorithm, "service.jwtAlgorithm", "", "RS256", "ES256")
+	v.nonNegative(c.Service.MaxPingCount, "service.maxPingCount")
+	v.nonNegative(c.Service.GrantReapInterval, "service.grantReapInterval")
+	v.nonNegative(c.Service.JwtKeyRotation, "service.jwtKeyRotation")
+	if c.Service.JwtKeyEncryptionKey != "" || c.Gorm.DBType != "memory" {
+		key, err := base64.StdEncoding.DecodeString(c.Service.JwtKeyEncryptionKey)
+		v.check(err == nil && len(key) == 32, "service.jwtKeyEncryptionKey", "must be 32 bytes encoded in base64")
+	}
+	v.nonNegative(c.Service.TokenTimeout, "service.tokenTimeout")
+	for i, proxy := range c.Service.TrustedProxies {
+		_, _, cidrErr := net.ParseCIDR(proxy)
+		v.check(cidrErr == nil || net.ParseIP(proxy) != nil, fmt.Sprintf("service.trustedProxies[%d]", i),
+			"must be an IP or CIDR, got %q", proxy)
+	}
+	v.nonNegative(c.Service.RefreshTokenTimeout, "service.refreshTokenTimeout")
+
+	v.required(c.Log.Dir, "log.dir")
+	v.nonNegative(c.Log.Remain, "log.remain")
+
+	v.nonNegative(c.Gorm.MaxLifetime, "gorm.maxLifetime")
+	v.nonNegative(c.Gorm.MaxOpenConns, "gorm.maxOpenConns")
+	v.nonNegative(c.Gorm.MaxIdleConns, "gorm.maxIdleConns")
+	v.check(tablePrefixPattern.MatchString(c.Gorm.TablePrefix), "gorm.tablePrefix",
+		"may only contain letters, digits and underscores, got %q", c.Gorm.TablePrefix)
+
+	v.oneOf(c.Gorm.DBType, "gorm.dbType", "", "mysql", "sqlite", "memory")
+	switch c.Gorm.DBType {
+	case "", "mysql":
+		v.required(c.MySql.Host, "mysql.host")
+		v.port(c.MySql.Port, "mysql.port")
+		v.required(c.MySql.DBName, "mysql.dbName")
+	case "sqlite":
+		v.required(c.Gorm.SQLitePath, "gorm.sqlitePath")
+	}
+
+	v.oneOf(c.Gorm.EntityStore, "gorm.entityStore", "", "database", "memory")
+
+	v.oneOf(c.Opa.RegoStore, "opa.regoStore", "", "mongo", "memory", "database")
+	if c.Opa.RegoStore == "mongo" || (c.Opa.RegoStore == "" && c.Gorm.DBType != "memory") {
+		v.required(c.Mongo.Address, "mongo.address")
+	}
+
+	if c.LdapClient.Host != "" {
+		v.port(c.LdapClient.Port, "ldapClient.port")
+	}
+	v.nonNegative(c.LdapClient.MaxConns, "ldapClient.maxConns")
+	v.nonNegative(c.LdapClient.Timeout, "ldapClient.timeout")
+	v.nonNegative(c.LdapClient.HealthCheckInterval, "ldapClient.healthCheckInterval")
+	v.nonNegative(c.LdapClient.Sync.Interval, "ldapClient.sync.interval")
+	for i, m := range c.LdapClient.Sync.Mappings {
+		field := fmt.Sprintf("ldapClient.sync.mappings[%d]", i)
+		v.required(m.Group, field+".group")
+		v.required(m.Project, field+".project")
+		v.required(m.Role, field+".role")
+	}
+
+	for i, p := range c.Auth.Providers {
+		v.oneOf(p, fmt.Sprintf("auth.providers[%d]", i), "ldap", "local")
+	}
+	if c.Auth.OIDC.Enabled {
+		v.url(c.Auth.OIDC.Issuer, "auth.oidc.issuer")
+		v.required(c.Auth.OIDC.ClientID, "auth.oidc.clientId")
+		v.url(c.Auth.OIDC.RedirectURL, "auth.oidc.redirectUrl")
+	}
+	v.oneOf(c.Auth.Lockout.Store, "auth.lockout.store", "", "memory", "database")
+	v.nonNegative(c.Auth.Lockout.MaxFailures, "auth.lockout.maxFailures")
+	v.nonNegative(c.Auth.Lockout.IPMaxFailures, "auth.lockout.ipMaxFailures")
+	v.nonNegative(c.Auth.Lockout.BaseDelay, "auth.lockout.baseDelay")
+	v.nonNegative(c.Auth.Lockout.MaxDelay, "auth.lockout.maxDelay")
+	v.nonNegative(c.Auth.Lockout.Duration, "auth.lockout.duration")
+	if c.Auth.MFA.EncryptionKey != "" {
+		key, err := base64.StdEncoding.DecodeString(c.Auth.MFA.EncryptionKey)
+		v.check(err == nil && len(key) == 32, "auth.mfa.encryptionKey", "must be 32 bytes encoded in base64")
+	}
+
+	if c.Notify.Slack.Enabled {
+		v.check(c.Notify.Slack.WebhookURL != "" || c.Notify.Slack.BotToken != "",
+			"notify.slack", "webhookUrl or botToken is required when enabled")
+		if c.Notify.Slack.WebhookURL == "" && c.Notify.Slack.BotToken != "" {
+			v.required(c.Notify.Slack.Channel, "notify.slack.channel")
+		}
+	}
+	for i, r := range c.Notify.Slack.Routes {
+		v.required(r.Project, fmt.Sprintf("notify.slack.routes[%d].project", i))
+	}
+
+	v.nonNegative(c.Webhook.MaxAttempts, "webhook.maxAttempts")
+	v.nonNegative(c.Webhook.Backoff, "webhook.backoff")
+	v.nonNegative(c.Webhook.Timeout, "webhook.timeout")
+
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
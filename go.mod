@@ -5,7 +5,6 @@ require (
 	github.com/StackExchange/wmi v1.2.1 // indirect
 	github.com/YueHonghui/rfw v1.0.0
 	github.com/alecthomas/template v0.0.0-20190718012654-fb15b899a751 // indirect
-	github.com/appleboy/gin-jwt/v2 v2.7.0
 	github.com/coreos/etcd v3.3.13+incompatible // indirect
 	github.com/dgrijalva/jwt-go v3.2.1-0.20190620180102-5e25c22bd5d6+incompatible
 	github.com/fsnotify/fsnotify v1.5.1
@@ -13,12 +12,12 @@ require (
 	github.com/gin-gonic/gin v1.7.4
 	github.com/go-ole/go-ole v1.2.6 // indirect
 	github.com/go-resty/resty/v2 v2.7.0 // indirect
-	github.com/go-sql-driver/mysql v1.6.0 // indirect
+	github.com/go-sql-driver/mysql v1.6.0
 	github.com/hashicorp/hcl v1.0.1-0.20191016231534-914dc3f8dd7c // indirect
 	github.com/jinzhu/gorm v1.9.12-0.20191119080800-59408390c2dc // indirect
-	github.com/jtblin/go-ldap-client v0.0.0-20170223121919-b73f66626b33
 	github.com/mailru/easyjson v0.7.1-0.20191009090205-6c0755d89d1e // indirect
 	github.com/mattn/go-colorable v0.1.11 // indirect
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/open-policy-agent/opa v0.34.2
 	github.com/pilu/config v0.0.0-20131214182432-3eb99e6c0b9a // indirect
 	github.com/pilu/fresh v0.0.0-20190826141211-0fa698148017 // indirect
@@ -40,9 +39,10 @@ require (
 	golang.org/x/crypto v0.0.0-20201216223049-8b5274cf687f
 	golang.org/x/sys v0.0.0-20211124211545-fe61309f8881 // indirect
 	gopkg.in/asn1-ber.v1 v1.0.0-20181015200546-f715ec2f112d // indirect
-	gopkg.in/ldap.v2 v2.5.1 // indirect
+	gopkg.in/ldap.v2 v2.5.1
 	gopkg.in/yaml.v2 v2.4.0
 	gorm.io/driver/mysql v1.2.0
+	gorm.io/driver/sqlite v1.1.4
 	gorm.io/gorm v1.22.3
 	istio.io/pkg v0.0.0-20200908160754-55ca040b8d7a
 )
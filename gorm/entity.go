@@ -0,0 +1,170 @@
+package gorm
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gopa/model"
+	"gorm.io/gorm"
+)
+
+const (
+	// EntityStoreDatabase 组、角色、成员和资源授权保存在gorm.dbType指定的关系数据库中
+	EntityStoreDatabase = "database"
+	// EntityStoreMemory 组、角色、成员和资源授权只保存在内存中，重启后丢失
+	EntityStoreMemory = "memory"
+)
+
+var (
+	// ErrEntityExists 名称相同的组、角色或授权已经存在
+	ErrEntityExists = errors.New("entity already exists")
+	// ErrEntityConflict 记录已经被修改，版本与请求中的不一致
+	ErrEntityConflict = errors.New("entity version conflict")
+)
+
+// EntityStore 组、角色、成员和资源授权的存储。其他表仍然通过DB访问
+type EntityStore interface {
+	Projects() ProjectRepository
+	Roles() RoleRepository
+	Members() MemberRepository
+	Resources() ResourceRepository
+	// DB 返回其他表所在的数据库，在Transaction中为同一个事务
+	DB() *gorm.DB
+	// Transaction 在一个事务中执行fn，fn通过tx修改实体，通过tx.DB()修改其他表，
+	// fn返回错误时全部回滚。可以嵌套
+	Transaction(fn func(tx EntityStore) error) error
+}
+
+// ProjectRepository 组以及组内的角色
+type ProjectRepository interface {
+	// List 返回全部组
+	List() ([]model.GopaProjects, error)
+	// Exists 判断组是否存在
+	Exists(name string) (bool, error)
+	// Create 添加组，版本为1。组名已存在时返回ErrEntityExists
+	Create(project model.GopaProjects) error
+	// Delete 删除组，返回删除的行数
+	Delete(name string) (int64, error)
+	// CountChildren 返回parent的直接下级组的数量
+	CountChildren(parent string) (int64, error)
+	// SetMfaRequired 修改组是否需要两步验证并把版本加一，返回修改的行数
+	SetMfaRequired(name string, required bool) (int64, error)
+	// AnyMfaRequired 判断names中是否有需要两步验证的组
+	AnyMfaRequired(names []string) (bool, error)
+	// ListRoles 返回全部组内的角色
+	ListRoles() ([]model.GopaProjectRoles, error)
+	// AddRole 为组添加角色，版本为1
+	AddRole(projectRole model.GopaProjectRoles) error
+	// RemoveRole 删除组内的角色，返回删除的行数
+	RemoveRole(project, role string) (int64, error)
+}
+
+// RoleRepository 角色以及角色的继承关系
+type RoleRepository interface {
+	// List 返回全部角色
+	List() ([]model.GopaRoles, error)
+	// Exists 判断角色是否存在
+	Exists(name string) (bool, error)
+	// Create 添加角色以及它继承的父角色，版本为1。角色名已存在时返回ErrEntityExists
+	Create(role model.GopaRoles, parents []string) error
+	// Delete 删除角色以及与它相关的继承关系，返回删除的角色数
+	Delete(name string) (int64, error)
+	// ListParents 返回全部继承关系
+	ListParents() ([]model.GopaRoleParents, error)
+	// ReplaceParents 用parents替换role的全部父角色并把角色的版本加一，返回修改的角色数。
+	// version不为AnyVersion时只修改该版本的角色，版本不同时返回ErrEntityConflict
+	ReplaceParents(role string, parents []string, version int64) (int64, error)
+	// SetMfaRequired 修改角色是否需要两步验证并把版本加一，返回修改的行数
+	SetMfaRequired(name string, required bool) (int64, error)
+	// AnyMfaRequired 判断names中是否有需要两步验证的角色
+	AnyMfaRequired(names []string) (bool, error)
+}
+
+// MemberQuery 查询授权的条件，为空的条件不限制。Projects不为nil时只返回这些组的授权
+type MemberQuery struct {
+	ID       uint64
+	Username string
+	Project  string
+	Projects []string
+	Role     string
+	Source   string
+	// ActiveAt 不为零时只返回在该时刻有效且未被停用的授权
+	ActiveAt time.Time
+	// ExpiredAt 不为零时只返回在该时刻已经过期的授权
+	ExpiredAt time.Time
+}
+
+// MemberUpdate 修改授权的字段，为空的字段不修改
+type MemberUpdate struct {
+	Project   string
+	Role      string
+	ValidFrom *time.Time
+	ExpiresAt *time.Time
+	Disabled  *bool
+}
+
+// MemberRepository 用户在组内的角色
+type MemberRepository interface {
+	// Find 按ID的顺序返回满足query的授权
+	Find(query MemberQuery) ([]model.GopaMembers, error)
+	// Create 添加授权，版本为1。用户在组内已经有该角色时返回ErrEntityExists
+	Create(member model.GopaMembers) error
+	// Update 修改id对应的授权并把版本加一，返回修改的行数，授权不存在时为0。
+	// version不为AnyVersion时只修改该版本的授权，版本不同时返回ErrEntityConflict，
+	// 修改后与用户的其他授权重复时返回ErrEntityExists
+	Update(id uint64, version int64, update MemberUpdate) (int64, error)
+	// Delete 删除id对应的授权，返回删除的行数
+	Delete(id uint64) (int64, error)
+	// DeleteUser 删除用户的全部授权，返回删除的行数
+	DeleteUser(username string) (int64, error)
+}
+
+// ResourceQuery 查询资源授权的条件，为空的条件不限制。
+// Projects和Roles不为nil时只返回授权给这些组和角色的记录
+type ResourceQuery struct {
+	ID       uint64
+	Router   string
+	Project  string
+	Role     string
+	Projects []string
+	Roles    []string
+}
+
+// ResourceRepository 资源对组内角色的授权
+type ResourceRepository interface {
+	// Find 按ID的顺序返回满足query的授权
+	Find(query ResourceQuery) ([]model.ProjectResources, error)
+	// Create 添加授权，版本为1
+	Create(resource model.ProjectResources) error
+	// Update 修改id对应的授权的组和角色并把版本加一，为空的字段不修改，返回修改的行数，授权不存在时为0。
+	// version不为AnyVersion时只修改该版本的授权，版本不同时返回ErrEntityConflict
+	Update(id uint64, version int64, project, role string) (int64, error)
+	// Delete 删除资源对组内角色的授权，返回删除的行数
+	Delete(router, project, role string) (int64, error)
+}
+
+// Entities 当前使用的组、角色、成员和资源授权的存储
+var Entities EntityStore
+
+// NewEntityStore 按gorm.entityStore创建组、角色、成员和资源授权的存储，db为其他表所在的数据库
+func NewEntityStore(c *model.SysConfig, db *gorm.DB) (EntityStore, error) {
+	switch EntityStoreType(c) {
+	case EntityStoreDatabase:
+		return SQLEntityStore{Self: db}, nil
+	case EntityStoreMemory:
+		return NewMemoryEntityStore(db), nil
+	}
+	return nil, fmt.Errorf("unknown gorm.entityStore %q", c.Gorm.EntityStore)
+}
+
+// EntityStoreType 返回生效的组、角色、成员和资源授权的存储方式
+func EntityStoreType(c *model.SysConfig) string {
+	if c.Gorm.EntityStore != "" {
+		return c.Gorm.EntityStore
+	}
+	if c.Gorm.DBType == DBTypeMemory {
+		return EntityStoreMemory
+	}
+	return EntityStoreDatabase
+}
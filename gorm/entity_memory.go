@@ -0,0 +1,559 @@
+package gorm
+
+import (
+	"sync"
+	"time"
+
+	"gopa/model"
+	"gorm.io/gorm"
+)
+
+// entityState 内存中某一时刻的全部实体。发布后不再修改，
+// 修改时复制一份，修改完成后替换，读取不会看到修改了一半的数据
+type entityState struct {
+	nextID       uint64
+	projects     []model.GopaProjects
+	roles        []model.GopaRoles
+	parents      []model.GopaRoleParents
+	projectRoles []model.GopaProjectRoles
+	members      []model.GopaMembers
+	resources    []model.ProjectResources
+}
+
+func (s *entityState) clone() *entityState {
+	return &entityState{
+		nextID:       s.nextID,
+		projects:     append([]model.GopaProjects(nil), s.projects...),
+		roles:        append([]model.GopaRoles(nil), s.roles...),
+		parents:      append([]model.GopaRoleParents(nil), s.parents...),
+		projectRoles: append([]model.GopaProjectRoles(nil), s.projectRoles...),
+		members:      append([]model.GopaMembers(nil), s.members...),
+		resources:    append([]model.ProjectResources(nil), s.resources...),
+	}
+}
+
+// newBase 返回新记录的ID和时间
+func (s *entityState) newBase() model.BaseModel {
+	s.nextID++
+	now := time.Now()
+	return model.BaseModel{ID: s.nextID, CreatedAt: now, UpdatedAt: now}
+}
+
+// memoryEntities 内存中实体的当前状态。writeMu保证同一时间只有一个修改，
+// mu只在替换state时持有，读取不需要等待正在进行的事务
+type memoryEntities struct {
+	writeMu sync.Mutex
+	mu      sync.RWMutex
+	state   *entityState
+}
+
+func (e *memoryEntities) current() *entityState {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.state
+}
+
+func (e *memoryEntities) replace(state *entityState) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.state = state
+}
+
+// MemoryEntityStore 保存在内存中的组、角色、成员和资源授权，用于测试和不依赖外部服务的部署。
+// 其他表仍然保存在db中，事务同时包括两者
+type MemoryEntityStore struct {
+	entities *memoryEntities
+	db       *gorm.DB
+	// tx 事务中修改的副本，不在事务中时为nil
+	tx *entityState
+}
+
+// NewMemoryEntityStore 创建空的MemoryEntityStore，db为其他表所在的数据库
+func NewMemoryEntityStore(db *gorm.DB) *MemoryEntityStore {
+	return &MemoryEntityStore{entities: &memoryEntities{state: &entityState{}}, db: db}
+}
+
+func (s *MemoryEntityStore) Projects() ProjectRepository   { return memoryProjects{s} }
+func (s *MemoryEntityStore) Roles() RoleRepository         { return memoryRoles{s} }
+func (s *MemoryEntityStore) Members() MemberRepository     { return memoryMembers{s} }
+func (s *MemoryEntityStore) Resources() ResourceRepository { return memoryResources{s} }
+func (s *MemoryEntityStore) DB() *gorm.DB                  { return s.db }
+
+// Transaction 在副本上执行fn，db中的事务提交后才替换当前的实体。
+// 事务进行时其他修改需要等待，读取的是事务开始前的数据
+func (s *MemoryEntityStore) Transaction(fn func(tx EntityStore) error) error {
+	if s.tx != nil {
+		nested := s.tx.clone()
+		err := s.db.Transaction(func(db *gorm.DB) error {
+			return fn(&MemoryEntityStore{entities: s.entities, db: db, tx: nested})
+		})
+		if err != nil {
+			return err
+		}
+		*s.tx = *nested
+		return nil
+	}
+	s.entities.writeMu.Lock()
+	defer s.entities.writeMu.Unlock()
+	next := s.entities.current().clone()
+	err := s.db.Transaction(func(db *gorm.DB) error {
+		return fn(&MemoryEntityStore{entities: s.entities, db: db, tx: next})
+	})
+	if err != nil {
+		return err
+	}
+	s.entities.replace(next)
+	return nil
+}
+
+// read 返回要读取的实体，事务中为事务的副本
+func (s *MemoryEntityStore) read() *entityState {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.entities.current()
+}
+
+// write 在副本上执行fn，fn返回错误时不修改。fn在返回错误之前不能修改state
+func (s *MemoryEntityStore) write(fn func(state *entityState) error) error {
+	if s.tx != nil {
+		return fn(s.tx)
+	}
+	s.entities.writeMu.Lock()
+	defer s.entities.writeMu.Unlock()
+	next := s.entities.current().clone()
+	if err := fn(next); err != nil {
+		return err
+	}
+	s.entities.replace(next)
+	return nil
+}
+
+// checkVersion 检查记录的版本，version为AnyVersion时不检查
+func checkVersion(current, version int64) error {
+	if version != AnyVersion && current != version {
+		return ErrEntityConflict
+	}
+	return nil
+}
+
+type memoryProjects struct{ s *MemoryEntityStore }
+
+func (r memoryProjects) List() ([]model.GopaProjects, error) {
+	return append([]model.GopaProjects(nil), r.s.read().projects...), nil
+}
+
+func (r memoryProjects) Exists(name string) (bool, error) {
+	return r.find(r.s.read(), name) >= 0, nil
+}
+
+func (memoryProjects) find(state *entityState, name string) int {
+	for i, project := range state.projects {
+		if project.ProjectName == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r memoryProjects) Create(project model.GopaProjects) error {
+	return r.s.write(func(state *entityState) error {
+		if r.find(state, project.ProjectName) >= 0 {
+			return ErrEntityExists
+		}
+		project.BaseModel = state.newBase()
+		project.Version = 1
+		state.projects = append(state.projects, project)
+		return nil
+	})
+}
+
+func (r memoryProjects) Delete(name string) (rows int64, err error) {
+	err = r.s.write(func(state *entityState) error {
+		kept := state.projects[:0]
+		for _, project := range state.projects {
+			if project.ProjectName == name {
+				rows++
+				continue
+			}
+			kept = append(kept, project)
+		}
+		state.projects = kept
+		return nil
+	})
+	return rows, err
+}
+
+func (r memoryProjects) CountChildren(parent string) (int64, error) {
+	var children int64
+	for _, project := range r.s.read().projects {
+		if project.ParentProject == parent {
+			children++
+		}
+	}
+	return children, nil
+}
+
+func (r memoryProjects) SetMfaRequired(name string, required bool) (rows int64, err error) {
+	err = r.s.write(func(state *entityState) error {
+		if i := r.find(state, name); i >= 0 {
+			state.projects[i].MfaRequired = required
+			state.projects[i].Version++
+			state.projects[i].UpdatedAt = time.Now()
+			rows = 1
+		}
+		return nil
+	})
+	return rows, err
+}
+
+func (r memoryProjects) AnyMfaRequired(names []string) (bool, error) {
+	for _, project := range r.s.read().projects {
+		if project.MfaRequired && containsName(names, project.ProjectName) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r memoryProjects) ListRoles() ([]model.GopaProjectRoles, error) {
+	return append([]model.GopaProjectRoles(nil), r.s.read().projectRoles...), nil
+}
+
+func (r memoryProjects) AddRole(projectRole model.GopaProjectRoles) error {
+	return r.s.write(func(state *entityState) error {
+		projectRole.BaseModel = state.newBase()
+		projectRole.Version = 1
+		state.projectRoles = append(state.projectRoles, projectRole)
+		return nil
+	})
+}
+
+func (r memoryProjects) RemoveRole(project, role string) (rows int64, err error) {
+	err = r.s.write(func(state *entityState) error {
+		kept := state.projectRoles[:0]
+		for _, projectRole := range state.projectRoles {
+			if projectRole.ProjectName == project && projectRole.RoleName == role {
+				rows++
+				continue
+			}
+			kept = append(kept, projectRole)
+		}
+		state.projectRoles = kept
+		return nil
+	})
+	return rows, err
+}
+
+type memoryRoles struct{ s *MemoryEntityStore }
+
+func (r memoryRoles) List() ([]model.GopaRoles, error) {
+	return append([]model.GopaRoles(nil), r.s.read().roles...), nil
+}
+
+func (r memoryRoles) Exists(name string) (bool, error) {
+	return r.find(r.s.read(), name) >= 0, nil
+}
+
+func (memoryRoles) find(state *entityState, name string) int {
+	for i, role := range state.roles {
+		if role.RoleName == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r memoryRoles) Create(role model.GopaRoles, parents []string) error {
+	return r.s.write(func(state *entityState) error {
+		if r.find(state, role.RoleName) >= 0 {
+			return ErrEntityExists
+		}
+		role.BaseModel = state.newBase()
+		role.Version = 1
+		state.roles = append(state.roles, role)
+		replaceParents(state, role.RoleName, parents)
+		return nil
+	})
+}
+
+func (r memoryRoles) Delete(name string) (rows int64, err error) {
+	err = r.s.write(func(state *entityState) error {
+		kept := state.roles[:0]
+		for _, role := range state.roles {
+			if role.RoleName == name {
+				rows++
+				continue
+			}
+			kept = append(kept, role)
+		}
+		state.roles = kept
+		edges := state.parents[:0]
+		for _, edge := range state.parents {
+			if edge.RoleName != name && edge.ParentRoleName != name {
+				edges = append(edges, edge)
+			}
+		}
+		state.parents = edges
+		return nil
+	})
+	return rows, err
+}
+
+func (r memoryRoles) ListParents() ([]model.GopaRoleParents, error) {
+	return append([]model.GopaRoleParents(nil), r.s.read().parents...), nil
+}
+
+func (r memoryRoles) ReplaceParents(role string, parents []string, version int64) (rows int64, err error) {
+	err = r.s.write(func(state *entityState) error {
+		i := r.find(state, role)
+		if i < 0 {
+			return nil
+		}
+		if err := checkVersion(state.roles[i].Version, version); err != nil {
+			return err
+		}
+		state.roles[i].Version++
+		state.roles[i].UpdatedAt = time.Now()
+		replaceParents(state, role, parents)
+		rows = 1
+		return nil
+	})
+	return rows, err
+}
+
+// replaceParents 用parents替换role当前的全部父角色
+func replaceParents(state *entityState, role string, parents []string) {
+	edges := state.parents[:0]
+	for _, edge := range state.parents {
+		if edge.RoleName != role {
+			edges = append(edges, edge)
+		}
+	}
+	for _, parent := range parents {
+		edges = append(edges, model.GopaRoleParents{BaseModel: state.newBase(), RoleName: role, ParentRoleName: parent})
+	}
+	state.parents = edges
+}
+
+func (r memoryRoles) SetMfaRequired(name string, required bool) (rows int64, err error) {
+	err = r.s.write(func(state *entityState) error {
+		if i := r.find(state, name); i >= 0 {
+			state.roles[i].MfaRequired = required
+			state.roles[i].Version++
+			state.roles[i].UpdatedAt = time.Now()
+			rows = 1
+		}
+		return nil
+	})
+	return rows, err
+}
+
+func (r memoryRoles) AnyMfaRequired(names []string) (bool, error) {
+	for _, role := range r.s.read().roles {
+		if role.MfaRequired && containsName(names, role.RoleName) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type memoryMembers struct{ s *MemoryEntityStore }
+
+func (r memoryMembers) Find(query MemberQuery) ([]model.GopaMembers, error) {
+	var members []model.GopaMembers
+	for _, member := range r.s.read().members {
+		if memberMatches(member, query) {
+			members = append(members, member)
+		}
+	}
+	return members, nil
+}
+
+// memberMatches 判断授权是否满足query，与sqlMembers.Find的条件一致
+func memberMatches(member model.GopaMembers, query MemberQuery) bool {
+	switch {
+	case query.ID != 0 && member.ID != query.ID,
+		query.Username != "" && member.Username != query.Username,
+		query.Project != "" && member.Project != query.Project,
+		query.Projects != nil && !containsName(query.Projects, member.Project),
+		query.Role != "" && member.Role != query.Role,
+		query.Source != "" && member.Source != query.Source:
+		return false
+	}
+	if now := query.ActiveAt; !now.IsZero() {
+		if member.Disabled || (member.ValidFrom != nil && member.ValidFrom.After(now)) ||
+			(member.ExpiresAt != nil && !member.ExpiresAt.After(now)) {
+			return false
+		}
+	}
+	if now := query.ExpiredAt; !now.IsZero() {
+		if member.ExpiresAt == nil || member.ExpiresAt.After(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// findGrant 返回用户在组内该角色的授权的位置，与唯一索引idx_gopa_members_grant对应
+func (memoryMembers) findGrant(state *entityState, username, project, role string) int {
+	for i, member := range state.members {
+		if member.Username == username && member.Project == project && member.Role == role {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r memoryMembers) Create(member model.GopaMembers) error {
+	return r.s.write(func(state *entityState) error {
+		if r.findGrant(state, member.Username, member.Project, member.Role) >= 0 {
+			return ErrEntityExists
+		}
+		member.BaseModel = state.newBase()
+		member.Version = 1
+		state.members = append(state.members, member)
+		return nil
+	})
+}
+
+func (r memoryMembers) Update(id uint64, version int64, update MemberUpdate) (rows int64, err error) {
+	err = r.s.write(func(state *entityState) error {
+		for i, member := range state.members {
+			if member.ID != id {
+				continue
+			}
+			if err := checkVersion(member.Version, version); err != nil {
+				return err
+			}
+			if update.Project != "" {
+				member.Project = update.Project
+			}
+			if update.Role != "" {
+				member.Role = update.Role
+			}
+			if update.ValidFrom != nil {
+				member.ValidFrom = update.ValidFrom
+			}
+			if update.ExpiresAt != nil {
+				member.ExpiresAt = update.ExpiresAt
+			}
+			if update.Disabled != nil {
+				member.Disabled = *update.Disabled
+			}
+			if j := r.findGrant(state, member.Username, member.Project, member.Role); j >= 0 && j != i {
+				return ErrEntityExists
+			}
+			member.Version++
+			member.UpdatedAt = time.Now()
+			state.members[i] = member
+			rows = 1
+			return nil
+		}
+		return nil
+	})
+	return rows, err
+}
+
+func (r memoryMembers) Delete(id uint64) (int64, error) {
+	return r.deleteWhere(func(member model.GopaMembers) bool { return member.ID == id })
+}
+
+func (r memoryMembers) DeleteUser(username string) (int64, error) {
+	return r.deleteWhere(func(member model.GopaMembers) bool { return member.Username == username })
+}
+
+func (r memoryMembers) deleteWhere(match func(member model.GopaMembers) bool) (rows int64, err error) {
+	err = r.s.write(func(state *entityState) error {
+		kept := state.members[:0]
+		for _, member := range state.members {
+			if match(member) {
+				rows++
+				continue
+			}
+			kept = append(kept, member)
+		}
+		state.members = kept
+		return nil
+	})
+	return rows, err
+}
+
+type memoryResources struct{ s *MemoryEntityStore }
+
+func (r memoryResources) Find(query ResourceQuery) ([]model.ProjectResources, error) {
+	var resources []model.ProjectResources
+	for _, resource := range r.s.read().resources {
+		switch {
+		case query.ID != 0 && resource.ID != query.ID,
+			query.Router != "" && resource.ResourceRouter != query.Router,
+			query.Project != "" && resource.ProjectName != query.Project,
+			query.Role != "" && resource.RoleName != query.Role,
+			query.Projects != nil && !containsName(query.Projects, resource.ProjectName),
+			query.Roles != nil && !containsName(query.Roles, resource.RoleName):
+			continue
+		}
+		resources = append(resources, resource)
+	}
+	return resources, nil
+}
+
+func (r memoryResources) Create(resource model.ProjectResources) error {
+	return r.s.write(func(state *entityState) error {
+		resource.BaseModel = state.newBase()
+		resource.Version = 1
+		state.resources = append(state.resources, resource)
+		return nil
+	})
+}
+
+func (r memoryResources) Update(id uint64, version int64, project, role string) (rows int64, err error) {
+	err = r.s.write(func(state *entityState) error {
+		for i, resource := range state.resources {
+			if resource.ID != id {
+				continue
+			}
+			if err := checkVersion(resource.Version, version); err != nil {
+				return err
+			}
+			if project != "" {
+				resource.ProjectName = project
+			}
+			if role != "" {
+				resource.RoleName = role
+			}
+			resource.Version++
+			resource.UpdatedAt = time.Now()
+			state.resources[i] = resource
+			rows = 1
+			return nil
+		}
+		return nil
+	})
+	return rows, err
+}
+
+func (r memoryResources) Delete(router, project, role string) (rows int64, err error) {
+	err = r.s.write(func(state *entityState) error {
+		kept := state.resources[:0]
+		for _, resource := range state.resources {
+			if resource.ResourceRouter == router && resource.ProjectName == project && resource.RoleName == role {
+				rows++
+				continue
+			}
+			kept = append(kept, resource)
+		}
+		state.resources = kept
+		return nil
+	})
+	return rows, err
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,323 @@
+package gorm
+
+import (
+	"gopa/model"
+	"gorm.io/gorm"
+)
+
+// SQLEntityStore 保存在关系数据库中的组、角色、成员和资源授权。
+// Self为事务时，实体和其他表的修改可以一起提交或回滚
+type SQLEntityStore struct {
+	Self *gorm.DB
+}
+
+func (s SQLEntityStore) Projects() ProjectRepository   { return sqlProjects{s.Self} }
+func (s SQLEntityStore) Roles() RoleRepository         { return sqlRoles{s.Self} }
+func (s SQLEntityStore) Members() MemberRepository     { return sqlMembers{s.Self} }
+func (s SQLEntityStore) Resources() ResourceRepository { return sqlResources{s.Self} }
+func (s SQLEntityStore) DB() *gorm.DB                  { return s.Self }
+
+func (s SQLEntityStore) Transaction(fn func(tx EntityStore) error) error {
+	return s.Self.Transaction(func(tx *gorm.DB) error {
+		return fn(SQLEntityStore{Self: tx})
+	})
+}
+
+// exists 判断满足条件的记录是否存在
+func exists(db *gorm.DB, value interface{}, query string, args ...interface{}) (bool, error) {
+	var count int64
+	res := db.Model(value).Where(query, args...).Count(&count)
+	return count > 0, res.Error
+}
+
+// create 插入value，唯一索引冲突时返回ErrEntityExists
+func create(db *gorm.DB, value interface{}) error {
+	err := db.Create(value).Error
+	if IsDuplicate(err) {
+		return ErrEntityExists
+	}
+	return err
+}
+
+// versionedUpdate 按id修改value对应的表并把版本加一，version不为AnyVersion时只修改该版本。
+// 没有修改任何记录而记录存在时，说明记录已经是其他版本
+func versionedUpdate(db *gorm.DB, value interface{}, id uint64, version int64, updates map[string]interface{}) (int64, error) {
+	updates["version"] = gorm.Expr("version + 1")
+	query := db.Model(value).Where("id = ?", id)
+	if version != AnyVersion {
+		query = query.Where("version = ?", version)
+	}
+	res := query.Updates(updates)
+	if IsDuplicate(res.Error) {
+		return 0, ErrEntityExists
+	}
+	if res.Error != nil || res.RowsAffected > 0 || version == AnyVersion {
+		return res.RowsAffected, res.Error
+	}
+	found, err := exists(db, value, "id = ?", id)
+	if err != nil {
+		return 0, err
+	}
+	if found {
+		return 0, ErrEntityConflict
+	}
+	return 0, nil
+}
+
+type sqlProjects struct{ db *gorm.DB }
+
+func (r sqlProjects) List() ([]model.GopaProjects, error) {
+	var projects []model.GopaProjects
+	res := r.db.Order("id").Find(&projects)
+	return projects, res.Error
+}
+
+func (r sqlProjects) Exists(name string) (bool, error) {
+	return exists(r.db, &model.GopaProjects{}, "project_name = ?", name)
+}
+
+func (r sqlProjects) Create(project model.GopaProjects) error {
+	return create(r.db, &project)
+}
+
+func (r sqlProjects) Delete(name string) (int64, error) {
+	res := r.db.Unscoped().Where("project_name = ?", name).Delete(&model.GopaProjects{})
+	return res.RowsAffected, res.Error
+}
+
+func (r sqlProjects) CountChildren(parent string) (int64, error) {
+	var children int64
+	res := r.db.Model(&model.GopaProjects{}).Where("parent_project = ?", parent).Count(&children)
+	return children, res.Error
+}
+
+func (r sqlProjects) SetMfaRequired(name string, required bool) (int64, error) {
+	res := r.db.Model(&model.GopaProjects{}).Where("project_name = ?", name).
+		Updates(map[string]interface{}{"mfa_required": required, "version": gorm.Expr("version + 1")})
+	return res.RowsAffected, res.Error
+}
+
+func (r sqlProjects) AnyMfaRequired(names []string) (bool, error) {
+	return exists(r.db, &model.GopaProjects{}, "project_name IN ? AND mfa_required = ?", names, true)
+}
+
+func (r sqlProjects) ListRoles() ([]model.GopaProjectRoles, error) {
+	var projectRoles []model.GopaProjectRoles
+	res := r.db.Order("id").Find(&projectRoles)
+	return projectRoles, res.Error
+}
+
+func (r sqlProjects) AddRole(projectRole model.GopaProjectRoles) error {
+	return r.db.Create(&projectRole).Error
+}
+
+func (r sqlProjects) RemoveRole(project, role string) (int64, error) {
+	res := r.db.Unscoped().Where("project_name = ? AND role_name = ?", project, role).Delete(&model.GopaProjectRoles{})
+	return res.RowsAffected, res.Error
+}
+
+type sqlRoles struct{ db *gorm.DB }
+
+func (r sqlRoles) List() ([]model.GopaRoles, error) {
+	var roles []model.GopaRoles
+	res := r.db.Order("id").Find(&roles)
+	return roles, res.Error
+}
+
+func (r sqlRoles) Exists(name string) (bool, error) {
+	return exists(r.db, &model.GopaRoles{}, "role_name = ?", name)
+}
+
+// Create 角色和它的继承关系一起提交，不会留下没有父角色的角色
+func (r sqlRoles) Create(role model.GopaRoles, parents []string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := create(tx, &role); err != nil {
+			return err
+		}
+		return replaceRoleParents(tx, role.RoleName, parents)
+	})
+}
+
+func (r sqlRoles) Delete(name string) (int64, error) {
+	var rows int64
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Unscoped().Where("role_name = ?", name).Delete(&model.GopaRoles{})
+		if res.Error != nil {
+			return res.Error
+		}
+		rows = res.RowsAffected
+		return tx.Unscoped().Where("role_name = ? OR parent_role_name = ?", name, name).Delete(&model.GopaRoleParents{}).Error
+	})
+	return rows, err
+}
+
+func (r sqlRoles) ListParents() ([]model.GopaRoleParents, error) {
+	var parents []model.GopaRoleParents
+	res := r.db.Order("id").Find(&parents)
+	return parents, res.Error
+}
+
+func (r sqlRoles) ReplaceParents(role string, parents []string, version int64) (int64, error) {
+	var rows int64
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		bump := tx.Model(&model.GopaRoles{}).Where("role_name = ?", role)
+		if version != AnyVersion {
+			bump = bump.Where("version = ?", version)
+		}
+		res := bump.Update("version", gorm.Expr("version + 1"))
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			found, err := exists(tx, &model.GopaRoles{}, "role_name = ?", role)
+			if err != nil || !found {
+				return err
+			}
+			return ErrEntityConflict
+		}
+		rows = res.RowsAffected
+		return replaceRoleParents(tx, role, parents)
+	})
+	return rows, err
+}
+
+// replaceRoleParents 在db中用parents替换role当前的全部父角色
+func replaceRoleParents(db *gorm.DB, role string, parents []string) error {
+	res := db.Unscoped().Where("role_name = ?", role).Delete(&model.GopaRoleParents{})
+	if res.Error != nil {
+		return res.Error
+	}
+	for _, parent := range parents {
+		edge := model.GopaRoleParents{RoleName: role, ParentRoleName: parent}
+		if res := db.Create(&edge); res.Error != nil {
+			return res.Error
+		}
+	}
+	return nil
+}
+
+func (r sqlRoles) SetMfaRequired(name string, required bool) (int64, error) {
+	res := r.db.Model(&model.GopaRoles{}).Where("role_name = ?", name).
+		Updates(map[string]interface{}{"mfa_required": required, "version": gorm.Expr("version + 1")})
+	return res.RowsAffected, res.Error
+}
+
+func (r sqlRoles) AnyMfaRequired(names []string) (bool, error) {
+	return exists(r.db, &model.GopaRoles{}, "role_name IN ? AND mfa_required = ?", names, true)
+}
+
+type sqlMembers struct{ db *gorm.DB }
+
+func (r sqlMembers) Find(query MemberQuery) ([]model.GopaMembers, error) {
+	db := r.db
+	if query.ID != 0 {
+		db = db.Where("id = ?", query.ID)
+	}
+	if query.Username != "" {
+		db = db.Where("username = ?", query.Username)
+	}
+	if query.Project != "" {
+		db = db.Where("project = ?", query.Project)
+	}
+	if query.Projects != nil {
+		db = db.Where("project IN ?", query.Projects)
+	}
+	if query.Role != "" {
+		db = db.Where("role = ?", query.Role)
+	}
+	if query.Source != "" {
+		db = db.Where("source = ?", query.Source)
+	}
+	if !query.ActiveAt.IsZero() {
+		db = db.Where("(valid_from IS NULL OR valid_from <= ?) AND (expires_at IS NULL OR expires_at > ?) AND disabled = ?",
+			query.ActiveAt, query.ActiveAt, false)
+	}
+	if !query.ExpiredAt.IsZero() {
+		db = db.Where("expires_at IS NOT NULL AND expires_at <= ?", query.ExpiredAt)
+	}
+	var members []model.GopaMembers
+	res := db.Order("id").Find(&members)
+	return members, res.Error
+}
+
+func (r sqlMembers) Create(member model.GopaMembers) error {
+	return create(r.db, &member)
+}
+
+func (r sqlMembers) Update(id uint64, version int64, update MemberUpdate) (int64, error) {
+	updates := map[string]interface{}{}
+	if update.Project != "" {
+		updates["project"] = update.Project
+	}
+	if update.Role != "" {
+		updates["role"] = update.Role
+	}
+	if update.ValidFrom != nil {
+		updates["valid_from"] = update.ValidFrom
+	}
+	if update.ExpiresAt != nil {
+		updates["expires_at"] = update.ExpiresAt
+	}
+	if update.Disabled != nil {
+		updates["disabled"] = *update.Disabled
+	}
+	return versionedUpdate(r.db, &model.GopaMembers{}, id, version, updates)
+}
+
+func (r sqlMembers) Delete(id uint64) (int64, error) {
+	res := r.db.Unscoped().Delete(&model.GopaMembers{}, id)
+	return res.RowsAffected, res.Error
+}
+
+func (r sqlMembers) DeleteUser(username string) (int64, error) {
+	res := r.db.Unscoped().Where("username = ?", username).Delete(&model.GopaMembers{})
+	return res.RowsAffected, res.Error
+}
+
+type sqlResources struct{ db *gorm.DB }
+
+func (r sqlResources) Find(query ResourceQuery) ([]model.ProjectResources, error) {
+	db := r.db
+	if query.ID != 0 {
+		db = db.Where("id = ?", query.ID)
+	}
+	if query.Router != "" {
+		db = db.Where("resource_router = ?", query.Router)
+	}
+	if query.Project != "" {
+		db = db.Where("project_name = ?", query.Project)
+	}
+	if query.Role != "" {
+		db = db.Where("role_name = ?", query.Role)
+	}
+	if query.Projects != nil {
+		db = db.Where("project_name IN ?", query.Projects)
+	}
+	if query.Roles != nil {
+		db = db.Where("role_name IN ?", query.Roles)
+	}
+	var resources []model.ProjectResources
+	res := db.Order("id").Find(&resources)
+	return resources, res.Error
+}
+
+func (r sqlResources) Create(resource model.ProjectResources) error {
+	return r.db.Create(&resource).Error
+}
+
+func (r sqlResources) Update(id uint64, version int64, project, role string) (int64, error) {
+	updates := map[string]interface{}{}
+	if project != "" {
+		updates["project_name"] = project
+	}
+	if role != "" {
+		updates["role_name"] = role
+	}
+	return versionedUpdate(r.db, &model.ProjectResources{}, id, version, updates)
+}
+
+func (r sqlResources) Delete(router, project, role string) (int64, error) {
+	res := r.db.Unscoped().Where("resource_router = ? AND project_name = ? AND role_name = ?", router, project, role).
+		Delete(&model.ProjectResources{})
+	return res.RowsAffected, res.Error
+}
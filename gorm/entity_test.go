@@ -0,0 +1,339 @@
+package gorm
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gopa/model"
+	"gorm.io/gorm"
+)
+
+// entityStores 返回要检查的实体存储，两者使用各自的内存数据库
+func entityStores(t *testing.T) map[string]func() EntityStore {
+	t.Helper()
+	newDB := func() *gorm.DB {
+		db, err := newSQLite(&model.GormConfig{DSN: ":memory:"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		migrator, err := NewMigrator(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := migrator.Up(0); err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	return map[string]func() EntityStore{
+		EntityStoreDatabase: func() EntityStore { return SQLEntityStore{Self: newDB()} },
+		EntityStoreMemory:   func() EntityStore { return NewMemoryEntityStore(newDB()) },
+	}
+}
+
+// 两种实体存储的行为要一致
+func TestEntityStores(t *testing.T) {
+	for name, newStore := range entityStores(t) {
+		t.Run(name, func(t *testing.T) {
+			t.Run("projects", func(t *testing.T) { checkProjects(t, newStore()) })
+			t.Run("roles", func(t *testing.T) { checkRoles(t, newStore()) })
+			t.Run("members", func(t *testing.T) { checkMembers(t, newStore()) })
+			t.Run("resources", func(t *testing.T) { checkResources(t, newStore()) })
+			t.Run("transaction", func(t *testing.T) { checkTransaction(t, newStore()) })
+		})
+	}
+}
+
+func checkProjects(t *testing.T, store EntityStore) {
+	projects := store.Projects()
+	if err := projects.Create(model.GopaProjects{ProjectName: "infra"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := projects.Create(model.GopaProjects{ProjectName: "infra-cloud", ParentProject: "infra"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := projects.Create(model.GopaProjects{ProjectName: "infra"}); err != ErrEntityExists {
+		t.Errorf("Create of an existing project = %v, want ErrEntityExists", err)
+	}
+	if found, err := projects.Exists("infra-cloud"); err != nil || !found {
+		t.Errorf("Exists(infra-cloud) = %v, %v", found, err)
+	}
+	if children, err := projects.CountChildren("infra"); err != nil || children != 1 {
+		t.Errorf("CountChildren(infra) = %d, %v; want 1", children, err)
+	}
+
+	if rows, err := projects.SetMfaRequired("infra", true); err != nil || rows != 1 {
+		t.Errorf("SetMfaRequired = %d, %v; want 1", rows, err)
+	}
+	if rows, err := projects.SetMfaRequired("data", true); err != nil || rows != 0 {
+		t.Errorf("SetMfaRequired of a missing project = %d, %v; want 0", rows, err)
+	}
+	if required, err := projects.AnyMfaRequired([]string{"infra-cloud", "infra"}); err != nil || !required {
+		t.Errorf("AnyMfaRequired(infra) = %v, %v; want true", required, err)
+	}
+	if required, err := projects.AnyMfaRequired([]string{"infra-cloud"}); err != nil || required {
+		t.Errorf("AnyMfaRequired(infra-cloud) = %v, %v; want false", required, err)
+	}
+	list, err := projects.List()
+	if err != nil || len(list) != 2 || list[0].ProjectName != "infra" || list[0].Version != 2 || list[1].Version != 1 {
+		t.Errorf("List = %+v, %v", list, err)
+	}
+
+	if err := projects.AddRole(model.GopaProjectRoles{ProjectName: "infra", RoleName: "dev"}); err != nil {
+		t.Fatal(err)
+	}
+	if roles, err := projects.ListRoles(); err != nil || len(roles) != 1 || roles[0].Version != 1 {
+		t.Errorf("ListRoles = %+v, %v", roles, err)
+	}
+	if rows, err := projects.RemoveRole("infra", "dev"); err != nil || rows != 1 {
+		t.Errorf("RemoveRole = %d, %v; want 1", rows, err)
+	}
+	if rows, err := projects.Delete("infra-cloud"); err != nil || rows != 1 {
+		t.Errorf("Delete = %d, %v; want 1", rows, err)
+	}
+	if found, _ := projects.Exists("infra-cloud"); found {
+		t.Error("infra-cloud exists after Delete")
+	}
+}
+
+func checkRoles(t *testing.T, store EntityStore) {
+	roles := store.Roles()
+	if err := roles.Create(model.GopaRoles{RoleName: "dev"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := roles.Create(model.GopaRoles{RoleName: "admin"}, []string{"dev"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := roles.Create(model.GopaRoles{RoleName: "dev"}, nil); err != ErrEntityExists {
+		t.Errorf("Create of an existing role = %v, want ErrEntityExists", err)
+	}
+	if parents, err := roles.ListParents(); err != nil || len(parents) != 1 || parents[0].ParentRoleName != "dev" {
+		t.Errorf("ListParents = %+v, %v", parents, err)
+	}
+
+	if err := roles.Create(model.GopaRoles{RoleName: "ops"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rows, err := roles.ReplaceParents("admin", []string{"ops"}, 1); err != nil || rows != 1 {
+		t.Errorf("ReplaceParents = %d, %v; want 1", rows, err)
+	}
+	if rows, err := roles.ReplaceParents("admin", []string{"dev"}, 1); err != ErrEntityConflict || rows != 0 {
+		t.Errorf("ReplaceParents of a stale version = %d, %v; want ErrEntityConflict", rows, err)
+	}
+	if rows, err := roles.ReplaceParents("viewer", nil, 1); err != nil || rows != 0 {
+		t.Errorf("ReplaceParents of a missing role = %d, %v; want 0", rows, err)
+	}
+	if parents, _ := roles.ListParents(); len(parents) != 1 || parents[0].ParentRoleName != "ops" {
+		t.Errorf("parents after ReplaceParents = %+v, want admin -> ops", parents)
+	}
+
+	if rows, err := roles.SetMfaRequired("ops", true); err != nil || rows != 1 {
+		t.Errorf("SetMfaRequired = %d, %v; want 1", rows, err)
+	}
+	if required, err := roles.AnyMfaRequired([]string{"dev", "ops"}); err != nil || !required {
+		t.Errorf("AnyMfaRequired = %v, %v; want true", required, err)
+	}
+
+	if rows, err := roles.Delete("ops"); err != nil || rows != 1 {
+		t.Errorf("Delete = %d, %v; want 1", rows, err)
+	}
+	if parents, _ := roles.ListParents(); len(parents) != 0 {
+		t.Errorf("parents after deleting ops = %+v, want none", parents)
+	}
+	list, err := roles.List()
+	if err != nil || len(list) != 2 || list[0].RoleName != "dev" || list[1].RoleName != "admin" || list[1].Version != 2 {
+		t.Errorf("List = %+v, %v", list, err)
+	}
+}
+
+func checkMembers(t *testing.T, store EntityStore) {
+	members := store.Members()
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	for _, member := range []model.GopaMembers{
+		{Username: "alice", Project: "infra", Role: "admin"},
+		{Username: "alice", Project: "data", Role: "dev", Source: model.MemberSourceLdap},
+		{Username: "bob", Project: "infra", Role: "admin", ExpiresAt: &past},
+		{Username: "carol", Project: "infra", Role: "admin", ValidFrom: &future},
+		{Username: "dave", Project: "infra", Role: "admin", Disabled: true},
+	} {
+		if err := members.Create(member); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := members.Create(model.GopaMembers{Username: "alice", Project: "infra", Role: "admin"}); err != ErrEntityExists {
+		t.Errorf("Create of an existing grant = %v, want ErrEntityExists", err)
+	}
+
+	usernames := func(query MemberQuery) []string {
+		found, err := members.Find(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, member := range found {
+			names = append(names, member.Username+"/"+member.Project)
+		}
+		return names
+	}
+	for _, c := range []struct {
+		name  string
+		query MemberQuery
+		want  []string
+	}{
+		{"all", MemberQuery{}, []string{"alice/infra", "alice/data", "bob/infra", "carol/infra", "dave/infra"}},
+		{"username", MemberQuery{Username: "alice"}, []string{"alice/infra", "alice/data"}},
+		{"projects", MemberQuery{Projects: []string{"data"}}, []string{"alice/data"}},
+		{"no projects", MemberQuery{Projects: []string{}}, nil},
+		{"source", MemberQuery{Source: model.MemberSourceLdap}, []string{"alice/data"}},
+		{"active", MemberQuery{Project: "infra", ActiveAt: now}, []string{"alice/infra"}},
+		{"expired", MemberQuery{ExpiredAt: now}, []string{"bob/infra"}},
+	} {
+		if got := usernames(c.query); !equalNames(got, c.want) {
+			t.Errorf("Find(%s) = %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	alice, _ := members.Find(MemberQuery{Username: "alice", Project: "infra"})
+	id := alice[0].ID
+	if rows, err := members.Update(id, 1, MemberUpdate{Role: "dev", ExpiresAt: &future}); err != nil || rows != 1 {
+		t.Errorf("Update = %d, %v; want 1", rows, err)
+	}
+	if rows, err := members.Update(id, 1, MemberUpdate{Role: "ops"}); err != ErrEntityConflict || rows != 0 {
+		t.Errorf("Update of a stale version = %d, %v; want ErrEntityConflict", rows, err)
+	}
+	if rows, err := members.Update(id, AnyVersion, MemberUpdate{Project: "data"}); err != ErrEntityExists || rows != 0 {
+		t.Errorf("Update to an existing grant = %d, %v; want ErrEntityExists", rows, err)
+	}
+	if rows, err := members.Update(id+100, AnyVersion, MemberUpdate{Role: "ops"}); err != nil || rows != 0 {
+		t.Errorf("Update of a missing grant = %d, %v; want 0", rows, err)
+	}
+	disabled := true
+	if rows, err := members.Update(id, AnyVersion, MemberUpdate{Disabled: &disabled}); err != nil || rows != 1 {
+		t.Errorf("Update of any version = %d, %v; want 1", rows, err)
+	}
+	updated, _ := members.Find(MemberQuery{ID: id})
+	if len(updated) != 1 || updated[0].Role != "dev" || !updated[0].Disabled || updated[0].ExpiresAt == nil || updated[0].Version != 3 {
+		t.Errorf("grant after updates = %+v", updated)
+	}
+
+	if rows, err := members.Delete(id); err != nil || rows != 1 {
+		t.Errorf("Delete = %d, %v; want 1", rows, err)
+	}
+	if rows, err := members.DeleteUser("alice"); err != nil || rows != 1 {
+		t.Errorf("DeleteUser = %d, %v; want 1", rows, err)
+	}
+	if got := usernames(MemberQuery{Username: "alice"}); len(got) != 0 {
+		t.Errorf("grants of alice after DeleteUser = %v", got)
+	}
+}
+
+func checkResources(t *testing.T, store EntityStore) {
+	resources := store.Resources()
+	for _, grant := range []model.GopaProjectRoles{
+		{ProjectName: "infra", RoleName: "dev"},
+		{ProjectName: "infra", RoleName: "ops"},
+		{ProjectName: "data", RoleName: "dev"},
+	} {
+		if err := resources.Create(model.ProjectResources{GopaProjectRoles: grant, ResourceRouter: "/api/v1/pay"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	found, err := resources.Find(ResourceQuery{Router: "/api/v1/pay", Projects: []string{"infra"}, Roles: []string{"dev", "viewer"}})
+	if err != nil || len(found) != 1 || found[0].RoleName != "dev" || found[0].Version != 1 {
+		t.Fatalf("Find = %+v, %v", found, err)
+	}
+	id := found[0].ID
+	if rows, err := resources.Update(id, 1, "ops", ""); err != nil || rows != 1 {
+		t.Errorf("Update = %d, %v; want 1", rows, err)
+	}
+	if rows, err := resources.Update(id, 1, "data", ""); err != ErrEntityConflict || rows != 0 {
+		t.Errorf("Update of a stale version = %d, %v; want ErrEntityConflict", rows, err)
+	}
+	if updated, _ := resources.Find(ResourceQuery{ID: id}); len(updated) != 1 || updated[0].ProjectName != "ops" || updated[0].RoleName != "dev" || updated[0].Version != 2 {
+		t.Errorf("grant after Update = %+v", updated)
+	}
+	if rows, err := resources.Delete("/api/v1/pay", "data", "dev"); err != nil || rows != 1 {
+		t.Errorf("Delete = %d, %v; want 1", rows, err)
+	}
+	if left, _ := resources.Find(ResourceQuery{}); len(left) != 2 {
+		t.Errorf("grants after Delete = %+v", left)
+	}
+}
+
+func checkTransaction(t *testing.T, store EntityStore) {
+	errRollback := errors.New("rollback")
+	err := store.Transaction(func(tx EntityStore) error {
+		if err := tx.Projects().Create(model.GopaProjects{ProjectName: "billing"}); err != nil {
+			return err
+		}
+		if err := tx.Members().Create(model.GopaMembers{Username: "alice", Project: "billing", Role: "dev"}); err != nil {
+			return err
+		}
+		if err := tx.DB().Create(&model.GopaAuditLogs{Actor: "alice", Action: "project.created"}).Error; err != nil {
+			return err
+		}
+		if found, _ := tx.Projects().Exists("billing"); !found {
+			t.Error("billing is not visible inside the transaction")
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatalf("Transaction = %v, want the error of fn", err)
+	}
+	if found, _ := store.Projects().Exists("billing"); found {
+		t.Error("project billing was not rolled back")
+	}
+	if members, _ := store.Members().Find(MemberQuery{}); len(members) != 0 {
+		t.Errorf("grants were not rolled back: %+v", members)
+	}
+	var audits int64
+	store.DB().Model(&model.GopaAuditLogs{}).Count(&audits)
+	if audits != 0 {
+		t.Error("audit log was not rolled back")
+	}
+
+	// 内层事务回滚时，外层事务中之前的修改保留
+	err = store.Transaction(func(tx EntityStore) error {
+		if err := tx.Projects().Create(model.GopaProjects{ProjectName: "billing"}); err != nil {
+			return err
+		}
+		inner := tx.Transaction(func(tx EntityStore) error {
+			if err := tx.Projects().Create(model.GopaProjects{ProjectName: "payments"}); err != nil {
+				return err
+			}
+			return errRollback
+		})
+		if inner != errRollback {
+			t.Errorf("nested Transaction = %v, want the error of fn", inner)
+		}
+		return tx.Transaction(func(tx EntityStore) error {
+			return tx.Roles().Create(model.GopaRoles{RoleName: "dev"}, nil)
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := store.Projects().Exists("billing"); !found {
+		t.Error("project billing was not committed")
+	}
+	if found, _ := store.Projects().Exists("payments"); found {
+		t.Error("project payments of the rolled back nested transaction was committed")
+	}
+	if found, _ := store.Roles().Exists("dev"); !found {
+		t.Error("role dev of the committed nested transaction is missing")
+	}
+}
+
+func equalNames(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,31 @@
+package gorm
+
+import (
+	"errors"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/mattn/go-sqlite3"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// mysqlDuplicateEntry MySQL唯一索引冲突的错误码
+const mysqlDuplicateEntry = 1062
+
+// IsDuplicate 判断err是否为唯一索引冲突，包括实体存储返回的ErrEntityExists
+func IsDuplicate(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrEntityExists) {
+		return true
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == mysqlDuplicateEntry
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return mongo.IsDuplicateKeyError(err)
+}
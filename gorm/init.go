@@ -9,7 +9,9 @@ import (
 	"gopa/config"
 	"gopa/model"
 	"gorm.io/driver/mysql"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
 	"istio.io/pkg/log"
 	"time"
 )
@@ -19,111 +21,210 @@ const (
 	RegoCollectionName = "regos"
 )
 
+const (
+	// DBTypeMySQL 关系数据保存在MySQL中
+	DBTypeMySQL = "mysql"
+	// DBTypeSQLite 关系数据保存在SQLite文件中
+	DBTypeSQLite = "sqlite"
+	// DBTypeMemory 关系数据保存在内存中的SQLite数据库，重启后丢失
+	DBTypeMemory = "memory"
+)
+
 type Database struct {
 	Self        *gorm.DB
 	Docker      *gorm.DB
 	MongoClient *mongo.Client
 }
 
-type MongoCollection struct {
-	RegoCollection *mongo.Collection
-}
-
-var Collections *MongoCollection
 var DB *Database
 
+// Models 全部数据表对应的结构体，执行全部迁移后的表结构与之一致
+func Models() []interface{} {
+	return []interface{}{
+		&model.GopaProjects{},
+		&model.GopaRoles{},
+		&model.GopaRoleParents{},
+		&model.GopaProjectRoles{},
+		&model.GopaMembers{},
+		&model.GopaCredentials{},
+		&model.GopaApplication{},
+		&model.ProjectResources{},
+		&model.GopaAuditLogs{},
+		&model.GopaAccessRequests{},
+		&model.GopaWebhooks{},
+		&model.GopaWebhookDeliveries{},
+		&model.GopaServiceAccounts{},
+		&model.GopaAPIKeys{},
+		&model.GopaRevokedTokens{},
+		&model.GopaTokenCutoffs{},
+		&model.GopaRefreshTokens{},
+		&model.GopaLoginFailures{},
+		&model.GopaMemberMFA{},
+		&model.GopaSigningKeys{},
+		&model.RegoDocuments{},
+	}
+}
+
 // NewMongoDB 创建新的MongoDB实例
-func NewMongoDB() *mongo.Client {
-	mongoAddress := config.GetConfig().Mongo.Address
+func NewMongoDB(mongoAddress string) (*mongo.Client, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoAddress))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	err = client.Ping(ctx, readpref.Primary())
-	if err != nil {
-		panic(err)
+	if err := client.Ping(ctx, readpref.Primary()); err != nil {
+		return nil, err
 	}
 	fmt.Println("Ping MongoDB: ", mongoAddress)
-	return client
+	return client, nil
 }
 
-func NewGormDB() *gorm.DB {
-	databaseConfig := config.GetConfig().Gorm
-	dsn := config.GetConfig().MySql.DSN()
-	db, err := newDatabase(
-		&model.GormConfig{
-			Debug:        databaseConfig.Debug,
-			DSN:          dsn,
-			MaxLifetime:  databaseConfig.MaxLifetime,
-			MaxOpenConns: databaseConfig.MaxOpenConns,
-			MaxIdleConns: databaseConfig.MaxIdleConns,
-			//TablePrefix:  databseConfig.TablePrefix,
-		})
-	if err != nil {
-		panic(err)
-		//log.Errorf(err, "Database connection failed. Database name: %s", db.Name())
-		//return nil
-	}
-	//err = db.AutoMigrate(&model.GopaProjects{})
-	//if err != nil {
-	//	panic(err)
-	//}
-	//err = db.AutoMigrate(&model.GopaRoles{})
-	//if err != nil {
-	//	panic(err)
-	//}
-	//err = db.AutoMigrate(&model.GopaMembers{})
-	//if err != nil {
-	//	panic(err)
-	//}
-	//err = db.AutoMigrate(&model.GopaProjectRoles{})
-	//if err != nil {
-	//	panic(err)
-	//}
-	//err = db.AutoMigrate(&model.GopaApplication{})
-	//if err != nil {
-	//	panic(err)
-	//}
-	//err = db.AutoMigrate(&model.ProjectResources{})
-	//if err != nil {
-	//	panic(err)
-	//}
-	return db
+// NewGormDB 按gorm.dbType连接关系数据库，并把gorm.tablePrefix设置为model.TablePrefix
+func NewGormDB(c *model.SysConfig) (*gorm.DB, error) {
+	model.TablePrefix = c.Gorm.TablePrefix
+	gormConfig := &model.GormConfig{
+		Debug:        c.Gorm.Debug,
+		MaxLifetime:  c.Gorm.MaxLifetime,
+		MaxOpenConns: c.Gorm.MaxOpenConns,
+		MaxIdleConns: c.Gorm.MaxIdleConns,
+		TablePrefix:  c.Gorm.TablePrefix,
+	}
+	switch c.Gorm.DBType {
+	case "", DBTypeMySQL:
+		gormConfig.DSN = c.MySql.DSN()
+		return newDatabase(mysql.Open(gormConfig.DSN), gormConfig)
+	case DBTypeSQLite:
+		gormConfig.DSN = c.Gorm.SQLitePath
+		return newSQLite(gormConfig)
+	case DBTypeMemory:
+		// 每次打开都是一个新的空数据库
+		gormConfig.DSN = ":memory:"
+		return newSQLite(gormConfig)
+	}
+	return nil, fmt.Errorf("unknown gorm.dbType %q", c.Gorm.DBType)
 }
 
-func newDatabase(c *model.GormConfig) (*gorm.DB, error) {
-	fmt.Println("Pinging database: ", c.DSN)
-	db, err := gorm.Open(mysql.Open(c.DSN), &gorm.Config{})
+// newDatabase 打开数据库并设置连接池。结构体的TableName已经加上了前缀，
+// 命名策略中的前缀用于没有TableName的结构体
+func newDatabase(dialector gorm.Dialector, c *model.GormConfig) (*gorm.DB, error) {
+	fmt.Println("Pinging database: ", dialector.Name())
+	db, err := gorm.Open(dialector, &gorm.Config{
+		NamingStrategy: schema.NamingStrategy{TablePrefix: c.TablePrefix},
+	})
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := db.DB()
 	if err != nil {
 		return nil, err
 	}
+	if c.MaxOpenConns > 0 {
+		sqlDB.SetMaxOpenConns(c.MaxOpenConns)
+	}
+	if c.MaxIdleConns > 0 {
+		sqlDB.SetMaxIdleConns(c.MaxIdleConns)
+	}
+	if c.MaxLifetime > 0 {
+		sqlDB.SetConnMaxLifetime(time.Duration(c.MaxLifetime) * time.Second)
+	}
 	if c.Debug {
 		db = db.Debug()
 	}
 	return db, nil
 }
 
-func GetSelfDB() *gorm.DB {
-	return NewGormDB()
+// newSQLite 打开c.DSN指定的SQLite数据库。SQLite同一时间只允许一个写入，
+// 所以只保留一个连接；内存数据库在连接关闭后会丢失，该连接也不会过期
+func newSQLite(c *model.GormConfig) (*gorm.DB, error) {
+	db, err := newDatabase(sqlite.Open(c.DSN), c)
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	sqlDB.SetMaxOpenConns(1)
+	sqlDB.SetMaxIdleConns(1)
+	sqlDB.SetConnMaxLifetime(0)
+	return db, nil
+}
+
+// NewRegoStore 按opa.regoStore创建rego文件的存储，使用MongoDB时同时返回连接，
+// 并确保regos集合的path上有唯一索引。保存在关系数据库时使用db
+func NewRegoStore(c *model.SysConfig, db *gorm.DB) (RegoStore, *mongo.Client, error) {
+	switch RegoStoreType(c) {
+	case RegoStoreMongo:
+		client, err := NewMongoDB(c.Mongo.Address)
+		if err != nil {
+			return nil, nil, err
+		}
+		store := NewMongoRegoStore(client)
+		if err := store.EnsureIndexes(); err != nil {
+			return nil, nil, err
+		}
+		return store, client, nil
+	case RegoStoreMemory:
+		return NewMemoryRegoStore(), nil, nil
+	case RegoStoreDatabase:
+		return SQLRegoStore{DB: db}, nil, nil
+	}
+	return nil, nil, fmt.Errorf("unknown opa.regoStore %q", c.Opa.RegoStore)
 }
 
-func GetCollection(database string, collectionName string) *mongo.Collection {
-	mongoClient := DB.MongoClient
-	collection := mongoClient.Database(database).Collection(collectionName)
-	return collection
+// RegoStoreType 返回生效的rego文件存储方式
+func RegoStoreType(c *model.SysConfig) string {
+	if c.Opa.RegoStore != "" {
+		return c.Opa.RegoStore
+	}
+	if c.Gorm.DBType == DBTypeMemory {
+		return RegoStoreMemory
+	}
+	return RegoStoreMongo
 }
 
-func (db *Database) Init() {
-	log.Info("Init DB.")
+// Setup 按配置连接关系数据库、rego文件和实体的存储，设置DB、Regos和Entities。
+// 开启自动迁移时先执行未执行的迁移
+func Setup(c *model.SysConfig) error {
+	self, err := NewGormDB(c)
+	if err != nil {
+		return err
+	}
+	if AutoMigrate(c) {
+		migrator, err := NewMigrator(self)
+		if err != nil {
+			return err
+		}
+		done, err := migrator.Up(0)
+		for _, migration := range done {
+			log.Infof("Applied migration %d %s.", migration.Version, migration.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	regos, client, err := NewRegoStore(c, self)
+	if err != nil {
+		return err
+	}
+	entities, err := NewEntityStore(c, self)
+	if err != nil {
+		return err
+	}
 	DB = &Database{
-		Self: GetSelfDB(),
+		Self: self,
 		//		Docker: GetDockerDB(),
-		MongoClient: NewMongoDB(),
-	}
-	Collections = &MongoCollection{
-		RegoCollection: GetCollection(RegoDatabaseName, RegoCollectionName),
+		MongoClient: client,
 	}
+	Regos = regos
+	Entities = entities
+	return nil
+}
 
+func (db *Database) Init() {
+	log.Info("Init DB.")
+	if err := Setup(config.GetConfig()); err != nil {
+		panic(err)
+	}
 }
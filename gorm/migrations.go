@@ -0,0 +1,230 @@
+package gorm
+
+import (
+	"gopa/model"
+	"gopa/pkg/migrate"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// uniqueIndexes 名称类字段上的唯一索引
+var uniqueIndexes = []struct {
+	model   interface{}
+	name    string
+	columns []string
+}{
+	{&model.GopaProjects{}, "idx_gopa_projects_project_name", []string{"project_name"}},
+	{&model.GopaRoles{}, "idx_gopa_roles_role_name", []string{"role_name"}},
+	{&model.GopaMembers{}, "idx_gopa_members_grant", []string{"username", "project", "role"}},
+	{&model.GopaServiceAccounts{}, "idx_gopa_service_accounts_name", []string{"name"}},
+	{&model.RegoDocuments{}, "idx_rego_documents_path", []string{"path"}},
+}
+
+// versionedModels 有Version列的表，用于检查并发修改
+var versionedModels = []interface{}{
+	&model.GopaProjects{},
+	&model.GopaRoles{},
+	&model.GopaProjectRoles{},
+	&model.GopaMembers{},
+	&model.GopaApplication{},
+	&model.ProjectResources{},
+}
+
+// Migrations GOPA的数据库迁移，按Version顺序执行。已经发布的迁移不要修改，
+// 表结构的变化追加为新的迁移。早期版本的create_tables按当时的结构体建表，
+// 所以之后的迁移要能在已经是新结构的表上重复执行
+func Migrations() []migrate.Migration {
+	return []migrate.Migration{
+		{
+			// 基线：按schema_v1.go建表，已有的表只补充缺少的列。
+			// 表中可能是引入迁移之前的数据，不能撤销
+			Version: 1,
+			Name:    "create_tables",
+			Up: func(tx *gorm.DB) error {
+				return tx.AutoMigrate(schemaV1()...)
+			},
+		},
+		{
+			Version: 2,
+			Name:    "unique_names",
+			Up: func(tx *gorm.DB) error {
+				for _, index := range uniqueIndexes {
+					if err := createUniqueIndex(tx, index.model, index.name, index.columns...); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			Down: func(tx *gorm.DB) error {
+				for _, index := range uniqueIndexes {
+					if !tx.Migrator().HasIndex(index.model, index.name) {
+						continue
+					}
+					if err := tx.Migrator().DropIndex(index.model, index.name); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Version: 3,
+			Name:    "entity_versions",
+			Up: func(tx *gorm.DB) error {
+				for _, m := range versionedModels {
+					if tx.Migrator().HasColumn(m, "version") {
+						continue
+					}
+					// 已有的行取默认值1
+					if err := tx.Migrator().AddColumn(m, "Version"); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			Down: func(tx *gorm.DB) error {
+				for _, m := range versionedModels {
+					if !tx.Migrator().HasColumn(m, "version") {
+						continue
+					}
+					if err := tx.Migrator().DropColumn(m, "version"); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Version: 4,
+			Name:    "unique_login_failure_subjects",
+			Up: func(tx *gorm.DB) error {
+				// 并发失败时可能产生了重复的记录，只保留最新的一条
+				table := model.GopaLoginFailures{}.TableName()
+				if err := tx.Exec("DELETE FROM ? WHERE id NOT IN (SELECT id FROM (SELECT MAX(id) AS id FROM ? GROUP BY subject) AS latest)",
+					clause.Table{Name: table}, clause.Table{Name: table}).Error; err != nil {
+					return err
+				}
+				// MySQL不能在text列上创建唯一索引
+				if err := tx.Migrator().AlterColumn(&model.GopaLoginFailures{}, "Subject"); err != nil {
+					return err
+				}
+				return createUniqueIndex(tx, &model.GopaLoginFailures{}, "idx_gopa_login_failures_subject", "subject")
+			},
+			Down: func(tx *gorm.DB) error {
+				if !tx.Migrator().HasIndex(&model.GopaLoginFailures{}, "idx_gopa_login_failures_subject") {
+					return nil
+				}
+				return tx.Migrator().DropIndex(&model.GopaLoginFailures{}, "idx_gopa_login_failures_subject")
+			},
+		},
+		{
+			Version: 5,
+			Name:    "refresh_token_mfa",
+			Up: func(tx *gorm.DB) error {
+				if tx.Migrator().HasColumn(&model.GopaRefreshTokens{}, "mfa") {
+					return nil
+				}
+				// 已有的登录视为没有通过两步验证，需要两步验证的用户刷新时要重新登录
+				return tx.Migrator().AddColumn(&model.GopaRefreshTokens{}, "Mfa")
+			},
+			Down: func(tx *gorm.DB) error {
+				if !tx.Migrator().HasColumn(&model.GopaRefreshTokens{}, "mfa") {
+					return nil
+				}
+				return tx.Migrator().DropColumn(&model.GopaRefreshTokens{}, "mfa")
+			},
+		},
+		{
+			Version: 6,
+			Name:    "credentials",
+			Up: func(tx *gorm.DB) error {
+				if !tx.Migrator().HasTable(&model.GopaCredentials{}) {
+					if err := tx.Migrator().CreateTable(&model.GopaCredentials{}); err != nil {
+						return err
+					}
+				}
+				if err := createUniqueIndex(tx, &model.GopaCredentials{}, "idx_gopa_credentials_username", "username"); err != nil {
+					return err
+				}
+				if !tx.Migrator().HasColumn(&model.GopaMembers{}, "password") {
+					return nil
+				}
+				// 密码原来保存在每一条授权上，登录时使用最新设置的一条
+				members, credentials := model.GopaMembers{}.TableName(), model.GopaCredentials{}.TableName()
+				if err := tx.Exec("INSERT INTO ? (created_at, updated_at, username, provider, password) "+
+					"SELECT created_at, updated_at, username, ?, password FROM ? WHERE id IN "+
+					"(SELECT MAX(id) FROM ? WHERE password <> '' AND deleted_at IS NULL GROUP BY username) "+
+					"AND username NOT IN (SELECT username FROM ?)",
+					clause.Table{Name: credentials}, model.CredentialLocal, clause.Table{Name: members},
+					clause.Table{Name: members}, clause.Table{Name: credentials}).Error; err != nil {
+					return err
+				}
+				// 保留password列，SQLite删除列时会重建表并丢掉表上的索引
+				return tx.Exec("UPDATE ? SET password = '' WHERE password <> ''", clause.Table{Name: members}).Error
+			},
+			Down: func(tx *gorm.DB) error {
+				if !tx.Migrator().HasTable(&model.GopaCredentials{}) {
+					return nil
+				}
+				if !tx.Migrator().HasColumn(&model.GopaMembers{}, "password") {
+					if err := tx.Migrator().AddColumn(&v1Members{}, "Password"); err != nil {
+						return err
+					}
+				}
+				// 本地密码写回该用户的每一条授权
+				members, credentials := model.GopaMembers{}.TableName(), model.GopaCredentials{}.TableName()
+				if err := tx.Exec("UPDATE ? SET password = (SELECT password FROM ? AS c WHERE c.username = ?.username AND c.provider = ?) "+
+					"WHERE username IN (SELECT username FROM ? WHERE provider = ?)",
+					clause.Table{Name: members}, clause.Table{Name: credentials}, clause.Table{Name: members}, model.CredentialLocal,
+					clause.Table{Name: credentials}, model.CredentialLocal).Error; err != nil {
+					return err
+				}
+				return tx.Migrator().DropTable(&model.GopaCredentials{})
+			},
+		},
+		{
+			Version: 7,
+			Name:    "signing_key_activation",
+			Up: func(tx *gorm.DB) error {
+				if tx.Migrator().HasColumn(&model.GopaSigningKeys{}, "active_from") {
+					return nil
+				}
+				// 已有的密钥都已经生效
+				return tx.Migrator().AddColumn(&model.GopaSigningKeys{}, "ActiveFrom")
+			},
+			Down: func(tx *gorm.DB) error {
+				if !tx.Migrator().HasColumn(&model.GopaSigningKeys{}, "active_from") {
+					return nil
+				}
+				return tx.Migrator().DropColumn(&model.GopaSigningKeys{}, "active_from")
+			},
+		},
+	}
+}
+
+// NewMigrator 返回在db上执行GOPA迁移的Migrator，执行记录保存在gopa_schema_migrations表中
+func NewMigrator(db *gorm.DB) (*migrate.Migrator, error) {
+	return migrate.New(db, model.Table("gopa_schema_migrations"), Migrations())
+}
+
+// AutoMigrate 启动时是否执行未执行的迁移。SQLite和内存数据库总是执行
+func AutoMigrate(c *model.SysConfig) bool {
+	return c.Gorm.EnableAutoMigrate || c.Gorm.DBType == DBTypeSQLite || c.Gorm.DBType == DBTypeMemory
+}
+
+// createUniqueIndex 在value对应的表上创建唯一索引，已存在时跳过。
+// 表中已有重复的值时创建失败
+func createUniqueIndex(tx *gorm.DB, value interface{}, name string, columns ...string) error {
+	if tx.Migrator().HasIndex(value, name) {
+		return nil
+	}
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(value); err != nil {
+		return err
+	}
+	fields := make([]interface{}, 0, len(columns))
+	for _, column := range columns {
+		fields = append(fields, clause.Column{Name: column})
+	}
+	return tx.Exec("CREATE UNIQUE INDEX ? ON ? ?", clause.Column{Name: name}, clause.Table{Name: stmt.Table}, fields).Error
+}
@@ -0,0 +1,97 @@
+package gorm
+
+import (
+	"testing"
+
+	"gopa/model"
+	"gorm.io/gorm"
+)
+
+func TestMigrations(t *testing.T) {
+	db, err := newSQLite(&model.GormConfig{DSN: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(0); err != nil {
+		t.Fatal(err)
+	}
+	// 结构体新增的列都要有对应的迁移
+	for _, m := range Models() {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(m); err != nil {
+			t.Fatal(err)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" && !db.Migrator().HasColumn(m, field.DBName) {
+				t.Errorf("column %s.%s is not created by any migration", stmt.Table, field.DBName)
+			}
+		}
+	}
+
+	migrations := Migrations()
+	if _, err := migrator.Down(len(migrations)); err == nil {
+		t.Error("rolling back the baseline succeeded, want an error")
+	}
+	if !db.Migrator().HasTable(&model.GopaMembers{}) {
+		t.Error("rolling back dropped the baseline tables")
+	}
+	if db.Migrator().HasColumn(&model.GopaMembers{}, "version") {
+		t.Error("migrations after the baseline were not rolled back")
+	}
+}
+
+func TestCredentialsMigration(t *testing.T) {
+	db, err := newSQLite(&model.GormConfig{DSN: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(5); err != nil {
+		t.Fatal(err)
+	}
+	for _, member := range []v1Members{
+		{Username: "alice", Password: "old", Project: "ops", Role: "dev"},
+		{Username: "alice", Password: "new", Project: "infra", Role: "dev"},
+		{Username: "alice", Project: "web", Role: "dev"},
+		{Username: "bob", Project: "ops", Role: "dev"},
+	} {
+		if err := db.Create(&member).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := migrator.Up(6); err != nil {
+		t.Fatal(err)
+	}
+	var credentials []model.GopaCredentials
+	db.Order("username").Find(&credentials)
+	if len(credentials) != 1 || credentials[0].Username != "alice" || credentials[0].Password != "new" ||
+		credentials[0].Provider != model.CredentialLocal {
+		t.Errorf("credentials = %+v, want the latest password of alice", credentials)
+	}
+	var left int64
+	db.Model(&v1Members{}).Where("password <> ''").Count(&left)
+	if left != 0 {
+		t.Errorf("%d memberships still hold a password", left)
+	}
+
+	if _, err := migrator.Down(1); err != nil {
+		t.Fatal(err)
+	}
+	var members []v1Members
+	db.Where("username = ?", "alice").Find(&members)
+	for _, member := range members {
+		if member.Password != "new" {
+			t.Errorf("rolled back membership %s/%s has password %q, want new", member.Project, member.Role, member.Password)
+		}
+	}
+	if db.Migrator().HasTable(&model.GopaCredentials{}) {
+		t.Error("rolling back kept the credentials table")
+	}
+}
@@ -0,0 +1,96 @@
+package gorm
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopa/model"
+)
+
+// MongoRegoStore 保存在MongoDB集合中的rego文件
+type MongoRegoStore struct {
+	Collection *mongo.Collection
+}
+
+// NewMongoRegoStore 使用client中gopa库的regos集合
+func NewMongoRegoStore(client *mongo.Client) MongoRegoStore {
+	return MongoRegoStore{Collection: client.Database(RegoDatabaseName).Collection(RegoCollectionName)}
+}
+
+// EnsureIndexes 在path上创建唯一索引，已存在时不做修改。
+// 集合中已有重复的path时创建失败
+func (s MongoRegoStore) EnsureIndexes() error {
+	_, err := s.Collection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "path", Value: 1}},
+		Options: options.Index().SetUnique(true).SetName("path_unique"),
+	})
+	return err
+}
+
+func (s MongoRegoStore) List() ([]model.RegoDocument, error) {
+	cur, err := s.Collection.Find(context.TODO(), bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.TODO())
+	var documents []model.RegoDocument
+	for cur.Next(context.TODO()) {
+		var document model.RegoDocument
+		if err := cur.Decode(&document); err != nil {
+			return nil, err
+		}
+		documents = append(documents, document)
+	}
+	return documents, cur.Err()
+}
+
+func (s MongoRegoStore) Get(path string) (model.RegoDocument, error) {
+	var document model.RegoDocument
+	err := s.Collection.FindOne(context.TODO(), bson.M{"path": path}).Decode(&document)
+	if err == mongo.ErrNoDocuments {
+		return document, ErrRegoNotFound
+	}
+	return document, err
+}
+
+func (s MongoRegoStore) Insert(document model.RegoDocument) error {
+	document.Version = 1
+	_, err := s.Collection.InsertOne(context.TODO(), document)
+	if IsDuplicate(err) {
+		return ErrRegoExists
+	}
+	return err
+}
+
+// Update 修改内容并增加version。增加版本之前保存的文件没有version字段，
+// 版本为0，第一次修改后为1
+func (s MongoRegoStore) Update(path, content string, version int64) (int64, error) {
+	filter := bson.M{"path": path, "content": bson.M{"$ne": content}}
+	switch version {
+	case AnyVersion:
+	case 0:
+		// null同时匹配没有version字段的文件
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	default:
+		filter["version"] = version
+	}
+	res, err := s.Collection.UpdateOne(context.TODO(), filter,
+		bson.M{"$set": bson.M{"content": content}, "$inc": bson.M{"version": 1}})
+	if err != nil {
+		return 0, err
+	}
+	if res.ModifiedCount > 0 {
+		return res.ModifiedCount, nil
+	}
+	return 0, regoConflict(s, path, version)
+}
+
+func (s MongoRegoStore) Delete(path string) (int64, error) {
+	res, err := s.Collection.DeleteOne(context.TODO(), bson.M{"path": path})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
@@ -0,0 +1,140 @@
+package gorm
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"gopa/model"
+)
+
+const (
+	// RegoStoreMongo rego文件保存在MongoDB的regos集合中
+	RegoStoreMongo = "mongo"
+	// RegoStoreMemory rego文件只保存在内存中，重启后丢失
+	RegoStoreMemory = "memory"
+	// RegoStoreDatabase rego文件保存在关系数据库的rego_documents表中
+	RegoStoreDatabase = "database"
+)
+
+var (
+	// ErrRegoNotFound 该路径下没有rego文件
+	ErrRegoNotFound = errors.New("rego document not found")
+	// ErrRegoExists 该路径下已经有rego文件
+	ErrRegoExists = errors.New("rego document already exists")
+	// ErrRegoConflict rego文件已经被修改，版本与请求中的不一致
+	ErrRegoConflict = errors.New("rego document version conflict")
+)
+
+// AnyVersion 修改时不检查版本
+const AnyVersion int64 = -1
+
+// RegoStore rego文件的存储，每个路径最多一个文件
+type RegoStore interface {
+	// List 返回全部rego文件
+	List() ([]model.RegoDocument, error)
+	// Get 返回path对应的rego文件，不存在时返回ErrRegoNotFound
+	Get(path string) (model.RegoDocument, error)
+	// Insert 保存新的rego文件，版本为1。path已存在时返回ErrRegoExists
+	Insert(document model.RegoDocument) error
+	// Update 修改path对应的rego文件的内容并把版本加一，返回修改的文件数，内容没有变化时不修改。
+	// version不为AnyVersion时只修改该版本的文件，文件的版本不同时返回ErrRegoConflict。
+	// 没有版本的旧文件版本为0
+	Update(path, content string, version int64) (int64, error)
+	// Delete 删除path对应的rego文件，返回删除的文件数
+	Delete(path string) (int64, error)
+}
+
+// Regos 当前使用的rego文件存储
+var Regos RegoStore
+
+// MemoryRegoStore 保存在内存中的rego文件，用于测试和不依赖外部服务的部署
+type MemoryRegoStore struct {
+	mu        sync.RWMutex
+	documents map[string]model.RegoDocument
+}
+
+// NewMemoryRegoStore 创建空的MemoryRegoStore
+func NewMemoryRegoStore() *MemoryRegoStore {
+	return &MemoryRegoStore{documents: map[string]model.RegoDocument{}}
+}
+
+// List 返回按路径排序的全部rego文件
+func (s *MemoryRegoStore) List() ([]model.RegoDocument, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	documents := make([]model.RegoDocument, 0, len(s.documents))
+	for _, document := range s.documents {
+		documents = append(documents, document)
+	}
+	sort.Slice(documents, func(i, j int) bool { return documents[i].Path < documents[j].Path })
+	return documents, nil
+}
+
+func (s *MemoryRegoStore) Get(path string) (model.RegoDocument, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	document, ok := s.documents[path]
+	if !ok {
+		return model.RegoDocument{}, ErrRegoNotFound
+	}
+	return document, nil
+}
+
+func (s *MemoryRegoStore) Insert(document model.RegoDocument) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.documents[document.Path]; ok {
+		return ErrRegoExists
+	}
+	document.Version = 1
+	s.documents[document.Path] = document
+	return nil
+}
+
+func (s *MemoryRegoStore) Update(path, content string, version int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	document, ok := s.documents[path]
+	if !ok {
+		return 0, nil
+	}
+	if version != AnyVersion && document.Version != version {
+		return 0, ErrRegoConflict
+	}
+	if document.Content == content {
+		return 0, nil
+	}
+	document.Content = content
+	document.Version++
+	s.documents[path] = document
+	return 1, nil
+}
+
+// regoConflict 条件修改没有修改任何文件时，判断是否因为path对应的文件不是该版本
+func regoConflict(s RegoStore, path string, version int64) error {
+	if version == AnyVersion {
+		return nil
+	}
+	document, err := s.Get(path)
+	if err == ErrRegoNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if document.Version != version {
+		return ErrRegoConflict
+	}
+	return nil
+}
+
+func (s *MemoryRegoStore) Delete(path string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.documents[path]; !ok {
+		return 0, nil
+	}
+	delete(s.documents, path)
+	return 1, nil
+}
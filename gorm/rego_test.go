@@ -0,0 +1,26 @@
+package gorm
+
+import (
+	"testing"
+
+	"gopa/model"
+)
+
+func TestMemoryRegoStoreVersions(t *testing.T) {
+	store := NewMemoryRegoStore()
+	// 增加版本之前保存的文件没有版本
+	store.documents["/api/a.rego"] = model.RegoDocument{Path: "/api/a.rego", Content: "package a"}
+
+	if n, err := store.Update("/api/a.rego", "package a2", 0); err != nil || n != 1 {
+		t.Fatalf("Update of version 0 = %d, %v; want 1", n, err)
+	}
+	if document, _ := store.Get("/api/a.rego"); document.Version != 1 {
+		t.Errorf("version after update = %d, want 1", document.Version)
+	}
+	if n, err := store.Update("/api/a.rego", "package a3", 0); err != ErrRegoConflict || n != 0 {
+		t.Errorf("Update of a stale version 0 = %d, %v; want ErrRegoConflict", n, err)
+	}
+	if n, err := store.Update("/api/a.rego", "package a3", AnyVersion); err != nil || n != 1 {
+		t.Errorf("Update of any version = %d, %v; want 1", n, err)
+	}
+}
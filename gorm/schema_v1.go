@@ -0,0 +1,259 @@
+package gorm
+
+import (
+	"time"
+
+	"gopa/model"
+	"gorm.io/gorm"
+)
+
+// 迁移create_tables建立的表结构。这里的结构体是第1版表结构的快照，
+// 不要随model中的结构体修改，表结构的变化追加为新的迁移
+
+type v1BaseModel struct {
+	ID        uint64
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt
+}
+
+type v1Projects struct {
+	Base          v1BaseModel `gorm:"embedded"`
+	ProjectName   string      `gorm:"size:191"`
+	ParentProject string
+	MfaRequired   bool
+}
+
+func (v1Projects) TableName() string { return model.Table("gopa_projects") }
+
+type v1Roles struct {
+	Base        v1BaseModel `gorm:"embedded"`
+	RoleName    string      `gorm:"size:191"`
+	MfaRequired bool
+}
+
+func (v1Roles) TableName() string { return model.Table("gopa_roles") }
+
+type v1RoleParents struct {
+	Base           v1BaseModel `gorm:"embedded"`
+	RoleName       string
+	ParentRoleName string
+}
+
+func (v1RoleParents) TableName() string { return model.Table("gopa_role_parents") }
+
+type v1ProjectRoles struct {
+	Base        v1BaseModel `gorm:"embedded"`
+	ProjectName string
+	RoleName    string
+}
+
+func (v1ProjectRoles) TableName() string { return model.Table("gopa_project_roles") }
+
+type v1Members struct {
+	Base      v1BaseModel `gorm:"embedded"`
+	Username  string      `gorm:"size:191"`
+	Password  string
+	Project   string `gorm:"size:191"`
+	Role      string `gorm:"size:191"`
+	ValidFrom *time.Time
+	ExpiresAt *time.Time
+	Source    string
+	Disabled  bool
+}
+
+func (v1Members) TableName() string { return model.Table("gopa_members") }
+
+type v1Applications struct {
+	Base         v1BaseModel `gorm:"embedded"`
+	ResourceName string
+	Address      string
+	Routers      string
+}
+
+func (v1Applications) TableName() string { return model.Table("gopa_applications") }
+
+type v1ProjectResources struct {
+	ProjectRole    v1ProjectRoles `gorm:"embedded"`
+	ResourceRouter string
+}
+
+func (v1ProjectResources) TableName() string { return model.Table("project_resources") }
+
+type v1AuditLogs struct {
+	Base   v1BaseModel `gorm:"embedded"`
+	Actor  string
+	Action string
+	Target string
+	Detail string
+}
+
+func (v1AuditLogs) TableName() string { return model.Table("gopa_audit_logs") }
+
+type v1AccessRequests struct {
+	Base          v1BaseModel `gorm:"embedded"`
+	Username      string
+	Project       string
+	Role          string
+	Justification string
+	ExpiresAt     *time.Time
+	Status        string
+	Reviewer      string
+	ReviewComment string
+	ReviewedAt    *time.Time
+}
+
+func (v1AccessRequests) TableName() string { return model.Table("gopa_access_requests") }
+
+type v1Webhooks struct {
+	Base    v1BaseModel `gorm:"embedded"`
+	URL     string
+	Secret  string
+	Events  string
+	Enabled bool
+}
+
+func (v1Webhooks) TableName() string { return model.Table("gopa_webhooks") }
+
+type v1WebhookDeliveries struct {
+	Base         v1BaseModel `gorm:"embedded"`
+	WebhookID    uint64
+	Event        string
+	Payload      string
+	Status       string
+	Attempts     int
+	ResponseCode int
+	LastError    string
+	DeliveredAt  *time.Time
+}
+
+func (v1WebhookDeliveries) TableName() string { return model.Table("gopa_webhook_deliveries") }
+
+type v1ServiceAccounts struct {
+	Base        v1BaseModel `gorm:"embedded"`
+	Name        string      `gorm:"size:191"`
+	Description string
+	Owner       string
+	Disabled    bool
+}
+
+func (v1ServiceAccounts) TableName() string { return model.Table("gopa_service_accounts") }
+
+type v1APIKeys struct {
+	Base           v1BaseModel `gorm:"embedded"`
+	ServiceAccount string
+	Prefix         string
+	KeyHash        string
+	Project        string
+	Role           string
+	ExpiresAt      *time.Time
+	RevokedAt      *time.Time
+	LastUsedAt     *time.Time
+	LastUsedIP     string
+}
+
+func (v1APIKeys) TableName() string { return model.Table("gopa_api_keys") }
+
+type v1RevokedTokens struct {
+	Base      v1BaseModel `gorm:"embedded"`
+	JTI       string      `gorm:"column:jti"`
+	Username  string
+	Reason    string
+	ExpiresAt time.Time
+}
+
+func (v1RevokedTokens) TableName() string { return model.Table("gopa_revoked_tokens") }
+
+type v1TokenCutoffs struct {
+	Base          v1BaseModel `gorm:"embedded"`
+	Username      string
+	RevokedBefore time.Time
+	Reason        string
+}
+
+func (v1TokenCutoffs) TableName() string { return model.Table("gopa_token_cutoffs") }
+
+type v1RefreshTokens struct {
+	Base            v1BaseModel `gorm:"embedded"`
+	Session         string
+	Username        string
+	TokenHash       string
+	Client          string
+	IP              string `gorm:"column:ip"`
+	AccessJTI       string `gorm:"column:access_jti"`
+	AccessExpiresAt time.Time
+	LoginAt         time.Time
+	ExpiresAt       time.Time
+	UsedAt          *time.Time
+	RevokedAt       *time.Time
+}
+
+func (v1RefreshTokens) TableName() string { return model.Table("gopa_refresh_tokens") }
+
+type v1LoginFailures struct {
+	Base          v1BaseModel `gorm:"embedded"`
+	Subject       string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+func (v1LoginFailures) TableName() string { return model.Table("gopa_login_failures") }
+
+type v1MemberMFA struct {
+	Base          v1BaseModel `gorm:"embedded"`
+	Username      string
+	Secret        string
+	ConfirmedAt   *time.Time
+	LastStep      int64
+	RecoveryCodes string
+}
+
+func (v1MemberMFA) TableName() string { return model.Table("gopa_member_mfa") }
+
+type v1SigningKeys struct {
+	Base       v1BaseModel `gorm:"embedded"`
+	Kid        string
+	Algorithm  string
+	PrivateKey string
+}
+
+func (v1SigningKeys) TableName() string { return model.Table("gopa_signing_keys") }
+
+type v1RegoDocuments struct {
+	Base      v1BaseModel `gorm:"embedded"`
+	Path      string      `gorm:"size:191"`
+	Method    string
+	Name      string
+	Content   string `gorm:"type:text"`
+	Arguments string
+	Revision  int64
+}
+
+func (v1RegoDocuments) TableName() string { return model.Table("rego_documents") }
+
+// schemaV1 第1版的全部表
+func schemaV1() []interface{} {
+	return []interface{}{
+		&v1Projects{},
+		&v1Roles{},
+		&v1RoleParents{},
+		&v1ProjectRoles{},
+		&v1Members{},
+		&v1Applications{},
+		&v1ProjectResources{},
+		&v1AuditLogs{},
+		&v1AccessRequests{},
+		&v1Webhooks{},
+		&v1WebhookDeliveries{},
+		&v1ServiceAccounts{},
+		&v1APIKeys{},
+		&v1RevokedTokens{},
+		&v1TokenCutoffs{},
+		&v1RefreshTokens{},
+		&v1LoginFailures{},
+		&v1MemberMFA{},
+		&v1SigningKeys{},
+		&v1RegoDocuments{},
+	}
+}
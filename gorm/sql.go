@@ -0,0 +1,96 @@
+package gorm
+
+import (
+	"encoding/json"
+
+	"gopa/model"
+	"gorm.io/gorm"
+)
+
+// SQLRegoStore 保存在关系数据库rego_documents表中的rego文件。
+// DB为事务时，rego文件和授权表的修改可以一起提交或回滚
+type SQLRegoStore struct {
+	DB *gorm.DB
+}
+
+func (s SQLRegoStore) List() ([]model.RegoDocument, error) {
+	var rows []model.RegoDocuments
+	if res := s.DB.Order("path").Find(&rows); res.Error != nil {
+		return nil, res.Error
+	}
+	documents := make([]model.RegoDocument, 0, len(rows))
+	for _, row := range rows {
+		document, err := regoDocument(row)
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, document)
+	}
+	return documents, nil
+}
+
+func (s SQLRegoStore) Get(path string) (model.RegoDocument, error) {
+	var row model.RegoDocuments
+	res := s.DB.Where("path = ?", path).Limit(1).Find(&row)
+	if res.Error != nil {
+		return model.RegoDocument{}, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return model.RegoDocument{}, ErrRegoNotFound
+	}
+	return regoDocument(row)
+}
+
+func (s SQLRegoStore) Insert(document model.RegoDocument) error {
+	arguments, err := json.Marshal(document.Arguments)
+	if err != nil {
+		return err
+	}
+	err = s.DB.Create(&model.RegoDocuments{
+		Path:      document.Path,
+		Method:    document.Method,
+		Name:      document.Name,
+		Content:   document.Content,
+		Arguments: string(arguments),
+		Revision:  1,
+	}).Error
+	if IsDuplicate(err) {
+		return ErrRegoExists
+	}
+	return err
+}
+
+// Update 修改内容并增加Revision，内容没有变化时不修改。Revision即文件的版本
+func (s SQLRegoStore) Update(path, content string, version int64) (int64, error) {
+	db := s.DB.Model(&model.RegoDocuments{}).Where("path = ? AND content <> ?", path, content)
+	if version != AnyVersion {
+		db = db.Where("revision = ?", version)
+	}
+	res := db.Updates(map[string]interface{}{"content": content, "revision": gorm.Expr("revision + 1")})
+	if res.Error != nil || res.RowsAffected > 0 {
+		return res.RowsAffected, res.Error
+	}
+	return 0, regoConflict(s, path, version)
+}
+
+func (s SQLRegoStore) Delete(path string) (int64, error) {
+	res := s.DB.Unscoped().Where("path = ?", path).Delete(&model.RegoDocuments{})
+	return res.RowsAffected, res.Error
+}
+
+// regoDocument 把rego_documents中的一行转为RegoDocument
+func regoDocument(row model.RegoDocuments) (model.RegoDocument, error) {
+	document := model.RegoDocument{
+		Method:  row.Method,
+		Path:    row.Path,
+		Name:    row.Name,
+		Content: row.Content,
+		Version: row.Revision,
+	}
+	if row.Arguments != "" {
+		if err := json.Unmarshal([]byte(row.Arguments), &document.Arguments); err != nil {
+			return document, err
+		}
+	}
+	return document, nil
+}
@@ -0,0 +1,67 @@
+package gorm
+
+import (
+	"reflect"
+	"testing"
+
+	"gopa/model"
+)
+
+func TestSQLRegoStore(t *testing.T) {
+	db, err := newSQLite(&model.GormConfig{DSN: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(0); err != nil {
+		t.Fatal(err)
+	}
+	store := SQLRegoStore{DB: db}
+	if _, err := store.Get("/api/a.rego"); err != ErrRegoNotFound {
+		t.Fatalf("Get on an empty table = %v, want ErrRegoNotFound", err)
+	}
+
+	document := model.RegoDocument{Method: "GET", Path: "/api/a.rego", Name: "a", Content: "package a", Arguments: []string{"project", "role"}}
+	if err := store.Insert(document); err != nil {
+		t.Fatal(err)
+	}
+	want := document
+	want.Version = 1
+	if got, err := store.Get(document.Path); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("Get = %+v, %v; want %+v", got, err, want)
+	}
+	if err := store.Insert(document); err != ErrRegoExists {
+		t.Errorf("Insert of an existing path = %v, want ErrRegoExists", err)
+	}
+
+	if n, err := store.Update(document.Path, "package a", AnyVersion); err != nil || n != 0 {
+		t.Errorf("Update with the same content = %d, %v; want 0", n, err)
+	}
+	if n, err := store.Update(document.Path, "package a2", 1); err != nil || n != 1 {
+		t.Errorf("Update = %d, %v; want 1", n, err)
+	}
+	var row model.RegoDocuments
+	db.Where("path = ?", document.Path).First(&row)
+	if row.Content != "package a2" || row.Revision != 2 {
+		t.Errorf("row after update = %q revision %d, want revision 2", row.Content, row.Revision)
+	}
+	if n, err := store.Update(document.Path, "package a3", 1); err != ErrRegoConflict || n != 0 {
+		t.Errorf("Update of a stale version = %d, %v; want ErrRegoConflict", n, err)
+	}
+	if n, err := store.Update(document.Path, "package a3", 0); err != ErrRegoConflict || n != 0 {
+		t.Errorf("Update of version 0 = %d, %v; want ErrRegoConflict", n, err)
+	}
+
+	if documents, err := store.List(); err != nil || len(documents) != 1 {
+		t.Errorf("List = %v, %v", documents, err)
+	}
+	if n, err := store.Delete(document.Path); err != nil || n != 1 {
+		t.Errorf("Delete = %d, %v; want 1", n, err)
+	}
+	if err := store.Insert(document); err != nil {
+		t.Errorf("Insert after Delete = %v", err)
+	}
+}
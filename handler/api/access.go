@@ -0,0 +1,261 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopa/gorm"
+	h "gopa/handler"
+	"gopa/model"
+	"gopa/pkg/errno"
+	"gopa/pkg/notify"
+	"gopa/service"
+	"gopa/util"
+)
+
+// AccessRequestAddForm 用户申请加入某个组并获得某个角色时的结构体
+// ExpiresAt不为空时，审批通过后得到的是临时授权
+type AccessRequestAddForm struct {
+	Project       string     `json:"project"`
+	Role          string     `json:"role"`
+	Justification string     `json:"justification"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+}
+
+// AccessRequestReviewForm 审批访问申请时的结构体
+type AccessRequestReviewForm struct {
+	ID      uint64 `json:"id"`
+	Comment string `json:"comment"`
+}
+
+// AccessRequest 访问申请的返回结构体
+type AccessRequest struct {
+	ID            uint64     `json:"id"`
+	Username      string     `json:"username"`
+	Project       string     `json:"project"`
+	Role          string     `json:"role"`
+	Justification string     `json:"justification"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	Status        string     `json:"status"`
+	Reviewer      string     `json:"reviewer"`
+	ReviewComment string     `json:"review_comment"`
+	ReviewedAt    *time.Time `json:"reviewed_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// TableName 结构体映射表名称
+func (AccessRequest) TableName() string {
+	return model.Table("gopa_access_requests")
+}
+
+// AccessRequestAdd 	api
+// @Summary          AccessRequestAdd
+// @Description    Submit a request to join a project with a role. The requester is taken from the token.
+// @Tags               accessRequest
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project  header            string                          true  "Project"
+// @Param            role     header            string                          true  "Role"
+// @Param                     form              body        AccessRequestAddForm  true  "form"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Router                    /api/v1/accessRequest/add [post]
+func AccessRequestAdd(context *gin.Context) {
+	var form AccessRequestAddForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	username := currentUsername(context)
+	if found, err := gorm.Entities.Projects().Exists(form.Project); err != nil || !found {
+		h.SendResponse400(context, errno.New(errno.ErrProjectNotFound, err).Addf("[%s]", form.Project), nil)
+		return
+	}
+	if found, err := gorm.Entities.Roles().Exists(form.Role); err != nil || !found {
+		h.SendResponse400(context, errno.New(errno.ErrRoleNotFound, err).Addf("[%s]", form.Role), nil)
+		return
+	}
+	db := gorm.DB.Self
+	var count int64
+	res := db.Model(&model.GopaAccessRequests{}).
+		Where("username = ? AND project = ? AND role = ? AND status = ?", username, form.Project, form.Role, model.AccessRequestPending).
+		Count(&count)
+	if res.Error != nil {
+		h.SendResponse400(context, res.Error, nil)
+		return
+	}
+	if count > 0 {
+		h.SendResponse400(context, errno.ErrAccessRequestDuplicate, nil)
+		return
+	}
+	request := model.GopaAccessRequests{
+		Username:      username,
+		Project:       form.Project,
+		Role:          form.Role,
+		Justification: form.Justification,
+		ExpiresAt:     form.ExpiresAt,
+		Status:        model.AccessRequestPending,
+	}
+	if res := db.Create(&request); res.Error != nil {
+		h.SendResponse400(context, res.Error, nil)
+		return
+	}
+	util.Audit(username, "accessRequest.created", username, fmt.Sprintf("request #%d for %s/%s", request.ID, request.Project, request.Role))
+	notify.Send(notify.Event{
+		Kind:    notify.AccessRequestCreated,
+		Project: request.Project,
+		Actor:   username,
+		Text:    fmt.Sprintf("request #%d for %s as %s: %s", request.ID, username, request.Role, request.Justification),
+	})
+	h.SendResponse(context, nil, request.ID)
+}
+
+// AccessRequestList 	api
+// @Summary          AccessRequestList
+// @Description    List access requests, optionally filtered by status, project or requester.
+// @Tags               accessRequest
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project            header    string    true   "Project"
+// @Param            role               header    string    true   "Role"
+// @Param            status             query     string    false  "pending, approved or denied"
+// @Param            project_name       query     string    false  "requested project"
+// @Param            username           query     string    false  "requester"
+// @Success          200      {object}  handler.Response
+// @Failure          400      {object}  handler.Response
+// @Router                    /api/v1/accessRequest/list [get]
+func AccessRequestList(context *gin.Context) {
+	var data []AccessRequest
+	db := gorm.DB.Self
+	if status, ok := context.GetQuery("status"); ok {
+		db = db.Where("status = ?", status)
+	}
+	if project, ok := context.GetQuery("project_name"); ok {
+		db = db.Where("project = ?", project)
+	}
+	if username, ok := context.GetQuery("username"); ok {
+		db = db.Where("username = ?", username)
+	}
+	res := db.Order("id desc").Find(&data)
+	if res.Error != nil {
+		h.SendResponse400(context, res.Error, nil)
+		return
+	}
+	h.SendResponse(context, errno.OK, data)
+}
+
+// AccessRequestApprove 	api
+// @Summary              AccessRequestApprove
+// @Description        Approve a pending access request and add the requested membership. Whether the caller may review is decided by the policy of /gopa/access-request/review.
+// @Tags                   accessRequest
+// @Accept               application/json
+// @Produce              application/json
+// @Security             Token
+// @Param                project  header            string                             true  "Project"
+// @Param                role     header            string                             true  "Role"
+// @Param                         form              body        AccessRequestReviewForm  true  "form"
+// @Success              200              {object}          handler.Response
+// @Failure              400              {object}          handler.Response
+// @Failure              403              {object}          handler.Response
+// @Router                        /api/v1/accessRequest/approve [post]
+func AccessRequestApprove(context *gin.Context) {
+	reviewAccessRequest(context, model.AccessRequestApproved)
+}
+
+// AccessRequestDeny 	api
+// @Summary           AccessRequestDeny
+// @Description     Deny a pending access request. Whether the caller may review is decided by the policy of /gopa/access-request/review.
+// @Tags                accessRequest
+// @Accept            application/json
+// @Produce           application/json
+// @Security          Token
+// @Param             project  header            string                             true  "Project"
+// @Param             role     header            string                             true  "Role"
+// @Param                      form              body        AccessRequestReviewForm  true  "form"
+// @Success           200              {object}          handler.Response
+// @Failure           400              {object}          handler.Response
+// @Failure           403              {object}          handler.Response
+// @Router                     /api/v1/accessRequest/deny [post]
+func AccessRequestDeny(context *gin.Context) {
+	reviewAccessRequest(context, model.AccessRequestDenied)
+}
+
+// reviewAccessRequest 把待审批的访问申请修改为status，
+// 审批通过时在同一个事务内添加对应的授权
+func reviewAccessRequest(context *gin.Context, status string) {
+	var form AccessRequestReviewForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	reviewer := currentUsername(context)
+	var request model.GopaAccessRequests
+	db := gorm.DB.Self
+	if res := db.First(&request, form.ID); res.Error != nil {
+		h.SendResponse400(context, errno.New(errno.ErrAccessRequestNotFound, res.Error), nil)
+		return
+	}
+	if request.Status != model.AccessRequestPending {
+		h.SendResponse400(context, errno.New(errno.ErrAccessRequestReviewed, nil).Addf("[%s]", request.Status), nil)
+		return
+	}
+	allowed, err := util.CanReviewAccessRequest(reviewer, request)
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	if !allowed {
+		h.SendResponse403(context, errno.ErrAccessReviewForbidden, nil)
+		return
+	}
+	now := time.Now()
+	err = gorm.Entities.Transaction(func(tx gorm.EntityStore) error {
+		res := tx.DB().Model(&model.GopaAccessRequests{}).
+			Where("id = ? AND status = ?", request.ID, model.AccessRequestPending).
+			Updates(map[string]interface{}{
+				"status":         status,
+				"reviewer":       reviewer,
+				"review_comment": form.Comment,
+				"reviewed_at":    now,
+			})
+		if res.Error != nil {
+			return res.Error
+		}
+		// 并发审批时只有一个能成功
+		if res.RowsAffected == 0 {
+			return errno.ErrAccessRequestReviewed
+		}
+		if status != model.AccessRequestApproved {
+			return nil
+		}
+		return tx.Members().Create(model.GopaMembers{
+			Username:  request.Username,
+			Project:   request.Project,
+			Role:      request.Role,
+			ExpiresAt: request.ExpiresAt,
+		})
+	})
+	if err != nil {
+		h.SendResponse400(context, duplicateError(err, errno.ErrMemberExists), nil)
+		return
+	}
+	util.Audit(reviewer, "accessRequest."+status, request.Username,
+		fmt.Sprintf("request #%d for %s/%s: %s", request.ID, request.Project, request.Role, form.Comment))
+	kind := notify.AccessRequestDenied
+	if status == model.AccessRequestApproved {
+		kind = notify.AccessRequestApproved
+	}
+	notify.Send(notify.Event{
+		Kind:    kind,
+		Project: request.Project,
+		Actor:   reviewer,
+		Text:    fmt.Sprintf("request #%d for %s as %s: %s", request.ID, request.Username, request.Role, form.Comment),
+	})
+	if status == model.AccessRequestApproved {
+		service.Publish(service.ResourceMember, service.EventCreated, reviewer, request)
+	}
+	h.SendResponse(context, nil, status)
+}
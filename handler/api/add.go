@@ -1,22 +1,33 @@
 package api
 
 import (
-	ctx "context"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"gopa/gorm"
 	h "gopa/handler"
 	"gopa/model"
+	"gopa/pkg/auth"
+	"gopa/pkg/errno"
+	"gopa/pkg/notify"
+	"gopa/service"
 	"gopa/util"
+	"time"
 )
 
 // ProjectAddForm 某用户发起添加新的组的请求时的结构体
+// ParentProject 为空时添加的是顶层组
 type ProjectAddForm struct {
 	AddedGroupName string `json:"project_name"`
+	ParentProject  string `json:"parent_project"`
+	MfaRequired    bool   `json:"mfa_required"`
 }
 
 // RoleAddForm 某用户发起添加新的角色的请求时的结构体
+// ParentRoles 为该角色继承的父角色
 type RoleAddForm struct {
-	AddedRoleName string `json:"role_name"`
+	AddedRoleName string   `json:"role_name"`
+	ParentRoles   []string `json:"parent_roles"`
+	MfaRequired   bool     `json:"mfa_required"`
 }
 
 // ProjectRolesAddForm 某用户发起向某个组添加新角色时发起请求的结构体
@@ -26,10 +37,15 @@ type ProjectRolesAddForm struct {
 }
 
 // UserAddForm 某用户发起添加新用户的请求时的结构体
+// ValidFrom和ExpiresAt为RFC3339格式的时间，用于添加临时授权。
+// Password不为空时设置该用户的本地密码，用户可以通过local认证方式登录，用于服务账号和紧急账号，只有管理员可以设置
 type UserAddForm struct {
-	Username string `json:"username"`
-	Project  string `json:"project"`
-	Role     string `json:"role"`
+	Username  string     `json:"username"`
+	Password  string     `json:"password,omitempty"`
+	Project   string     `json:"project"`
+	Role      string     `json:"role"`
+	ValidFrom *time.Time `json:"valid_from"`
+	ExpiresAt *time.Time `json:"expires_at"`
 }
 
 type ApplicationAddForm struct {
@@ -54,7 +70,7 @@ type ProjectResourceForm struct {
 
 // ProjectAdd 		api
 // @Summary          ProjectAdd
-// @Description    Add a project/group into the database
+// @Description    Add a project/group into the database. If parent_project is set, the new project is a subproject of it.
 // @Tags               project
 // @Accept           application/json
 // @Produce          application/json
@@ -71,20 +87,37 @@ func ProjectAdd(context *gin.Context) {
 		h.SendResponse400(context, err, nil)
 		return
 	}
-	addedGroupName := form.AddedGroupName
-	group := model.GopaProjects{ProjectName: addedGroupName}
-	db := gorm.DB.Self
-	res := db.Create(&group)
-	if res.Error != nil {
-		h.SendResponse400(context, res.Error, nil)
+	rows, err := addProject(gorm.Entities, form)
+	if err != nil {
+		h.SendResponse400(context, err, nil)
 		return
 	}
-	h.SendResponse(context, nil, res.RowsAffected)
+	service.Publish(service.ResourceProject, service.EventCreated, currentUsername(context), form)
+	h.SendResponse(context, nil, rows)
+}
+
+// addProject 在store中添加组，ParentProject不为空时必须已经存在
+func addProject(store gorm.EntityStore, form ProjectAddForm) (int64, error) {
+	addedGroupName := form.AddedGroupName
+	if form.ParentProject != "" {
+		found, err := store.Projects().Exists(form.ParentProject)
+		if err != nil {
+			return 0, err
+		}
+		if !found || form.ParentProject == addedGroupName {
+			return 0, errno.New(errno.ErrProjectNotFound, nil).Addf("[%s]", form.ParentProject)
+		}
+	}
+	group := model.GopaProjects{ProjectName: addedGroupName, ParentProject: form.ParentProject, MfaRequired: form.MfaRequired}
+	if err := store.Projects().Create(group); err != nil {
+		return 0, duplicateError(err, errno.ErrProjectExists)
+	}
+	return 1, nil
 }
 
 // RoleAdd 			api
 // @Summary          RoleAdd
-// @Description    Add a role into the database
+// @Description    Add a role into the database. parent_roles lists the roles it inherits permissions from.
 // @Tags               role
 // @Accept           application/json
 // @Produce          application/json
@@ -102,14 +135,19 @@ func RoleAdd(context *gin.Context) {
 		return
 	}
 	addedRoleName := form.AddedRoleName
-	role := model.GopaRoles{RoleName: addedRoleName}
-	db := gorm.DB.Self
-	res := db.Create(&role)
-	if res.Error != nil {
-		h.SendResponse400(context, res.Error, nil)
+	if err := checkRoleParents(addedRoleName, form.ParentRoles); err != nil {
+		h.SendResponse400(context, err, nil)
 		return
 	}
-	h.SendResponse(context, nil, res.RowsAffected)
+	role := model.GopaRoles{RoleName: addedRoleName, MfaRequired: form.MfaRequired}
+	// 角色和它的继承关系一起提交，不会留下没有父角色的角色
+	if err := gorm.Entities.Roles().Create(role, form.ParentRoles); err != nil {
+		h.SendResponse400(context, duplicateError(err, errno.ErrRoleExists), nil)
+		return
+	}
+	util.InvalidateRoleGraph()
+	service.Publish(service.ResourceRole, service.EventCreated, currentUsername(context), form)
+	h.SendResponse(context, nil, 1)
 }
 
 // ProjectRoleAdd 	api
@@ -131,22 +169,29 @@ func ProjectRoleAdd(context *gin.Context) {
 		h.SendResponse400(context, err, nil)
 		return
 	}
+	rows, err := addProjectRole(gorm.Entities, form)
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	h.SendResponse(context, nil, rows)
+}
+
+// addProjectRole 在store中为组添加角色
+func addProjectRole(store gorm.EntityStore, form ProjectRolesAddForm) (int64, error) {
 	req := model.GopaProjectRoles{
 		ProjectName: form.ToProject,
 		RoleName:    form.AddedRoleName,
 	}
-	db := gorm.DB.Self
-	res := db.Create(&req)
-	if res.Error != nil {
-		h.SendResponse400(context, res.Error, nil)
-		return
+	if err := store.Projects().AddRole(req); err != nil {
+		return 0, err
 	}
-	h.SendResponse(context, nil, res.RowsAffected)
+	return 1, nil
 }
 
 // UserAdd 			api
 // @Summary          UserAdd
-// @Description    Add a user into the database
+// @Description    Add a user into the database. valid_from and expires_at make the grant temporary. Only administrators allowed by the policy of /gopa/admin can set a password, which replaces the local password of the user and is refused for users of LDAP or OIDC.
 // @Tags               user
 // @Accept           application/json
 // @Produce          application/json
@@ -156,6 +201,7 @@ func ProjectRoleAdd(context *gin.Context) {
 // @Param                     form                    body        UserAddForm  true    "form"
 // @Success          200                    {object}          handler.Response
 // @Failure          400                    {object}          handler.Response
+// @Failure          403                    {object}          handler.Response
 // @Router                    /api/v1/user/add [post]
 func UserAdd(context *gin.Context) {
 	var form UserAddForm
@@ -163,18 +209,73 @@ func UserAdd(context *gin.Context) {
 		h.SendResponse400(context, err, nil)
 		return
 	}
-	req := model.GopaMembers{
-		Username: form.Username,
-		Project:  form.Project,
-		Role:     form.Role,
+	if form.Password != "" && !requirePasswordAdmin(context, form.Username) {
+		return
 	}
-	db := gorm.DB.Self
-	res := db.Create(&req)
-	if res.Error != nil {
-		h.SendResponse400(context, res.Error, nil)
+	member, password, err := newMember(&form)
+	if err != nil {
+		h.SendResponse400(context, err, nil)
 		return
 	}
-	h.SendResponse(context, nil, res.RowsAffected)
+	rows, err := addUser(gorm.Entities, member, password)
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	publishUserAdded(currentUsername(context), form)
+	h.SendResponse(context, nil, rows)
+}
+
+// newMember 按form生成要添加的授权，form中有密码时检查可以设置本地密码并返回密码的哈希。
+// 计算哈希后清空form中的密码，密码不会出现在通知和webhook中
+func newMember(form *UserAddForm) (model.GopaMembers, string, error) {
+	member := model.GopaMembers{
+		Username:  form.Username,
+		Project:   form.Project,
+		Role:      form.Role,
+		ValidFrom: form.ValidFrom,
+		ExpiresAt: form.ExpiresAt,
+	}
+	if form.Password == "" {
+		return member, "", nil
+	}
+	if err := checkLocalPassword(form.Username); err != nil {
+		return member, "", err
+	}
+	hashed, err := auth.Encrypt(form.Password)
+	if err != nil {
+		return member, "", errno.New(errno.ErrEncrypt, err)
+	}
+	form.Password = ""
+	return member, hashed, nil
+}
+
+// addUser 在store中添加用户在组内的角色，password不为空时同时设置用户的本地密码
+func addUser(store gorm.EntityStore, member model.GopaMembers, password string) (int64, error) {
+	err := store.Transaction(func(tx gorm.EntityStore) error {
+		if err := tx.Members().Create(member); err != nil {
+			return duplicateError(err, errno.ErrMemberExists)
+		}
+		if password == "" {
+			return nil
+		}
+		return setLocalPassword(tx.DB(), member.Username, password)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// publishUserAdded 发送添加用户的通知和webhook
+func publishUserAdded(actor string, form UserAddForm) {
+	notify.Send(notify.Event{
+		Kind:    notify.MemberAdded,
+		Project: form.Project,
+		Actor:   actor,
+		Text:    fmt.Sprintf("%s as %s", form.Username, form.Role),
+	})
+	service.Publish(service.ResourceMember, service.EventCreated, actor, form)
 }
 
 // ApplicationAdd 	api
@@ -207,12 +308,13 @@ func ApplicationAdd(context *gin.Context) {
 		h.SendResponse400(context, res.Error, nil)
 		return
 	}
+	service.Publish(service.ResourceApplication, service.EventCreated, currentUsername(context), form)
 	h.SendResponse(context, nil, res.RowsAffected)
 }
 
 // RegoAdd api
 // @Summary          RegoAdd
-// @Description    Add a new rego file by given path to the database. If the path already exists, do not insert.
+// @Description    Add a new rego file by given path to the database. If the path already exists, do not insert. Paths under /gopa/ hold the policies of GOPA itself and can only be written by administrators allowed by the policy of /gopa/admin.
 // @Tags               rego
 // @Accept           application/json
 // @Produce          application/json
@@ -222,6 +324,7 @@ func ApplicationAdd(context *gin.Context) {
 // @Param                     form              body        RegoForm    true    "form"
 // @Success          200              {object}          handler.Response
 // @Failure          400              {object}          handler.Response
+// @Failure          403              {object}          handler.Response
 // @Router                    /api/v1/rego/add [post]
 func RegoAdd(context *gin.Context) {
 	var form RegoForm
@@ -229,6 +332,9 @@ func RegoAdd(context *gin.Context) {
 		h.SendResponse400(context, err, nil)
 		return
 	}
+	if !requireRegoWrite(context, "rego.add", form.FilePath) {
+		return
+	}
 	newRegoDocument := model.RegoDocument{
 		Method:    form.Method,
 		Path:      form.FilePath,
@@ -236,14 +342,18 @@ func RegoAdd(context *gin.Context) {
 		Content:   form.FileContent,
 		Arguments: util.ArgumentsParser(form.FileContent),
 	}
-	insertResult, err := gorm.Collections.RegoCollection.InsertOne(ctx.TODO(), newRegoDocument)
-	if err != nil {
+	if err := gorm.Regos.Insert(newRegoDocument); err == gorm.ErrRegoExists {
+		h.SendResponse400(context, errno.New(errno.ErrRegoExists, err).Addf("[%s]", newRegoDocument.Path), nil)
+		return
+	} else if err != nil {
+		h.SendResponse400(context, err, nil)
 		return
 	}
-	h.SendResponse(context, nil, insertResult)
+	notify.Send(notify.Event{Kind: notify.RegoAdded, Actor: currentUsername(context), Text: newRegoDocument.Path})
+	service.Publish(service.ResourceRego, service.EventCreated, currentUsername(context), newRegoDocument)
+	h.SendResponse(context, nil, newRegoDocument)
 }
 
-
 // ProjectResourceAdd 	api
 // @Summary            ProjectResourceAdd
 // @Description      Add a group and role to the given resource.
@@ -263,21 +373,34 @@ func ProjectResourceAdd(context *gin.Context) {
 		h.SendResponse400(context, err, nil)
 		return
 	}
-	addedResourceName := form.ResourceName
-	addedProjectName := form.ProjectName
-	addedRoleName := form.RoleName
+	rows, err := addProjectResource(gorm.Entities, form)
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	service.Publish(service.ResourceProjectResource, service.EventCreated, currentUsername(context), form)
+	h.SendResponse(context, nil, rows)
+}
+
+// addProjectResource 在store中把资源授权给组内的角色
+func addProjectResource(store gorm.EntityStore, form ProjectResourceForm) (int64, error) {
 	resource := model.ProjectResources{
 		GopaProjectRoles: model.GopaProjectRoles{
-			ProjectName: addedProjectName,
-			RoleName:    addedRoleName,
+			ProjectName: form.ProjectName,
+			RoleName:    form.RoleName,
 		},
-		ResourceRouter: addedResourceName,
+		ResourceRouter: form.ResourceName,
 	}
-	db := gorm.DB.Self
-	res := db.Create(&resource)
-	if res.Error != nil {
-		h.SendResponse400(context, res.Error, nil)
-		return
+	if err := store.Resources().Create(resource); err != nil {
+		return 0, err
 	}
-	h.SendResponse(context, nil, res.RowsAffected)
+	return 1, nil
+}
+
+// duplicateError 唯一索引冲突时返回code对应的错误，其他错误原样返回
+func duplicateError(err error, code *errno.Errno) error {
+	if gorm.IsDuplicate(err) {
+		return errno.New(code, err)
+	}
+	return err
 }
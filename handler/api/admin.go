@@ -0,0 +1,49 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	h "gopa/handler"
+	"gopa/pkg/errno"
+	"gopa/util"
+)
+
+// requireAdmin 根据/gopa/admin的策略判断调用者能否对target执行action，
+// 不能或判断出错时返回403
+func requireAdmin(context *gin.Context, action string, target map[string]interface{}) bool {
+	allowed, err := util.CanAdminister(currentUsername(context), action, target)
+	if err != nil {
+		h.SendResponse403(context, err, nil)
+		return false
+	}
+	if !allowed {
+		h.SendResponse403(context, errno.New(errno.ErrAdminForbidden, nil).Addf("[%s]", action), nil)
+		return false
+	}
+	return true
+}
+
+// requirePasswordAdmin 设置本地密码时要求调用者是管理员，
+// 否则任何用户都可以为别人设置密码并以其身份登录
+func requirePasswordAdmin(context *gin.Context, username string) bool {
+	return requireAdmin(context, "user.setPassword", map[string]interface{}{"username": username})
+}
+
+// requireRegoWrite 修改GOPA自身策略路由下的rego文件时要求调用者是管理员，
+// 否则任何用户都可以上传策略给自己管理权限
+func requireRegoWrite(context *gin.Context, action, path string) bool {
+	if !util.IsReservedRoute(path) {
+		return true
+	}
+	return requireAdmin(context, action, map[string]interface{}{"path": path})
+}
+
+// RequireAdmin 只允许通过/gopa/admin策略的调用者执行action，需放在认证中间件之后
+func RequireAdmin(action string) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if !requireAdmin(context, action, map[string]interface{}{"path": context.Request.URL.Path}) {
+			context.Abort()
+			return
+		}
+		context.Next()
+	}
+}
@@ -6,10 +6,14 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/pkg/errors"
+	"gopa/gorm"
 	"gopa/handler"
+	"gopa/pkg/errno"
+	"gopa/pkg/notify"
 	"gopa/schema"
 	"gopa/util"
 	"strings"
+	"time"
 )
 
 // Auth api
@@ -39,6 +43,16 @@ func Auth(context *gin.Context) {
 		handler.SendResponse(context, nil, "allowed")
 		return
 	}
+	// 只有当前有效的授权参与鉴权，查询授权出错时拒绝
+	granted, err := util.HasActiveGrant(currentUsername(context), context.GetHeader("project"), context.GetHeader("role"), time.Now())
+	if err != nil {
+		handler.SendResponse403(context, err, "rejected")
+		return
+	}
+	if !granted {
+		handler.SendResponse403(context, errno.New(errno.ErrGrantExpired, nil), "rejected")
+		return
+	}
 	mongoPath := util.BuildPath(referer)
 	evalQuery := util.BuildQuery(referer, false)
 	// 拿通配单独匹配判断
@@ -54,17 +68,26 @@ func Auth(context *gin.Context) {
 		handler.SendResponse403(context, err, nil)
 		return
 	}
-	regoFileResult, err := util.FetchRegoByPath(mongoPath)
+	regoFileResult, err := util.FetchPolicyByPath(mongoPath)
 	// 没有通配权限
 	// 也没有找到该路径对应的策略文件
-	if err != nil {
+	if err == gorm.ErrRegoNotFound {
 		msg := fmt.Sprintf("No rules specified for %s", mongoPath)
 		handler.SendResponse403(context, errors.New(msg), nil)
 		return
 	}
+	// 查询策略文件出错时拒绝
+	if err != nil {
+		handler.SendResponse403(context, err, nil)
+		return
+	}
 	module := regoFileResult.Content
 	arguments := regoFileResult.Arguments
-	form := util.BuildForm(context, arguments)
+	form, err := util.BuildForm(context, arguments)
+	if err != nil {
+		handler.SendResponse403(context, err, nil)
+		return
+	}
 	// Evaluate Permission
 	fmt.Println("Evaluating")
 	query := rego.New(
@@ -80,6 +103,14 @@ func Auth(context *gin.Context) {
 	if results.Allowed() {
 		handler.SendResponse(context, nil, "allowed")
 	} else {
+		if notify.IsPrivileged(referer) {
+			notify.Send(notify.Event{
+				Kind:    notify.DecisionDenied,
+				Project: context.GetHeader("project"),
+				Actor:   currentUsername(context),
+				Text:    fmt.Sprintf("%s as %s", referer, context.GetHeader("role")),
+			})
+		}
 		handler.SendResponse403(context, forbiddenError, "rejected")
 	}
 }
@@ -0,0 +1,368 @@
+package api
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopa/gorm"
+	h "gopa/handler"
+	"gopa/model"
+	"gopa/pkg/errno"
+	"gopa/service"
+)
+
+// maxBatchOperations 一次批量请求最多包含的操作数
+const maxBatchOperations = 100
+
+// BatchOperation 批量请求中的一步，Op为操作名，Form为对应接口的表单
+type BatchOperation struct {
+	Op   string          `json:"op"`
+	Form json.RawMessage `json:"form"`
+}
+
+// BatchForm 接口Batch接受的表单数据
+type BatchForm struct {
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchResult 一步操作影响的行数
+type BatchResult struct {
+	Op           string `json:"op"`
+	RowsAffected int64  `json:"rows_affected"`
+}
+
+// BatchFailure 失败的一步，Index为该步在全部操作中的序号，从0开始
+type BatchFailure struct {
+	Index int    `json:"index"`
+	Op    string `json:"op"`
+}
+
+// ProvisionMember 创建组时添加的成员
+type ProvisionMember struct {
+	Username  string     `json:"username"`
+	Password  string     `json:"password,omitempty"`
+	Role      string     `json:"role"`
+	ValidFrom *time.Time `json:"valid_from"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// ProvisionResource 创建组时授权给组内角色的资源
+type ProvisionResource struct {
+	ResourceName string `json:"resource_name"`
+	RoleName     string `json:"role_name"`
+}
+
+// ProjectProvisionForm 接口ProjectProvision接受的表单数据，
+// 创建组的同时添加组内的角色、成员和资源
+type ProjectProvisionForm struct {
+	ProjectAddForm
+	Roles     []string            `json:"roles"`
+	Members   []ProvisionMember   `json:"members"`
+	Resources []ProvisionResource `json:"resources"`
+}
+
+// batchStep 批量请求中的一步。apply在事务中执行，publish在事务提交后发送通知和webhook
+type batchStep interface {
+	apply(tx gorm.EntityStore) (int64, error)
+	publish(actor string)
+}
+
+// batchPreparer 需要在事务开始前完成的准备，如计算密码的哈希，避免长时间占用事务
+type batchPreparer interface {
+	prepare() error
+}
+
+// batchOps 批量请求支持的操作，表单与同名接口相同。修改操作的版本只能由表单中的version指定
+var batchOps = map[string]func() batchStep{
+	"project.add":            func() batchStep { return &projectAddStep{} },
+	"project.delete":         func() batchStep { return &projectDeleteStep{} },
+	"projectRole.add":        func() batchStep { return &projectRoleAddStep{} },
+	"projectRole.delete":     func() batchStep { return &projectRoleDeleteStep{} },
+	"user.add":               func() batchStep { return &userAddStep{} },
+	"user.update":            func() batchStep { return &userUpdateStep{} },
+	"user.delete":            func() batchStep { return &userDeleteStep{} },
+	"projectResource.add":    func() batchStep { return &projectResourceAddStep{} },
+	"projectResource.update": func() batchStep { return &projectResourceUpdateStep{} },
+	"projectResource.delete": func() batchStep { return &projectResourceDeleteStep{} },
+}
+
+type projectAddStep struct{ ProjectAddForm }
+
+func (s *projectAddStep) apply(tx gorm.EntityStore) (int64, error) {
+	return addProject(tx, s.ProjectAddForm)
+}
+
+func (s *projectAddStep) publish(actor string) {
+	service.Publish(service.ResourceProject, service.EventCreated, actor, s.ProjectAddForm)
+}
+
+type projectDeleteStep struct{ ProjectDeleteForm }
+
+func (s *projectDeleteStep) apply(tx gorm.EntityStore) (int64, error) {
+	return deleteProject(tx, s.ProjectDeleteForm)
+}
+
+func (s *projectDeleteStep) publish(actor string) {
+	service.Publish(service.ResourceProject, service.EventDeleted, actor, s.ProjectDeleteForm)
+}
+
+type projectRoleAddStep struct{ ProjectRolesAddForm }
+
+func (s *projectRoleAddStep) apply(tx gorm.EntityStore) (int64, error) {
+	return addProjectRole(tx, s.ProjectRolesAddForm)
+}
+
+func (s *projectRoleAddStep) publish(string) {}
+
+type projectRoleDeleteStep struct{ RoleDeleteFromGroupForm }
+
+func (s *projectRoleDeleteStep) apply(tx gorm.EntityStore) (int64, error) {
+	return deleteProjectRole(tx, s.RoleDeleteFromGroupForm)
+}
+
+func (s *projectRoleDeleteStep) publish(string) {}
+
+type userAddStep struct {
+	UserAddForm
+	member   model.GopaMembers
+	password string
+}
+
+func (s *userAddStep) prepare() (err error) {
+	s.member, s.password, err = newMember(&s.UserAddForm)
+	return err
+}
+
+func (s *userAddStep) apply(tx gorm.EntityStore) (int64, error) {
+	return addUser(tx, s.member, s.password)
+}
+
+func (s *userAddStep) publish(actor string) { publishUserAdded(actor, s.UserAddForm) }
+
+type userUpdateStep struct {
+	UpdatePermissionForm
+	version int64
+}
+
+func (s *userUpdateStep) prepare() (err error) {
+	s.version, err = formVersion(s.Version)
+	return err
+}
+
+func (s *userUpdateStep) apply(tx gorm.EntityStore) (int64, error) {
+	return updateMembership(tx, s.UpdatePermissionForm, s.version)
+}
+
+func (s *userUpdateStep) publish(actor string) {
+	publishMembershipUpdated(actor, s.UpdatePermissionForm)
+}
+
+type userDeleteStep struct {
+	UserDeleteForm
+	deleted []model.GopaMembers
+}
+
+func (s *userDeleteStep) apply(tx gorm.EntityStore) (rows int64, err error) {
+	s.deleted, rows, err = deleteUser(tx, s.UserDeleteForm)
+	return rows, err
+}
+
+func (s *userDeleteStep) publish(actor string) {
+	publishUserDeleted(actor, s.UserDeleteForm, s.deleted)
+}
+
+type projectResourceAddStep struct{ ProjectResourceForm }
+
+func (s *projectResourceAddStep) apply(tx gorm.EntityStore) (int64, error) {
+	return addProjectResource(tx, s.ProjectResourceForm)
+}
+
+func (s *projectResourceAddStep) publish(actor string) {
+	service.Publish(service.ResourceProjectResource, service.EventCreated, actor, s.ProjectResourceForm)
+}
+
+type projectResourceUpdateStep struct {
+	UpdatedProjectResourceForm
+	version int64
+}
+
+func (s *projectResourceUpdateStep) prepare() (err error) {
+	s.version, err = formVersion(s.Version)
+	return err
+}
+
+func (s *projectResourceUpdateStep) apply(tx gorm.EntityStore) (int64, error) {
+	return updateProjectResource(tx, s.UpdatedProjectResourceForm, s.version)
+}
+
+func (s *projectResourceUpdateStep) publish(actor string) {
+	service.Publish(service.ResourceProjectResource, service.EventUpdated, actor, s.UpdatedProjectResourceForm)
+}
+
+type projectResourceDeleteStep struct {
+	ProjectResourceForm
+	rows int64
+}
+
+func (s *projectResourceDeleteStep) apply(tx gorm.EntityStore) (int64, error) {
+	rows, err := deleteProjectResource(tx, s.ProjectResourceForm)
+	s.rows = rows
+	return rows, err
+}
+
+func (s *projectResourceDeleteStep) publish(actor string) {
+	if s.rows > 0 {
+		service.Publish(service.ResourceProjectResource, service.EventDeleted, actor, s.ProjectResourceForm)
+	}
+}
+
+// namedStep 带操作名的一步
+type namedStep struct {
+	op   string
+	step batchStep
+}
+
+// Batch 	api
+// @Summary          Batch
+// @Description    Run a list of management operations in one database transaction. Only administrators allowed by the policy of /gopa/admin can call it. Supported ops are project.add, project.delete, projectRole.add, projectRole.delete, user.add, user.update, user.delete, projectResource.add, projectResource.update and projectResource.delete, each taking the form of the endpoint with the same name. Updates only check the version given in the form. If any operation fails, nothing is applied and data reports the index and op of the failed operation.
+// @Tags               batch
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project  header            string         true  "Project"
+// @Param            role     header            string         true  "Role"
+// @Param                     form              body        BatchForm    true    "form"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Failure          403              {object}          handler.Response
+// @Failure          409              {object}          handler.Response
+// @Router                    /api/v1/batch [post]
+func Batch(context *gin.Context) {
+	var form BatchForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	if len(form.Operations) == 0 || len(form.Operations) > maxBatchOperations {
+		h.SendResponse400(context, errno.New(errno.ErrBatchSize, nil), nil)
+		return
+	}
+	steps := make([]namedStep, 0, len(form.Operations))
+	for i, operation := range form.Operations {
+		newStep, ok := batchOps[operation.Op]
+		if !ok {
+			h.SendResponse400(context, errno.New(errno.ErrBatchOperation, nil).Addf("[%s]", operation.Op),
+				BatchFailure{Index: i, Op: operation.Op})
+			return
+		}
+		step := newStep()
+		if err := json.Unmarshal(operation.Form, step); err != nil {
+			h.SendResponse400(context, errno.New(errno.ErrBatchOperation, err).Addf("[%s]: %v", operation.Op, err),
+				BatchFailure{Index: i, Op: operation.Op})
+			return
+		}
+		steps = append(steps, namedStep{op: operation.Op, step: step})
+	}
+	runBatch(context, steps)
+}
+
+// ProjectProvision 	api
+// @Summary          ProjectProvision
+// @Description    Create a project together with its roles, members and resources in one database transaction. The project of each member and resource is the new project. If any step fails, nothing is applied and data reports the index and op of the failed step, counting the project first, then roles, members and resources in the order given.
+// @Tags               project
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project  header            string                     true  "Project"
+// @Param            role     header            string                     true  "Role"
+// @Param                     form              body        ProjectProvisionForm    true    "form"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Router                    /api/v1/project/provision [post]
+func ProjectProvision(context *gin.Context) {
+	var form ProjectProvisionForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	project := form.AddedGroupName
+	steps := []namedStep{{op: "project.add", step: &projectAddStep{form.ProjectAddForm}}}
+	for _, role := range form.Roles {
+		steps = append(steps, namedStep{op: "projectRole.add", step: &projectRoleAddStep{
+			ProjectRolesAddForm{ToProject: project, AddedRoleName: role},
+		}})
+	}
+	for _, member := range form.Members {
+		steps = append(steps, namedStep{op: "user.add", step: &userAddStep{UserAddForm: UserAddForm{
+			Username:  member.Username,
+			Password:  member.Password,
+			Project:   project,
+			Role:      member.Role,
+			ValidFrom: member.ValidFrom,
+			ExpiresAt: member.ExpiresAt,
+		}}})
+	}
+	for _, resource := range form.Resources {
+		steps = append(steps, namedStep{op: "projectResource.add", step: &projectResourceAddStep{
+			ProjectResourceForm{ResourceName: resource.ResourceName, ProjectName: project, RoleName: resource.RoleName},
+		}})
+	}
+	runBatch(context, steps)
+}
+
+// runBatch 在一个事务中依次执行steps并返回每一步的结果。
+// 任何一步失败时回滚全部修改，返回该步的错误码以及序号和操作名；提交后才发送通知和webhook
+func runBatch(context *gin.Context, steps []namedStep) {
+	for _, s := range steps {
+		if add, ok := s.step.(*userAddStep); ok && add.Password != "" && !requirePasswordAdmin(context, add.Username) {
+			return
+		}
+	}
+	for i, s := range steps {
+		if p, ok := s.step.(batchPreparer); ok {
+			if err := p.prepare(); err != nil {
+				sendBatchFailure(context, steps, i, err)
+				return
+			}
+		}
+	}
+	results := make([]BatchResult, 0, len(steps))
+	failed := -1
+	err := gorm.Entities.Transaction(func(tx gorm.EntityStore) error {
+		for i, s := range steps {
+			rows, err := s.step.apply(tx)
+			if err != nil {
+				failed = i
+				return err
+			}
+			results = append(results, BatchResult{Op: s.op, RowsAffected: rows})
+		}
+		return nil
+	})
+	if err != nil {
+		if failed < 0 {
+			h.SendResponse400(context, err, nil)
+			return
+		}
+		sendBatchFailure(context, steps, failed, err)
+		return
+	}
+	actor := currentUsername(context)
+	for _, s := range steps {
+		s.step.publish(actor)
+	}
+	h.SendResponse(context, nil, results)
+}
+
+// sendBatchFailure 返回第failed步的错误码以及序号和操作名，版本冲突时为409
+func sendBatchFailure(context *gin.Context, steps []namedStep, failed int, err error) {
+	op := steps[failed].op
+	code, message := errno.DecodeErr(err)
+	failure := errno.New(&errno.Errno{Code: code, Message: message}, err).Addf("(operation %d: %s)", failed, op)
+	if isVersionConflict(err) {
+		h.SendResponse409(context, failure, BatchFailure{Index: failed, Op: op})
+		return
+	}
+	h.SendResponse400(context, failure, BatchFailure{Index: failed, Op: op})
+}
@@ -1,12 +1,16 @@
 package api
 
 import (
-	ctx "context"
+	"fmt"
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
 	"gopa/gorm"
 	h "gopa/handler"
 	"gopa/model"
+	"gopa/pkg/errno"
+	"gopa/pkg/logger"
+	"gopa/pkg/notify"
+	"gopa/service"
+	"gopa/util"
 )
 
 type ProjectDeleteForm struct {
@@ -34,10 +38,9 @@ type DeletedRegoDocumentForm struct {
 	FilePath string `json:"path"`
 }
 
-
 // ProjectDelete 	api
 // @Summary          ProjectDelete
-// @Description    Delete a project
+// @Description    Delete a project. Rejected while the project still has subprojects.
 // @Tags               project
 // @Accept           application/json
 // @Produce          application/json
@@ -54,14 +57,26 @@ func ProjectDelete(context *gin.Context) {
 		h.SendResponse400(context, err, nil)
 		return
 	}
-	group := form.DeletedGroupName
-	db := gorm.DB.Self
-	res := db.Unscoped().Where("project_name = ?", group).Delete(&model.GopaProjects{ProjectName: group})
-	if res.Error != nil {
-		h.SendResponse400(context, res.Error, nil)
+	rows, err := deleteProject(gorm.Entities, form)
+	if err != nil {
+		h.SendResponse400(context, err, nil)
 		return
 	}
-	h.SendResponse(context, nil, res.RowsAffected)
+	service.Publish(service.ResourceProject, service.EventDeleted, currentUsername(context), form)
+	h.SendResponse(context, nil, rows)
+}
+
+// deleteProject 在store中删除组，还有下级组时不允许删除
+func deleteProject(store gorm.EntityStore, form ProjectDeleteForm) (int64, error) {
+	group := form.DeletedGroupName
+	children, err := store.Projects().CountChildren(group)
+	if err != nil {
+		return 0, err
+	}
+	if children > 0 {
+		return 0, errno.New(errno.ErrProjectHasChildren, nil).Addf("[%s]", group)
+	}
+	return store.Projects().Delete(group)
 }
 
 // RoleDelete 	api
@@ -83,14 +98,15 @@ func RoleDelete(context *gin.Context) {
 		h.SendResponse400(context, err, nil)
 		return
 	}
-	role := form.DeletedRoleName
-	db := gorm.DB.Self
-	res := db.Unscoped().Where("role_name = ?", role).Delete(&model.GopaRoles{RoleName: role})
-	if res.Error != nil {
-		h.SendResponse400(context, res.Error, nil)
+	// 同时删除该角色相关的继承关系
+	rows, err := gorm.Entities.Roles().Delete(form.DeletedRoleName)
+	if err != nil {
+		h.SendResponse400(context, err, nil)
 		return
 	}
-	h.SendResponse(context, nil, res.RowsAffected)
+	util.InvalidateRoleGraph()
+	service.Publish(service.ResourceRole, service.EventDeleted, currentUsername(context), form)
+	h.SendResponse(context, nil, rows)
 }
 
 // ProjectRoleDelete 	api
@@ -112,19 +128,17 @@ func ProjectRoleDelete(context *gin.Context) {
 		h.SendResponse400(context, err, nil)
 		return
 	}
-	group := form.DeletedGroupName
-	role := form.DeletedRoleName
-	db := gorm.DB.Self
-	res := db.Unscoped().Where("project_name = ?", group).Where("role_name = ?", role).Delete(
-		&model.GopaProjectRoles{
-			ProjectName: group,
-			RoleName: role,
-		})
-	if res.Error != nil {
-		h.SendResponse400(context, res.Error, nil)
+	rows, err := deleteProjectRole(gorm.Entities, form)
+	if err != nil {
+		h.SendResponse400(context, err, nil)
 		return
 	}
-	h.SendResponse(context, nil, res.RowsAffected)
+	h.SendResponse(context, nil, rows)
+}
+
+// deleteProjectRole 在store中删除组内的角色
+func deleteProjectRole(store gorm.EntityStore, form RoleDeleteFromGroupForm) (int64, error) {
+	return store.Projects().RemoveRole(form.DeletedGroupName, form.DeletedRoleName)
 }
 
 // UserDelete 	api
@@ -146,20 +160,54 @@ func UserDelete(context *gin.Context) {
 		h.SendResponse400(context, err, nil)
 		return
 	}
-	username := form.Username
-	db := gorm.DB.Self
-	res := db.Unscoped().Where("username = ?", username).Delete(
-		&model.GopaMembers{
-			Username: username,
-		})
-	if res.Error != nil {
-		h.SendResponse400(context, res.Error, nil)
+	var deleted []model.GopaMembers
+	var rows int64
+	err := gorm.Entities.Transaction(func(tx gorm.EntityStore) (err error) {
+		deleted, rows, err = deleteUser(tx, form)
+		return err
+	})
+	if err != nil {
+		h.SendResponse400(context, err, nil)
 		return
 	}
-	h.SendResponse(context, nil, res.RowsAffected)
+	publishUserDeleted(currentUsername(context), form, deleted)
+	h.SendResponse(context, nil, rows)
 }
 
+// deleteUser 在store中删除用户的全部授权以及本地密码，返回删除的授权和行数。
+// store需要是事务，授权和密码一起删除
+func deleteUser(store gorm.EntityStore, form UserDeleteForm) ([]model.GopaMembers, int64, error) {
+	username := form.Username
+	deleted, err := store.Members().Find(gorm.MemberQuery{Username: username})
+	if err != nil {
+		return nil, 0, err
+	}
+	rows, err := store.Members().DeleteUser(username)
+	if err != nil {
+		return nil, 0, err
+	}
+	// 用户的授权全部删除后本地密码也不再保留
+	if err := store.DB().Unscoped().Where("username = ? AND provider = ?", username, model.CredentialLocal).Delete(&model.GopaCredentials{}).Error; err != nil {
+		return nil, 0, err
+	}
+	return deleted, rows, nil
+}
 
+// publishUserDeleted 吊销用户已签发的token，并为删除的每个授权发送通知，最后发送webhook
+func publishUserDeleted(actor string, form UserDeleteForm, deleted []model.GopaMembers) {
+	if err := util.RevokeUserTokens(form.Username, "membership deleted"); err != nil {
+		logger.RuntimeEmit("api.UserDelete", "", err.Error(), false)
+	}
+	for _, member := range deleted {
+		notify.Send(notify.Event{
+			Kind:    notify.MemberDeleted,
+			Project: member.Project,
+			Actor:   actor,
+			Text:    fmt.Sprintf("%s as %s", member.Username, member.Role),
+		})
+	}
+	service.Publish(service.ResourceMember, service.EventDeleted, actor, form)
+}
 
 // RegoDelete 	api
 // @Summary        RegoDelete
@@ -173,6 +221,7 @@ func UserDelete(context *gin.Context) {
 // @Param                   form              body        DeletedRegoDocumentForm    true    "form"
 // @Success        200              {object}          handler.Response
 // @Failure        400              {object}          handler.Response
+// @Failure        403              {object}          handler.Response
 // @Router                  /api/v1/rego/delete [post]
 func RegoDelete(context *gin.Context) {
 	var form DeletedRegoDocumentForm
@@ -180,13 +229,21 @@ func RegoDelete(context *gin.Context) {
 		h.SendResponse400(context, err, nil)
 		return
 	}
-	filter := bson.D{{"path", form.FilePath}}
-	deleteResult, err := gorm.Collections.RegoCollection.DeleteOne(ctx.TODO(), filter)
+	if !requireRegoWrite(context, "rego.delete", form.FilePath) {
+		return
+	}
+	deleted, err := gorm.Regos.Delete(form.FilePath)
 	if err != nil {
 		h.SendResponse400(context, err, nil)
 		return
 	}
-	h.SendResponse(context, nil, deleteResult.DeletedCount)
+	if deleted > 0 {
+		notify.Send(notify.Event{Kind: notify.RegoDeleted, Actor: currentUsername(context), Text: form.FilePath})
+	}
+	if deleted > 0 {
+		service.Publish(service.ResourceRego, service.EventDeleted, currentUsername(context), form)
+	}
+	h.SendResponse(context, nil, deleted)
 }
 
 // ApplicationDelete api
@@ -218,10 +275,10 @@ func ApplicationDelete(context *gin.Context) {
 		h.SendResponse400(context, res.Error, nil)
 		return
 	}
+	service.Publish(service.ResourceApplication, service.EventDeleted, currentUsername(context), form)
 	h.SendResponse(context, nil, res.RowsAffected)
 }
 
-
 // ProjectResourceDelete 	api
 // @Summary              ProjectResourceDelete
 // @Description        Delete a projectRole from a resource.
@@ -231,10 +288,31 @@ func ApplicationDelete(context *gin.Context) {
 // @Security             Token
 // @Param                project  header            string                                     true  "Project"
 // @Param                role     header            string                                     true  "Role"
-// @Param                         form              body        ApplicationDeleteForm    true        "form"
+// @Param                         form              body        ProjectResourceForm    true        "form"
 // @Success              200              {object}          handler.Response
 // @Failure              400              {object}          handler.Response
 // @Router                        /api/v1/projectResource/delete [post]
 func ProjectResourceDelete(context *gin.Context) {
+	var form ProjectResourceForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	rows, err := deleteProjectResource(gorm.Entities, form)
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	if rows > 0 {
+		service.Publish(service.ResourceProjectResource, service.EventDeleted, currentUsername(context), form)
+	}
+	h.SendResponse(context, nil, rows)
+}
 
-}
\ No newline at end of file
+// deleteProjectResource 在store中删除资源对组内角色的授权
+func deleteProjectResource(store gorm.EntityStore, form ProjectResourceForm) (int64, error) {
+	if form.ResourceName == "" || form.ProjectName == "" || form.RoleName == "" {
+		return 0, errno.New(errno.ErrValidation, nil).Add("resource_name, project_name and role_name are required")
+	}
+	return store.Resources().Delete(form.ResourceName, form.ProjectName, form.RoleName)
+}
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"gopa/config"
+	"gopa/gorm"
+	h "gopa/handler"
+	"gopa/model"
+	"gopa/pkg/auth"
+	"gopa/pkg/errno"
+	"gopa/pkg/logger"
+	"gopa/pkg/token"
+	g "gorm.io/gorm"
+)
+
+// oidcStateCookie 保存OIDC登录的state和nonce，回调时用于防止CSRF和重放
+const oidcStateCookie = "gopa_oidc_state"
+
+var (
+	oidcMu       sync.Mutex
+	oidcProvider *auth.OIDC
+	oidcConf     model.OIDCProvider
+)
+
+// identityChain 按配置的顺序组合用户名密码认证方式，未配置时只使用LDAP。
+// 配置了未知的认证方式时记录日志并退回到LDAP
+func identityChain() auth.Chain {
+	names := config.GetConfig().Auth.Providers
+	if len(names) == 0 {
+		names = []string{auth.ProviderLdap}
+	}
+	chain, err := auth.NewChain(names, map[string]auth.Provider{
+		auth.ProviderLdap:  auth.Ldap{Pool: ldapPool},
+		auth.ProviderLocal: auth.Local{Lookup: localPassword},
+	})
+	if err != nil {
+		logger.RuntimeEmit("api.identityChain", "", err.Error(), false)
+		return auth.Chain{auth.Ldap{Pool: ldapPool}}
+	}
+	return chain
+}
+
+// ldapEnabled 判断是否使用LDAP认证用户
+func ldapEnabled() bool {
+	names := config.GetConfig().Auth.Providers
+	if len(names) == 0 {
+		return true
+	}
+	for _, name := range names {
+		if name == auth.ProviderLdap {
+			return true
+		}
+	}
+	return false
+}
+
+// localPassword 返回用户的本地密码哈希，没有设置时返回空字符串
+func localPassword(username string) (string, error) {
+	var credential model.GopaCredentials
+	res := gorm.DB.Self.Where("username = ? AND provider = ?", username, model.CredentialLocal).Limit(1).Find(&credential)
+	if res.Error != nil {
+		return "", res.Error
+	}
+	return credential.Password, nil
+}
+
+// checkLocalPassword 检查可以为username设置本地密码：用户没有通过OIDC登录过，
+// 不是LDAP同步的成员，使用LDAP认证时LDAP中也没有同名的用户。
+// 否则设置密码的人可以用local认证方式冒充LDAP或OIDC的用户
+func checkLocalPassword(username string) error {
+	var total int64
+	res := gorm.DB.Self.Model(&model.GopaCredentials{}).Where("username = ? AND provider <> ?", username, model.CredentialLocal).Count(&total)
+	if res.Error != nil {
+		return res.Error
+	}
+	if total > 0 {
+		return errno.New(errno.ErrExternalUser, nil).Addf("[%s]", username)
+	}
+	synced, err := gorm.Entities.Members().Find(gorm.MemberQuery{Username: username, Source: model.MemberSourceLdap})
+	if err != nil {
+		return err
+	}
+	if len(synced) > 0 {
+		return errno.New(errno.ErrExternalUser, nil).Addf("[%s]", username)
+	}
+	if !ldapEnabled() {
+		return nil
+	}
+	pool := ldapPool()
+	if pool == nil {
+		return nil
+	}
+	exists, err := pool.UserExists(username)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errno.New(errno.ErrExternalUser, nil).Addf("[%s] in LDAP", username)
+	}
+	return nil
+}
+
+// setLocalPassword 在db中设置用户的本地密码，hashed为bcrypt哈希。
+// 每个用户只有一条凭据，已经设置过时替换原来的密码
+func setLocalPassword(db *g.DB, username, hashed string) error {
+	res := db.Model(&model.GopaCredentials{}).Where("username = ? AND provider = ?", username, model.CredentialLocal).
+		Update("password", hashed)
+	if res.Error != nil || res.RowsAffected > 0 {
+		return res.Error
+	}
+	return db.Create(&model.GopaCredentials{Username: username, Provider: model.CredentialLocal, Password: hashed}).Error
+}
+
+// recordOIDCUser 记录通过OIDC登录的用户，之后不能再为其设置本地密码。
+// 用户已经有凭据时不修改
+func recordOIDCUser(username string) error {
+	var total int64
+	if res := gorm.DB.Self.Model(&model.GopaCredentials{}).Where("username = ?", username).Count(&total); res.Error != nil || total > 0 {
+		return res.Error
+	}
+	return gorm.DB.Self.Create(&model.GopaCredentials{Username: username, Provider: model.CredentialOIDC}).Error
+}
+
+// oidc 返回按配置创建的OIDC登录，配置重新加载后重新创建
+func oidc() *auth.OIDC {
+	conf := config.GetConfig().Auth.OIDC
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if oidcProvider == nil || !reflect.DeepEqual(conf, oidcConf) {
+		oidcProvider = auth.NewOIDC(conf)
+		oidcConf = conf
+	}
+	return oidcProvider
+}
+
+// OidcLogin 		api
+// @Summary          OidcLogin
+// @Description    Redirect to the OIDC issuer to log in with the authorization code flow
+// @Tags               auth
+// @Success          302
+// @Failure          400              {object}          handler.Response
+// @Router                    /api/oidc/login [get]
+func OidcLogin(context *gin.Context) {
+	state, err := randomHex()
+	if err != nil {
+		h.SendResponse400(context, errno.New(errno.ErrOIDCLogin, err), nil)
+		return
+	}
+	nonce, err := randomHex()
+	if err != nil {
+		h.SendResponse400(context, errno.New(errno.ErrOIDCLogin, err), nil)
+		return
+	}
+	redirect, err := oidc().AuthCodeURL(state, nonce)
+	if err != nil {
+		h.SendResponse400(context, errno.New(errno.ErrOIDCLogin, err), nil)
+		return
+	}
+	context.SetCookie(oidcStateCookie, state+"."+nonce, 600, "/api/oidc", "", context.Request.TLS != nil, true)
+	context.Redirect(http.StatusFound, redirect)
+}
+
+// OidcCallback 	api
+// @Summary          OidcCallback
+// @Description    Exchange the authorization code for an id_token and issue a GOPA token for the user
+// @Tags               auth
+// @Produce          application/json
+// @Param            code     query     string    true  "authorization code"
+// @Param            state    query     string    true  "state returned by the issuer"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Failure          403              {object}          handler.Response
+// @Router                    /api/oidc/callback [get]
+func OidcCallback(tokens *token.Service) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		oidcCallback(context, tokens)
+	}
+}
+
+// oidcCallback 校验state后用授权码换取用户身份并签发token
+func oidcCallback(context *gin.Context, tokens *token.Service) {
+	cookie, err := context.Cookie(oidcStateCookie)
+	context.SetCookie(oidcStateCookie, "", -1, "/api/oidc", "", context.Request.TLS != nil, true)
+	parts := strings.SplitN(cookie, ".", 2)
+	if err != nil || len(parts) != 2 || parts[0] != context.Query("state") {
+		h.SendResponse403(context, errno.ErrOIDCState, nil)
+		return
+	}
+	identity, err := oidc().Exchange(context.Query("code"), parts[1])
+	if err != nil {
+		logger.RuntimeEmit("api.OidcCallback", "", err.Error(), false)
+		h.SendResponse403(context, errno.New(errno.ErrOIDCLogin, err), nil)
+		return
+	}
+	if err := recordOIDCUser(identity.Username); err != nil {
+		logger.RuntimeEmit("api.OidcCallback", "", err.Error(), false)
+	}
+	completeLogin(context, tokens, loginUser(context, identity.Username))
+}
+
+// randomHex 返回16字节的随机数的十六进制表示
+func randomHex() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,30 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	h "gopa/handler"
+	"gopa/pkg/token"
+)
+
+// Jwks 			api
+// @Summary          Jwks
+// @Description    Public keys for verifying GOPA tokens offline. Tokens carry the kid of the signing key in their header.
+// @Tags               auth
+// @Produce          application/json
+// @Success          200              {object}          token.JWKSet
+// @Router                    /.well-known/jwks.json [get]
+func Jwks(tokens *token.Service) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		ring := tokens.KeyRing()
+		if ring.Active() == nil {
+			h.SendResponse400(context, token.ErrNoSigningKey, nil)
+			return
+		}
+		// 密钥轮换后下游服务需要及时获取新的公钥
+		context.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(token.JWKSMaxAge.Seconds())))
+		context.JSON(http.StatusOK, ring.JWKS())
+	}
+}
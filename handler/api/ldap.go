@@ -1,32 +1,48 @@
 package api
 
 import (
-	"fmt"
-	ldap "github.com/jtblin/go-ldap-client"
+	"github.com/gin-gonic/gin"
 	"gopa/config"
+	h "gopa/handler"
+	"gopa/pkg/ldap"
+	"gopa/pkg/logger"
+	"gopa/service"
 )
 
-//LdapAuth 加载LDAP配置参数
-func LdapAuth(username, password string) error {
-	ldapClient := &ldap.LDAPClient{
-		Base:         config.GetConfig().LdapClient.Base,
-		Host:         config.GetConfig().LdapClient.Host,
-		Port:         config.GetConfig().LdapClient.Port,
-		UseSSL:       config.GetConfig().LdapClient.UseSSL,
-		SkipTLS:      config.GetConfig().LdapClient.SkipTLS,
-		BindDN:       config.GetConfig().LdapClient.BindDN,
-		BindPassword: config.GetConfig().LdapClient.BindPassword,
-		UserFilter:   config.GetConfig().LdapClient.UserFilter,
-		GroupFilter:  config.GetConfig().LdapClient.GroupFilter,
-		Attributes:   config.GetConfig().LdapClient.Attributes,
-		ServerName:   config.GetConfig().LdapClient.ServerName,
+// ldapPool 返回LDAP连接池，未初始化时按配置创建
+func ldapPool() *ldap.Pool {
+	return ldap.Ensure(config.GetConfig().LdapClient)
+}
+
+// LdapSyncForm 手动触发LDAP同步时的结构体
+type LdapSyncForm struct {
+	DryRun bool `json:"dry_run"`
+}
+
+// LdapSync 		api
+// @Summary          LdapSync
+// @Description    Synchronise LDAP groups into memberships. With dry_run the report lists the changes without applying them. Users that no longer exist in LDAP are returned in missing.
+// @Tags               ldap
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project  header            string                 true  "Project"
+// @Param            role     header            string                 true  "Role"
+// @Param                     form              body        LdapSyncForm  true  "form"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Router                    /api/v1/ldap/sync [post]
+func LdapSync(context *gin.Context) {
+	var form LdapSyncForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
 	}
-	defer ldapClient.Close()
-	_, _, err := ldapClient.Authenticate(username, password)
-	fmt.Println(err)
+	report, err := service.SyncLdap(form.DryRun)
 	if err != nil {
-		return err
+		logger.RuntimeEmit("api.LdapSync", "", err.Error(), false)
+		h.SendResponse400(context, err, nil)
+		return
 	}
-
-	return nil
+	h.SendResponse(context, nil, report)
 }
@@ -1,65 +1,117 @@
 package api
 
 import (
-	ctx "context"
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
 	"gopa/gorm"
 	h "gopa/handler"
 	"gopa/model"
 	"gopa/pkg/errno"
+	"gopa/util"
+	"sort"
+	"time"
 )
 
+// GopaProjects 组，Version用于修改时检查并发修改，其他实体相同
 type GopaProjects struct {
-	ProjectName string `json:"project_name"`
+	ProjectName   string `json:"project_name"`
+	ParentProject string `json:"parent_project"`
+	Version       int64  `json:"version"`
 }
 
 type GopaRoles struct {
 	RoleName string `json:"role_name"`
+	Version  int64  `json:"version"`
 }
 
+// GopaProjectRoles 组内的角色。Version为该记录的版本，不是组或角色的版本，
+// 所以不嵌入GopaProjects和GopaRoles；gopa_project_roles中没有parent_project
 type GopaProjectRoles struct {
-	GopaProjects
-	GopaRoles
+	ProjectName   string `json:"project_name"`
+	ParentProject string `json:"parent_project" gorm:"-"`
+	RoleName      string `json:"role_name"`
+	Version       int64  `json:"version"`
 }
 
 type GopaMembers struct {
-	Username string `json:"username"`
-	Project  string `json:"projecr"`
-	Role     string `json:"role"`
+	Username  string     `json:"username"`
+	Project   string     `json:"projecr"`
+	Role      string     `json:"role"`
+	ValidFrom *time.Time `json:"valid_from"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Source    string     `json:"source"`
+	Disabled  bool       `json:"disabled"`
+	Version   int64      `json:"version"`
 }
 
 type GopaApplication struct {
 	ResourceName string `json:"resource_name"`
 	Address      string `json:"address"`
 	Routers      string `json:"routers"`
+	Version      int64  `json:"version"`
 }
 
 type ProjectResource struct {
-	ProjectName  string `json:"project_name"`
-	RoleName     string `json:"role_name"`
+	ProjectName    string `json:"project_name"`
+	RoleName       string `json:"role_name"`
 	ResourceRouter string `json:"resource_router"`
+	Version        int64  `json:"version"`
+}
+
+// RoleEdge 角色继承图中的一条边，Role继承Parent
+type RoleEdge struct {
+	Role   string `json:"role"`
+	Parent string `json:"parent"`
+}
+
+// RoleGraphResult 角色继承图
+type RoleGraphResult struct {
+	Nodes []string   `json:"nodes"`
+	Edges []RoleEdge `json:"edges"`
+}
+
+// RolePermissions 某个角色的有效角色以及可访问的资源
+type RolePermissions struct {
+	Role           string            `json:"role"`
+	EffectiveRoles []string          `json:"effective_roles"`
+	Resources      []ProjectResource `json:"resources"`
 }
 
 // ProjectsList 		api
 // @Summary          ProjectsList
-// @Description    list all projects of OPA
+// @Description    list all projects of OPA. If tree is true, projects are returned as a tree of subprojects. If detail is true, projects are returned with their parent and version.
 // @Tags               project
 // @Accept           application/json
 // @Produce          application/json
 // @Security         Token
-// @Param            project            header    string    true  "Project"
-// @Param            role               header    string    true  "Role"
+// @Param            project            header    string    true   "Project"
+// @Param            role               header    string    true   "Role"
+// @Param            tree               query     bool      false  "return projects as a tree"
+// @Param            detail             query     bool      false  "return projects with their parent and version"
 // @Success          200      {object}  handler.Response
 // @Failure          400      {object}  handler.Response
 // @Router                    /api/v1/project/list [get]
 func ProjectsList(context *gin.Context) {
-	var data []GopaProjects
+	if context.Query("tree") == "true" {
+		tree, err := util.FetchProjectTree()
+		if err != nil {
+			h.SendResponse400(context, err, nil)
+			return
+		}
+		h.SendResponse(context, errno.OK, tree.Nodes())
+		return
+	}
+	projects, err := gorm.Entities.Projects().List()
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	data := make([]GopaProjects, 0, len(projects))
 	var result []string
-	db := gorm.DB.Self
-	res := db.Find(&data)
-	if res.Error != nil {
-		h.SendResponse400(context, res.Error, nil)
+	for _, project := range projects {
+		data = append(data, GopaProjects{ProjectName: project.ProjectName, ParentProject: project.ParentProject, Version: project.Version})
+	}
+	if context.Query("detail") == "true" {
+		h.SendResponse(context, errno.OK, data)
 		return
 	}
 	for _, project := range data {
@@ -70,23 +122,30 @@ func ProjectsList(context *gin.Context) {
 
 // RolesList 		api
 // @Summary          RolesList
-// @Description    list all roles of OPA
+// @Description    list all roles of OPA. If detail is true, roles are returned with their version.
 // @Tags               role
 // @Accept           application/json
 // @Produce          application/json
 // @Security         Token
 // @Param            project            header    string    true  "Project"
 // @Param            role               header    string    true  "Role"
+// @Param            detail             query     bool      false "return roles with their version"
 // @Success          200      {object}  handler.Response
 // @Failure          400      {object}  handler.Response
 // @Router                    /api/v1/role/list [get]
 func RolesList(context *gin.Context) {
-	var data []GopaRoles
+	roles, err := gorm.Entities.Roles().List()
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	data := make([]GopaRoles, 0, len(roles))
 	var result []string
-	db := gorm.DB.Self
-	res := db.Find(&data)
-	if res.Error != nil {
-		h.SendResponse400(context, res.Error, nil)
+	for _, role := range roles {
+		data = append(data, GopaRoles{RoleName: role.RoleName, Version: role.Version})
+	}
+	if context.Query("detail") == "true" {
+		h.SendResponse(context, errno.OK, data)
 		return
 	}
 	for _, role := range data {
@@ -95,6 +154,83 @@ func RolesList(context *gin.Context) {
 	h.SendResponse(context, errno.OK, result)
 }
 
+// RoleGraphList 	api
+// @Summary          RoleGraphList
+// @Description    Return the role inheritance graph. An edge means role inherits all permissions of parent.
+// @Tags               role
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project            header    string    true  "Project"
+// @Param            role               header    string    true  "Role"
+// @Success          200      {object}  handler.Response
+// @Failure          400      {object}  handler.Response
+// @Router                    /api/v1/role/graph [get]
+func RoleGraphList(context *gin.Context) {
+	graph, err := util.FetchRoleGraph()
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	result := RoleGraphResult{Nodes: []string{}, Edges: []RoleEdge{}}
+	for role, parents := range graph {
+		result.Nodes = append(result.Nodes, role)
+		for _, parent := range parents {
+			result.Edges = append(result.Edges, RoleEdge{Role: role, Parent: parent})
+		}
+	}
+	sort.Strings(result.Nodes)
+	sort.Slice(result.Edges, func(i, j int) bool {
+		if result.Edges[i].Role != result.Edges[j].Role {
+			return result.Edges[i].Role < result.Edges[j].Role
+		}
+		return result.Edges[i].Parent < result.Edges[j].Parent
+	})
+	h.SendResponse(context, errno.OK, result)
+}
+
+// RolePermissionList 	api
+// @Summary          RolePermissionList
+// @Description    Return the effective roles of a role, including inherited ones, and the project resources granted to any of them.
+// @Tags               role
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project            header    string    true     "Project"
+// @Param            role               header    string    true     "Role"
+// @Param            role_name          query     string    true     "role to resolve"
+// @Param            project_name       query     string    false    "only return resources effective in this project, including those granted on its parent projects"
+// @Success          200      {object}  handler.Response
+// @Failure          400      {object}  handler.Response
+// @Router                    /api/v1/role/permissions [get]
+func RolePermissionList(context *gin.Context) {
+	role, ok := context.GetQuery("role_name")
+	if !ok || role == "" {
+		h.SendResponse400(context, errno.New(errno.ErrValidation, nil).Add("role_name is required"), nil)
+		return
+	}
+	graph, err := util.FetchRoleGraph()
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	effectiveRoles := graph.Ancestors(role)
+	query := gorm.ResourceQuery{Roles: effectiveRoles}
+	if project, ok := context.GetQuery("project_name"); ok {
+		query.Projects = util.EffectiveProjects(project)
+	}
+	resources, err := gorm.Entities.Resources().Find(query)
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	h.SendResponse(context, errno.OK, RolePermissions{
+		Role:           role,
+		EffectiveRoles: effectiveRoles,
+		Resources:      projectResources(resources),
+	})
+}
+
 // ProjectRoleList 	api
 // @Summary          ProjectRoleList
 // @Description    list all projects and corresponding roles of OPA
@@ -108,36 +244,59 @@ func RolesList(context *gin.Context) {
 // @Failure           400      {object}  handler.Response
 // @Router                     /api/v1/projectRole/list [get]
 func ProjectRoleList(context *gin.Context) {
-	var data []GopaProjectRoles
-	db := gorm.DB.Self
-	res := db.Find(&data)
-	if res.Error != nil {
-		h.SendResponse400(context, res.Error, nil)
+	projectRoles, err := gorm.Entities.Projects().ListRoles()
+	if err != nil {
+		h.SendResponse400(context, err, nil)
 		return
 	}
+	data := make([]GopaProjectRoles, 0, len(projectRoles))
+	for _, projectRole := range projectRoles {
+		data = append(data, GopaProjectRoles{ProjectName: projectRole.ProjectName, RoleName: projectRole.RoleName, Version: projectRole.Version})
+	}
 	h.SendResponse(context, errno.OK, data)
 }
 
 // UserList 		api
 // @Summary          UserList
-// @Description    list all users of OPA
+// @Description    list all users of OPA. If project_name is set, only members of that project and its parent projects are returned, since memberships of a parent project apply to its subprojects.
 // @Tags               user
 // @Accept           application/json
 // @Produce          application/json
 // @Security         Token
-// @Param            project            header    string    true  "Project"
-// @Param            role               header    string    true  "Role"
+// @Param            project            header    string    true   "Project"
+// @Param            role               header    string    true   "Role"
+// @Param            project_name       query     string    false  "only return members effective in this project"
 // @Success          200      {object}  handler.Response
 // @Failure          400      {object}  handler.Response
 // @Router       /api/v1/user/list [get]
 func UserList(context *gin.Context) {
-	var data []GopaMembers
-	db := gorm.DB.Self
-	res := db.Find(&data)
-	if res.Error != nil {
-		h.SendResponse400(context, res.Error, nil)
+	var query gorm.MemberQuery
+	if project, ok := context.GetQuery("project_name"); ok {
+		tree, err := util.FetchProjectTree()
+		if err != nil {
+			h.SendResponse400(context, err, nil)
+			return
+		}
+		query.Projects = tree.Ancestors(project)
+	}
+	members, err := gorm.Entities.Members().Find(query)
+	if err != nil {
+		h.SendResponse400(context, err, nil)
 		return
 	}
+	data := make([]GopaMembers, 0, len(members))
+	for _, member := range members {
+		data = append(data, GopaMembers{
+			Username:  member.Username,
+			Project:   member.Project,
+			Role:      member.Role,
+			ValidFrom: member.ValidFrom,
+			ExpiresAt: member.ExpiresAt,
+			Source:    member.Source,
+			Disabled:  member.Disabled,
+			Version:   member.Version,
+		})
+	}
 	h.SendResponse(context, errno.OK, data)
 }
 
@@ -166,7 +325,7 @@ func ApplicationList(context *gin.Context) {
 
 // RegoList 		api
 // @Summary          RegoList
-// @Description    Return a rego file by given path currently in database. If filepath is not specified, API returns all rego files.
+// @Description    Return a rego file by given path currently in database, with its version in the ETag header. If filepath is not specified, API returns all rego files.
 // @Tags               rego
 // @Accept           application/json
 // @Produce          application/json
@@ -179,32 +338,20 @@ func ApplicationList(context *gin.Context) {
 // @Router                    /api/v1/rego/list [get]
 func RegoList(context *gin.Context) {
 	path, ok := context.GetQuery("filepath")
-	var filter bson.D
-	var result model.RegoDocument
 	if !ok {
-		var results []model.RegoDocument
-		filter = bson.D{}
-		cur, err := gorm.Collections.RegoCollection.Find(ctx.TODO(), filter)
+		results, err := gorm.Regos.List()
 		if err != nil {
 			h.SendResponse400(context, err, nil)
 			return
 		}
-		for cur.Next(ctx.TODO()) {
-			err := cur.Decode(&result)
-			if err != nil {
-				h.SendResponse400(context, err, nil)
-				return
-			}
-			results = append(results, result)
-		}
 		h.SendResponse(context, nil, results)
 	} else {
-		filter = bson.D{{"path", path}}
-		err := gorm.Collections.RegoCollection.FindOne(ctx.TODO(), filter).Decode(&result)
+		result, err := gorm.Regos.Get(path)
 		if err != nil {
 			h.SendResponse400(context, err, nil)
 			return
 		}
+		setETag(context, result.Version)
 		h.SendResponse(context, nil, result)
 	}
 }
@@ -219,12 +366,24 @@ func RegoList(context *gin.Context) {
 // @Failure            400  {object}  handler.Response
 // @Router                  /api/v1/projectResource/list [get]
 func ProjectResourceList(context *gin.Context) {
-	var data []ProjectResource
-	db := gorm.DB.Self
-	res := db.Find(&data)
-	if res.Error != nil {
-		h.SendResponse400(context, res.Error, nil)
+	resources, err := gorm.Entities.Resources().Find(gorm.ResourceQuery{})
+	if err != nil {
+		h.SendResponse400(context, err, nil)
 		return
 	}
-	h.SendResponse(context, errno.OK, data)
+	h.SendResponse(context, errno.OK, projectResources(resources))
+}
+
+// projectResources 去掉资源授权中不需要返回的字段
+func projectResources(resources []model.ProjectResources) []ProjectResource {
+	data := make([]ProjectResource, 0, len(resources))
+	for _, resource := range resources {
+		data = append(data, ProjectResource{
+			ProjectName:    resource.ProjectName,
+			RoleName:       resource.RoleName,
+			ResourceRouter: resource.ResourceRouter,
+			Version:        resource.Version,
+		})
+	}
+	return data
 }
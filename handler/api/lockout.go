@@ -0,0 +1,146 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	h "gopa/handler"
+	"gopa/pkg/errno"
+	"gopa/pkg/lockout"
+	"gopa/pkg/logger"
+	"gopa/util"
+)
+
+// LockoutUnlockForm 解除登录限制时的结构体，Username和IP至少填写一个
+type LockoutUnlockForm struct {
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+}
+
+// Lockout 被限制登录的用户名或IP
+type Lockout struct {
+	Key         string     `json:"key"`
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"last_failure"`
+	LockedUntil *time.Time `json:"locked_until"`
+	RetryAfter  int        `json:"retry_after"`
+}
+
+// LockoutList 		api
+// @Summary          LockoutList
+// @Description    List usernames and IPs that currently have to wait before logging in again. Only administrators allowed by the policy of /gopa/admin may list them.
+// @Tags               auth
+// @Produce          application/json
+// @Security         Token
+// @Param            project  header            string                     true  "Project"
+// @Param            role     header            string                     true  "Role"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Failure          403              {object}          handler.Response
+// @Router                    /api/v1/lockout/list [get]
+func LockoutList(limiter *lockout.Limiter) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if !requireAdmin(context, "lockout.list", nil) {
+			return
+		}
+		now := time.Now()
+		blocked, err := limiter.Blocked(now)
+		if err != nil {
+			h.SendResponse400(context, err, nil)
+			return
+		}
+		list := make([]Lockout, 0, len(blocked))
+		for _, e := range blocked {
+			item := Lockout{
+				Key:         e.Key,
+				Failures:    e.Failures,
+				LastFailure: e.LastFailure,
+				RetryAfter:  seconds(limiter.RetryAfter(e, now)),
+			}
+			if !e.LockedUntil.IsZero() {
+				lockedUntil := e.LockedUntil
+				item.LockedUntil = &lockedUntil
+			}
+			list = append(list, item)
+		}
+		h.SendResponse(context, nil, list)
+	}
+}
+
+// LockoutUnlock 	api
+// @Summary          LockoutUnlock
+// @Description    Clear the failed login attempts of a username and/or an IP. Only administrators allowed by the policy of /gopa/admin may unlock.
+// @Tags               auth
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project  header            string                     true  "Project"
+// @Param            role     header            string                     true  "Role"
+// @Param                     form              body        LockoutUnlockForm  true  "form"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Failure          403              {object}          handler.Response
+// @Router                    /api/v1/lockout/unlock [post]
+func LockoutUnlock(limiter *lockout.Limiter) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		var form LockoutUnlockForm
+		if err := context.BindJSON(&form); err != nil {
+			h.SendResponse400(context, err, nil)
+			return
+		}
+		var keys []string
+		if form.Username != "" {
+			keys = append(keys, lockout.UserKey(form.Username))
+		}
+		if form.IP != "" {
+			keys = append(keys, lockout.IPKey(form.IP))
+		}
+		if len(keys) == 0 {
+			h.SendResponse400(context, errno.New(errno.ErrValidation, nil).Add("username or ip is required"), nil)
+			return
+		}
+		if !requireAdmin(context, "lockout.unlock", map[string]interface{}{"username": form.Username, "ip": form.IP}) {
+			return
+		}
+		for _, key := range keys {
+			if err := limiter.Unlock(key); err != nil {
+				h.SendResponse400(context, err, nil)
+				return
+			}
+			logger.RuntimeEmit("api.LockoutUnlock", "", key+" unlocked by "+currentUsername(context), true)
+			util.Audit(currentUsername(context), "login.unlocked", key, "failed login attempts cleared")
+		}
+		h.SendResponse(context, nil, "success")
+	}
+}
+
+// loginFailed 记录一次登录失败，新的锁定写入运行日志
+func loginFailed(limiter *lockout.Limiter, username, ip string) {
+	locked, err := limiter.Fail(username, ip, time.Now())
+	if err != nil {
+		logger.RuntimeEmit("api.Login", "", err.Error(), false)
+	}
+	for _, e := range locked {
+		logger.RuntimeEmit("api.Login", "", fmt.Sprintf("login locked: %s failed %d times, locked until %s",
+			e.Key, e.Failures, e.LockedUntil.Format(time.RFC3339)), false)
+	}
+}
+
+// tooManyAttempts 以429返回需要等待的时间
+func tooManyAttempts(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(seconds(wait)))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"code":        http.StatusTooManyRequests,
+		"message":     errno.ErrLoginLocked.Message,
+		"retry_after": seconds(wait),
+	})
+}
+
+// seconds 向上取整到秒
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
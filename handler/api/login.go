@@ -2,12 +2,17 @@ package api
 
 import (
 	"fmt"
-	"github.com/appleboy/gin-jwt/v2"
+	jwtgo "github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"gopa/config"
 	"gopa/gorm"
 	"gopa/handler"
 	"gopa/model"
+	"gopa/pkg/lockout"
+	"gopa/pkg/logger"
+	"gopa/pkg/token"
+	"gopa/util"
+	"net/http"
 	"time"
 )
 
@@ -25,7 +30,10 @@ type User struct {
 
 var identityKey = "username"
 
-// JwtAuth 			api
+// claimsKey token中的声明在gin.Context中的键
+const claimsKey = "JWT_PAYLOAD"
+
+// Login 			api
 // @Summary            Login handler
 // @Description    Login to obtain token, project and role
 // @Tags               auth
@@ -34,111 +42,189 @@ var identityKey = "username"
 // @Param                 form            body      LoginForm        true  "form"
 // @Success          200        {object}        handler.Response
 // @Failure          400        {object}        handler.Response
-// @Failure          403        {object}        handler.Response
+// @Failure          401        {object}        handler.Response
+// @Failure          429        {object}        handler.Response
 // @Router                /api/sso-login [post]
-func JwtAuth() *jwt.GinJWTMiddleware {
-	secretKey := config.GetConfig().Service.JwtSecret
-	authMiddleware, err := jwt.New(&jwt.GinJWTMiddleware{
-		Realm:      "test zone",
-		Key:        []byte(secretKey),
-		Timeout:    time.Hour,
-		MaxRefresh: time.Hour,
-		PayloadFunc: func(data interface{}) jwt.MapClaims {
-			v, ok := data.(*User)
-			if ok {
-				return jwt.MapClaims{
-					identityKey: v.Username,
-					"group": v.Group,
-					"role": v.Role,
-				}
-			}
-			return jwt.MapClaims{}
-		},
-		IdentityKey: identityKey,
-		Authenticator: func(c *gin.Context) (interface{}, error) {
-			var form LoginForm
-			var project string
-			var role string
-			var defaultUser = &User{
-				Username: "",
-				Group:    "guest",
-				Role:     "guest",
-			}
-			if err := c.BindJSON(&form); err != nil {
-				return nil, jwt.ErrMissingLoginValues
-			}
-			if err := LdapAuth(form.Username, form.Password); err != nil {
-				return nil, jwt.ErrFailedAuthentication
-			}
-			var data GopaMembers
-			defaultUser.Username = form.Username
-			db := gorm.DB.Self
-			res := db.Where("username = ?", form.Username).First(&data)
-			c.Set("username", form.Username)
-			if res.Error != nil {
-				fmt.Println("This user does not exist. Now create a new user.")
-				req := model.GopaMembers{
-					Username: form.Username,
-					Project:  "guest",
-					Role:     "guest",
-				}
-				res := db.Create(&req)
-				if res.Error != nil {
-					return defaultUser, nil
-				}
-				project = "guest"
-				role = "guest"
-			} else {
-				project = data.Project
-				role = data.Role
-			}
-			c.Set("group", project)
-			c.Set("role", role)
-			return &User{
-				Username: form.Username,
-				Group: project,
-				Role: role,
-			}, nil
-		},
-		Unauthorized: func(c *gin.Context, code int, message string) {
-			c.JSON(code, gin.H{
-				"code":    code,
-				"message": message,
-			})
-		},
-		TokenLookup:   "header: Authorization",
-		TokenHeadName: "Bearer",
-		TimeFunc:      time.Now,
-		LoginResponse: func(c *gin.Context, code int, message string, time time.Time) {
-			username, _ := c.Get("username")
-			group, _ := c.Get("group")
-			role, _ := c.Get("role")
-			c.JSON(code, gin.H{
-				"token": message,
-				"expires": time,
-				"username": username,
-				"group": group,
-				"role": role,
-			})
+func Login(tokens *token.Service, limiter *lockout.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var form LoginForm
+		if err := c.BindJSON(&form); err != nil {
+			unauthorizedMessage(c, "missing Username or Password")
+			return
+		}
+		// 在认证前检查，被限制的请求不会再访问LDAP
+		wait, err := limiter.Allow(form.Username, clientIP(c), time.Now())
+		if err == lockout.ErrLocked {
+			tooManyAttempts(c, wait)
+			return
+		} else if err != nil {
+			// 失败记录读取不到时不阻止登录
+			logger.RuntimeEmit("api.Login", "", err.Error(), false)
+		}
+		identity, err := identityChain().Authenticate(form.Username, form.Password)
+		if err != nil {
+			logger.RuntimeEmit("api.Login", "", err.Error(), false)
+			loginFailed(limiter, form.Username, clientIP(c))
+			unauthorizedMessage(c, "incorrect Username or Password")
+			return
+		}
+		if err := limiter.Succeed(form.Username); err != nil {
+			logger.RuntimeEmit("api.Login", "", err.Error(), false)
+		}
+		completeLogin(c, tokens, loginUser(c, identity.Username))
+	}
+}
+
+// Authenticate 校验请求头 Authorization: Bearer <token>，两步验证的临时token会被拒绝。
+// 通过后把token中的声明保存到gin.Context中
+func Authenticate(tokens *token.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := tokens.ParseRequest(c)
+		if err != nil {
+			unauthorizedMessage(c, err.Error())
+			return
+		}
+		c.Set(claimsKey, claims)
+		c.Set(identityKey, claims.Username)
+		c.Next()
+	}
+}
+
+// clientIP 返回请求的来源IP，只信任配置的反向代理添加的X-Forwarded-For
+func clientIP(c *gin.Context) string {
+	return util.ClientIP(c.Request, config.GetConfig().Service.TrustedProxies)
+}
+
+// tokenClaims 返回Authenticate或APIKeyAuth保存的声明
+func tokenClaims(c *gin.Context) *token.Claims {
+	if claims, ok := c.Get(claimsKey); ok {
+		if v, ok := claims.(*token.Claims); ok {
+			return v
+		}
+	}
+	return &token.Claims{}
+}
+
+// loginResponse 为登录成功的用户开始一个新的登录，签发token和刷新token并返回，
+// extra中的字段一并返回
+func loginResponse(c *gin.Context, tokens *token.Service, user *User, mfa bool, extra gin.H) {
+	session, err := randomHex()
+	if err != nil {
+		logger.RuntimeEmit("api.loginResponse", "", err.Error(), false)
+		unauthorizedMessage(c, "failed to create JWT Token")
+		return
+	}
+	sessionResponse(c, tokens, token.Claims{
+		Username: user.Username,
+		Group:    user.Group,
+		Role:     user.Role,
+		Session:  session,
+		MFA:      mfa,
+		StandardClaims: jwtgo.StandardClaims{
+			IssuedAt: time.Now().Unix(),
 		},
-	})
+	}, extra)
+}
 
+// sessionResponse 按claims签发token，并为该登录保存一个新的刷新token
+func sessionResponse(c *gin.Context, tokens *token.Service, claims token.Claims, extra gin.H) {
+	signed, issued, err := tokens.Refresh(claims)
+	if err != nil {
+		logger.RuntimeEmit("api.sessionResponse", "", err.Error(), false)
+		unauthorizedMessage(c, "failed to create JWT Token")
+		return
+	}
+	refresh, err := tokens.NewRefreshToken()
 	if err != nil {
-		//handler.SendResponse400(context, err, nil)
-		return nil
+		logger.RuntimeEmit("api.sessionResponse", "", err.Error(), false)
+		unauthorizedMessage(c, "failed to create JWT Token")
+		return
+	}
+	expires := time.Unix(issued.ExpiresAt, 0)
+	res := gorm.DB.Self.Create(&model.GopaRefreshTokens{
+		Session:         issued.Session,
+		Username:        issued.Username,
+		TokenHash:       refresh.Hash,
+		Client:          c.Request.UserAgent(),
+		IP:              clientIP(c),
+		AccessJTI:       issued.Id,
+		AccessExpiresAt: expires,
+		LoginAt:         time.Unix(issued.IssuedAt, 0),
+		ExpiresAt:       refresh.ExpiresAt,
+		Mfa:             issued.MFA,
+	})
+	if res.Error != nil {
+		logger.RuntimeEmit("api.sessionResponse", "", res.Error.Error(), false)
+		unauthorizedMessage(c, "failed to create JWT Token")
+		return
+	}
+	response := gin.H{
+		"token":           signed,
+		"expires":         expires,
+		"refresh_token":   refresh.Raw,
+		"refresh_expires": refresh.ExpiresAt,
+		"username":        issued.Username,
+		"group":           issued.Group,
+		"role":            issued.Role,
 	}
-	errInit := authMiddleware.MiddlewareInit()
-	if errInit != nil {
-		//handler.SendResponse400(context, err, nil)
-		return nil
+	for k, v := range extra {
+		response[k] = v
 	}
-	return authMiddleware
+	c.JSON(http.StatusOK, response)
+}
+
+// unauthorizedMessage 以401返回认证失败的原因
+func unauthorizedMessage(c *gin.Context, message string) {
+	c.Header("WWW-Authenticate", "JWT realm=gopa")
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+		"code":    http.StatusUnauthorized,
+		"message": message,
+	})
+}
+
+// loginUser 查询认证通过的用户当前生效的组和角色。
+// 第一次登录的用户会被加入guest组
+func loginUser(c *gin.Context, username string) *User {
+	var project string
+	var role string
+	members := gorm.Entities.Members()
+	// 只使用当前有效的授权，有多条时以最新的一条为准
+	active, err := members.Find(gorm.MemberQuery{Username: username, ActiveAt: time.Now()})
+	c.Set("username", username)
+	if err == nil && len(active) > 0 {
+		project = active[len(active)-1].Project
+		role = active[len(active)-1].Role
+	} else if all, _ := members.Find(gorm.MemberQuery{Username: username}); len(all) > 0 {
+		// 该用户的授权都已过期、尚未生效或已停用
+		project = "guest"
+		role = "guest"
+	} else {
+		fmt.Println("This user does not exist. Now create a new user.")
+		members.Create(model.GopaMembers{
+			Username: username,
+			Project:  "guest",
+			Role:     "guest",
+		})
+		project = "guest"
+		role = "guest"
+	}
+	c.Set("group", project)
+	c.Set("role", role)
+	return &User{
+		Username: username,
+		Group:    project,
+		Role:     role,
+	}
+}
 
+// currentUsername 返回token中的用户名
+func currentUsername(context *gin.Context) string {
+	return tokenClaims(context).Username
 }
 
 func Test(context *gin.Context) {
-	fmt.Println(jwt.ExtractClaims(context)["username"])
-	fmt.Println(jwt.ExtractClaims(context)["group"])
-	fmt.Println(jwt.ExtractClaims(context)["role"])
+	fmt.Println(tokenClaims(context).Username)
+	fmt.Println(tokenClaims(context).Group)
+	fmt.Println(tokenClaims(context).Role)
 	handler.SendResponse(context, nil, "OK")
 }
@@ -0,0 +1,610 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopa/config"
+	"gopa/gorm"
+	h "gopa/handler"
+	"gopa/model"
+	"gopa/pkg/auth"
+	"gopa/pkg/errno"
+	"gopa/pkg/lockout"
+	"gopa/pkg/logger"
+	"gopa/pkg/secretbox"
+	"gopa/pkg/token"
+	"gopa/pkg/totp"
+	"gopa/service"
+	"gopa/util"
+)
+
+// recoveryCodeCount 每次生成的恢复码个数
+const recoveryCodeCount = 10
+
+var (
+	mfaBoxOnce sync.Once
+	mfaBoxErr  error
+	mfaSecrets *secretbox.Box
+)
+
+// MFALoginForm 登录第二步的结构体，MfaToken为第一步返回的临时token
+type MFALoginForm struct {
+	MfaToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// MFACodeForm 已登录的用户确认、关闭两步验证或重新生成恢复码时的结构体
+type MFACodeForm struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// MFAResetForm 管理员清除某个用户两步验证时的结构体
+type MFAResetForm struct {
+	Username string `json:"username"`
+}
+
+// MFARequireForm 设置组或角色是否需要两步验证时的结构体，ProjectName和RoleName至少填写一个
+type MFARequireForm struct {
+	ProjectName string `json:"project_name"`
+	RoleName    string `json:"role_name"`
+	MfaRequired bool   `json:"mfa_required"`
+}
+
+// MFAEnrollment 绑定两步验证时返回的密钥，URI用于生成身份验证器应用扫描的二维码
+type MFAEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// mfaBox 返回加密TOTP密钥的Box，未配置密钥时返回错误
+func mfaBox() (*secretbox.Box, error) {
+	mfaBoxOnce.Do(func() {
+		key := config.GetConfig().Auth.MFA.EncryptionKey
+		if key == "" {
+			mfaBoxErr = errno.ErrMFAUnavailable
+			return
+		}
+		mfaSecrets, mfaBoxErr = secretbox.NewFromBase64(key)
+	})
+	return mfaSecrets, mfaBoxErr
+}
+
+// completeLogin 认证通过后，需要两步验证的用户先返回临时token，其他用户直接签发token。
+// 已绑定两步验证的用户总是需要两步验证
+func completeLogin(c *gin.Context, tokens *token.Service, user *User) {
+	enrolled, required, err := mfaNeeded(user.Username)
+	if err != nil {
+		// 无法确定是否需要两步验证时不签发token
+		logger.RuntimeEmit("api.completeLogin", "", err.Error(), false)
+		unauthorizedMessage(c, "failed to create JWT Token")
+		return
+	}
+	if !required {
+		loginResponse(c, tokens, user, false, nil)
+		return
+	}
+	challenge, err := tokens.IssueChallenge(user.Username)
+	if err != nil {
+		logger.RuntimeEmit("api.completeLogin", "", err.Error(), false)
+		unauthorizedMessage(c, "failed to create JWT Token")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"mfa_required": true,
+		"mfa_enrolled": enrolled,
+		"mfa_token":    challenge,
+		"expires":      time.Now().Add(token.ChallengeTimeout),
+	})
+}
+
+// mfaNeeded 返回用户是否已绑定两步验证，以及登录时是否需要两步验证。
+// 已绑定的用户总是需要
+func mfaNeeded(username string) (enrolled, required bool, err error) {
+	mfa, err := findMFA(username)
+	if err != nil {
+		return false, false, err
+	}
+	enrolled = mfa != nil && mfa.ConfirmedAt != nil
+	if enrolled {
+		return true, true, nil
+	}
+	required, err = mfaRequired(username)
+	return false, required, err
+}
+
+// mfaRequired 用户当前有效的任一授权所在的组或角色需要两步验证时返回true。
+// 用户登录后可以通过请求头切换组和角色，所以不只检查登录时的组和角色
+func mfaRequired(username string) (bool, error) {
+	members, err := gorm.Entities.Members().Find(gorm.MemberQuery{Username: username, ActiveAt: time.Now()})
+	if err != nil || len(members) == 0 {
+		return false, err
+	}
+	var projects, roles []string
+	for _, m := range members {
+		projects = append(projects, m.Project)
+		roles = append(roles, m.Role)
+	}
+	required, err := gorm.Entities.Projects().AnyMfaRequired(projects)
+	if err != nil || required {
+		return required, err
+	}
+	return gorm.Entities.Roles().AnyMfaRequired(roles)
+}
+
+// findMFA 返回用户的两步验证，没有时返回nil
+func findMFA(username string) (*model.GopaMemberMFA, error) {
+	var mfa model.GopaMemberMFA
+	res := gorm.DB.Self.Where("username = ?", username).Limit(1).Find(&mfa)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return nil, res.Error
+	}
+	return &mfa, nil
+}
+
+// MfaLoginEnroll 	api
+// @Summary          MfaLoginEnroll
+// @Description    Start two-factor enrolment during login, for users that have to use it but have not enrolled yet. Finish it with /api/mfa/verify.
+// @Tags               auth
+// @Accept           application/json
+// @Produce          application/json
+// @Param                     form              body        MFALoginForm  true  "form"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Failure          401              {object}          handler.Response
+// @Router                    /api/mfa/enroll [post]
+func MfaLoginEnroll(tokens *token.Service) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		var form MFALoginForm
+		if err := context.BindJSON(&form); err != nil {
+			h.SendResponse400(context, err, nil)
+			return
+		}
+		claims, err := tokens.ParseChallenge(form.MfaToken)
+		if err != nil {
+			unauthorized(context, errno.ErrMFAChallenge)
+			return
+		}
+		enrollMFA(context, claims.Username)
+	}
+}
+
+// MfaLoginVerify 	api
+// @Summary          MfaLoginVerify
+// @Description    Finish logging in with a TOTP code or a recovery code. The first successful code after enrolment enables two-factor authentication and returns the recovery codes once.
+// @Tags               auth
+// @Accept           application/json
+// @Produce          application/json
+// @Param                     form              body        MFALoginForm  true  "form"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Failure          401              {object}          handler.Response
+// @Failure          429              {object}          handler.Response
+// @Router                    /api/mfa/verify [post]
+func MfaLoginVerify(tokens *token.Service, limiter *lockout.Limiter) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		var form MFALoginForm
+		if err := context.BindJSON(&form); err != nil {
+			h.SendResponse400(context, err, nil)
+			return
+		}
+		claims, err := tokens.ParseChallenge(form.MfaToken)
+		if err != nil {
+			unauthorized(context, errno.ErrMFAChallenge)
+			return
+		}
+		username := claims.Username
+		wait, err := limiter.Allow(username, clientIP(context), time.Now())
+		if err == lockout.ErrLocked {
+			tooManyAttempts(context, wait)
+			return
+		} else if err != nil {
+			logger.RuntimeEmit("api.MfaLoginVerify", "", err.Error(), false)
+		}
+		mfa, err := findMFA(username)
+		if err != nil || mfa == nil {
+			h.SendResponse400(context, errno.ErrMFANotEnrolled, nil)
+			return
+		}
+		if err := verifyMFA(mfa, form.Code, form.RecoveryCode); err != nil {
+			loginFailed(limiter, username, clientIP(context))
+			unauthorized(context, errno.ErrMFACode)
+			return
+		}
+		var extra gin.H
+		if mfa.ConfirmedAt == nil {
+			codes, err := confirmMFA(mfa)
+			if err != nil {
+				h.SendResponse400(context, err, nil)
+				return
+			}
+			util.Audit(username, "mfa.enrolled", username, "two-factor authentication enabled at login")
+			extra = gin.H{"recovery_codes": codes}
+		}
+		if err := limiter.Succeed(username); err != nil {
+			logger.RuntimeEmit("api.MfaLoginVerify", "", err.Error(), false)
+		}
+		loginResponse(context, tokens, loginUser(context, username), true, extra)
+	}
+}
+
+// MfaEnroll 		api
+// @Summary          MfaEnroll
+// @Description    Start two-factor enrolment for the current user. Finish it with /api/v1/mfa/confirm.
+// @Tags               mfa
+// @Produce          application/json
+// @Security         Token
+// @Param            project  header            string                     true  "Project"
+// @Param            role     header            string                     true  "Role"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Router                    /api/v1/mfa/enroll [post]
+func MfaEnroll(context *gin.Context) {
+	enrollMFA(context, currentUsername(context))
+}
+
+// MfaConfirm 		api
+// @Summary          MfaConfirm
+// @Description    Enable two-factor authentication with the first TOTP code. Returns the recovery codes once.
+// @Tags               mfa
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project  header            string                     true  "Project"
+// @Param            role     header            string                     true  "Role"
+// @Param                     form              body        MFACodeForm  true  "form"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Router                    /api/v1/mfa/confirm [post]
+func MfaConfirm(context *gin.Context) {
+	var form MFACodeForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	username := currentUsername(context)
+	mfa, err := findMFA(username)
+	if err != nil || mfa == nil {
+		h.SendResponse400(context, errno.ErrMFANotEnrolled, nil)
+		return
+	}
+	if mfa.ConfirmedAt != nil {
+		h.SendResponse400(context, errno.ErrMFAEnrolled, nil)
+		return
+	}
+	if err := verifyMFA(mfa, form.Code, ""); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	codes, err := confirmMFA(mfa)
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	util.Audit(username, "mfa.enrolled", username, "two-factor authentication enabled")
+	h.SendResponse(context, nil, gin.H{"recovery_codes": codes})
+}
+
+// MfaDisable 		api
+// @Summary          MfaDisable
+// @Description    Disable two-factor authentication for the current user with a TOTP code or a recovery code. Users in MFA-required projects or roles have to enrol again at the next login.
+// @Tags               mfa
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project  header            string                     true  "Project"
+// @Param            role     header            string                     true  "Role"
+// @Param                     form              body        MFACodeForm  true  "form"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Router                    /api/v1/mfa/disable [post]
+func MfaDisable(context *gin.Context) {
+	var form MFACodeForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	username := currentUsername(context)
+	mfa, err := findMFA(username)
+	if err != nil || mfa == nil || mfa.ConfirmedAt == nil {
+		h.SendResponse400(context, errno.ErrMFANotEnrolled, nil)
+		return
+	}
+	if err := verifyMFA(mfa, form.Code, form.RecoveryCode); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	if res := gorm.DB.Self.Unscoped().Delete(&model.GopaMemberMFA{}, mfa.ID); res.Error != nil {
+		h.SendResponse400(context, res.Error, nil)
+		return
+	}
+	util.Audit(username, "mfa.disabled", username, "two-factor authentication disabled")
+	h.SendResponse(context, nil, "success")
+}
+
+// MfaRecoveryCodes 	api
+// @Summary          MfaRecoveryCodes
+// @Description    Replace the recovery codes of the current user. The old codes stop working.
+// @Tags               mfa
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project  header            string                     true  "Project"
+// @Param            role     header            string                     true  "Role"
+// @Param                     form              body        MFACodeForm  true  "form"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Router                    /api/v1/mfa/recoveryCodes [post]
+func MfaRecoveryCodes(context *gin.Context) {
+	var form MFACodeForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	username := currentUsername(context)
+	mfa, err := findMFA(username)
+	if err != nil || mfa == nil || mfa.ConfirmedAt == nil {
+		h.SendResponse400(context, errno.ErrMFANotEnrolled, nil)
+		return
+	}
+	if err := verifyMFA(mfa, form.Code, ""); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	if res := gorm.DB.Self.Model(&model.GopaMemberMFA{}).Where("id = ?", mfa.ID).Update("recovery_codes", hashes); res.Error != nil {
+		h.SendResponse400(context, res.Error, nil)
+		return
+	}
+	util.Audit(username, "mfa.recoveryCodes", username, "recovery codes replaced")
+	h.SendResponse(context, nil, gin.H{"recovery_codes": codes})
+}
+
+// MfaReset 		api
+// @Summary          MfaReset
+// @Description    Remove the two-factor authentication of a user who lost the device and the recovery codes. Only administrators allowed by the policy of /gopa/admin may reset it.
+// @Tags               mfa
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project  header            string                     true  "Project"
+// @Param            role     header            string                     true  "Role"
+// @Param                     form              body        MFAResetForm  true  "form"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Failure          403              {object}          handler.Response
+// @Router                    /api/v1/mfa/reset [post]
+func MfaReset(context *gin.Context) {
+	var form MFAResetForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	if !requireAdmin(context, "mfa.reset", map[string]interface{}{"username": form.Username}) {
+		return
+	}
+	res := gorm.DB.Self.Unscoped().Where("username = ?", form.Username).Delete(&model.GopaMemberMFA{})
+	if res.Error != nil {
+		h.SendResponse400(context, res.Error, nil)
+		return
+	}
+	if res.RowsAffected == 0 {
+		h.SendResponse400(context, errno.ErrMFANotEnrolled, nil)
+		return
+	}
+	util.Audit(currentUsername(context), "mfa.reset", form.Username, "two-factor authentication removed")
+	h.SendResponse(context, nil, res.RowsAffected)
+}
+
+// MfaRequire 		api
+// @Summary          MfaRequire
+// @Description    Mark a project and/or a role as requiring two-factor authentication at login. Only administrators allowed by the policy of /gopa/admin may change it.
+// @Tags               mfa
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project  header            string                     true  "Project"
+// @Param            role     header            string                     true  "Role"
+// @Param                     form              body        MFARequireForm  true  "form"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Failure          403              {object}          handler.Response
+// @Router                    /api/v1/mfa/require [post]
+func MfaRequire(context *gin.Context) {
+	var form MFARequireForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	if form.ProjectName == "" && form.RoleName == "" {
+		h.SendResponse400(context, errno.New(errno.ErrValidation, nil).Add("project_name or role_name is required"), nil)
+		return
+	}
+	if !requireAdmin(context, "mfa.require", map[string]interface{}{
+		"project_name": form.ProjectName, "role_name": form.RoleName, "mfa_required": form.MfaRequired,
+	}) {
+		return
+	}
+	if form.ProjectName != "" {
+		rows, err := gorm.Entities.Projects().SetMfaRequired(form.ProjectName, form.MfaRequired)
+		if err != nil {
+			h.SendResponse400(context, err, nil)
+			return
+		}
+		if rows == 0 {
+			h.SendResponse400(context, errno.New(errno.ErrProjectNotFound, nil).Addf("[%s]", form.ProjectName), nil)
+			return
+		}
+		service.Publish(service.ResourceProject, service.EventUpdated, currentUsername(context), gin.H{
+			"project_name": form.ProjectName, "mfa_required": form.MfaRequired,
+		})
+	}
+	if form.RoleName != "" {
+		rows, err := gorm.Entities.Roles().SetMfaRequired(form.RoleName, form.MfaRequired)
+		if err != nil {
+			h.SendResponse400(context, err, nil)
+			return
+		}
+		if rows == 0 {
+			h.SendResponse400(context, errno.New(errno.ErrRoleNotFound, nil).Addf("[%s]", form.RoleName), nil)
+			return
+		}
+		service.Publish(service.ResourceRole, service.EventUpdated, currentUsername(context), gin.H{
+			"role_name": form.RoleName, "mfa_required": form.MfaRequired,
+		})
+	}
+	h.SendResponse(context, nil, "success")
+}
+
+// enrollMFA 为还没有完成绑定的用户生成新的TOTP密钥
+func enrollMFA(context *gin.Context, username string) {
+	box, err := mfaBox()
+	if err != nil {
+		h.SendResponse400(context, errno.New(errno.ErrMFAUnavailable, err), nil)
+		return
+	}
+	existing, err := findMFA(username)
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	if existing != nil && existing.ConfirmedAt != nil {
+		h.SendResponse400(context, errno.ErrMFAEnrolled, nil)
+		return
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	sealed, err := box.Seal(secret)
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	db := gorm.DB.Self
+	if existing != nil {
+		err = db.Model(&model.GopaMemberMFA{}).Where("id = ?", existing.ID).
+			Updates(map[string]interface{}{"secret": sealed, "last_step": 0}).Error
+	} else {
+		err = db.Create(&model.GopaMemberMFA{Username: username, Secret: sealed}).Error
+	}
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	issuer := config.GetConfig().Auth.MFA.Issuer
+	if issuer == "" {
+		issuer = "GOPA"
+	}
+	h.SendResponse(context, nil, MFAEnrollment{Secret: totp.EncodeSecret(secret), URI: totp.URI(issuer, username, secret)})
+}
+
+// verifyMFA 校验TOTP密码或恢复码。使用过的密码的步数会被记录，用掉的恢复码会被删除，
+// 并发的请求只有一个能通过
+func verifyMFA(mfa *model.GopaMemberMFA, code, recoveryCode string) error {
+	db := gorm.DB.Self
+	if code != "" {
+		box, err := mfaBox()
+		if err != nil {
+			return errno.New(errno.ErrMFAUnavailable, err)
+		}
+		secret, err := box.Open(mfa.Secret)
+		if err != nil {
+			return err
+		}
+		step, ok := totp.Validate(secret, code, time.Now())
+		if !ok {
+			return errno.ErrMFACode
+		}
+		res := db.Model(&model.GopaMemberMFA{}).Where("id = ? AND last_step < ?", mfa.ID, step).Update("last_step", step)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errno.ErrMFACode
+		}
+		return nil
+	}
+	if recoveryCode == "" || mfa.ConfirmedAt == nil {
+		return errno.ErrMFACode
+	}
+	var hashes []string
+	if err := json.Unmarshal([]byte(mfa.RecoveryCodes), &hashes); err != nil {
+		return errno.ErrMFACode
+	}
+	recoveryCode = normalizeRecoveryCode(recoveryCode)
+	for i, hashed := range hashes {
+		if auth.Compare(hashed, recoveryCode) != nil {
+			continue
+		}
+		remaining, _ := json.Marshal(append(hashes[:i:i], hashes[i+1:]...))
+		res := db.Model(&model.GopaMemberMFA{}).Where("id = ? AND recovery_codes = ?", mfa.ID, mfa.RecoveryCodes).
+			Update("recovery_codes", string(remaining))
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errno.ErrMFACode
+		}
+		util.Audit(mfa.Username, "mfa.recoveryCodeUsed", mfa.Username, "recovery code used")
+		return nil
+	}
+	return errno.ErrMFACode
+}
+
+// confirmMFA 完成绑定并生成恢复码
+func confirmMFA(mfa *model.GopaMemberMFA) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	res := gorm.DB.Self.Model(&model.GopaMemberMFA{}).Where("id = ?", mfa.ID).
+		Updates(map[string]interface{}{"confirmed_at": now, "recovery_codes": hashes})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	mfa.ConfirmedAt = &now
+	return codes, nil
+}
+
+// newRecoveryCodes 生成一组恢复码，返回恢复码和保存用的bcrypt哈希的JSON数组
+func newRecoveryCodes() ([]string, string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, "", err
+		}
+		code := hex.EncodeToString(b)
+		hashed, err := auth.Encrypt(code)
+		if err != nil {
+			return nil, "", err
+		}
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashed)
+	}
+	encoded, err := json.Marshal(hashes)
+	return codes, string(encoded), err
+}
+
+// normalizeRecoveryCode 忽略恢复码中的连字符、空格和大小写
+func normalizeRecoveryCode(code string) string {
+	code = strings.Replace(code, "-", "", -1)
+	code = strings.Replace(code, " ", "", -1)
+	return strings.ToLower(code)
+}
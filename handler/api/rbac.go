@@ -0,0 +1,49 @@
+package api
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	h "gopa/handler"
+	"gopa/model"
+	"gopa/util"
+)
+
+// RbacPreview 生成的RBAC策略文件以及该路由是否被手写rego覆盖
+type RbacPreview struct {
+	Route      string             `json:"route"`
+	Overridden bool               `json:"overridden"`
+	Generated  model.RegoDocument `json:"generated"`
+}
+
+// RbacPreviewRego 	api
+// @Summary          RbacPreviewRego
+// @Description    Render the rego generated from project resources for the given route. If a hand-written rego file exists for the route, overridden is true and the hand-written file is used instead.
+// @Tags               rbac
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project            header            string    true    "Project"
+// @Param            role               header            string    true    "Role"
+// @Param                     route             query               string    true    "resource router, such as /perf-server/api/v1/bus/latestData"
+// @Success          200                        {object}          handler.Response
+// @Failure          400                        {object}          handler.Response
+// @Router                    /api/v1/rbac/preview [get]
+func RbacPreviewRego(context *gin.Context) {
+	route, ok := context.GetQuery("route")
+	if !ok || route == "" {
+		h.SendResponse400(context, errors.New("no route specified"), nil)
+		return
+	}
+	generated, err := util.GenerateRego(route)
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	_, err = util.FetchRegoByPath(util.BuildPath(route))
+	h.SendResponse(context, nil, RbacPreview{
+		Route:      route,
+		Overridden: err == nil,
+		Generated:  generated,
+	})
+}
@@ -0,0 +1,24 @@
+package api
+
+import (
+	"gopa/pkg/errno"
+	"gopa/util"
+)
+
+// checkRoleParents 检查父角色是否存在，以及把role的父角色
+// 设置为parents后继承关系中是否会出现环
+func checkRoleParents(role string, parents []string) error {
+	graph, err := util.FetchRoleGraph()
+	if err != nil {
+		return err
+	}
+	for _, parent := range parents {
+		if _, ok := graph[parent]; !ok {
+			return errno.New(errno.ErrRoleNotFound, nil).Addf("[%s]", parent)
+		}
+	}
+	if cycle := graph.FindCycle(role, parents); cycle != nil {
+		return errno.New(errno.ErrRoleCycle, nil).Addf("[%s]", util.FormatRolePath(cycle))
+	}
+	return nil
+}
@@ -0,0 +1,520 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopa/gorm"
+	h "gopa/handler"
+	"gopa/model"
+	"gopa/pkg/errno"
+	"gopa/pkg/token"
+	"gopa/service"
+	"gopa/util"
+)
+
+// apiKeyHeader 除Authorization: ApiKey <key>外，也可以通过该请求头传递API key
+const apiKeyHeader = "X-Api-Key"
+
+// apiKeyTouchInterval 同一个key两次记录最近使用时间的最小间隔，避免每个请求都写数据库
+const apiKeyTouchInterval = time.Minute
+
+// ServiceAccountAddForm 添加服务账号时的结构体
+type ServiceAccountAddForm struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// ServiceAccountDeleteForm 删除服务账号时的结构体
+type ServiceAccountDeleteForm struct {
+	Name string `json:"name"`
+}
+
+// APIKeyAddForm 为服务账号创建API key时的结构体。
+// 服务账号必须已经在Project组内拥有有效的Role角色
+type APIKeyAddForm struct {
+	ServiceAccount string     `json:"service_account"`
+	Project        string     `json:"project"`
+	Role           string     `json:"role"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+}
+
+// APIKeyRevokeForm 吊销API key时的结构体
+type APIKeyRevokeForm struct {
+	ID uint64 `json:"id"`
+}
+
+// APIKeyRotateForm 轮换API key时的结构体。
+// GracePeriod秒内旧key仍然可用，为0时立即吊销旧key
+type APIKeyRotateForm struct {
+	ID          uint64 `json:"id"`
+	GracePeriod int    `json:"grace_period"`
+}
+
+// ServiceAccount 服务账号的返回结构体
+type ServiceAccount struct {
+	ID          uint64    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Owner       string    `json:"owner"`
+	Disabled    bool      `json:"disabled"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// TableName 结构体映射表名称
+func (ServiceAccount) TableName() string {
+	return model.Table("gopa_service_accounts")
+}
+
+// APIKey API key的返回结构体，不返回key的哈希
+type APIKey struct {
+	ID             uint64     `json:"id"`
+	ServiceAccount string     `json:"service_account"`
+	Prefix         string     `json:"prefix"`
+	Project        string     `json:"project"`
+	Role           string     `json:"role"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	RevokedAt      *time.Time `json:"revoked_at"`
+	LastUsedAt     *time.Time `json:"last_used_at"`
+	LastUsedIP     string     `json:"last_used_ip"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// TableName 结构体映射表名称
+func (APIKey) TableName() string {
+	return model.Table("gopa_api_keys")
+}
+
+// CreatedAPIKey 创建或轮换API key的返回结构体，Key只在此时返回一次
+type CreatedAPIKey struct {
+	ID     uint64 `json:"id"`
+	Key    string `json:"key"`
+	Prefix string `json:"prefix"`
+}
+
+// ServiceAccountAdd 	api
+// @Summary              ServiceAccountAdd
+// @Description        Add a service account. Grant it projects and roles with /api/v1/user/add using the account name as username.
+// @Tags                   serviceAccount
+// @Accept               application/json
+// @Produce              application/json
+// @Security             Token
+// @Param                project  header            string                         true  "Project"
+// @Param                role     header            string                         true  "Role"
+// @Param                         form              body        ServiceAccountAddForm  true  "form"
+// @Success              200              {object}          handler.Response
+// @Failure              400              {object}          handler.Response
+// @Router                        /api/v1/serviceAccount/add [post]
+func ServiceAccountAdd(context *gin.Context) {
+	var form ServiceAccountAddForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	if form.Name == "" {
+		h.SendResponse400(context, errno.New(errno.ErrValidation, nil).Add("name is required"), nil)
+		return
+	}
+	db := gorm.DB.Self
+	var total int64
+	db.Model(&model.GopaServiceAccounts{}).Where("name = ?", form.Name).Count(&total)
+	if total > 0 {
+		h.SendResponse400(context, errno.New(errno.ErrServiceAccountExists, nil), nil)
+		return
+	}
+	// 删除服务账号时会删除同名的全部授权，不能与用户重名
+	if err := checkServiceAccountName(form.Name); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	account := model.GopaServiceAccounts{
+		Name:        form.Name,
+		Description: form.Description,
+		Owner:       currentUsername(context),
+	}
+	if res := db.Create(&account); res.Error != nil {
+		// 同时创建同名的服务账号时由唯一索引拒绝
+		h.SendResponse400(context, duplicateError(res.Error, errno.ErrServiceAccountExists), nil)
+		return
+	}
+	service.Publish(service.ResourceServiceAccount, service.EventCreated, currentUsername(context), form)
+	h.SendResponse(context, nil, account.ID)
+}
+
+// ServiceAccountList 	api
+// @Summary               ServiceAccountList
+// @Description         List service accounts.
+// @Tags                    serviceAccount
+// @Accept                application/json
+// @Produce               application/json
+// @Security              Token
+// @Param                 project            header    string    true  "Project"
+// @Param                 role               header    string    true  "Role"
+// @Success               200      {object}  handler.Response
+// @Failure               400      {object}  handler.Response
+// @Router                         /api/v1/serviceAccount/list [get]
+func ServiceAccountList(context *gin.Context) {
+	var data []ServiceAccount
+	res := gorm.DB.Self.Find(&data)
+	if res.Error != nil {
+		h.SendResponse400(context, res.Error, nil)
+		return
+	}
+	h.SendResponse(context, errno.OK, data)
+}
+
+// ServiceAccountDelete 	api
+// @Summary                 ServiceAccountDelete
+// @Description           Delete a service account together with its memberships. All of its API keys are revoked.
+// @Tags                      serviceAccount
+// @Accept                  application/json
+// @Produce                 application/json
+// @Security                Token
+// @Param                   project  header            string                            true  "Project"
+// @Param                   role     header            string                            true  "Role"
+// @Param                            form              body        ServiceAccountDeleteForm  true  "form"
+// @Success                 200              {object}          handler.Response
+// @Failure                 400              {object}          handler.Response
+// @Router                           /api/v1/serviceAccount/delete [post]
+func ServiceAccountDelete(context *gin.Context) {
+	var form ServiceAccountDeleteForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	now := time.Now()
+	err := gorm.Entities.Transaction(func(tx gorm.EntityStore) error {
+		res := tx.DB().Unscoped().Where("name = ?", form.Name).Delete(&model.GopaServiceAccounts{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errno.New(errno.ErrServiceAccountNotFound, nil)
+		}
+		if res := tx.DB().Model(&model.GopaAPIKeys{}).Where("service_account = ? AND revoked_at IS NULL", form.Name).
+			Update("revoked_at", now); res.Error != nil {
+			return res.Error
+		}
+		_, err := tx.Members().DeleteUser(form.Name)
+		return err
+	})
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	util.Audit(currentUsername(context), "serviceAccount.deleted", form.Name, "all API keys revoked")
+	service.Publish(service.ResourceServiceAccount, service.EventDeleted, currentUsername(context), form)
+	h.SendResponse(context, nil, nil)
+}
+
+// APIKeyAdd 		api
+// @Summary          APIKeyAdd
+// @Description    Create an API key for a service account, scoped to one of its project and role memberships. The key is only returned once.
+// @Tags               serviceAccount
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project  header            string                true  "Project"
+// @Param            role     header            string                true  "Role"
+// @Param                     form              body        APIKeyAddForm  true  "form"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Router                    /api/v1/serviceAccount/key/add [post]
+func APIKeyAdd(context *gin.Context) {
+	var form APIKeyAddForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	if _, err := activeServiceAccount(form.ServiceAccount); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	members, _ := gorm.Entities.Members().Find(gorm.MemberQuery{
+		Username: form.ServiceAccount,
+		Project:  form.Project,
+		Role:     form.Role,
+		ActiveAt: time.Now(),
+	})
+	if len(members) == 0 {
+		h.SendResponse400(context, errno.New(errno.ErrAPIKeyScope, nil).
+			Addf("%s is not a member of %s as %s", form.ServiceAccount, form.Project, form.Role), nil)
+		return
+	}
+	created, err := createAPIKey(model.GopaAPIKeys{
+		ServiceAccount: form.ServiceAccount,
+		Project:        form.Project,
+		Role:           form.Role,
+		ExpiresAt:      form.ExpiresAt,
+	})
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	util.Audit(currentUsername(context), "apiKey.created", form.ServiceAccount,
+		fmt.Sprintf("key %s for %s/%s", created.Prefix, form.Project, form.Role))
+	service.Publish(service.ResourceAPIKey, service.EventCreated, currentUsername(context), gin.H{
+		"id": created.ID, "service_account": form.ServiceAccount, "prefix": created.Prefix,
+		"project": form.Project, "role": form.Role,
+	})
+	h.SendResponse(context, nil, created)
+}
+
+// APIKeyList 		api
+// @Summary          APIKeyList
+// @Description    List API keys with their scope and last use. Hashes are never returned.
+// @Tags               serviceAccount
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project            header    string    true   "Project"
+// @Param            role               header    string    true   "Role"
+// @Param            service_account    query     string    false  "only return keys of this service account"
+// @Success          200      {object}  handler.Response
+// @Failure          400      {object}  handler.Response
+// @Router                    /api/v1/serviceAccount/key/list [get]
+func APIKeyList(context *gin.Context) {
+	var data []APIKey
+	db := gorm.DB.Self
+	if name, ok := context.GetQuery("service_account"); ok {
+		db = db.Where("service_account = ?", name)
+	}
+	res := db.Order("id desc").Find(&data)
+	if res.Error != nil {
+		h.SendResponse400(context, res.Error, nil)
+		return
+	}
+	h.SendResponse(context, errno.OK, data)
+}
+
+// APIKeyRevoke 		api
+// @Summary          APIKeyRevoke
+// @Description    Revoke an API key immediately.
+// @Tags               serviceAccount
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project  header            string                   true  "Project"
+// @Param            role     header            string                   true  "Role"
+// @Param                     form              body        APIKeyRevokeForm  true  "form"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Router                    /api/v1/serviceAccount/key/revoke [post]
+func APIKeyRevoke(context *gin.Context) {
+	var form APIKeyRevokeForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	var key model.GopaAPIKeys
+	if res := gorm.DB.Self.First(&key, form.ID); res.Error != nil {
+		h.SendResponse400(context, errno.New(errno.ErrAPIKeyNotFound, res.Error), nil)
+		return
+	}
+	res := gorm.DB.Self.Model(&model.GopaAPIKeys{}).Where("id = ? AND revoked_at IS NULL", key.ID).Update("revoked_at", time.Now())
+	if res.Error != nil {
+		h.SendResponse400(context, res.Error, nil)
+		return
+	}
+	util.Audit(currentUsername(context), "apiKey.revoked", key.ServiceAccount, "key "+key.Prefix)
+	service.Publish(service.ResourceAPIKey, service.EventDeleted, currentUsername(context), gin.H{
+		"id": key.ID, "service_account": key.ServiceAccount, "prefix": key.Prefix,
+	})
+	h.SendResponse(context, nil, res.RowsAffected)
+}
+
+// APIKeyRotate 		api
+// @Summary          APIKeyRotate
+// @Description    Issue a new API key with the same scope and expiry. The old key stays valid for grace_period seconds, or is revoked immediately when grace_period is 0.
+// @Tags               serviceAccount
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project  header            string                   true  "Project"
+// @Param            role     header            string                   true  "Role"
+// @Param                     form              body        APIKeyRotateForm  true  "form"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Router                    /api/v1/serviceAccount/key/rotate [post]
+func APIKeyRotate(context *gin.Context) {
+	var form APIKeyRotateForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	now := time.Now()
+	var old model.GopaAPIKeys
+	if res := gorm.DB.Self.First(&old, form.ID); res.Error != nil {
+		h.SendResponse400(context, errno.New(errno.ErrAPIKeyNotFound, res.Error), nil)
+		return
+	}
+	if !util.APIKeyActive(old, now) {
+		h.SendResponse400(context, errno.New(errno.ErrAPIKeyInvalid, nil), nil)
+		return
+	}
+	created, err := createAPIKey(model.GopaAPIKeys{
+		ServiceAccount: old.ServiceAccount,
+		Project:        old.Project,
+		Role:           old.Role,
+		ExpiresAt:      old.ExpiresAt,
+	})
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	updates := map[string]interface{}{"revoked_at": now}
+	if form.GracePeriod > 0 {
+		updates = map[string]interface{}{"revoked_at": now.Add(time.Duration(form.GracePeriod) * time.Second)}
+	}
+	if res := gorm.DB.Self.Model(&model.GopaAPIKeys{}).Where("id = ?", old.ID).Updates(updates); res.Error != nil {
+		h.SendResponse400(context, res.Error, nil)
+		return
+	}
+	util.Audit(currentUsername(context), "apiKey.rotated", old.ServiceAccount,
+		fmt.Sprintf("key %s replaced by %s", old.Prefix, created.Prefix))
+	service.Publish(service.ResourceAPIKey, service.EventUpdated, currentUsername(context), gin.H{
+		"id": created.ID, "replaces": old.ID, "service_account": old.ServiceAccount, "prefix": created.Prefix,
+	})
+	h.SendResponse(context, nil, created)
+}
+
+// APIKeyAuth 请求带有API key时以对应的服务账号认证，否则交给JWT中间件。
+// API key只能用于创建时的组和角色：请求头中没有project和role时自动补上，
+// 与key的范围不一致时拒绝请求
+func APIKeyAuth(jwtAuth gin.HandlerFunc) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		raw := apiKeyFromRequest(context)
+		if raw == "" {
+			jwtAuth(context)
+			return
+		}
+		if !util.LooksLikeAPIKey(raw) {
+			unauthorized(context, errno.ErrAPIKeyInvalid)
+			return
+		}
+		now := time.Now()
+		var key model.GopaAPIKeys
+		res := gorm.DB.Self.Where("key_hash = ?", util.HashAPIKey(raw)).Limit(1).Find(&key)
+		if res.Error != nil || res.RowsAffected == 0 || !util.APIKeyActive(key, now) {
+			unauthorized(context, errno.ErrAPIKeyInvalid)
+			return
+		}
+		if _, err := activeServiceAccount(key.ServiceAccount); err != nil {
+			unauthorized(context, errno.ErrAPIKeyInvalid)
+			return
+		}
+		// 服务账号在key的组内的授权被删除、过期或停用后，key不再可用
+		granted, err := util.HasActiveGrant(key.ServiceAccount, key.Project, key.Role, now)
+		if err != nil {
+			h.SendResponse403(context, err, nil)
+			context.Abort()
+			return
+		}
+		if !granted {
+			h.SendResponse403(context, errno.New(errno.ErrAPIKeyScope, nil).
+				Addf("%s is no longer a member of %s as %s", key.ServiceAccount, key.Project, key.Role), nil)
+			context.Abort()
+			return
+		}
+		for header, scope := range map[string]string{"project": key.Project, "role": key.Role} {
+			value := context.GetHeader(header)
+			if value == "" {
+				context.Request.Header.Set(header, scope)
+			} else if value != scope {
+				h.SendResponse403(context, errno.ErrAPIKeyScope, nil)
+				context.Abort()
+				return
+			}
+		}
+		if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyTouchInterval {
+			gorm.DB.Self.Model(&model.GopaAPIKeys{}).Where("id = ?", key.ID).
+				Updates(map[string]interface{}{"last_used_at": now, "last_used_ip": clientIP(context)})
+		}
+		context.Set(claimsKey, &token.Claims{
+			Username:       key.ServiceAccount,
+			Group:          key.Project,
+			Role:           key.Role,
+			ServiceAccount: true,
+			APIKeyID:       key.ID,
+		})
+		context.Set(identityKey, key.ServiceAccount)
+		context.Next()
+	}
+}
+
+// apiKeyFromRequest 从 Authorization: ApiKey <key> 或 X-Api-Key 请求头中读取API key
+func apiKeyFromRequest(context *gin.Context) string {
+	if key := context.GetHeader(apiKeyHeader); key != "" {
+		return key
+	}
+	parts := strings.SplitN(context.GetHeader("Authorization"), " ", 2)
+	if len(parts) == 2 && strings.EqualFold(parts[0], "ApiKey") {
+		return strings.TrimSpace(parts[1])
+	}
+	return ""
+}
+
+// checkServiceAccountName 检查name没有被用户使用：没有同名的授权，
+// 使用LDAP认证时LDAP中也没有同名的用户
+func checkServiceAccountName(name string) error {
+	members, err := gorm.Entities.Members().Find(gorm.MemberQuery{Username: name})
+	if err != nil {
+		return err
+	}
+	if len(members) > 0 {
+		return errno.New(errno.ErrServiceAccountName, nil).Addf("[%s]", name)
+	}
+	if !ldapEnabled() {
+		return nil
+	}
+	pool := ldapPool()
+	if pool == nil {
+		return nil
+	}
+	exists, err := pool.UserExists(name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errno.New(errno.ErrServiceAccountName, nil).Addf("[%s] in LDAP", name)
+	}
+	return nil
+}
+
+// activeServiceAccount 返回未停用的服务账号
+func activeServiceAccount(name string) (*model.GopaServiceAccounts, error) {
+	var account model.GopaServiceAccounts
+	res := gorm.DB.Self.Where("name = ? AND disabled = ?", name, false).Limit(1).Find(&account)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, errno.New(errno.ErrServiceAccountNotFound, nil)
+	}
+	return &account, nil
+}
+
+// createAPIKey 生成一个新的key并保存它的哈希
+func createAPIKey(key model.GopaAPIKeys) (*CreatedAPIKey, error) {
+	raw, prefix, err := util.GenerateAPIKey()
+	if err != nil {
+		return nil, err
+	}
+	key.Prefix = prefix
+	key.KeyHash = util.HashAPIKey(raw)
+	if res := gorm.DB.Self.Create(&key); res.Error != nil {
+		return nil, res.Error
+	}
+	return &CreatedAPIKey{ID: key.ID, Key: raw, Prefix: prefix}, nil
+}
+
+// unauthorized 以与JWT中间件相同的格式返回401
+func unauthorized(context *gin.Context, err *errno.Errno) {
+	context.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+		"code":    http.StatusUnauthorized,
+		"message": err.Message,
+	})
+}
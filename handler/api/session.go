@@ -0,0 +1,278 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"gopa/gorm"
+	h "gopa/handler"
+	"gopa/model"
+	"gopa/pkg/errno"
+	"gopa/pkg/logger"
+	"gopa/pkg/token"
+	"gopa/util"
+)
+
+// RevokeSessionsForm 吊销某个用户全部登录状态时的结构体
+type RevokeSessionsForm struct {
+	Username string `json:"username"`
+}
+
+// RefreshTokenForm 刷新token时的结构体
+type RefreshTokenForm struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// SessionRevokeForm 吊销当前用户一个登录时的结构体
+type SessionRevokeForm struct {
+	ID string `json:"id"`
+}
+
+// Session 用户的一个登录，Client为登录或最近一次刷新时的User-Agent
+type Session struct {
+	ID              string    `json:"id"`
+	Client          string    `json:"client"`
+	IP              string    `json:"ip"`
+	LoginAt         time.Time `json:"login_at"`
+	LastRefreshedAt time.Time `json:"last_refreshed_at"`
+	ExpiresAt       time.Time `json:"expires_at"`
+	Current         bool      `json:"current"`
+}
+
+// RefreshToken 		api
+// @Summary          RefreshToken
+// @Description    Exchange a refresh token for a new token and a new refresh token. Each refresh token can be used once; presenting a used refresh token revokes the whole session. A session that did not pass two-factor authentication is revoked once the user has to use it.
+// @Tags               auth
+// @Accept           application/json
+// @Produce          application/json
+// @Param                     form              body        RefreshTokenForm  true  "form"
+// @Success          200              {object}          handler.Response
+// @Failure          401              {object}          handler.Response
+// @Router                    /api/refresh_token [post]
+func RefreshToken(tokens *token.Service) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		var form RefreshTokenForm
+		if err := context.BindJSON(&form); err != nil || form.RefreshToken == "" {
+			unauthorized(context, errno.ErrRefreshToken)
+			return
+		}
+		now := time.Now()
+		db := gorm.DB.Self
+		var current model.GopaRefreshTokens
+		res := db.Where("token_hash = ?", token.HashRefreshToken(form.RefreshToken)).Limit(1).Find(&current)
+		if res.Error != nil || res.RowsAffected == 0 {
+			unauthorized(context, errno.ErrRefreshToken)
+			return
+		}
+		err := token.CheckRefresh(current.UsedAt, current.RevokedAt, current.ExpiresAt, now)
+		if err == nil && !current.Mfa {
+			// 登录后组或角色改为需要两步验证的，没有通过两步验证的登录不能继续刷新
+			_, required, mfaErr := mfaNeeded(current.Username)
+			if mfaErr != nil {
+				logger.RuntimeEmit("api.RefreshToken", "", mfaErr.Error(), false)
+				unauthorized(context, errno.ErrRefreshToken)
+				return
+			}
+			if required {
+				if err := util.RevokeSession(current.Session, "two-factor authentication required"); err != nil {
+					logger.RuntimeEmit("api.RefreshToken", "", err.Error(), false)
+				}
+				unauthorized(context, errno.ErrMFASession)
+				return
+			}
+		}
+		if err == nil {
+			// 并发刷新时只有一个请求能使用该刷新token
+			res = db.Model(&model.GopaRefreshTokens{}).Where("id = ? AND used_at IS NULL AND revoked_at IS NULL", current.ID).
+				Update("used_at", now)
+			if res.Error != nil {
+				logger.RuntimeEmit("api.RefreshToken", "", res.Error.Error(), false)
+				unauthorized(context, errno.ErrRefreshToken)
+				return
+			}
+			if res.RowsAffected == 0 {
+				err = token.ErrRefreshReused
+			}
+		}
+		if err == token.ErrRefreshReused {
+			// 刷新token可能已经泄露，吊销整个登录
+			if err := util.RevokeSession(current.Session, "refresh token reused"); err != nil {
+				logger.RuntimeEmit("api.RefreshToken", "", err.Error(), false)
+			}
+			util.Audit(current.Username, "session.reused", current.Username,
+				"refresh token reused from "+clientIP(context)+", session "+current.Session+" revoked")
+			unauthorized(context, errno.ErrRefreshReused)
+			return
+		}
+		if err != nil {
+			unauthorized(context, errno.ErrRefreshToken)
+			return
+		}
+		// 重新读取组和角色，使授权的变化在刷新后生效
+		user := loginUser(context, current.Username)
+		sessionResponse(context, tokens, token.Claims{
+			Username: user.Username,
+			Group:    user.Group,
+			Role:     user.Role,
+			Session:  current.Session,
+			MFA:      current.Mfa,
+			StandardClaims: jwtgo.StandardClaims{
+				IssuedAt: current.LoginAt.Unix(),
+			},
+		}, nil)
+	}
+}
+
+// Logout 			api
+// @Summary          Logout
+// @Description    Log out, revoke the presented token and the refresh tokens of its session
+// @Tags               auth
+// @Produce          application/json
+// @Security         Token
+// @Success          200              {object}          handler.Response
+// @Router                    /api/sso-logout [get]
+func Logout(tokens *token.Service) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if claims, err := tokens.ParseRequest(context); err == nil && claims.Id != "" {
+			if err := util.RevokeToken(claims.Id, claims.Username, time.Unix(claims.ExpiresAt, 0), "logout"); err != nil {
+				logger.RuntimeEmit("api.Logout", "", err.Error(), false)
+			}
+			if claims.Session != "" {
+				if err := util.RevokeSession(claims.Session, "logout"); err != nil {
+					logger.RuntimeEmit("api.Logout", "", err.Error(), false)
+				}
+			}
+		}
+		context.JSON(http.StatusOK, gin.H{"code": http.StatusOK})
+	}
+}
+
+// RejectRevokedTokens 拒绝已吊销的token，需放在JWT中间件之后。
+// API key有自己的吊销方式，不在此检查
+func RejectRevokedTokens() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		claims := tokenClaims(context)
+		if claims.ServiceAccount {
+			context.Next()
+			return
+		}
+		revoked, err := util.TokenRevoked(claims.Id, claims.Username, time.Unix(claims.IssuedAt, 0))
+		if err != nil {
+			// 无法确认token未被吊销时拒绝请求
+			logger.RuntimeEmit("api.RejectRevokedTokens", "", err.Error(), false)
+			h.SendResponse403(context, err, nil)
+			context.Abort()
+			return
+		}
+		if revoked {
+			unauthorized(context, errno.ErrTokenRevoked)
+			return
+		}
+		context.Next()
+	}
+}
+
+// RevokeSessions 	api
+// @Summary          RevokeSessions
+// @Description    Revoke all tokens issued to a user so far. The user has to log in again. Users may revoke their own sessions; revoking the sessions of others is only allowed to administrators allowed by the policy of /gopa/admin.
+// @Tags               user
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project  header            string                     true  "Project"
+// @Param            role     header            string                     true  "Role"
+// @Param                     form              body        RevokeSessionsForm  true  "form"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Failure          403              {object}          handler.Response
+// @Router                    /api/v1/user/revokeSessions [post]
+func RevokeSessions(context *gin.Context) {
+	var form RevokeSessionsForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	if form.Username == "" {
+		h.SendResponse400(context, errno.New(errno.ErrValidation, nil).Add("username is required"), nil)
+		return
+	}
+	if form.Username != currentUsername(context) &&
+		!requireAdmin(context, "session.revokeAll", map[string]interface{}{"username": form.Username}) {
+		return
+	}
+	if err := util.RevokeUserTokens(form.Username, "revoked by "+currentUsername(context)); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	util.Audit(currentUsername(context), "session.revoked", form.Username, "all sessions revoked")
+	h.SendResponse(context, nil, "success")
+}
+
+// SessionList 		api
+// @Summary          SessionList
+// @Description    List the sessions of the current user, one per logged in client
+// @Tags               user
+// @Produce          application/json
+// @Security         Token
+// @Param            project  header            string                     true  "Project"
+// @Param            role     header            string                     true  "Role"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Router                    /api/v1/user/sessions [get]
+func SessionList(context *gin.Context) {
+	claims := tokenClaims(context)
+	active, err := util.ActiveRefreshTokens(claims.Username, time.Now())
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	sessions := make([]Session, 0, len(active))
+	for _, t := range active {
+		sessions = append(sessions, Session{
+			ID:              t.Session,
+			Client:          t.Client,
+			IP:              t.IP,
+			LoginAt:         t.LoginAt,
+			LastRefreshedAt: t.CreatedAt,
+			ExpiresAt:       t.ExpiresAt,
+			Current:         t.Session == claims.Session,
+		})
+	}
+	h.SendResponse(context, nil, sessions)
+}
+
+// SessionRevoke 	api
+// @Summary          SessionRevoke
+// @Description    Log out one session of the current user, e.g. a lost device
+// @Tags               user
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project  header            string                     true  "Project"
+// @Param            role     header            string                     true  "Role"
+// @Param                     form              body        SessionRevokeForm  true  "form"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Router                    /api/v1/user/sessions/revoke [post]
+func SessionRevoke(context *gin.Context) {
+	var form SessionRevokeForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	username := currentUsername(context)
+	var total int64
+	gorm.DB.Self.Model(&model.GopaRefreshTokens{}).Where("session = ? AND username = ?", form.ID, username).Count(&total)
+	if form.ID == "" || total == 0 {
+		h.SendResponse400(context, errno.ErrSessionNotFound, nil)
+		return
+	}
+	if err := util.RevokeSession(form.ID, "revoked by "+username); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	util.Audit(username, "session.revoked", username, "session "+form.ID+" revoked")
+	h.SendResponse(context, nil, "success")
+}
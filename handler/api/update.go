@@ -1,46 +1,74 @@
 package api
 
 import (
-	ctx "context"
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
 	"gopa/gorm"
 	h "gopa/handler"
 	"gopa/model"
+	"gopa/pkg/errno"
+	"gopa/pkg/logger"
+	"gopa/pkg/notify"
 	"gopa/schema"
+	"gopa/service"
+	"gopa/util"
+	"time"
 )
 
+// 要修改的授权由ID或者OldProject和OldRole指定，用户只有一个授权时可以都不填
 type UpdatePermissionForm struct {
 	schema.ActionUserForm
-	Username string `json:"username"`
-	Project    string `json:"project"`
-	Role     string `json:"role"`
+	Username   string     `json:"username"`
+	ID         uint64     `json:"id"`
+	OldProject string     `json:"old_project"`
+	OldRole    string     `json:"old_role"`
+	Project    string     `json:"project"`
+	Role       string     `json:"role"`
+	ValidFrom  *time.Time `json:"valid_from"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	Version    int64      `json:"version"`
 }
 
+// UpdatedRoleForm 修改某个角色继承的父角色时的结构体
+type UpdatedRoleForm struct {
+	RoleName    string   `json:"role_name"`
+	ParentRoles []string `json:"parent_roles"`
+	Version     int64    `json:"version"`
+}
+
+// UpdatedRegoDocumentForm 修改rego文件时的结构体，Version不为0时只修改该版本的文件
 type UpdatedRegoDocumentForm struct {
 	FilePath   string `json:"path"`
 	NewContent string `json:"content"`
+	Version    int64  `json:"version"`
 }
 
+// UpdatedProjectResourceForm 修改资源授权时的结构体。要修改的授权由ID或者OldProjectName和OldRoleName指定，
+// 资源只授权给一个组和角色时可以都不填
 type UpdatedProjectResourceForm struct {
-	ResourceName string `json:"resource_name"`
-	ProjectName  string `json:"project_name"`
-	RoleName     string `json:"role_name"`
+	ResourceName   string `json:"resource_name"`
+	ID             uint64 `json:"id"`
+	OldProjectName string `json:"old_project_name"`
+	OldRoleName    string `json:"old_role_name"`
+	ProjectName    string `json:"project_name"`
+	RoleName       string `json:"role_name"`
+	Version        int64  `json:"version"`
 }
 
 // UserUpdate 	api
 // @Summary        UserUpdate
-// @Description  Update the group or role of a given user
+// @Description  Update the group or role of one membership of a given user, chosen by id or by old_project and old_role. Both may be omitted when the user has a single membership. If If-Match or version is given, the membership is only updated at that version, otherwise the request fails with a version conflict.
 // @Tags             user
 // @Accept         application/json
 // @Produce        application/json
 // @Security       Token
 // @Param          project  header            string                                    true  "Project"
 // @Param          role     header            string                                    true  "Role"
+// @Param          If-Match header            string                                    false "expected version"
 // @Param                   form              body        UpdatePermissionForm    true        "form"
 // @Success        200              {object}          handler.Response
 // @Failure        400              {object}          handler.Response
+// @Failure        409              {object}          handler.Response
 // @Router                  /api/v1/user/update [post]
 func UserUpdate(context *gin.Context) {
 	var form UpdatePermissionForm
@@ -48,29 +76,154 @@ func UserUpdate(context *gin.Context) {
 		h.SendResponse400(context, err, nil)
 		return
 	}
-	db := gorm.DB.Self
-	var user model.GopaMembers
-	user.Username = form.Username
-	res := db.Model(&user).Where("username = ?", form.Username).Updates(model.GopaMembers{Project: form.Project, Role: form.Role})
-	if res.Error != nil {
-		h.SendResponse400(context, res.Error, nil)
+	version, err := expectedVersion(context, form.Version)
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	if _, err := updateMembership(gorm.Entities, form, version); err != nil {
+		sendWriteError(context, err)
 		return
 	}
+	publishMembershipUpdated(currentUsername(context), form)
+	h.SendResponse(context, nil, "success")
+}
+
+// updateMembership 在store中修改form指定的授权，version不为gorm.AnyVersion时只修改该版本
+func updateMembership(store gorm.EntityStore, form UpdatePermissionForm, version int64) (int64, error) {
+	member, err := findMembership(store, form)
+	if err != nil {
+		return 0, err
+	}
+	// 为空的字段不修改
+	rows, err := store.Members().Update(member.ID, version, gorm.MemberUpdate{
+		Project:   form.Project,
+		Role:      form.Role,
+		ValidFrom: form.ValidFrom,
+		ExpiresAt: form.ExpiresAt,
+	})
+	if err == gorm.ErrEntityConflict {
+		return 0, conflictError(form.Username)
+	} else if err != nil {
+		return 0, duplicateError(err, errno.ErrMemberExists)
+	}
+	if rows == 0 {
+		return 0, errno.New(errno.ErrMemberNotFound, nil).Addf("[%s]", form.Username)
+	}
+	return rows, nil
+}
+
+// publishMembershipUpdated 吊销用户已签发的token，并发送修改授权的通知和webhook
+func publishMembershipUpdated(actor string, form UpdatePermissionForm) {
+	// 已签发的token中还是旧的组和角色，需要重新登录
+	if err := util.RevokeUserTokens(form.Username, "membership updated"); err != nil {
+		logger.RuntimeEmit("api.UserUpdate", "", err.Error(), false)
+	}
+	notify.Send(notify.Event{
+		Kind:    notify.MemberUpdated,
+		Project: form.Project,
+		Actor:   actor,
+		Text:    fmt.Sprintf("%s as %s", form.Username, form.Role),
+	})
+	service.Publish(service.ResourceMember, service.EventUpdated, actor, form)
+}
+
+// findMembership 返回form要修改的授权
+func findMembership(store gorm.EntityStore, form UpdatePermissionForm) (model.GopaMembers, error) {
+	query := gorm.MemberQuery{Username: form.Username}
+	switch {
+	case form.ID != 0:
+		query.ID = form.ID
+	case form.OldProject != "" || form.OldRole != "":
+		if form.OldProject == "" || form.OldRole == "" {
+			return model.GopaMembers{}, errno.New(errno.ErrValidation, nil).Add("old_project and old_role are both required")
+		}
+		query.Project, query.Role = form.OldProject, form.OldRole
+	}
+	members, err := store.Members().Find(query)
+	if err != nil {
+		return model.GopaMembers{}, err
+	}
+	switch len(members) {
+	case 0:
+		return model.GopaMembers{}, errno.New(errno.ErrMemberNotFound, nil).Addf("[%s]", form.Username)
+	case 1:
+		return members[0], nil
+	default:
+		return model.GopaMembers{}, errno.New(errno.ErrValidation, nil).Addf("%s has several memberships, id or old_project and old_role is required", form.Username)
+	}
+}
+
+// RoleUpdate 	api
+// @Summary        RoleUpdate
+// @Description  Replace the parent roles of a given role. Rejected if the inheritance would contain a cycle, or if If-Match or version is given and the role is at another version.
+// @Tags             role
+// @Accept         application/json
+// @Produce        application/json
+// @Security       Token
+// @Param          project  header            string                             true  "Project"
+// @Param          role     header            string                             true  "Role"
+// @Param          If-Match header            string                             false "expected version"
+// @Param                   form              body        UpdatedRoleForm    true    "form"
+// @Success        200              {object}          handler.Response
+// @Failure        400              {object}          handler.Response
+// @Failure        409              {object}          handler.Response
+// @Router                  /api/v1/role/update [post]
+func RoleUpdate(context *gin.Context) {
+	var form UpdatedRoleForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	version, err := expectedVersion(context, form.Version)
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	roles := gorm.Entities.Roles()
+	found, err := roles.Exists(form.RoleName)
+	if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	if !found {
+		h.SendResponse400(context, errno.New(errno.ErrRoleNotFound, nil).Addf("[%s]", form.RoleName), nil)
+		return
+	}
+	if err := checkRoleParents(form.RoleName, form.ParentRoles); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	rows, err := roles.ReplaceParents(form.RoleName, form.ParentRoles, version)
+	if err == gorm.ErrEntityConflict {
+		err = conflictError(form.RoleName)
+	} else if err == nil && rows == 0 {
+		err = errno.New(errno.ErrRoleNotFound, nil).Addf("[%s]", form.RoleName)
+	}
+	if err != nil {
+		sendWriteError(context, err)
+		return
+	}
+	util.InvalidateRoleGraph()
+	service.Publish(service.ResourceRole, service.EventUpdated, currentUsername(context), form)
 	h.SendResponse(context, nil, "success")
 }
 
 // RegoUpdate 	api
 // @Summary        RegoUpdate
-// @Description  Update the content of a rego file by given path
+// @Description  Update the content of a rego file by given path. If If-Match or version is given and the file is at another version, the request fails with a version conflict.
 // @Tags             rego
 // @Accept         application/json
 // @Produce        application/json
 // @Security       Token
 // @Param          project  header            string                                         true  "Project"
 // @Param          role     header            string                                         true  "Role"
+// @Param          If-Match header            string                                         false "expected version"
 // @Param                   form              body        UpdatedRegoDocumentForm    true    "form"
 // @Success        200              {object}          handler.Response
 // @Failure        400              {object}          handler.Response
+// @Failure        403              {object}          handler.Response
+// @Failure        409              {object}          handler.Response
 // @Router                  /api/v1/rego/update [post]
 func RegoUpdate(context *gin.Context) {
 	var form UpdatedRegoDocumentForm
@@ -78,31 +231,43 @@ func RegoUpdate(context *gin.Context) {
 		h.SendResponse400(context, err, nil)
 		return
 	}
-	filter := bson.D{{"path", form.FilePath}}
-	update := bson.D{
-		{"$set", bson.D{{"content", form.NewContent}}},
+	if !requireRegoWrite(context, "rego.update", form.FilePath) {
+		return
 	}
-	updateResult, err := gorm.Collections.RegoCollection.UpdateOne(ctx.TODO(), filter, update)
+	version, err := expectedVersion(context, form.Version)
 	if err != nil {
 		h.SendResponse400(context, err, nil)
 		return
 	}
-	fmt.Println("Matched updated content: ", updateResult.ModifiedCount)
-	h.SendResponse(context, nil, updateResult.ModifiedCount)
+	modified, err := gorm.Regos.Update(form.FilePath, form.NewContent, version)
+	if err == gorm.ErrRegoConflict {
+		sendWriteError(context, conflictError(form.FilePath))
+		return
+	} else if err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	if modified > 0 {
+		notify.Send(notify.Event{Kind: notify.RegoUpdated, Actor: currentUsername(context), Text: form.FilePath})
+		service.Publish(service.ResourceRego, service.EventUpdated, currentUsername(context), form)
+	}
+	h.SendResponse(context, nil, modified)
 }
 
 // ProjectResourceUpdate 	api
 // @Summary              ProjectResourceUpdate
-// @Description        Update the permission of a group with its related role to a resource
+// @Description        Update one grant of a resource to a group and role, chosen by id or by old_project_name and old_role_name. Both may be omitted when the resource has a single grant. If If-Match or version is given, the grant is only updated at that version, otherwise the request fails with a version conflict. Omitted project_name or role_name are left unchanged, and the given group and role must exist.
 // @Tags                   projectResource
 // @Accept               application/json
 // @Produce              application/json
 // @Security             Token
 // @Param                project  header            string                                            true  "Project"
 // @Param                role     header            string                                            true  "Role"
+// @Param                If-Match header            string                                            false "expected version"
 // @Param                         form    body                UpdatedProjectResourceForm    true    "form"
 // @Success              200              {object}          handler.Response
 // @Failure              400              {object}          handler.Response
+// @Failure              409              {object}          handler.Response
 // @Router                        /api/v1/projectResource/update [post]
 func ProjectResourceUpdate(context *gin.Context) {
 	var form UpdatedProjectResourceForm
@@ -110,13 +275,82 @@ func ProjectResourceUpdate(context *gin.Context) {
 		h.SendResponse400(context, err, nil)
 		return
 	}
-	filter := bson.D{{"resouce_router", form.ResourceName}}
-	update := bson.D{{"project_name", form.ProjectName}, {"role_name", form.RoleName}}
-	updateResult, err := gorm.Collections.RegoCollection.UpdateOne(ctx.TODO(), filter, update)
+	version, err := expectedVersion(context, form.Version)
 	if err != nil {
 		h.SendResponse400(context, err, nil)
 		return
 	}
-	fmt.Println("Matched updated content: ", updateResult.ModifiedCount)
-	h.SendResponse(context, nil, updateResult.ModifiedCount)
+	rows, err := updateProjectResource(gorm.Entities, form, version)
+	if err != nil {
+		sendWriteError(context, err)
+		return
+	}
+	service.Publish(service.ResourceProjectResource, service.EventUpdated, currentUsername(context), form)
+	h.SendResponse(context, nil, rows)
+}
+
+// updateProjectResource 在store中修改form指定的资源授权，version不为gorm.AnyVersion时只修改该版本
+func updateProjectResource(store gorm.EntityStore, form UpdatedProjectResourceForm, version int64) (int64, error) {
+	if form.ProjectName == "" && form.RoleName == "" {
+		return 0, errno.New(errno.ErrValidation, nil).Add("project_name or role_name is required")
+	}
+	if err := checkProjectRole(store, form.ProjectName, form.RoleName); err != nil {
+		return 0, err
+	}
+	grant, err := findProjectResource(store, form)
+	if err != nil {
+		return 0, err
+	}
+	// 与UserUpdate一致，为空的字段不修改
+	rows, err := store.Resources().Update(grant.ID, version, form.ProjectName, form.RoleName)
+	if err == gorm.ErrEntityConflict {
+		return 0, conflictError(form.ResourceName)
+	} else if err != nil {
+		return 0, err
+	}
+	if rows == 0 {
+		return 0, errno.New(errno.ErrProjectResourceNotFound, nil).Addf("[%s]", form.ResourceName)
+	}
+	return rows, nil
+}
+
+// checkProjectRole 检查不为空的组和角色是否存在
+func checkProjectRole(store gorm.EntityStore, project, role string) error {
+	if project != "" {
+		if found, err := store.Projects().Exists(project); err != nil || !found {
+			return errno.New(errno.ErrProjectNotFound, err).Addf("[%s]", project)
+		}
+	}
+	if role != "" {
+		if found, err := store.Roles().Exists(role); err != nil || !found {
+			return errno.New(errno.ErrRoleNotFound, err).Addf("[%s]", role)
+		}
+	}
+	return nil
+}
+
+// findProjectResource 返回form要修改的资源授权
+func findProjectResource(store gorm.EntityStore, form UpdatedProjectResourceForm) (model.ProjectResources, error) {
+	query := gorm.ResourceQuery{Router: form.ResourceName}
+	switch {
+	case form.ID != 0:
+		query.ID = form.ID
+	case form.OldProjectName != "" || form.OldRoleName != "":
+		if form.OldProjectName == "" || form.OldRoleName == "" {
+			return model.ProjectResources{}, errno.New(errno.ErrValidation, nil).Add("old_project_name and old_role_name are both required")
+		}
+		query.Project, query.Role = form.OldProjectName, form.OldRoleName
+	}
+	grants, err := store.Resources().Find(query)
+	if err != nil {
+		return model.ProjectResources{}, err
+	}
+	switch len(grants) {
+	case 0:
+		return model.ProjectResources{}, errno.New(errno.ErrProjectResourceNotFound, nil).Addf("[%s]", form.ResourceName)
+	case 1:
+		return grants[0], nil
+	default:
+		return model.ProjectResources{}, errno.New(errno.ErrValidation, nil).Addf("%s is granted several times, id or old_project_name and old_role_name is required", form.ResourceName)
+	}
 }
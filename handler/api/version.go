@@ -0,0 +1,65 @@
+package api
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gopa/gorm"
+	h "gopa/handler"
+	"gopa/pkg/errno"
+)
+
+// expectedVersion 返回修改请求要求的版本。请求头If-Match优先于表单中的version，
+// 都没有或If-Match为*时返回gorm.AnyVersion，表示不检查版本。
+// 表单中的version为0即没有填写；If-Match可以为"0"，对应没有版本的旧记录
+func expectedVersion(context *gin.Context, version int64) (int64, error) {
+	match := strings.TrimSpace(context.GetHeader("If-Match"))
+	if match == "*" {
+		return gorm.AnyVersion, nil
+	}
+	if match == "" {
+		return formVersion(version)
+	}
+	parsed, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(match, "W/"), `"`), 10, 64)
+	if err != nil || parsed < 0 {
+		return 0, errno.New(errno.ErrValidation, err).Addf("invalid If-Match %s", match)
+	}
+	return parsed, nil
+}
+
+// formVersion 返回表单中的version要求的版本，为0时返回gorm.AnyVersion
+func formVersion(version int64) (int64, error) {
+	if version < 0 {
+		return 0, errno.New(errno.ErrValidation, nil).Addf("invalid version %d", version)
+	}
+	if version == 0 {
+		return gorm.AnyVersion, nil
+	}
+	return version, nil
+}
+
+// setETag 在返回单个实体的响应中以ETag返回它的版本，修改时可以原样放在If-Match中
+func setETag(context *gin.Context, version int64) {
+	context.Header("ETag", `"`+strconv.FormatInt(version, 10)+`"`)
+}
+
+// conflictError 返回target的版本冲突
+func conflictError(target string) error {
+	return errno.New(errno.ErrVersionConflict, nil).Addf("[%s]", target)
+}
+
+// isVersionConflict 判断err是否为版本冲突
+func isVersionConflict(err error) bool {
+	code, _ := errno.DecodeErr(err)
+	return code == errno.ErrVersionConflict.Code
+}
+
+// sendWriteError 返回修改失败的错误，版本冲突时为409
+func sendWriteError(context *gin.Context, err error) {
+	if isVersionConflict(err) {
+		h.SendResponse409(context, err, nil)
+		return
+	}
+	h.SendResponse400(context, err, nil)
+}
@@ -0,0 +1,225 @@
+package api
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopa/gorm"
+	h "gopa/handler"
+	"gopa/model"
+	"gopa/pkg/errno"
+	"gopa/service"
+)
+
+// WebhookAddForm 注册webhook订阅时的结构体
+// Events为逗号分隔的事件类型，如project.created,rego.*，*表示全部事件
+type WebhookAddForm struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+	Events string `json:"events"`
+}
+
+// WebhookDeleteForm 删除webhook订阅时的结构体
+type WebhookDeleteForm struct {
+	ID uint64 `json:"id"`
+}
+
+// WebhookRedeliverForm 重新投递某条记录时的结构体
+type WebhookRedeliverForm struct {
+	ID uint64 `json:"id"`
+}
+
+// Webhook webhook订阅的返回结构体，不返回secret
+type Webhook struct {
+	ID        uint64    `json:"id"`
+	URL       string    `json:"url"`
+	Events    string    `json:"events"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName 结构体映射表名称
+func (Webhook) TableName() string {
+	return model.Table("gopa_webhooks")
+}
+
+// WebhookDelivery 投递记录的返回结构体
+type WebhookDelivery struct {
+	ID           uint64     `json:"id"`
+	WebhookID    uint64     `json:"webhook_id"`
+	Event        string     `json:"event"`
+	Payload      string     `json:"payload"`
+	Status       string     `json:"status"`
+	Attempts     int        `json:"attempts"`
+	ResponseCode int        `json:"response_code"`
+	LastError    string     `json:"last_error"`
+	DeliveredAt  *time.Time `json:"delivered_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// TableName 结构体映射表名称
+func (WebhookDelivery) TableName() string {
+	return model.Table("gopa_webhook_deliveries")
+}
+
+// WebhookAdd 		api
+// @Summary          WebhookAdd
+// @Description    Register a webhook. Events are signed with HMAC-SHA256 of the secret in the X-Gopa-Signature header.
+// @Tags               webhook
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project  header            string                    true  "Project"
+// @Param            role     header            string                    true  "Role"
+// @Param                     form              body        WebhookAddForm  true  "form"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Router                    /api/v1/webhook/add [post]
+func WebhookAdd(context *gin.Context) {
+	var form WebhookAddForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	if form.URL == "" || form.Secret == "" {
+		h.SendResponse400(context, errno.New(errno.ErrValidation, nil).Add("url and secret are required"), nil)
+		return
+	}
+	if form.Events == "" {
+		form.Events = "*"
+	}
+	hook := model.GopaWebhooks{
+		URL:     form.URL,
+		Secret:  form.Secret,
+		Events:  form.Events,
+		Enabled: true,
+	}
+	res := gorm.DB.Self.Create(&hook)
+	if res.Error != nil {
+		h.SendResponse400(context, res.Error, nil)
+		return
+	}
+	h.SendResponse(context, nil, hook.ID)
+}
+
+// WebhookList 		api
+// @Summary          WebhookList
+// @Description    List registered webhooks.
+// @Tags               webhook
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project            header    string    true  "Project"
+// @Param            role               header    string    true  "Role"
+// @Success          200      {object}  handler.Response
+// @Failure          400      {object}  handler.Response
+// @Router                    /api/v1/webhook/list [get]
+func WebhookList(context *gin.Context) {
+	var data []Webhook
+	res := gorm.DB.Self.Find(&data)
+	if res.Error != nil {
+		h.SendResponse400(context, res.Error, nil)
+		return
+	}
+	h.SendResponse(context, errno.OK, data)
+}
+
+// WebhookDelete 	api
+// @Summary          WebhookDelete
+// @Description    Delete a webhook. Its delivery history is kept.
+// @Tags               webhook
+// @Accept           application/json
+// @Produce          application/json
+// @Security         Token
+// @Param            project  header            string                       true  "Project"
+// @Param            role     header            string                       true  "Role"
+// @Param                     form              body        WebhookDeleteForm  true  "form"
+// @Success          200              {object}          handler.Response
+// @Failure          400              {object}          handler.Response
+// @Router                    /api/v1/webhook/delete [post]
+func WebhookDelete(context *gin.Context) {
+	var form WebhookDeleteForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	res := gorm.DB.Self.Unscoped().Delete(&model.GopaWebhooks{}, form.ID)
+	if res.Error != nil {
+		h.SendResponse400(context, res.Error, nil)
+		return
+	}
+	h.SendResponse(context, nil, res.RowsAffected)
+}
+
+// WebhookDeliveryList 	api
+// @Summary              WebhookDeliveryList
+// @Description        Return the delivery history. Deliveries with status dead form the dead-letter list.
+// @Tags                   webhook
+// @Accept               application/json
+// @Produce              application/json
+// @Security             Token
+// @Param                project            header    string    true   "Project"
+// @Param                role               header    string    true   "Role"
+// @Param                webhook_id         query     int       false  "only return deliveries of this webhook"
+// @Param                status             query     string    false  "pending, delivered or dead"
+// @Success              200      {object}  handler.Response
+// @Failure              400      {object}  handler.Response
+// @Router                        /api/v1/webhook/deliveries [get]
+func WebhookDeliveryList(context *gin.Context) {
+	var data []WebhookDelivery
+	db := gorm.DB.Self
+	if id, ok := context.GetQuery("webhook_id"); ok {
+		db = db.Where("webhook_id = ?", id)
+	}
+	if status, ok := context.GetQuery("status"); ok {
+		db = db.Where("status = ?", status)
+	}
+	res := db.Order("id desc").Find(&data)
+	if res.Error != nil {
+		h.SendResponse400(context, res.Error, nil)
+		return
+	}
+	h.SendResponse(context, errno.OK, data)
+}
+
+// WebhookRedeliver 	api
+// @Summary           WebhookRedeliver
+// @Description     Deliver a recorded event again, typically one from the dead-letter list.
+// @Tags                webhook
+// @Accept            application/json
+// @Produce           application/json
+// @Security          Token
+// @Param             project  header            string                          true  "Project"
+// @Param             role     header            string                          true  "Role"
+// @Param                      form              body        WebhookRedeliverForm  true  "form"
+// @Success           200              {object}          handler.Response
+// @Failure           400              {object}          handler.Response
+// @Router                     /api/v1/webhook/redeliver [post]
+func WebhookRedeliver(context *gin.Context) {
+	var form WebhookRedeliverForm
+	if err := context.BindJSON(&form); err != nil {
+		h.SendResponse400(context, err, nil)
+		return
+	}
+	db := gorm.DB.Self
+	var delivery model.GopaWebhookDeliveries
+	if res := db.First(&delivery, form.ID); res.Error != nil {
+		h.SendResponse400(context, errno.New(errno.ErrDeliveryNotFound, res.Error), nil)
+		return
+	}
+	var hook model.GopaWebhooks
+	if res := db.First(&hook, delivery.WebhookID); res.Error != nil {
+		h.SendResponse400(context, errno.New(errno.ErrWebhookNotFound, res.Error), nil)
+		return
+	}
+	delivery.Status = model.DeliveryPending
+	delivery.Attempts = 0
+	res := db.Model(&model.GopaWebhookDeliveries{}).Where("id = ?", delivery.ID).
+		Updates(map[string]interface{}{"status": delivery.Status, "attempts": 0})
+	if res.Error != nil {
+		h.SendResponse400(context, res.Error, nil)
+		return
+	}
+	go service.Deliver(hook, delivery)
+	h.SendResponse(context, nil, delivery.ID)
+}
@@ -45,4 +45,14 @@ func SendResponse403(c *gin.Context, err error, data interface{}) {
 		Message: message,
 		Data:    data,
 	})
-}
\ No newline at end of file
+}
+
+func SendResponse409(c *gin.Context, err error, data interface{}) {
+	code, message := errno.DecodeErr(err)
+
+	c.JSON(http.StatusConflict, Response{
+		Code:    code,
+		Message: message,
+		Data:    data,
+	})
+}
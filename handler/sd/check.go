@@ -1,10 +1,14 @@
 package sd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
+	"gopa/config"
+	"gopa/gorm"
 	v "gopa/pkg/version"
 
 	"github.com/gin-gonic/gin"
@@ -34,7 +38,7 @@ func HealthCheck(c *gin.Context) {
 
 }
 
-//VersionCheck show the version info as Running status
+// VersionCheck show the version info as Running status
 // @Summary      VersionCheck show the version info as Running status
 // @Description  versionCheck
 // @Tags         sd
@@ -49,7 +53,7 @@ func VersionCheck(c *gin.Context) {
 	c.String(http.StatusOK, "\n"+string(marshalled))
 }
 
-//DiskCheck checks the disk usage.
+// DiskCheck checks the disk usage.
 // @Summary      DiskCheck checks the disk usage.
 // @Description  DiskCheck
 // @Tags         sd
@@ -81,7 +85,7 @@ func DiskCheck(c *gin.Context) {
 	c.String(status, "\n"+message)
 }
 
-//CPUCheck checks the cpu usage.
+// CPUCheck checks the cpu usage.
 // @Summary      CPUCheck checks the cpu usage.
 // @Description  CPUCheck
 // @Tags         sd
@@ -112,7 +116,7 @@ func CPUCheck(c *gin.Context) {
 	c.String(status, "\n"+message)
 }
 
-//RAMCheck checks the disk usage.
+// RAMCheck checks the disk usage.
 // @Summary      RAMCheck checks the disk usage.
 // @Description  RAMCheck
 // @Tags         sd
@@ -143,3 +147,61 @@ func RAMCheck(c *gin.Context) {
 	message := fmt.Sprintf("%s - Free space: %dMB (%dGB) / %dMB (%dGB) | Used: %d%%", text, usedMB, usedGB, totalMB, totalGB, usedPercent)
 	c.String(status, "\n"+message)
 }
+
+// ConfigCheck shows the active configuration with passwords and secrets redacted.
+// @Summary      ConfigCheck shows the active configuration.
+// @Description  ConfigCheck shows the active configuration with secrets redacted, when and where it was loaded, and the changed sections that need a restart. Only administrators allowed by the policy of /gopa/admin may read it.
+// @Tags         sd
+// @Produce      json
+// @Security     Token
+// @Success      200  {object}  handler.Response
+// @Failure      401  {object}  handler.Response
+// @Failure      403  {object}  handler.Response
+// @Router       /sd/config [get]
+func ConfigCheck(c *gin.Context) {
+	loadedAt, source := config.LoadedAt()
+	c.JSON(http.StatusOK, gin.H{
+		"source":          source,
+		"loaded_at":       loadedAt,
+		"pending_restart": config.PendingRestart(),
+		"config":          config.Redacted(config.GetConfig()),
+	})
+}
+
+// DBCheck pings the relational database and shows its connection pool statistics.
+// @Summary      DBCheck shows the database connection pool statistics.
+// @Description  DBCheck pings the relational database and shows the pool limits, open, in-use and idle connections, and how often callers waited for a connection. Only administrators allowed by the policy of /gopa/admin may read it.
+// @Tags         sd
+// @Produce      json
+// @Security     Token
+// @Success      200  {object}  handler.Response
+// @Failure      401  {object}  handler.Response
+// @Failure      403  {object}  handler.Response
+// @Router       /sd/db [get]
+func DBCheck(c *gin.Context) {
+	sqlDB, err := gorm.DB.Self.DB()
+	if err != nil {
+		c.String(http.StatusInternalServerError, "\nCRITICAL - "+err.Error())
+		return
+	}
+	status, text := http.StatusOK, "OK"
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+	if err := sqlDB.PingContext(ctx); err != nil {
+		status, text = http.StatusInternalServerError, "CRITICAL - "+err.Error()
+	}
+	stats := sqlDB.Stats()
+	c.JSON(status, gin.H{
+		"status":               text,
+		"table_prefix":         config.GetConfig().Gorm.TablePrefix,
+		"max_open_connections": stats.MaxOpenConnections,
+		"open_connections":     stats.OpenConnections,
+		"in_use":               stats.InUse,
+		"idle":                 stats.Idle,
+		"wait_count":           stats.WaitCount,
+		"wait_duration":        stats.WaitDuration.String(),
+		"max_idle_closed":      stats.MaxIdleClosed,
+		"max_idle_time_closed": stats.MaxIdleTimeClosed,
+		"max_lifetime_closed":  stats.MaxLifetimeClosed,
+	})
+}
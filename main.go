@@ -1,16 +1,27 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"gopa/config"
+	"gopa/gorm"
+	"gopa/model"
+	"gopa/pkg/ldap"
 	log "gopa/pkg/logger"
+	"gopa/pkg/migrate"
+	"gopa/pkg/notify"
+	"gopa/pkg/secretbox"
+	"gopa/pkg/token"
 	v "gopa/pkg/version"
 	"gopa/router"
 	"gopa/router/middleware"
+	"gopa/service"
 	"net/http"
 	"os"
+	"reflect"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -38,6 +49,119 @@ func pingServer() error {
 	return errors.New("Cannot connect to the router.\n")
 }
 
+// reloadConfig 重新初始化配置有变化的模块。token、登录限制和数据库等
+// 只在启动时读取配置的模块不在此处理，修改后需要重启
+func reloadConfig(old, next *model.SysConfig) {
+	if !reflect.DeepEqual(old.Log, next.Log) {
+		// SetLog在目录不可用时会退出进程，先检查目录
+		if err := os.MkdirAll(next.Log.Dir, os.ModePerm); err != nil {
+			log.RuntimeEmit("config.Reload", "", err.Error(), false)
+		} else if err := log.SetLog(); err != nil {
+			log.RuntimeEmit("config.Reload", "", err.Error(), false)
+		}
+	}
+	if !reflect.DeepEqual(old.LdapClient, next.LdapClient) {
+		ldap.Init(next.LdapClient)
+	}
+	if !reflect.DeepEqual(old.Notify, next.Notify) {
+		notify.Init(next.Notify)
+	}
+}
+
+// copyRegos 把MongoDB中的rego文件复制到关系数据库的rego_documents表，
+// 复制完成后可以把opa.regoStore改为database。已存在的路径不会覆盖
+func copyRegos() error {
+	if err := config.SetConfig(); err != nil {
+		return err
+	}
+	conf := config.GetConfig()
+	if conf.Mongo.Address == "" {
+		return errors.New("mongo.address is required to copy rego documents")
+	}
+	db, err := gorm.NewGormDB(conf)
+	if err != nil {
+		return err
+	}
+	if !db.Migrator().HasTable(&model.RegoDocuments{}) {
+		return fmt.Errorf("table %s does not exist, run the migrate up command first", model.Table("rego_documents"))
+	}
+	client, err := gorm.NewMongoDB(conf.Mongo.Address)
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+	copied, skipped, err := service.CopyRegos(gorm.NewMongoRegoStore(client), gorm.SQLRegoStore{DB: db})
+	fmt.Printf("Copied %d rego documents, skipped %d existing paths.\n", copied, skipped)
+	return err
+}
+
+// runMigrate 执行数据库迁移：
+//
+//	migrate status          列出全部迁移及执行时间
+//	migrate up [version]    执行到version为止的未执行的迁移，未指定时执行全部
+//	migrate down [steps]    撤销最近执行的steps个迁移，默认为1个
+func runMigrate(args []string) error {
+	if err := config.SetConfig(); err != nil {
+		return err
+	}
+	db, err := gorm.NewGormDB(config.GetConfig())
+	if err != nil {
+		return err
+	}
+	migrator, err := gorm.NewMigrator(db)
+	if err != nil {
+		return err
+	}
+	action, arg := "status", ""
+	if len(args) > 0 {
+		action = args[0]
+	}
+	if len(args) > 1 {
+		arg = args[1]
+	}
+	var done []migrate.Migration
+	switch action {
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-24s %s\n", status.Version, status.Name, applied)
+		}
+		return nil
+	case "up":
+		var target int64
+		if arg != "" {
+			if target, err = strconv.ParseInt(arg, 10, 64); err != nil {
+				return fmt.Errorf("invalid version %q", arg)
+			}
+		}
+		done, err = migrator.Up(target)
+	case "down":
+		steps := 1
+		if arg != "" {
+			if steps, err = strconv.Atoi(arg); err != nil || steps <= 0 {
+				return fmt.Errorf("invalid steps %q", arg)
+			}
+		}
+		done, err = migrator.Down(steps)
+	default:
+		return fmt.Errorf("unknown migrate action %q, want status, up or down", action)
+	}
+	for _, migration := range done {
+		fmt.Printf("%s %d %s\n", action, migration.Version, migration.Name)
+	}
+	if err == nil && len(done) == 0 {
+		fmt.Println("Nothing to migrate.")
+	}
+	return err
+}
+
 // @title        Gopa-server Swagger Documentation
 // @version      1.0
 // @description  This is gopa-server. Use these APIs to manage different groups, roles of GOPA
@@ -60,6 +184,24 @@ func main() {
 		return
 	}
 
+	// 子命令执行完后退出，不启动服务
+	if command := pflag.Arg(0); command != "" {
+		var err error
+		switch command {
+		case "copy-regos":
+			err = copyRegos()
+		case "migrate":
+			err = runMigrate(pflag.Args()[1:])
+		default:
+			err = fmt.Errorf("unknown command %q", command)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if err := config.SetConfig(); err != nil {
 		panic(err)
 	}
@@ -68,11 +210,48 @@ func main() {
 		panic(err)
 	}
 
+	notify.Init(config.GetConfig().Notify)
+	ldap.Init(config.GetConfig().LdapClient)
+	// 配置文件或Apollo中的配置修改后，重新初始化可以热加载的模块
+	config.OnReload(reloadConfig)
+	if err := config.Watch(func(message string, success bool) {
+		log.RuntimeEmit("config.Watch", "", message, success)
+	}); err != nil {
+		log.RuntimeEmit("config.Watch", "", err.Error(), false)
+	}
+
 	gin.SetMode(config.GetConfig().Service.Runmode)
 	//g := gin.New() // Create the Gin engine.
 	g := router.InitEngine()
+	// token签名密钥，定期轮换
+	keyRotation := time.Duration(config.GetConfig().Service.JwtKeyRotation) * time.Second
+	var keyBox *secretbox.Box
+	if encryptionKey := config.GetConfig().Service.JwtKeyEncryptionKey; encryptionKey != "" {
+		box, err := secretbox.NewFromBase64(encryptionKey)
+		if err != nil {
+			panic(err)
+		}
+		keyBox = box
+	}
+	ring, err := service.InitSigningKeys(config.GetConfig().Service.JwtAlgorithm, keyRotation, keyBox)
+	if err != nil {
+		panic(err)
+	}
+	go service.SigningKeyRotator(ring, keyBox, keyRotation)
+	tokens := token.NewService(ring, token.Config{
+		Timeout:        time.Duration(config.GetConfig().Service.TokenTimeout) * time.Second,
+		RefreshTimeout: time.Duration(config.GetConfig().Service.RefreshTokenTimeout) * time.Second,
+	})
+	// 登录失败的限制，过期的失败记录随临时授权一起定期清理
+	limiter := service.NewLoginLimiter(config.GetConfig().Auth.Lockout)
+	go service.LockoutPruner(limiter, time.Duration(config.GetConfig().Service.GrantReapInterval)*time.Second)
 	// Routes.
-	router.Load(g, middleware.Logging(), middleware.RequestID())
+	router.Load(g, tokens, limiter, middleware.Logging(), middleware.RequestID())
+
+	// 定期清理过期的临时授权
+	go service.GrantReaper(time.Duration(config.GetConfig().Service.GrantReapInterval) * time.Second)
+	// 定期把LDAP的组同步为组内的授权
+	go service.LdapSyncer(time.Duration(config.GetConfig().LdapClient.Sync.Interval) * time.Second)
 
 	// HealthCheck: Ping the server to make sure the router is working.
 	go func() {
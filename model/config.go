@@ -8,19 +8,21 @@ type GormConfig struct {
 	MaxLifetime  int
 	MaxOpenConns int
 	MaxIdleConns int
-	//TablePrefix  string
+	TablePrefix  string
 }
 
 // SysConfig 读取config.yaml
 type SysConfig struct {
-	Service    SysService   `yaml:"service" mapstructure:"service"`
-	Log        Logger       `yaml:"log" mapstructure:"log"`
-	Gorm       GormService  `yaml:"gorm" mapstructure:"gorm"`
-	MySql      MySQL        `yaml:"mysql" mapstructure:"mysql"`
-	Opa        OpaService   `yaml:"opa" mapstructure:"opa"`
-	Mongo      MongoService `yaml:"mongo" mapstructure:"mongo"`
-	LdapClient LdapClient   `yaml:"ldapClient" mapstructure:"ldapClient"`
-
+	Service    SysService     `yaml:"service" mapstructure:"service"`
+	Log        Logger         `yaml:"log" mapstructure:"log"`
+	Gorm       GormService    `yaml:"gorm" mapstructure:"gorm"`
+	MySql      MySQL          `yaml:"mysql" mapstructure:"mysql"`
+	Opa        OpaService     `yaml:"opa" mapstructure:"opa"`
+	Mongo      MongoService   `yaml:"mongo" mapstructure:"mongo"`
+	LdapClient LdapClient     `yaml:"ldapClient" mapstructure:"ldapClient"`
+	Notify     NotifyService  `yaml:"notify" mapstructure:"notify"`
+	Webhook    WebhookService `yaml:"webhook" mapstructure:"webhook"`
+	Auth       AuthService    `yaml:"auth" mapstructure:"auth"`
 }
 
 type SysService struct {
@@ -30,15 +32,43 @@ type SysService struct {
 	Url          string `yaml:"url" mapstructure:"url"`
 	MaxPingCount int    `yaml:"maxPingCount" mapstructure:"maxPingCount"`
 	JwtSecret    string `yaml:"jwtSecret" mapstructure:"jwtSecret"`
+	// GrantReapInterval 清理过期临时授权的间隔，单位为秒
+	GrantReapInterval int `yaml:"grantReapInterval" mapstructure:"grantReapInterval"`
+	// JwtAlgorithm token的签名算法，RS256或ES256，默认为RS256
+	JwtAlgorithm string `yaml:"jwtAlgorithm" mapstructure:"jwtAlgorithm"`
+	// JwtKeyRotation 轮换签名密钥的间隔，单位为秒，默认为7天。
+	// 旧密钥在轮换后还会保留一个间隔用于校验已签发的token
+	JwtKeyRotation int `yaml:"jwtKeyRotation" mapstructure:"jwtKeyRotation"`
+	// JwtKeyEncryptionKey 加密保存在数据库中的签名私钥的base64编码的32字节密钥，
+	// 关系数据保存在内存中时可以不配置
+	JwtKeyEncryptionKey string `yaml:"jwtKeyEncryptionKey" mapstructure:"jwtKeyEncryptionKey"`
+	// TrustedProxies 可信的反向代理的IP或CIDR，如Kong网关。只有来自这些地址的请求
+	// 才使用X-Forwarded-For判断来源IP，未配置时使用直接连接的地址
+	TrustedProxies []string `yaml:"trustedProxies" mapstructure:"trustedProxies"`
+	// TokenTimeout 登录签发的token的有效期，单位为秒，默认为1小时
+	TokenTimeout int `yaml:"tokenTimeout" mapstructure:"tokenTimeout"`
+	// RefreshTokenTimeout 刷新token的有效期，单位为秒，默认为7天。
+	// 每次刷新后重新计算，超过该时间未刷新需要重新登录
+	RefreshTokenTimeout int `yaml:"refreshTokenTimeout" mapstructure:"refreshTokenTimeout"`
 }
 
 // GormService Gorm配置信息
 type GormService struct {
-	Debug             bool   `yaml:"debug" mapstructure:"debug"`
-	DBType            string `yaml:"dbType" mapstructure:"dbType"`
-	MaxLifetime       int    `yaml:"maxLifetime" mapstructure:"maxLifetime"`
-	MaxOpenConns      int    `yaml:"maxOpenConns" mapstructure:"maxOpenConns"`
-	MaxIdleConns      int    `yaml:"maxIdleConns" mapstructure:"maxIdleConns"`
+	Debug bool `yaml:"debug" mapstructure:"debug"`
+	// DBType 关系数据的存储方式，可选mysql、sqlite和memory，默认为mysql。
+	// sqlite保存在SQLitePath指定的文件中，memory只保存在内存中，重启后丢失
+	DBType     string `yaml:"dbType" mapstructure:"dbType"`
+	SQLitePath string `yaml:"sqlitePath" mapstructure:"sqlitePath"`
+	// EntityStore 组、角色、成员和资源授权的存储方式，可选database和memory。
+	// database保存在DBType指定的关系数据库中，memory只保存在内存中，其他表仍然使用DBType。
+	// DBType为memory时默认为memory，否则默认为database
+	EntityStore string `yaml:"entityStore" mapstructure:"entityStore"`
+	// MaxLifetime 连接最长使用的秒数，MaxOpenConns和MaxIdleConns为最大连接数和最大空闲连接数，
+	// 为0时使用database/sql的默认值。SQLite和内存数据库只使用一个连接，忽略这三项
+	MaxLifetime  int `yaml:"maxLifetime" mapstructure:"maxLifetime"`
+	MaxOpenConns int `yaml:"maxOpenConns" mapstructure:"maxOpenConns"`
+	MaxIdleConns int `yaml:"maxIdleConns" mapstructure:"maxIdleConns"`
+	// TablePrefix 全部GOPA表名的前缀，与其他服务共用数据库时使用，如gopa_prod_
 	TablePrefix       string `yaml:"tablePrefix" mapstructure:"tablePrefix"`
 	EnableAutoMigrate bool   `yaml:"enableAutoMigrate" mapstructure:"enableAutoMigrate"`
 }
@@ -61,6 +91,10 @@ type Logger struct {
 // OpaService 读取OPA部署的配置信息
 type OpaService struct {
 	WatchDirectory string `yaml:"watchDirectory" mapstructure:"watchDirectory"`
+	// RegoStore rego文件的存储方式，可选mongo、memory和database，
+	// database保存在gorm.dbType指定的关系数据库中。
+	// gorm.dbType为memory时默认为memory，否则默认为mongo
+	RegoStore string `yaml:"regoStore" mapstructure:"regoStore"`
 }
 
 type MongoService struct {
@@ -73,7 +107,7 @@ func (a MySQL) DSN() string {
 		a.User, a.Password, a.Host, a.Port, a.DBName, a.Parameters)
 }
 
-//LdapClient configuration
+// LdapClient configuration
 type LdapClient struct {
 	Base             string   `yaml:"base" mapstructure:"base"`
 	Host             string   `yaml:"host" mapstructure:"host"`
@@ -88,4 +122,119 @@ type LdapClient struct {
 	ServerName       string   `yaml:"serverName" mapstructure:"serverName"`
 	SyncInitPassword string   `yaml:"syncInitPassword" mapstructure:"syncInitPassword"`
 	SyncInitRoleID   string   `yaml:"syncInitRoleID" mapstructure:"syncInitRoleID"`
+	// MaxConns 连接池中最多同时打开的连接数
+	MaxConns int `yaml:"maxConns" mapstructure:"maxConns"`
+	// Timeout 建立连接、等待空闲连接以及单次请求的超时秒数
+	Timeout int `yaml:"timeout" mapstructure:"timeout"`
+	// HealthCheckInterval 空闲超过该秒数的连接在复用前会先做健康检查
+	HealthCheckInterval int      `yaml:"healthCheckInterval" mapstructure:"healthCheckInterval"`
+	Sync                LdapSync `yaml:"sync" mapstructure:"sync"`
+}
+
+// LdapSync 把LDAP的组同步为GOPA的组和角色的配置。
+// 用户所属的LDAP组通过LdapClient.GroupFilter查询
+type LdapSync struct {
+	// Interval 定时同步的间隔秒数，为0时只能通过API手动同步
+	Interval int `yaml:"interval" mapstructure:"interval"`
+	// UserSearchFilter 查询全部LDAP用户的过滤条件，如(objectClass=person)
+	UserSearchFilter string `yaml:"userSearchFilter" mapstructure:"userSearchFilter"`
+	// UsernameAttribute 用户名对应的属性，默认为uid
+	UsernameAttribute string `yaml:"usernameAttribute" mapstructure:"usernameAttribute"`
+	// GroupAttribute 组名对应的属性，默认为cn
+	GroupAttribute string             `yaml:"groupAttribute" mapstructure:"groupAttribute"`
+	Mappings       []LdapGroupMapping `yaml:"mappings" mapstructure:"mappings"`
+}
+
+// LdapGroupMapping LDAP组Group的成员在GOPA中属于Project组，角色为Role
+type LdapGroupMapping struct {
+	Group   string `yaml:"group" mapstructure:"group"`
+	Project string `yaml:"project" mapstructure:"project"`
+	Role    string `yaml:"role" mapstructure:"role"`
+}
+
+// AuthService 登录认证配置
+type AuthService struct {
+	// Providers 用户名密码登录时依次尝试的认证方式，可选ldap和local，
+	// 未配置时只使用ldap
+	Providers []string     `yaml:"providers" mapstructure:"providers"`
+	OIDC      OIDCProvider `yaml:"oidc" mapstructure:"oidc"`
+	Lockout   LoginLockout `yaml:"lockout" mapstructure:"lockout"`
+	MFA       MFAService   `yaml:"mfa" mapstructure:"mfa"`
+	// AdminProjects 在这些组中拥有admin角色的用户可以执行管理操作，默认为admin。
+	// 在/gopa/admin配置策略后以策略为准
+	AdminProjects []string `yaml:"adminProjects" mapstructure:"adminProjects"`
+}
+
+// MFAService TOTP两步验证的配置
+type MFAService struct {
+	// Issuer 身份验证器应用中显示的名称，默认为GOPA
+	Issuer string `yaml:"issuer" mapstructure:"issuer"`
+	// EncryptionKey 加密TOTP密钥的base64编码的32字节密钥，未配置时不能绑定两步验证
+	EncryptionKey string `yaml:"encryptionKey" mapstructure:"encryptionKey"`
+}
+
+// LoginLockout 连续登录失败的限制，时间的单位均为秒
+type LoginLockout struct {
+	// Store 失败记录保存的位置，memory只在本实例内有效，
+	// database保存在数据库中由多个实例共用，默认为memory
+	Store string `yaml:"store" mapstructure:"store"`
+	// MaxFailures 同一用户名连续失败多少次后锁定，默认为10
+	MaxFailures int `yaml:"maxFailures" mapstructure:"maxFailures"`
+	// IPMaxFailures 同一IP连续失败多少次后锁定，默认为100
+	IPMaxFailures int `yaml:"ipMaxFailures" mapstructure:"ipMaxFailures"`
+	// BaseDelay 失败后需要等待的时间，每次失败翻倍，默认为1秒，最多为MaxDelay，默认为60秒
+	BaseDelay int `yaml:"baseDelay" mapstructure:"baseDelay"`
+	MaxDelay  int `yaml:"maxDelay" mapstructure:"maxDelay"`
+	// Duration 锁定的时间，默认为15分钟
+	Duration int `yaml:"duration" mapstructure:"duration"`
+}
+
+// OIDCProvider OIDC授权码登录的配置
+type OIDCProvider struct {
+	Enabled bool `yaml:"enabled" mapstructure:"enabled"`
+	// Issuer 签发方地址，从 <Issuer>/.well-known/openid-configuration 读取各个端点
+	Issuer       string   `yaml:"issuer" mapstructure:"issuer"`
+	ClientID     string   `yaml:"clientId" mapstructure:"clientId"`
+	ClientSecret string   `yaml:"clientSecret" mapstructure:"clientSecret"`
+	RedirectURL  string   `yaml:"redirectUrl" mapstructure:"redirectUrl"`
+	Scopes       []string `yaml:"scopes" mapstructure:"scopes"`
+	// UsernameClaim 作为GOPA用户名的claim，默认为preferred_username
+	UsernameClaim string `yaml:"usernameClaim" mapstructure:"usernameClaim"`
+}
+
+// NotifyService 权限变更等事件的通知配置
+type NotifyService struct {
+	Slack SlackNotify `yaml:"slack" mapstructure:"slack"`
+}
+
+// SlackNotify Slack通知配置。WebhookURL和BotToken二选一，
+// 同时配置时优先使用WebhookURL
+type SlackNotify struct {
+	Enabled    bool   `yaml:"enabled" mapstructure:"enabled"`
+	WebhookURL string `yaml:"webhookUrl" mapstructure:"webhookUrl"`
+	BotToken   string `yaml:"botToken" mapstructure:"botToken"`
+	Channel    string `yaml:"channel" mapstructure:"channel"`
+	// APIURL 为空时使用Slack官方地址，用于代理或测试
+	APIURL string `yaml:"apiUrl" mapstructure:"apiUrl"`
+	// PrivilegedRoutes 路由前缀，这些路由上被拒绝的鉴权会发送通知
+	PrivilegedRoutes []string     `yaml:"privilegedRoutes" mapstructure:"privilegedRoutes"`
+	Routes           []SlackRoute `yaml:"routes" mapstructure:"routes"`
+}
+
+// SlackRoute 按组把通知发送到不同的频道或webhook，
+// Project为*时匹配所有组
+type SlackRoute struct {
+	Project    string `yaml:"project" mapstructure:"project"`
+	Channel    string `yaml:"channel" mapstructure:"channel"`
+	WebhookURL string `yaml:"webhookUrl" mapstructure:"webhookUrl"`
+}
+
+// WebhookService webhook投递配置
+type WebhookService struct {
+	// MaxAttempts 最大投递次数，超过后进入死信
+	MaxAttempts int `yaml:"maxAttempts" mapstructure:"maxAttempts"`
+	// Backoff 第一次重试前等待的秒数，之后每次翻倍
+	Backoff int `yaml:"backoff" mapstructure:"backoff"`
+	// Timeout 单次投递的超时秒数
+	Timeout int `yaml:"timeout" mapstructure:"timeout"`
 }
@@ -5,6 +5,14 @@ import (
 	"time"
 )
 
+// TablePrefix 全部GOPA表名的前缀，连接数据库前按gorm.tablePrefix设置，运行期间不能修改
+var TablePrefix string
+
+// Table 返回加上TablePrefix的表名，各结构体的TableName都通过它返回表名
+func Table(name string) string {
+	return TablePrefix + name
+}
+
 // BaseModel config
 type BaseModel struct {
 	ID        uint64
@@ -13,35 +21,79 @@ type BaseModel struct {
 	DeletedAt gorm.DeletedAt
 }
 
+// GopaProjects 组，ParentProject为空时是顶层组
+// MfaRequired 为true时组内的用户登录需要两步验证
 type GopaProjects struct {
 	BaseModel
-	ProjectName string
+	ProjectName   string `gorm:"size:191"`
+	ParentProject string
+	MfaRequired   bool
+	Version       int64 `gorm:"not null;default:1"`
 }
 
+// GopaRoles 角色，MfaRequired为true时拥有该角色的用户登录需要两步验证
 type GopaRoles struct {
 	BaseModel
-	RoleName string
+	RoleName    string `gorm:"size:191"`
+	MfaRequired bool
+	Version     int64 `gorm:"not null;default:1"`
+}
+
+// GopaRoleParents 角色继承关系，RoleName继承ParentRoleName的全部权限
+type GopaRoleParents struct {
+	BaseModel
+	RoleName       string
+	ParentRoleName string
 }
 
 type GopaProjectRoles struct {
 	BaseModel
 	ProjectName string
 	RoleName    string
+	Version     int64 `gorm:"not null;default:1"`
 }
 
+// GopaMembers 用户在某个组内的角色。ValidFrom和ExpiresAt为空时
+// 该授权一直有效，否则只在[ValidFrom, ExpiresAt)内有效。
+// Source为ldap的授权由LDAP同步维护，Disabled的授权不生效。
+// 各实体的Version在每次修改后加一，用于检查并发修改
 type GopaMembers struct {
 	BaseModel
-	Username string
+	Username  string `gorm:"size:191"`
+	Project   string `gorm:"size:191"`
+	Role      string `gorm:"size:191"`
+	ValidFrom *time.Time
+	ExpiresAt *time.Time
+	Source    string
+	Disabled  bool
+	Version   int64 `gorm:"not null;default:1"`
+}
+
+// MemberSourceLdap 由LDAP同步创建的授权
+const MemberSourceLdap = "ldap"
+
+// GopaCredentials 用户的登录凭据，每个用户一条，与用户在哪些组内有授权无关。
+// Provider为local时Password是local认证方式使用的bcrypt哈希；
+// 通过OIDC登录过的用户记录一条Provider为oidc、没有密码的凭据，之后不能再设置本地密码
+type GopaCredentials struct {
+	BaseModel
+	Username string `gorm:"size:191"`
+	Provider string
 	Password string
-	Project  string
-	Role     string
 }
 
+// 凭据的Provider
+const (
+	CredentialLocal = "local"
+	CredentialOIDC  = "oidc"
+)
+
 type GopaApplication struct {
 	BaseModel
 	ResourceName string
 	Address      string
 	Routers      string
+	Version      int64 `gorm:"not null;default:1"`
 }
 
 type ProjectResources struct {
@@ -51,25 +103,117 @@ type ProjectResources struct {
 
 // TableName 结构体映射表名称
 func (GopaProjects) TableName() string {
-	return "gopa_projects"
+	return Table("gopa_projects")
 }
 
 // TableName 结构体映射表名称
 func (GopaRoles) TableName() string {
-	return "gopa_roles"
+	return Table("gopa_roles")
+}
+
+// TableName 结构体映射表名称
+func (GopaRoleParents) TableName() string {
+	return Table("gopa_role_parents")
 }
 
 // TableName 结构体映射表名称
 func (GopaProjectRoles) TableName() string {
-	return "gopa_project_roles"
+	return Table("gopa_project_roles")
 }
 
 // TableName 结构体映射表名称
 func (GopaMembers) TableName() string {
-	return "gopa_members"
+	return Table("gopa_members")
+}
+
+// TableName 结构体映射表名称
+func (GopaCredentials) TableName() string {
+	return Table("gopa_credentials")
+}
+
+// GopaAuditLogs 审计日志，记录谁在什么时候对什么做了什么
+type GopaAuditLogs struct {
+	BaseModel
+	Actor  string
+	Action string
+	Target string
+	Detail string
+}
+
+// TableName 结构体映射表名称
+func (GopaAuditLogs) TableName() string {
+	return Table("gopa_audit_logs")
+}
+
+// 访问申请的状态
+const (
+	AccessRequestPending  = "pending"
+	AccessRequestApproved = "approved"
+	AccessRequestDenied   = "denied"
+)
+
+// GopaAccessRequests 用户申请加入某个组并获得某个角色的记录
+type GopaAccessRequests struct {
+	BaseModel
+	Username      string
+	Project       string
+	Role          string
+	Justification string
+	ExpiresAt     *time.Time
+	Status        string
+	Reviewer      string
+	ReviewComment string
+	ReviewedAt    *time.Time
+}
+
+// TableName 结构体映射表名称
+func (GopaAccessRequests) TableName() string {
+	return Table("gopa_access_requests")
+}
+
+// 投递状态
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// GopaWebhooks 外部系统注册的webhook订阅。Events为逗号分隔的事件类型，
+// 如project.created,rego.updated，*表示订阅全部事件
+type GopaWebhooks struct {
+	BaseModel
+	URL     string
+	Secret  string
+	Events  string
+	Enabled bool
+}
+
+// GopaWebhookDeliveries 每一次事件投递的记录，超过最大重试次数仍失败的
+// 投递状态为dead，即死信
+type GopaWebhookDeliveries struct {
+	BaseModel
+	WebhookID    uint64
+	Event        string
+	Payload      string
+	Status       string
+	Attempts     int
+	ResponseCode int
+	LastError    string
+	DeliveredAt  *time.Time
+}
+
+// TableName 结构体映射表名称
+func (GopaWebhooks) TableName() string {
+	return Table("gopa_webhooks")
+}
+
+// TableName 结构体映射表名称
+func (GopaWebhookDeliveries) TableName() string {
+	return Table("gopa_webhook_deliveries")
 }
 
 // RegoDocument MongoDB
+// Version在每次修改内容后加一，保存在数据库中时即rego_documents的Revision
 type RegoDocument struct {
 	//ID          string
 	Method    string
@@ -77,14 +221,15 @@ type RegoDocument struct {
 	Name      string
 	Content   string
 	Arguments []string
+	Version   int64
 }
 
 func (GopaApplication) TableName() string {
-	return "gopa_applications"
+	return Table("gopa_applications")
 }
 
 func (ProjectResources) TableName() string {
-	return "project_resources"
+	return Table("project_resources")
 }
 
 // UserRole 用户角色
@@ -110,3 +255,152 @@ type User struct {
 	CreatedAt time.Time `json:"created_at"`                            // 创建时间
 	UserRoles UserRoles `json:"user_roles" binding:"required,gt=0"`    // 角色授权
 }
+
+// GopaServiceAccounts 供CI和后端服务调用GOPA的服务账号。
+// 服务账号的组和角色与普通用户一样记录在gopa_members中，Username为服务账号的Name
+type GopaServiceAccounts struct {
+	BaseModel
+	Name        string `gorm:"size:191"`
+	Description string
+	Owner       string
+	Disabled    bool
+}
+
+// TableName 结构体映射表名称
+func (GopaServiceAccounts) TableName() string {
+	return Table("gopa_service_accounts")
+}
+
+// GopaAPIKeys 服务账号的API key，只能以Project组的Role角色调用。
+// 只保存key的SHA-256哈希，Prefix为key的前几位，用于展示和辨认
+type GopaAPIKeys struct {
+	BaseModel
+	ServiceAccount string
+	Prefix         string
+	KeyHash        string
+	Project        string
+	Role           string
+	ExpiresAt      *time.Time
+	RevokedAt      *time.Time
+	LastUsedAt     *time.Time
+	LastUsedIP     string
+}
+
+// TableName 结构体映射表名称
+func (GopaAPIKeys) TableName() string {
+	return Table("gopa_api_keys")
+}
+
+// GopaRevokedTokens 已吊销的token，按JTI记录，ExpiresAt之后可以清理
+type GopaRevokedTokens struct {
+	BaseModel
+	JTI       string `gorm:"column:jti"`
+	Username  string
+	Reason    string
+	ExpiresAt time.Time
+}
+
+// TableName 结构体映射表名称
+func (GopaRevokedTokens) TableName() string {
+	return Table("gopa_revoked_tokens")
+}
+
+// GopaTokenCutoffs 用户在RevokedBefore之前签发的token全部失效
+type GopaTokenCutoffs struct {
+	BaseModel
+	Username      string
+	RevokedBefore time.Time
+	Reason        string
+}
+
+// TableName 结构体映射表名称
+func (GopaTokenCutoffs) TableName() string {
+	return Table("gopa_token_cutoffs")
+}
+
+// GopaRefreshTokens 服务端保存的刷新token，同一次登录的刷新token有相同的Session。
+// 每次刷新都签发新的刷新token并记录旧的UsedAt，已使用的刷新token再次出现时吊销整个Session
+type GopaRefreshTokens struct {
+	BaseModel
+	Session         string
+	Username        string
+	TokenHash       string
+	Client          string
+	IP              string `gorm:"column:ip"`
+	AccessJTI       string `gorm:"column:access_jti"`
+	AccessExpiresAt time.Time
+	LoginAt         time.Time
+	ExpiresAt       time.Time
+	UsedAt          *time.Time
+	RevokedAt       *time.Time
+	// Mfa 该登录是否通过了两步验证
+	Mfa bool
+}
+
+// TableName 结构体映射表名称
+func (GopaRefreshTokens) TableName() string {
+	return Table("gopa_refresh_tokens")
+}
+
+// GopaLoginFailures 连续登录失败的记录，Subject为用户名或IP，多个实例共用
+type GopaLoginFailures struct {
+	BaseModel
+	Subject       string `gorm:"size:191"`
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+// TableName 结构体映射表名称
+func (GopaLoginFailures) TableName() string {
+	return Table("gopa_login_failures")
+}
+
+// GopaMemberMFA 用户的TOTP两步验证。Secret用配置的密钥加密保存，
+// ConfirmedAt为空时还没有完成绑定；LastStep为最近使用的密码的步数，用于防止重放；
+// RecoveryCodes为未使用的恢复码的bcrypt哈希组成的JSON数组
+type GopaMemberMFA struct {
+	BaseModel
+	Username      string
+	Secret        string
+	ConfirmedAt   *time.Time
+	LastStep      int64
+	RecoveryCodes string
+}
+
+// TableName 结构体映射表名称
+func (GopaMemberMFA) TableName() string {
+	return Table("gopa_member_mfa")
+}
+
+// GopaSigningKeys token的签名密钥，PrivateKey为用secretbox加密的PKCS#8 PEM。
+// 多个GOPA实例共用同一组密钥。ActiveFrom为开始用于签名的时间，为空时创建后立即使用
+type GopaSigningKeys struct {
+	BaseModel
+	Kid        string
+	Algorithm  string
+	PrivateKey string
+	ActiveFrom *time.Time
+}
+
+// TableName 结构体映射表名称
+func (GopaSigningKeys) TableName() string {
+	return Table("gopa_signing_keys")
+}
+
+// RegoDocuments 保存在数据库中的rego文件，每个Path一个文件。
+// Arguments为JSON数组，Revision在每次修改内容后加一
+type RegoDocuments struct {
+	BaseModel
+	Path      string `gorm:"size:191"`
+	Method    string
+	Name      string
+	Content   string `gorm:"type:text"`
+	Arguments string
+	Revision  int64
+}
+
+// TableName 结构体映射表名称
+func (RegoDocuments) TableName() string {
+	return Table("rego_documents")
+}
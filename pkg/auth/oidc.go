@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"gopa/model"
+)
+
+// DefaultUsernameClaim 未配置时作为用户名的claim
+const DefaultUsernameClaim = "preferred_username"
+
+var (
+	// ErrOIDCDisabled 未启用OIDC登录
+	ErrOIDCDisabled = errors.New("oidc: provider is not enabled")
+	// ErrInvalidIDToken id_token的签名或声明校验失败
+	ErrInvalidIDToken = errors.New("oidc: invalid id_token")
+)
+
+// oidcDiscovery <issuer>/.well-known/openid-configuration 中用到的字段
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+// jwk JWKS中的一个RSA公钥
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// OIDC 授权码模式的OIDC登录。签发方的端点和公钥在首次使用时读取，
+// 遇到未知的kid时重新读取公钥以支持签发方轮换密钥
+type OIDC struct {
+	conf   model.OIDCProvider
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+// NewOIDC 根据配置创建OIDC登录
+func NewOIDC(conf model.OIDCProvider) *OIDC {
+	return &OIDC{conf: conf, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Name 认证方式的名称
+func (o *OIDC) Name() string {
+	return ProviderOIDC
+}
+
+// AuthCodeURL 返回跳转到签发方登录页面的地址
+func (o *OIDC) AuthCodeURL(state, nonce string) (string, error) {
+	if !o.conf.Enabled {
+		return "", ErrOIDCDisabled
+	}
+	discovery, err := o.discover()
+	if err != nil {
+		return "", err
+	}
+	scopes := o.conf.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {o.conf.ClientID},
+		"redirect_uri":  {o.conf.RedirectURL},
+		"scope":         {strings.Join(scopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange 用授权码换取id_token，校验后返回其中的用户
+func (o *OIDC) Exchange(code, nonce string) (*Identity, error) {
+	if !o.conf.Enabled {
+		return nil, ErrOIDCDisabled
+	}
+	discovery, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.client.PostForm(discovery.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.conf.RedirectURL},
+		"client_id":     {o.conf.ClientID},
+		"client_secret": {o.conf.ClientSecret},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || token.Error != "" {
+		return nil, fmt.Errorf("oidc: token endpoint responded with status %d: %s %s",
+			resp.StatusCode, token.Error, token.ErrorDescription)
+	}
+	claims, err := o.Verify(token.IDToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+	usernameClaim := o.conf.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = DefaultUsernameClaim
+	}
+	username, _ := claims[usernameClaim].(string)
+	if username == "" {
+		return nil, fmt.Errorf("%w: missing claim %s", ErrInvalidIDToken, usernameClaim)
+	}
+	return &Identity{Username: username, Provider: ProviderOIDC}, nil
+}
+
+// Verify 校验id_token的签名、签发方、受众、有效期和nonce，返回其中的声明
+func (o *OIDC) Verify(rawIDToken, nonce string) (jwt.MapClaims, error) {
+	discovery, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return o.key(discovery, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	if iss, _ := claims["iss"].(string); iss != discovery.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidIDToken, iss)
+	}
+	if !audienceContains(claims["aud"], o.conf.ClientID) {
+		return nil, fmt.Errorf("%w: audience does not contain %q", ErrInvalidIDToken, o.conf.ClientID)
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, fmt.Errorf("%w: missing exp", ErrInvalidIDToken)
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+	return claims, nil
+}
+
+// discover 读取并缓存签发方的端点
+func (o *OIDC) discover() (*oidcDiscovery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+	var discovery oidcDiscovery
+	if err := o.getJSON(strings.TrimSuffix(o.conf.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if discovery.Issuer != o.conf.Issuer {
+		return nil, fmt.Errorf("oidc: issuer %q does not match the configured %q", discovery.Issuer, o.conf.Issuer)
+	}
+	o.discovery = &discovery
+	return o.discovery, nil
+}
+
+// key 返回kid对应的公钥，缓存中没有时重新读取JWKS
+func (o *OIDC) key(discovery *oidcDiscovery, kid string) (*rsa.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := o.getJSON(discovery.JwksURI, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		key, err := parseRSAKey(k)
+		if err != nil {
+			return nil, err
+		}
+		keys[k.Kid] = key
+	}
+	o.keys = keys
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+func (o *OIDC) getJSON(url string, v interface{}) error {
+	resp, err := o.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: %s responded with status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// parseRSAKey 把JWK中base64url编码的模数和指数转换为公钥
+func parseRSAKey(k jwk) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// audienceContains 判断aud声明（字符串或字符串数组）是否包含clientID
+func audienceContains(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok && s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
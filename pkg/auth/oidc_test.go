@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"gopa/model"
+)
+
+// mockIssuer 本地的OIDC签发方，授权码code对应claims中的声明
+type mockIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+	codes  map[string]jwt.MapClaims
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &mockIssuer{key: key, kid: "key-1", codes: map[string]jwt.MapClaims{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                issuer.server.URL,
+			AuthorizationEndpoint: issuer.server.URL + "/authorize",
+			TokenEndpoint:         issuer.server.URL + "/token",
+			JwksURI:               issuer.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string][]jwk{"keys": {{
+			Kid: issuer.kid,
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(issuer.key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(issuer.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		claims, ok := issuer.codes[r.Form.Get("code")]
+		if !ok || r.Form.Get("client_secret") != "gopa-secret" || r.Form.Get("grant_type") != "authorization_code" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": issuer.sign(t, claims, issuer.key)})
+	})
+	issuer.server = httptest.NewServer(mux)
+	return issuer
+}
+
+func (m *mockIssuer) sign(t *testing.T, claims jwt.MapClaims, key *rsa.PrivateKey) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = m.kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func (m *mockIssuer) claims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":                m.server.URL,
+		"aud":                "gopa",
+		"sub":                "1001",
+		"preferred_username": "alice",
+		"nonce":              nonce,
+		"exp":                time.Now().Add(time.Minute).Unix(),
+		"iat":                time.Now().Unix(),
+	}
+}
+
+func (m *mockIssuer) provider() *OIDC {
+	return NewOIDC(model.OIDCProvider{
+		Enabled:      true,
+		Issuer:       m.server.URL,
+		ClientID:     "gopa",
+		ClientSecret: "gopa-secret",
+		RedirectURL:  "https://gopa.example.com/api/oidc/callback",
+	})
+}
+
+func TestOIDCAuthCodeURL(t *testing.T) {
+	issuer := newMockIssuer(t)
+	defer issuer.server.Close()
+
+	redirect, err := issuer.provider().AuthCodeURL("state-1", "nonce-1")
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	u, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if u.Path != "/authorize" || query.Get("client_id") != "gopa" || query.Get("state") != "state-1" ||
+		query.Get("nonce") != "nonce-1" || query.Get("response_type") != "code" {
+		t.Errorf("AuthCodeURL = %s", redirect)
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	issuer := newMockIssuer(t)
+	defer issuer.server.Close()
+	provider := issuer.provider()
+
+	issuer.codes["good"] = issuer.claims("nonce-1")
+	identity, err := provider.Exchange("good", "nonce-1")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if identity.Username != "alice" || identity.Provider != ProviderOIDC {
+		t.Errorf("Exchange = %+v", identity)
+	}
+
+	if _, err := provider.Exchange("unknown", "nonce-1"); err == nil {
+		t.Error("Exchange with an unknown code should fail")
+	}
+	if _, err := provider.Exchange("good", "nonce-2"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("Exchange with another nonce = %v, want ErrInvalidIDToken", err)
+	}
+
+	wrongAudience := issuer.claims("nonce-1")
+	wrongAudience["aud"] = []string{"another-client"}
+	issuer.codes["wrong-audience"] = wrongAudience
+	if _, err := provider.Exchange("wrong-audience", "nonce-1"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("Exchange with another audience = %v, want ErrInvalidIDToken", err)
+	}
+
+	expired := issuer.claims("nonce-1")
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	issuer.codes["expired"] = expired
+	if _, err := provider.Exchange("expired", "nonce-1"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("Exchange with an expired id_token = %v, want ErrInvalidIDToken", err)
+	}
+}
+
+func TestOIDCVerifyRejectsForgedToken(t *testing.T) {
+	issuer := newMockIssuer(t)
+	defer issuer.server.Close()
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := issuer.sign(t, issuer.claims("nonce-1"), other)
+	if _, err := issuer.provider().Verify(forged, "nonce-1"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("Verify(forged) = %v, want ErrInvalidIDToken", err)
+	}
+}
+
+func TestOIDCDisabled(t *testing.T) {
+	if _, err := NewOIDC(model.OIDCProvider{}).AuthCodeURL("state", "nonce"); err != ErrOIDCDisabled {
+		t.Errorf("AuthCodeURL = %v, want ErrOIDCDisabled", err)
+	}
+}
+
+// staticProvider 返回固定结果的认证方式
+type staticProvider struct {
+	name string
+	err  error
+}
+
+func (p staticProvider) Name() string { return p.name }
+
+func (p staticProvider) Authenticate(username, password string) (*Identity, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return &Identity{Username: username, Provider: p.name}, nil
+}
+
+func TestChain(t *testing.T) {
+	hashed, err := Encrypt("break-glass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := Local{Lookup: func(username string) (string, error) {
+		if username == "root" {
+			return hashed, nil
+		}
+		return "", nil
+	}}
+	providers := map[string]Provider{
+		ProviderLdap:  staticProvider{name: ProviderLdap, err: errors.New("ldap: connection refused")},
+		ProviderLocal: local,
+	}
+	chain, err := NewChain([]string{ProviderLdap, ProviderLocal}, providers)
+	if err != nil {
+		t.Fatalf("NewChain: %v", err)
+	}
+
+	// LDAP不可用时本地账号仍然可以登录
+	identity, err := chain.Authenticate("root", "break-glass")
+	if err != nil || identity.Provider != ProviderLocal {
+		t.Errorf("Authenticate(root) = %+v, %v", identity, err)
+	}
+	if _, err := chain.Authenticate("root", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Authenticate with a wrong password = %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := chain.Authenticate("alice", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Authenticate(alice) = %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := NewChain([]string{"kerberos"}, providers); err == nil {
+		t.Error("NewChain with an unknown provider should fail")
+	}
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopa/pkg/ldap"
+)
+
+// 可在配置中选择的用户名密码认证方式
+const (
+	ProviderLdap  = "ldap"
+	ProviderLocal = "local"
+	ProviderOIDC  = "oidc"
+)
+
+// ErrInvalidCredentials 所有认证方式都没有通过
+var ErrInvalidCredentials = errors.New("auth: invalid username or password")
+
+// Identity 认证通过的用户，Provider为认证通过的方式
+type Identity struct {
+	Username string
+	Provider string
+}
+
+// Provider 用户名密码认证方式
+type Provider interface {
+	Name() string
+	Authenticate(username, password string) (*Identity, error)
+}
+
+// Chain 按顺序尝试的多个认证方式，任意一个通过即认证成功
+type Chain []Provider
+
+// NewChain 按names的顺序从providers中选出认证方式
+func NewChain(names []string, providers map[string]Provider) (Chain, error) {
+	chain := make(Chain, 0, len(names))
+	for _, name := range names {
+		provider, ok := providers[name]
+		if !ok {
+			return nil, fmt.Errorf("auth: unknown provider %q", name)
+		}
+		chain = append(chain, provider)
+	}
+	return chain, nil
+}
+
+// Authenticate 依次尝试每个认证方式。前面的认证方式不可用时（如LDAP无法连接）
+// 仍会继续尝试后面的，保证本地的紧急账号可以登录。
+// 全部失败时返回的错误包装了ErrInvalidCredentials，并带上每个认证方式的原因
+func (c Chain) Authenticate(username, password string) (*Identity, error) {
+	reasons := make([]string, 0, len(c))
+	for _, provider := range c {
+		identity, err := provider.Authenticate(username, password)
+		if err == nil {
+			return identity, nil
+		}
+		reasons = append(reasons, provider.Name()+": "+err.Error())
+	}
+	return nil, fmt.Errorf("%w (%s)", ErrInvalidCredentials, strings.Join(reasons, "; "))
+}
+
+// Local 使用gopa_members中bcrypt加密的密码认证，用于服务账号和紧急账号。
+// Lookup返回用户的密码哈希，用户不存在或没有设置密码时返回空字符串
+type Local struct {
+	Lookup func(username string) (string, error)
+}
+
+// Name 认证方式的名称
+func (Local) Name() string {
+	return ProviderLocal
+}
+
+// Authenticate 校验密码是否与保存的哈希一致
+func (l Local) Authenticate(username, password string) (*Identity, error) {
+	if password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	hashed, err := l.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	if hashed == "" || Compare(hashed, password) != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{Username: username, Provider: ProviderLocal}, nil
+}
+
+// Ldap 通过LDAP连接池绑定用户认证
+type Ldap struct {
+	Pool func() *ldap.Pool
+}
+
+// Name 认证方式的名称
+func (Ldap) Name() string {
+	return ProviderLdap
+}
+
+// Authenticate 以用户的DN和密码绑定LDAP
+func (l Ldap) Authenticate(username, password string) (*Identity, error) {
+	if _, err := l.Pool().Authenticate(username, password); err != nil {
+		return nil, err
+	}
+	return &Identity{Username: username, Provider: ProviderLdap}, nil
+}
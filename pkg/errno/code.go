@@ -26,14 +26,71 @@ var (
 	ErrAliCloudSlbReject               = &Errno{Code: 22006, Message: "vGroup has only one instance, cannot pull out."}
 
 	// user errors
-	NotOK             = &Errno{Code: 20001, Message: "Not OK"}
-	ErrValidation     = &Errno{Code: 20001, Message: "Validation failed."}
-	ErrDatabase       = &Errno{Code: 20002, Message: "Database error."}
-	ErrToken          = &Errno{Code: 20003, Message: "Error occurred while signing the JSON web token."}
-	ErrInstanceStatus = &Errno{Code: 20004, Message: "Instance status must be up or down."}
+	NotOK              = &Errno{Code: 20001, Message: "Not OK"}
+	ErrValidation      = &Errno{Code: 20001, Message: "Validation failed."}
+	ErrDatabase        = &Errno{Code: 20002, Message: "Database error."}
+	ErrToken           = &Errno{Code: 20003, Message: "Error occurred while signing the JSON web token."}
+	ErrInstanceStatus  = &Errno{Code: 20004, Message: "Instance status must be up or down."}
+	ErrVersionConflict = &Errno{Code: 20005, Message: "The resource has been modified by someone else, reload it and try again."}
 
 	ErrUserNotFound      = &Errno{Code: 20102, Message: "The user was not found."}
 	ErrEncrypt           = &Errno{Code: 20101, Message: "Error occurred while encrypting the user password."}
 	ErrTokenInvalid      = &Errno{Code: 20103, Message: "The token was invalid."}
 	ErrPasswordIncorrect = &Errno{Code: 20104, Message: "The password was incorrect."}
+	ErrOIDCState         = &Errno{Code: 20105, Message: "The OIDC login state is missing or does not match."}
+	ErrOIDCLogin         = &Errno{Code: 20106, Message: "OIDC login failed."}
+	ErrTokenRevoked      = &Errno{Code: 20107, Message: "The token has been revoked, please log in again."}
+	ErrRefreshToken      = &Errno{Code: 20108, Message: "The refresh token is invalid or expired, please log in again."}
+	ErrRefreshReused     = &Errno{Code: 20109, Message: "The refresh token was already used, the session has been revoked."}
+	ErrSessionNotFound   = &Errno{Code: 20110, Message: "The session was not found."}
+	ErrLoginLocked       = &Errno{Code: 20111, Message: "Too many failed login attempts, please try again later."}
+	ErrMFAUnavailable    = &Errno{Code: 20112, Message: "Two-factor authentication is not configured."}
+	ErrMFACode           = &Errno{Code: 20113, Message: "The verification code is incorrect."}
+	ErrMFAEnrolled       = &Errno{Code: 20114, Message: "Two-factor authentication is already enabled."}
+	ErrMFANotEnrolled    = &Errno{Code: 20115, Message: "Two-factor authentication is not enabled."}
+	ErrMFAChallenge      = &Errno{Code: 20116, Message: "The two-factor login has expired, please log in again."}
+	ErrAdminForbidden    = &Errno{Code: 20117, Message: "You are not allowed to perform this administrative operation."}
+	ErrMFASession        = &Errno{Code: 20118, Message: "Two-factor authentication is now required, please log in again."}
+	ErrExternalUser      = &Errno{Code: 20119, Message: "The user logs in through LDAP or OIDC, a local password cannot be set."}
+
+	// role errors
+	ErrRoleNotFound = &Errno{Code: 20201, Message: "The role was not found."}
+	ErrRoleCycle    = &Errno{Code: 20202, Message: "The role inheritance contains a cycle."}
+	ErrRoleExists   = &Errno{Code: 20203, Message: "The role already exists."}
+
+	// project errors
+	ErrProjectNotFound         = &Errno{Code: 20301, Message: "The project was not found."}
+	ErrProjectHasChildren      = &Errno{Code: 20302, Message: "The project still has subprojects."}
+	ErrProjectExists           = &Errno{Code: 20303, Message: "The project already exists."}
+	ErrProjectResourceNotFound = &Errno{Code: 20304, Message: "The resource grant was not found."}
+
+	// member errors
+	ErrGrantExpired   = &Errno{Code: 20401, Message: "The user has no active grant of this project and role."}
+	ErrMemberExists   = &Errno{Code: 20402, Message: "The user already has this role in the project."}
+	ErrMemberNotFound = &Errno{Code: 20403, Message: "The membership was not found."}
+
+	// access request errors
+	ErrAccessRequestNotFound  = &Errno{Code: 20501, Message: "The access request was not found."}
+	ErrAccessRequestReviewed  = &Errno{Code: 20502, Message: "The access request has already been reviewed."}
+	ErrAccessRequestDuplicate = &Errno{Code: 20503, Message: "A pending access request for this project and role already exists."}
+	ErrAccessReviewForbidden  = &Errno{Code: 20504, Message: "You are not allowed to review this access request."}
+
+	// webhook errors
+	ErrWebhookNotFound  = &Errno{Code: 20601, Message: "The webhook was not found."}
+	ErrDeliveryNotFound = &Errno{Code: 20602, Message: "The webhook delivery was not found."}
+
+	// service account errors
+	ErrServiceAccountNotFound = &Errno{Code: 20701, Message: "The service account was not found or is disabled."}
+	ErrServiceAccountExists   = &Errno{Code: 20702, Message: "The service account already exists."}
+	ErrAPIKeyNotFound         = &Errno{Code: 20703, Message: "The API key was not found."}
+	ErrAPIKeyInvalid          = &Errno{Code: 20704, Message: "The API key is invalid, expired or revoked."}
+	ErrAPIKeyScope            = &Errno{Code: 20705, Message: "The API key is not allowed for this project and role."}
+	ErrServiceAccountName     = &Errno{Code: 20706, Message: "The name is already used by a user."}
+
+	// rego errors
+	ErrRegoExists = &Errno{Code: 20801, Message: "A rego document already exists at this path."}
+
+	// batch errors
+	ErrBatchOperation = &Errno{Code: 20901, Message: "The batch operation is unknown or its form is invalid."}
+	ErrBatchSize      = &Errno{Code: 20902, Message: "A batch must contain between 1 and 100 operations."}
 )
@@ -0,0 +1,386 @@
+// Package ldap 提供复用连接的LDAP客户端，用于登录时的用户认证
+// 以及从LDAP读取用户和组
+package ldap
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopa/model"
+	"gopa/pkg/logger"
+	goldap "gopkg.in/ldap.v2"
+)
+
+// 未配置时连接池的参数
+const (
+	DefaultMaxConns            = 10
+	DefaultTimeout             = 5 * time.Second
+	DefaultHealthCheckInterval = 30 * time.Second
+)
+
+var (
+	// ErrPoolExhausted 在超时时间内没有等到空闲连接
+	ErrPoolExhausted = errors.New("ldap: no idle connection available")
+	// ErrPoolClosed 连接池已关闭
+	ErrPoolClosed = errors.New("ldap: pool is closed")
+	// ErrInvalidCredentials 用户名或密码错误
+	ErrInvalidCredentials = errors.New("ldap: invalid credentials")
+	// ErrUserNotFound 用户不存在或匹配到多个用户
+	ErrUserNotFound = errors.New("ldap: user does not exist or too many entries returned")
+)
+
+// Conn 连接池管理的LDAP连接，*goldap.Conn满足该接口
+type Conn interface {
+	Bind(username, password string) error
+	Search(searchRequest *goldap.SearchRequest) (*goldap.SearchResult, error)
+	Close()
+}
+
+// Dialer 建立一条新的LDAP连接
+type Dialer func() (Conn, error)
+
+// idleConn 空闲连接以及它放回连接池的时间
+type idleConn struct {
+	conn     Conn
+	returned time.Time
+}
+
+// Pool LDAP连接池。每次操作从池中取出一条连接，先以BindDN绑定，
+// 操作结束后放回；网络错误的连接直接关闭，不再复用
+type Pool struct {
+	conf                model.LdapClient
+	dial                Dialer
+	timeout             time.Duration
+	healthCheckInterval time.Duration
+
+	mu     sync.Mutex
+	idle   []idleConn
+	closed bool
+	slots  chan struct{}
+
+	stats *bindStats
+}
+
+var (
+	defaultPool *Pool
+	defaultMu   sync.RWMutex
+)
+
+// Init 根据配置创建全局连接池，已有的连接池会被关闭
+func Init(conf model.LdapClient) {
+	pool := NewPool(conf, DefaultDialer(conf))
+	defaultMu.Lock()
+	old := defaultPool
+	defaultPool = pool
+	defaultMu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// Default 返回全局连接池
+func Default() *Pool {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultPool
+}
+
+// Ensure 返回全局连接池，还没有创建时按conf创建。
+// 并发调用时只创建一个连接池，不会关闭别的调用者正在使用的连接池
+func Ensure(conf model.LdapClient) *Pool {
+	if pool := Default(); pool != nil {
+		return pool
+	}
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultPool == nil {
+		defaultPool = NewPool(conf, DefaultDialer(conf))
+	}
+	return defaultPool
+}
+
+// NewPool 创建连接池，dial用于建立新连接
+func NewPool(conf model.LdapClient, dial Dialer) *Pool {
+	maxConns := conf.MaxConns
+	if maxConns <= 0 {
+		maxConns = DefaultMaxConns
+	}
+	timeout := DefaultTimeout
+	if conf.Timeout > 0 {
+		timeout = time.Duration(conf.Timeout) * time.Second
+	}
+	healthCheckInterval := DefaultHealthCheckInterval
+	if conf.HealthCheckInterval > 0 {
+		healthCheckInterval = time.Duration(conf.HealthCheckInterval) * time.Second
+	}
+	return &Pool{
+		conf:                conf,
+		dial:                dial,
+		timeout:             timeout,
+		healthCheckInterval: healthCheckInterval,
+		slots:               make(chan struct{}, maxConns),
+		stats:               &bindStats{},
+	}
+}
+
+// DefaultDialer 按配置通过TCP或TLS建立连接，并设置请求超时
+func DefaultDialer(conf model.LdapClient) Dialer {
+	return func() (Conn, error) {
+		timeout := DefaultTimeout
+		if conf.Timeout > 0 {
+			timeout = time.Duration(conf.Timeout) * time.Second
+		}
+		address := net.JoinHostPort(conf.Host, strconv.Itoa(conf.Port))
+		dialer := &net.Dialer{Timeout: timeout}
+		var conn *goldap.Conn
+		if conf.UseSSL {
+			c, err := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{ServerName: conf.ServerName})
+			if err != nil {
+				return nil, err
+			}
+			conn = goldap.NewConn(c, true)
+			conn.Start()
+		} else {
+			c, err := dialer.Dial("tcp", address)
+			if err != nil {
+				return nil, err
+			}
+			conn = goldap.NewConn(c, false)
+			conn.Start()
+			if !conf.SkipTLS {
+				if err := conn.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+		}
+		conn.SetTimeout(timeout)
+		return conn, nil
+	}
+}
+
+// Authenticate 校验用户名和密码，返回配置的Attributes对应的用户属性
+func (p *Pool) Authenticate(username, password string) (map[string]string, error) {
+	var user map[string]string
+	err := p.do(func(conn Conn) error {
+		// 空密码会被LDAP当作匿名绑定而成功，必须拒绝
+		if password == "" {
+			return ErrInvalidCredentials
+		}
+		attributes := append([]string{"dn"}, p.conf.Attributes...)
+		sr, err := conn.Search(goldap.NewSearchRequest(
+			p.conf.Base,
+			goldap.ScopeWholeSubtree, goldap.NeverDerefAliases, 0, 0, false,
+			fmt.Sprintf(p.conf.UserFilter, goldap.EscapeFilter(username)),
+			attributes,
+			nil,
+		))
+		if err != nil {
+			return err
+		}
+		if len(sr.Entries) != 1 {
+			return ErrUserNotFound
+		}
+		entry := sr.Entries[0]
+		if err := conn.Bind(entry.DN, password); err != nil {
+			if goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+				return ErrInvalidCredentials
+			}
+			return err
+		}
+		user = map[string]string{"dn": entry.DN}
+		for _, attr := range p.conf.Attributes {
+			user[attr] = entry.GetAttributeValue(attr)
+		}
+		// 恢复连接的身份，避免放回连接池后以该用户的身份执行查询
+		return p.bindService(conn)
+	})
+	if err == ErrInvalidCredentials {
+		p.stats.fail(time.Now())
+		logger.MetricsEmit("ldap.Authenticate", "",
+			fmt.Sprintf("failed bind for [%s], %d failed binds in the last minute", username, p.FailedBindRate()), false)
+	}
+	return user, err
+}
+
+// UserExists 以BindDN的身份按UserFilter查询username是否存在
+func (p *Pool) UserExists(username string) (bool, error) {
+	sr, err := p.Search(goldap.NewSearchRequest(
+		p.conf.Base,
+		goldap.ScopeWholeSubtree, goldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(p.conf.UserFilter, goldap.EscapeFilter(username)),
+		[]string{"dn"},
+		nil,
+	))
+	if err != nil {
+		return false, err
+	}
+	return len(sr.Entries) > 0, nil
+}
+
+// Search 以BindDN的身份执行一次查询
+func (p *Pool) Search(searchRequest *goldap.SearchRequest) (*goldap.SearchResult, error) {
+	var result *goldap.SearchResult
+	err := p.do(func(conn Conn) error {
+		var err error
+		result, err = conn.Search(searchRequest)
+		return err
+	})
+	return result, err
+}
+
+// FailedBindRate 返回最近一分钟内用户密码错误的次数
+func (p *Pool) FailedBindRate() int {
+	return p.stats.count(time.Now())
+}
+
+// Close 关闭连接池以及全部空闲连接
+func (p *Pool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+	for _, c := range idle {
+		c.conn.Close()
+	}
+}
+
+// do 取出一条以BindDN绑定好的连接执行f，结束后放回连接池。
+// 网络错误时关闭该连接
+func (p *Pool) do(f func(conn Conn) error) error {
+	conn, err := p.get()
+	if err != nil {
+		return err
+	}
+	err = f(conn)
+	p.put(conn, isConnError(err))
+	return err
+}
+
+// get 等待空闲名额并取出一条可用的连接
+func (p *Pool) get() (Conn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-time.After(p.timeout):
+		return nil, ErrPoolExhausted
+	}
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			<-p.slots
+			return nil, ErrPoolClosed
+		}
+		var c idleConn
+		found := false
+		if n := len(p.idle); n > 0 {
+			c, found = p.idle[n-1], true
+			p.idle = p.idle[:n-1]
+		}
+		p.mu.Unlock()
+
+		if !found {
+			conn, err := p.dial()
+			if err != nil {
+				<-p.slots
+				return nil, err
+			}
+			if err := p.bindService(conn); err != nil {
+				conn.Close()
+				<-p.slots
+				return nil, err
+			}
+			return conn, nil
+		}
+		if err := p.check(c); err != nil {
+			c.conn.Close()
+			// 连接已断开时换一条连接，其他错误直接返回
+			if isConnError(err) {
+				continue
+			}
+			<-p.slots
+			return nil, err
+		}
+		return c.conn, nil
+	}
+}
+
+// check 复用前检查空闲连接：配置了BindDN时重新绑定，
+// 否则对空闲较久的连接查询一次rootDSE
+func (p *Pool) check(c idleConn) error {
+	if p.conf.BindDN != "" && p.conf.BindPassword != "" {
+		return p.bindService(c.conn)
+	}
+	if time.Since(c.returned) < p.healthCheckInterval {
+		return nil
+	}
+	_, err := c.conn.Search(goldap.NewSearchRequest(
+		"", goldap.ScopeBaseObject, goldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"1.1"}, nil,
+	))
+	return err
+}
+
+// put 把连接放回连接池，broken为true时关闭该连接
+func (p *Pool) put(conn Conn, broken bool) {
+	defer func() { <-p.slots }()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if broken || p.closed {
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, idleConn{conn: conn, returned: time.Now()})
+}
+
+// bindService 以配置的BindDN绑定连接，未配置BindDN时使用匿名绑定
+func (p *Pool) bindService(conn Conn) error {
+	if p.conf.BindDN == "" || p.conf.BindPassword == "" {
+		return conn.Bind("", "")
+	}
+	return conn.Bind(p.conf.BindDN, p.conf.BindPassword)
+}
+
+// isConnError 判断错误是否意味着连接已不可用
+func isConnError(err error) bool {
+	if err == nil || err == ErrInvalidCredentials || err == ErrUserNotFound {
+		return false
+	}
+	if e, ok := err.(*goldap.Error); ok {
+		return e.ResultCode == goldap.ErrorNetwork
+	}
+	return true
+}
+
+// bindStats 记录最近一分钟内的密码错误次数
+type bindStats struct {
+	mu       sync.Mutex
+	failures []time.Time
+}
+
+func (s *bindStats) fail(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.prune(now), now)
+}
+
+func (s *bindStats) count(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = s.prune(now)
+	return len(s.failures)
+}
+
+func (s *bindStats) prune(now time.Time) []time.Time {
+	i := 0
+	for i < len(s.failures) && now.Sub(s.failures[i]) > time.Minute {
+		i++
+	}
+	return s.failures[i:]
+}
@@ -0,0 +1,232 @@
+package ldap
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopa/model"
+	goldap "gopkg.in/ldap.v2"
+)
+
+// directory 进程内的LDAP替身，按DN保存密码和属性
+type directory struct {
+	mu      sync.Mutex
+	entries map[string]map[string]string
+	dials   int
+	open    int
+}
+
+func newDirectory() *directory {
+	return &directory{entries: map[string]map[string]string{
+		"cn=readonly,dc=graviti,dc=com": {"userPassword": "readonly"},
+		"uid=alice,ou=people,dc=graviti,dc=com": {
+			"uid": "alice", "mail": "alice@graviti.com", "userPassword": "alice-pass",
+		},
+	}}
+}
+
+func (d *directory) dial() (Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials++
+	d.open++
+	return &fakeConn{dir: d}, nil
+}
+
+// fakeConn 连接到directory的一条连接，broken为true时模拟网络断开
+type fakeConn struct {
+	dir    *directory
+	bound  string
+	broken bool
+	closed bool
+}
+
+func (c *fakeConn) Bind(username, password string) error {
+	if c.broken {
+		return goldap.NewError(goldap.ErrorNetwork, nil)
+	}
+	if username == "" && password == "" {
+		c.bound = ""
+		return nil
+	}
+	c.dir.mu.Lock()
+	defer c.dir.mu.Unlock()
+	entry, ok := c.dir.entries[username]
+	if !ok || entry["userPassword"] != password {
+		return goldap.NewError(goldap.LDAPResultInvalidCredentials, nil)
+	}
+	c.bound = username
+	return nil
+}
+
+func (c *fakeConn) Search(req *goldap.SearchRequest) (*goldap.SearchResult, error) {
+	if c.broken {
+		return nil, goldap.NewError(goldap.ErrorNetwork, nil)
+	}
+	if c.bound != "cn=readonly,dc=graviti,dc=com" {
+		return nil, goldap.NewError(goldap.LDAPResultInsufficientAccessRights, nil)
+	}
+	// 只支持(uid=xxx)形式的过滤条件
+	uid := strings.TrimSuffix(strings.TrimPrefix(req.Filter, "(uid="), ")")
+	c.dir.mu.Lock()
+	defer c.dir.mu.Unlock()
+	result := &goldap.SearchResult{}
+	for dn, attrs := range c.dir.entries {
+		if attrs["uid"] != uid || !strings.HasSuffix(dn, req.BaseDN) {
+			continue
+		}
+		entry := &goldap.Entry{DN: dn}
+		for _, name := range req.Attributes {
+			if value, ok := attrs[name]; ok {
+				entry.Attributes = append(entry.Attributes, &goldap.EntryAttribute{Name: name, Values: []string{value}})
+			}
+		}
+		result.Entries = append(result.Entries, entry)
+	}
+	return result, nil
+}
+
+func (c *fakeConn) Close() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.dir.mu.Lock()
+	c.dir.open--
+	c.dir.mu.Unlock()
+}
+
+func testConfig() model.LdapClient {
+	return model.LdapClient{
+		Base:         "dc=graviti,dc=com",
+		BindDN:       "cn=readonly,dc=graviti,dc=com",
+		BindPassword: "readonly",
+		UserFilter:   "(uid=%s)",
+		Attributes:   []string{"uid", "mail"},
+		MaxConns:     2,
+		Timeout:      1,
+	}
+}
+
+func TestPoolAuthenticate(t *testing.T) {
+	dir := newDirectory()
+	pool := NewPool(testConfig(), dir.dial)
+	defer pool.Close()
+
+	for i := 0; i < 3; i++ {
+		user, err := pool.Authenticate("alice", "alice-pass")
+		if err != nil {
+			t.Fatalf("Authenticate(alice): %v", err)
+		}
+		if user["mail"] != "alice@graviti.com" || user["dn"] != "uid=alice,ou=people,dc=graviti,dc=com" {
+			t.Errorf("Authenticate(alice) = %v", user)
+		}
+	}
+	if dir.dials != 1 {
+		t.Errorf("dialed %d connections for sequential logins, want 1", dir.dials)
+	}
+
+	if _, err := pool.Authenticate("alice", "wrong"); err != ErrInvalidCredentials {
+		t.Errorf("Authenticate with a wrong password = %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := pool.Authenticate("alice", ""); err != ErrInvalidCredentials {
+		t.Errorf("Authenticate with an empty password = %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := pool.Authenticate("bob", "bob-pass"); err != ErrUserNotFound {
+		t.Errorf("Authenticate(bob) = %v, want ErrUserNotFound", err)
+	}
+	if got := pool.FailedBindRate(); got != 2 {
+		t.Errorf("FailedBindRate() = %d, want 2", got)
+	}
+	// 密码错误后连接的身份已恢复，可以继续复用
+	if _, err := pool.Authenticate("alice", "alice-pass"); err != nil || dir.dials != 1 {
+		t.Errorf("Authenticate after a failed bind = %v, dials = %d", err, dir.dials)
+	}
+}
+
+func TestPoolUserExists(t *testing.T) {
+	dir := newDirectory()
+	pool := NewPool(testConfig(), dir.dial)
+	defer pool.Close()
+
+	if exists, err := pool.UserExists("alice"); err != nil || !exists {
+		t.Errorf("UserExists(alice) = %v, %v, want true", exists, err)
+	}
+	if exists, err := pool.UserExists("bob"); err != nil || exists {
+		t.Errorf("UserExists(bob) = %v, %v, want false", exists, err)
+	}
+}
+
+func TestPoolReplacesBrokenConn(t *testing.T) {
+	dir := newDirectory()
+	pool := NewPool(testConfig(), dir.dial)
+	defer pool.Close()
+
+	if _, err := pool.Authenticate("alice", "alice-pass"); err != nil {
+		t.Fatalf("Authenticate(alice): %v", err)
+	}
+	pool.mu.Lock()
+	pool.idle[0].conn.(*fakeConn).broken = true
+	pool.mu.Unlock()
+
+	if _, err := pool.Authenticate("alice", "alice-pass"); err != nil {
+		t.Fatalf("Authenticate after the connection broke: %v", err)
+	}
+	if dir.dials != 2 || dir.open != 1 {
+		t.Errorf("dials = %d, open = %d, want 2 and 1", dir.dials, dir.open)
+	}
+}
+
+func TestPoolLimit(t *testing.T) {
+	dir := newDirectory()
+	conf := testConfig()
+	conf.MaxConns = 1
+	pool := NewPool(conf, dir.dial)
+	defer pool.Close()
+
+	held, err := pool.get()
+	if err != nil {
+		t.Fatalf("get(): %v", err)
+	}
+	start := time.Now()
+	if _, err := pool.Authenticate("alice", "alice-pass"); err != ErrPoolExhausted {
+		t.Errorf("Authenticate while the pool is exhausted = %v, want ErrPoolExhausted", err)
+	}
+	if time.Since(start) < time.Second {
+		t.Error("Authenticate should wait for the configured timeout")
+	}
+	pool.put(held, false)
+	if _, err := pool.Authenticate("alice", "alice-pass"); err != nil {
+		t.Errorf("Authenticate after the connection was returned: %v", err)
+	}
+}
+
+func TestEnsureCreatesOnePool(t *testing.T) {
+	defer Init(testConfig())
+	defaultMu.Lock()
+	defaultPool = nil
+	defaultMu.Unlock()
+
+	pools := make(chan *Pool, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(pools); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pools <- Ensure(testConfig())
+		}()
+	}
+	wg.Wait()
+	close(pools)
+	first := Default()
+	for pool := range pools {
+		if pool != first {
+			t.Fatal("concurrent Ensure created more than one pool")
+		}
+	}
+	if first.closed {
+		t.Error("Ensure returned a closed pool")
+	}
+}
@@ -0,0 +1,219 @@
+// Package lockout 按用户名和来源IP统计连续登录失败的次数。
+// 每次失败后需要等待的时间按指数增长，失败次数过多时临时锁定
+package lockout
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 未配置时的限制
+const (
+	DefaultMaxFailures   = 10
+	DefaultIPMaxFailures = 100
+	DefaultBaseDelay     = time.Second
+	DefaultMaxDelay      = time.Minute
+	DefaultDuration      = 15 * time.Minute
+)
+
+// ErrLocked 登录尝试过于频繁，需要等待
+var ErrLocked = errors.New("lockout: too many failed login attempts")
+
+// Entry 一个用户名或IP的失败记录
+type Entry struct {
+	Key         string
+	Failures    int
+	LastFailure time.Time
+	// LockedUntil 锁定的结束时间，没有锁定时为零值
+	LockedUntil time.Time
+}
+
+// Store 保存失败记录。MemoryStore只在本实例内有效，
+// 多个实例需要使用共享的Store
+type Store interface {
+	// Get 返回key的失败记录，不存在时返回只有Key的Entry
+	Get(key string) (Entry, error)
+	// Increment 原子地把key的失败次数加一、最后一次失败设为now，返回修改后的记录。
+	// 不在锁定中且最后一次失败不晚于resetBefore的记录从1重新计数
+	Increment(key string, now, resetBefore time.Time) (Entry, error)
+	// Lock 把key锁定到until
+	Lock(key string, until time.Time) error
+	Delete(key string) error
+	List() ([]Entry, error)
+	// Prune 删除最后一次失败在before之前的记录
+	Prune(before time.Time) error
+}
+
+// Config 登录失败的限制
+type Config struct {
+	// MaxFailures 同一用户名连续失败多少次后锁定
+	MaxFailures int
+	// IPMaxFailures 同一IP连续失败多少次后锁定。一个IP后面可能有很多用户，
+	// 失败次数超过一半后才开始退避
+	IPMaxFailures int
+	// BaseDelay 开始退避后第一次失败需要等待的时间，之后每次失败翻倍，最多为MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Duration 锁定的时间，超过该时间没有失败的记录也会被清零
+	Duration time.Duration
+}
+
+// Limiter 登录失败的限制
+type Limiter struct {
+	store Store
+	conf  Config
+}
+
+// New 创建使用store保存失败记录的Limiter，未配置的限制使用默认值
+func New(store Store, conf Config) *Limiter {
+	if conf.MaxFailures <= 0 {
+		conf.MaxFailures = DefaultMaxFailures
+	}
+	if conf.IPMaxFailures <= 0 {
+		conf.IPMaxFailures = DefaultIPMaxFailures
+	}
+	if conf.BaseDelay <= 0 {
+		conf.BaseDelay = DefaultBaseDelay
+	}
+	if conf.MaxDelay <= 0 {
+		conf.MaxDelay = DefaultMaxDelay
+	}
+	if conf.Duration <= 0 {
+		conf.Duration = DefaultDuration
+	}
+	return &Limiter{store: store, conf: conf}
+}
+
+// UserKey 用户名的记录键，用户名不区分大小写
+func UserKey(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+// IPKey IP的记录键
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Allow 判断username从ip登录在now是否允许，不允许时返回ErrLocked和需要等待的时间
+func (l *Limiter) Allow(username, ip string, now time.Time) (time.Duration, error) {
+	var wait time.Duration
+	for _, key := range []string{UserKey(username), IPKey(ip)} {
+		entry, err := l.store.Get(key)
+		if err != nil {
+			return 0, err
+		}
+		if w := l.retryAfter(entry, now); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return wait, ErrLocked
+	}
+	return 0, nil
+}
+
+// Fail 记录一次失败，返回因这次失败而被锁定的记录
+func (l *Limiter) Fail(username, ip string, now time.Time) ([]Entry, error) {
+	var locked []Entry
+	for _, key := range []string{UserKey(username), IPKey(ip)} {
+		entry, err := l.store.Increment(key, now, now.Add(-l.conf.Duration))
+		if err != nil {
+			return locked, err
+		}
+		if entry.Failures >= l.maxFailures(key) && !entry.LockedUntil.After(now) {
+			entry.LockedUntil = now.Add(l.conf.Duration)
+			if err := l.store.Lock(key, entry.LockedUntil); err != nil {
+				return locked, err
+			}
+			locked = append(locked, entry)
+		}
+	}
+	return locked, nil
+}
+
+// Succeed 登录成功后清除用户名的失败记录。IP的记录保留，
+// 避免攻击者用自己的账号清零
+func (l *Limiter) Succeed(username string) error {
+	return l.store.Delete(UserKey(username))
+}
+
+// Unlock 清除一条失败记录
+func (l *Limiter) Unlock(key string) error {
+	return l.store.Delete(key)
+}
+
+// Blocked 返回在now需要等待的记录，需要等待的时间最长的在前
+func (l *Limiter) Blocked(now time.Time) ([]Entry, error) {
+	entries, err := l.store.List()
+	if err != nil {
+		return nil, err
+	}
+	var blocked []Entry
+	for _, e := range entries {
+		if l.retryAfter(e, now) > 0 {
+			blocked = append(blocked, e)
+		}
+	}
+	sort.SliceStable(blocked, func(i, j int) bool {
+		return l.retryAfter(blocked[i], now) > l.retryAfter(blocked[j], now)
+	})
+	return blocked, nil
+}
+
+// RetryAfter 返回entry在now还需要等待的时间
+func (l *Limiter) RetryAfter(entry Entry, now time.Time) time.Duration {
+	return l.retryAfter(entry, now)
+}
+
+// Prune 清理已经不再限制登录的记录。锁定从最后一次失败开始计算，
+// 最后一次失败超过Duration的记录不会再限制登录
+func (l *Limiter) Prune(now time.Time) error {
+	return l.store.Prune(now.Add(-l.conf.Duration))
+}
+
+func (l *Limiter) retryAfter(entry Entry, now time.Time) time.Duration {
+	if entry.LockedUntil.After(now) {
+		return entry.LockedUntil.Sub(now)
+	}
+	if entry.Failures == 0 || l.expired(entry, now) {
+		return 0
+	}
+	if wait := entry.LastFailure.Add(l.delay(entry)).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// expired 最后一次失败已超过Duration且不在锁定中的记录重新计数
+func (l *Limiter) expired(entry Entry, now time.Time) bool {
+	return !entry.LockedUntil.After(now) && now.Sub(entry.LastFailure) >= l.conf.Duration
+}
+
+// delay 第n次失败后需要等待的时间
+func (l *Limiter) delay(entry Entry) time.Duration {
+	free := 0
+	if strings.HasPrefix(entry.Key, "ip:") {
+		free = l.conf.IPMaxFailures / 2
+	}
+	n := entry.Failures - free
+	if n <= 0 {
+		return 0
+	}
+	delay := l.conf.BaseDelay
+	for i := 1; i < n && delay < l.conf.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > l.conf.MaxDelay {
+		delay = l.conf.MaxDelay
+	}
+	return delay
+}
+
+func (l *Limiter) maxFailures(key string) int {
+	if strings.HasPrefix(key, "ip:") {
+		return l.conf.IPMaxFailures
+	}
+	return l.conf.MaxFailures
+}
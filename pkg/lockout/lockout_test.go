@@ -0,0 +1,120 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestLimiter() *Limiter {
+	return New(NewMemoryStore(), Config{
+		MaxFailures:   5,
+		IPMaxFailures: 10,
+		BaseDelay:     time.Second,
+		MaxDelay:      4 * time.Second,
+		Duration:      time.Minute,
+	})
+}
+
+func TestLimiterBackoff(t *testing.T) {
+	start := time.Now()
+	cases := []struct {
+		name     string
+		failures int
+		after    time.Duration
+		wait     time.Duration
+	}{
+		{"no failures", 0, 0, 0},
+		{"first failure", 1, 0, time.Second},
+		{"first failure waited", 1, time.Second, 0},
+		{"doubled", 3, 0, 4 * time.Second},
+		{"capped", 4, 0, 4 * time.Second},
+		{"locked", 5, 0, time.Minute},
+		{"still locked after the backoff", 5, 10 * time.Second, 50 * time.Second},
+		{"lock expired", 5, time.Minute, 0},
+	}
+	for _, c := range cases {
+		l := newTestLimiter()
+		for i := 0; i < c.failures; i++ {
+			if _, err := l.Fail("alice", "10.0.0.1", start); err != nil {
+				t.Fatal(err)
+			}
+		}
+		wait, err := l.Allow("alice", "10.0.0.1", start.Add(c.after))
+		if wait != c.wait || (c.wait > 0) != (err == ErrLocked) {
+			t.Errorf("%s: Allow = %v, %v, want %v", c.name, wait, err, c.wait)
+		}
+	}
+}
+
+func TestLimiterLockout(t *testing.T) {
+	l := newTestLimiter()
+	now := time.Now()
+	var locked []Entry
+	for i := 0; i < 5; i++ {
+		now = now.Add(10 * time.Second)
+		locked, _ = l.Fail("Alice", "10.0.0.1", now)
+	}
+	if len(locked) != 1 || locked[0].Key != "user:alice" {
+		t.Fatalf("locked = %+v, want user:alice", locked)
+	}
+	// 锁定的是用户名，同一IP的其他用户不受影响
+	if _, err := l.Allow("bob", "10.0.0.1", now); err != nil {
+		t.Errorf("bob should be allowed: %v", err)
+	}
+	if _, err := l.Allow("alice", "10.0.0.2", now); err != ErrLocked {
+		t.Errorf("alice should be locked from every IP: %v", err)
+	}
+	blocked, _ := l.Blocked(now)
+	if len(blocked) != 1 || blocked[0].Key != "user:alice" {
+		t.Errorf("Blocked = %+v", blocked)
+	}
+	if err := l.Unlock(UserKey("alice")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Allow("alice", "10.0.0.1", now); err != nil {
+		t.Errorf("alice should be allowed after unlock: %v", err)
+	}
+}
+
+func TestLimiterIP(t *testing.T) {
+	l := newTestLimiter()
+	now := time.Now()
+	// 每个用户名只失败一次，前一半的失败不会让IP退避
+	for i := 0; i < 5; i++ {
+		l.Fail(string(rune('a'+i)), "10.0.0.1", now)
+	}
+	if _, err := l.Allow("zed", "10.0.0.1", now); err != nil {
+		t.Errorf("the IP should not back off yet: %v", err)
+	}
+	var locked []Entry
+	for i := 5; i < 10; i++ {
+		locked, _ = l.Fail(string(rune('a'+i)), "10.0.0.1", now)
+	}
+	if len(locked) != 1 || locked[0].Key != "ip:10.0.0.1" {
+		t.Errorf("locked = %+v, want ip:10.0.0.1", locked)
+	}
+	if _, err := l.Allow("zed", "10.0.0.1", now); err != ErrLocked {
+		t.Errorf("the IP should be locked: %v", err)
+	}
+	// 登录成功只清除用户名的记录
+	l.Succeed("a")
+	if _, err := l.Allow("zed", "10.0.0.1", now); err != ErrLocked {
+		t.Errorf("a successful login should not unlock the IP: %v", err)
+	}
+}
+
+func TestLimiterPrune(t *testing.T) {
+	store := NewMemoryStore()
+	l := New(store, Config{Duration: time.Minute})
+	now := time.Now()
+	l.Fail("alice", "10.0.0.1", now)
+	l.Fail("bob", "10.0.0.2", now.Add(time.Minute))
+	l.Prune(now.Add(90 * time.Second))
+	entries, _ := store.List()
+	if len(entries) != 2 {
+		t.Errorf("Prune kept %d entries, want bob's 2", len(entries))
+	}
+	if e, _ := store.Get(UserKey("alice")); e.Failures != 0 {
+		t.Errorf("alice should be pruned: %+v", e)
+	}
+}
@@ -0,0 +1,85 @@
+package lockout
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore 保存在本实例内存中的失败记录
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+// NewMemoryStore 创建空的MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: map[string]Entry{}}
+}
+
+// Get 返回key的失败记录
+func (s *MemoryStore) Get(key string) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.entries[key]; ok {
+		return entry, nil
+	}
+	return Entry{Key: key}, nil
+}
+
+// Increment 把key的失败次数加一
+func (s *MemoryStore) Increment(key string, now, resetBefore time.Time) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok || (!entry.LockedUntil.After(now) && !entry.LastFailure.After(resetBefore)) {
+		entry = Entry{Key: key}
+	}
+	entry.Failures++
+	entry.LastFailure = now
+	s.entries[key] = entry
+	return entry, nil
+}
+
+// Lock 把key锁定到until
+func (s *MemoryStore) Lock(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		entry = Entry{Key: key}
+	}
+	entry.LockedUntil = until
+	s.entries[key] = entry
+	return nil
+}
+
+// Delete 删除失败记录
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// List 返回全部失败记录
+func (s *MemoryStore) List() ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]Entry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Prune 删除最后一次失败在before之前的记录
+func (s *MemoryStore) Prune(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, entry := range s.entries {
+		if entry.LastFailure.Before(before) {
+			delete(s.entries, key)
+		}
+	}
+	return nil
+}
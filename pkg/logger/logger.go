@@ -29,7 +29,7 @@ type logFieldKey string
 
 type MetricsJSONFormatter struct{}
 
-//Format log fotmat
+// Format log fotmat
 func (f *MetricsJSONFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	// Note this doesn't include Time, Level and Message which are available on
 	// the Entry.
@@ -41,8 +41,11 @@ func (f *MetricsJSONFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	return append(serialized, '\n'), nil
 }
 
-//MetricsEmit logs the metrics message
+// MetricsEmit logs the metrics message
 func MetricsEmit(method, reqID string, message interface{}, success bool) {
+	if MetricsLog == nil {
+		return
+	}
 	MetricsLog.WithFields(logrus.Fields{
 		"topic":   "trace",
 		"method":  method,
@@ -51,8 +54,11 @@ func MetricsEmit(method, reqID string, message interface{}, success bool) {
 	}).Info(message)
 }
 
-//RuntimeEmit logs the runtime message
+// RuntimeEmit logs the runtime message
 func RuntimeEmit(method, reqID string, message interface{}, success bool) {
+	if RuntimeErrLog == nil {
+		return
+	}
 	RuntimeErrLog.WithFields(logrus.Fields{
 		"topic":   "trace",
 		"method":  method,
@@ -61,7 +67,7 @@ func RuntimeEmit(method, reqID string, message interface{}, success bool) {
 	}).Warn(message)
 }
 
-//SetLog init the logger config
+// SetLog init the logger config
 func SetLog() error {
 	logrus.SetFormatter(&logrus.JSONFormatter{}) // Log as JSON instead of the default ASCII formatter.
 	logrus.SetOutput(os.Stdout)                  // Output to stdout instead of the default stderr, Can be any io.Writer
@@ -0,0 +1,144 @@
+// Package migrate 按版本号顺序执行数据库迁移，并在数据库中记录已经执行的版本
+package migrate
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migration 一次迁移。Version唯一且递增，Down撤销Up的修改
+type Migration struct {
+	Version int64
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// Status 一次迁移的执行状态，AppliedAt为空时还没有执行
+type Status struct {
+	Version   int64      `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at"`
+}
+
+// Record 已经执行的迁移，保存在New指定的表中
+type Record struct {
+	Version   int64 `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// Migrator 在db上执行migrations
+type Migrator struct {
+	db         *gorm.DB
+	table      string
+	migrations []Migration
+}
+
+// New 创建Migrator，已经执行的迁移记录在table中。
+// migrations按Version排序，Version重复时返回错误
+func New(db *gorm.DB, table string, migrations []Migration) (*Migrator, error) {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].Version == sorted[i-1].Version {
+			return nil, fmt.Errorf("migrate: duplicate version %d", sorted[i].Version)
+		}
+	}
+	return &Migrator{db: db, table: table, migrations: sorted}, nil
+}
+
+// applied 返回已经执行的版本，记录表不存在时创建
+func (m *Migrator) applied() (map[int64]Record, error) {
+	if err := m.db.Table(m.table).AutoMigrate(&Record{}); err != nil {
+		return nil, err
+	}
+	var records []Record
+	if res := m.db.Table(m.table).Find(&records); res.Error != nil {
+		return nil, res.Error
+	}
+	applied := make(map[int64]Record, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// Status 返回全部迁移的执行状态
+func (m *Migrator) Status() ([]Status, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]Status, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := Status{Version: migration.Version, Name: migration.Name}
+		if record, ok := applied[migration.Version]; ok {
+			appliedAt := record.AppliedAt
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Up 依次执行版本不超过target的未执行的迁移，target为0时执行全部。
+// 每次迁移和它的记录在同一个事务中，返回执行成功的迁移
+func (m *Migrator) Up(target int64) ([]Migration, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for _, migration := range m.migrations {
+		if target > 0 && migration.Version > target {
+			break
+		}
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		err := m.db.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Up(tx); err != nil {
+				return err
+			}
+			return tx.Table(m.table).Create(&Record{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("migrate: up %d %s: %v", migration.Version, migration.Name, err)
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
+
+// Down 从最新的版本开始撤销steps个已经执行的迁移，返回撤销成功的迁移
+func (m *Migrator) Down(steps int) ([]Migration, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		if migration.Down == nil {
+			return done, fmt.Errorf("migrate: %d %s cannot be rolled back", migration.Version, migration.Name)
+		}
+		err := m.db.Transaction(func(tx *gorm.DB) error {
+			if err := migration.Down(tx); err != nil {
+				return err
+			}
+			return tx.Table(m.table).Delete(&Record{}, migration.Version).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("migrate: down %d %s: %v", migration.Version, migration.Name, err)
+		}
+		done = append(done, migration)
+	}
+	return done, nil
+}
@@ -0,0 +1,74 @@
+package migrate
+
+import (
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+type widget struct {
+	ID   uint
+	Name string
+}
+
+func TestMigrator(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(db, "schema_migrations", []Migration{
+		{
+			Version: 2,
+			Name:    "unique_name",
+			Up: func(tx *gorm.DB) error {
+				return tx.Exec("CREATE UNIQUE INDEX idx_widgets_name ON widgets (name)").Error
+			},
+			Down: func(tx *gorm.DB) error { return tx.Migrator().DropIndex(&widget{}, "idx_widgets_name") },
+		},
+		{
+			Version: 1,
+			Name:    "create_widgets",
+			Up:      func(tx *gorm.DB) error { return tx.AutoMigrate(&widget{}) },
+			Down:    func(tx *gorm.DB) error { return tx.Migrator().DropTable(&widget{}) },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if done, err := m.Up(1); err != nil || len(done) != 1 || done[0].Version != 1 {
+		t.Fatalf("Up(1) = %v, %v", done, err)
+	}
+	if !db.Migrator().HasTable("schema_migrations") {
+		t.Fatal("applied versions are not recorded in schema_migrations")
+	}
+	statuses, err := m.Status()
+	if err != nil || len(statuses) != 2 || statuses[0].AppliedAt == nil || statuses[1].AppliedAt != nil {
+		t.Fatalf("Status after Up(1) = %+v, %v", statuses, err)
+	}
+	if done, err := m.Up(0); err != nil || len(done) != 1 || done[0].Version != 2 {
+		t.Fatalf("Up(0) = %v, %v", done, err)
+	}
+	if done, err := m.Up(0); err != nil || len(done) != 0 {
+		t.Errorf("Up(0) again = %v, %v; want nothing", done, err)
+	}
+	db.Create(&widget{Name: "a"})
+	if err := db.Create(&widget{Name: "a"}).Error; err == nil {
+		t.Error("duplicate name inserted after unique_name")
+	}
+
+	if done, err := m.Down(1); err != nil || len(done) != 1 || done[0].Version != 2 {
+		t.Fatalf("Down(1) = %v, %v", done, err)
+	}
+	if err := db.Create(&widget{Name: "a"}).Error; err != nil {
+		t.Errorf("duplicate name after rolling back unique_name: %v", err)
+	}
+	if done, err := m.Down(5); err != nil || len(done) != 1 || db.Migrator().HasTable(&widget{}) {
+		t.Errorf("Down(5) = %v, %v", done, err)
+	}
+
+	if _, err := New(db, "schema_migrations", []Migration{{Version: 1}, {Version: 1}}); err == nil {
+		t.Error("New accepted duplicate versions")
+	}
+}
@@ -0,0 +1,178 @@
+package notify
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+	"gopa/model"
+	"gopa/pkg/logger"
+)
+
+// 通知事件类型
+const (
+	MemberAdded    = "member.added"
+	MemberUpdated  = "member.updated"
+	MemberDeleted  = "member.deleted"
+	RegoAdded      = "rego.added"
+	RegoUpdated    = "rego.updated"
+	RegoDeleted    = "rego.deleted"
+	DecisionDenied = "decision.denied"
+
+	AccessRequestCreated  = "accessRequest.created"
+	AccessRequestApproved = "accessRequest.approved"
+	AccessRequestDenied   = "accessRequest.denied"
+)
+
+// Event 一条需要通知的事件
+type Event struct {
+	Kind    string
+	Project string
+	Actor   string
+	Text    string
+}
+
+// Notifier 通知的发送方
+type Notifier interface {
+	Notify(event Event) error
+}
+
+var (
+	// defaultNotifier 全局使用的通知发送方，未配置时为nil，不发送任何通知
+	defaultNotifier Notifier
+	// privilegedRoutes 被拒绝时需要通知的路由前缀
+	privilegedRoutes []string
+	// defaultMu 配置热加载时Init与Send、IsPrivileged并发执行
+	defaultMu sync.RWMutex
+)
+
+// Init 根据配置初始化全局的通知发送方
+func Init(conf model.NotifyService) {
+	var notifier Notifier
+	if conf.Slack.Enabled {
+		notifier = NewSlack(conf.Slack)
+	}
+	defaultMu.Lock()
+	defaultNotifier = notifier
+	privilegedRoutes = conf.Slack.PrivilegedRoutes
+	defaultMu.Unlock()
+}
+
+// Default 返回全局使用的通知发送方，未配置时为nil
+func Default() Notifier {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultNotifier
+}
+
+// Send 异步发送事件，发送失败时记录到runtime日志
+func Send(event Event) {
+	notifier := Default()
+	if notifier == nil {
+		return
+	}
+	go func() {
+		if err := notifier.Notify(event); err != nil {
+			logger.RuntimeEmit("notify.Send", "", fmt.Sprintf("%s: %v", event.Kind, err), false)
+		}
+	}()
+}
+
+// IsPrivileged 判断route是否为需要通知的特权路由
+func IsPrivileged(route string) bool {
+	defaultMu.RLock()
+	routes := privilegedRoutes
+	defaultMu.RUnlock()
+	for _, prefix := range routes {
+		if prefix != "" && strings.HasPrefix(route, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Slack 通过webhook或bot token向Slack发送通知
+type Slack struct {
+	conf       model.SlackNotify
+	client     *slack.Client
+	httpClient *http.Client
+}
+
+// NewSlack 创建Slack通知发送方
+func NewSlack(conf model.SlackNotify) *Slack {
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	options := []slack.Option{slack.OptionHTTPClient(httpClient)}
+	if conf.APIURL != "" {
+		options = append(options, slack.OptionAPIURL(strings.TrimSuffix(conf.APIURL, "/")+"/"))
+	}
+	return &Slack{
+		conf:       conf,
+		client:     slack.New(conf.BotToken, options...),
+		httpClient: httpClient,
+	}
+}
+
+// Notify 按组选择频道或webhook并发送事件
+func (s *Slack) Notify(event Event) error {
+	channel, webhookURL := s.route(event.Project)
+	text := Format(event)
+	if webhookURL != "" {
+		return slack.PostWebhookCustomHTTP(webhookURL, s.httpClient, &slack.WebhookMessage{
+			Channel: channel,
+			Text:    text,
+		})
+	}
+	if s.conf.BotToken == "" || channel == "" {
+		return fmt.Errorf("no slack webhook or channel configured for project [%s]", event.Project)
+	}
+	_, _, err := s.client.PostMessage(channel, slack.MsgOptionText(text, false))
+	return err
+}
+
+// route 返回project对应的频道和webhook，优先使用精确匹配的规则，
+// 其次是*规则，最后是默认配置
+func (s *Slack) route(project string) (string, string) {
+	var wildcard *model.SlackRoute
+	for i, route := range s.conf.Routes {
+		if route.Project == project {
+			return s.merge(route)
+		}
+		if route.Project == "*" && wildcard == nil {
+			wildcard = &s.conf.Routes[i]
+		}
+	}
+	if wildcard != nil {
+		return s.merge(*wildcard)
+	}
+	return s.conf.Channel, s.conf.WebhookURL
+}
+
+// merge 规则中未配置的频道或webhook使用默认配置
+func (s *Slack) merge(route model.SlackRoute) (string, string) {
+	channel, webhookURL := route.Channel, route.WebhookURL
+	if channel == "" {
+		channel = s.conf.Channel
+	}
+	if webhookURL == "" && route.Channel == "" {
+		webhookURL = s.conf.WebhookURL
+	}
+	return channel, webhookURL
+}
+
+// Format 把事件格式化成通知文本
+func Format(event Event) string {
+	text := fmt.Sprintf("[GOPA] %s", event.Kind)
+	if event.Project != "" {
+		text += fmt.Sprintf(" in project %s", event.Project)
+	}
+	if event.Actor != "" {
+		text += fmt.Sprintf(" by %s", event.Actor)
+	}
+	if event.Text != "" {
+		text += ": " + event.Text
+	}
+	return text
+}
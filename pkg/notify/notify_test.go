@@ -0,0 +1,151 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopa/model"
+)
+
+// fakeSlack 本地的Slack替身，记录收到的webhook和chat.postMessage请求
+type fakeSlack struct {
+	mu       sync.Mutex
+	webhooks map[string][]string
+	messages map[string][]string
+}
+
+func newFakeSlack() (*fakeSlack, *httptest.Server) {
+	fake := &fakeSlack{webhooks: map[string][]string{}, messages: map[string][]string{}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.HasPrefix(r.URL.Path, "/hooks/") {
+			var msg struct {
+				Text string `json:"text"`
+			}
+			_ = json.Unmarshal(body, &msg)
+			fake.webhooks[r.URL.Path] = append(fake.webhooks[r.URL.Path], msg.Text)
+			_, _ = w.Write([]byte("ok"))
+			return
+		}
+		if r.URL.Path == "/api/chat.postMessage" {
+			form, _ := url.ParseQuery(string(body))
+			if form.Get("token") != "xoxb-test" && r.Header.Get("Authorization") != "Bearer xoxb-test" {
+				_, _ = w.Write([]byte(`{"ok":false,"error":"invalid_auth"}`))
+				return
+			}
+			channel := form.Get("channel")
+			fake.messages[channel] = append(fake.messages[channel], form.Get("text"))
+			_, _ = w.Write([]byte(`{"ok":true,"channel":"` + channel + `","ts":"1"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	return fake, server
+}
+
+func TestSlackNotify(t *testing.T) {
+	fake, server := newFakeSlack()
+	defer server.Close()
+
+	s := NewSlack(model.SlackNotify{
+		Enabled:    true,
+		WebhookURL: server.URL + "/hooks/default",
+		BotToken:   "xoxb-test",
+		APIURL:     server.URL + "/api",
+		Routes: []model.SlackRoute{
+			{Project: "infra", Channel: "#infra-alerts"},
+			{Project: "data", WebhookURL: server.URL + "/hooks/data"},
+		},
+	})
+	events := []Event{
+		{Kind: MemberAdded, Project: "infra", Actor: "alice", Text: "bob as admin"},
+		{Kind: RegoUpdated, Project: "data", Actor: "alice", Text: "/data/api/v1/export.rego"},
+		{Kind: DecisionDenied, Project: "guest", Actor: "mallory", Text: "/eva/api/v1/release"},
+	}
+	for _, event := range events {
+		if err := s.Notify(event); err != nil {
+			t.Fatalf("Notify(%s): %v", event.Kind, err)
+		}
+	}
+
+	if got := fake.messages["#infra-alerts"]; len(got) != 1 || got[0] != "[GOPA] member.added in project infra by alice: bob as admin" {
+		t.Errorf("bot messages to #infra-alerts = %v", got)
+	}
+	if got := fake.webhooks["/hooks/data"]; len(got) != 1 || !strings.Contains(got[0], "rego.updated") {
+		t.Errorf("webhook messages to data = %v", got)
+	}
+	if got := fake.webhooks["/hooks/default"]; len(got) != 1 || !strings.Contains(got[0], "decision.denied") {
+		t.Errorf("webhook messages to default = %v", got)
+	}
+}
+
+func TestSlackNotifyBadToken(t *testing.T) {
+	_, server := newFakeSlack()
+	defer server.Close()
+
+	s := NewSlack(model.SlackNotify{
+		BotToken: "xoxb-wrong",
+		Channel:  "#gopa",
+		APIURL:   server.URL + "/api",
+	})
+	if err := s.Notify(Event{Kind: MemberDeleted, Project: "infra"}); err == nil {
+		t.Error("Notify with an invalid bot token should fail")
+	}
+}
+
+func TestIsPrivileged(t *testing.T) {
+	Init(model.NotifyService{Slack: model.SlackNotify{PrivilegedRoutes: []string{"/eva/api/v1/release", "/api/v1/rego"}}})
+	cases := map[string]bool{
+		"/eva/api/v1/release":      true,
+		"/api/v1/rego/update":      true,
+		"/perf-server/api/v1/bus":  false,
+		"/eva/api/v1/applications": false,
+	}
+	for route, want := range cases {
+		if got := IsPrivileged(route); got != want {
+			t.Errorf("IsPrivileged(%s) = %v, want %v", route, got, want)
+		}
+	}
+}
+
+// 配置热加载时Init与Send、IsPrivileged并发执行，用go test -race检查
+func TestInitWhileSending(t *testing.T) {
+	_, server := newFakeSlack()
+	defer server.Close()
+	defer Init(model.NotifyService{})
+	enabled := model.NotifyService{Slack: model.SlackNotify{
+		Enabled:          true,
+		WebhookURL:       server.URL + "/hooks/default",
+		PrivilegedRoutes: []string{"/api/v1/rego"},
+	}}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if j%2 == 0 {
+					Init(enabled)
+				} else {
+					Init(model.NotifyService{})
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				Send(Event{Kind: RegoUpdated, Project: "ops", Actor: "alice", Text: "/api/v1/demo.rego"})
+				IsPrivileged("/api/v1/rego/update")
+			}
+		}()
+	}
+	wg.Wait()
+}
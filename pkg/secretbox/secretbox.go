@@ -0,0 +1,76 @@
+// Package secretbox 用AES-256-GCM加密保存在数据库中的敏感信息
+package secretbox
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+)
+
+// KeySize 密钥的字节数
+const KeySize = 32
+
+var (
+	// ErrKeySize 密钥不是32字节
+	ErrKeySize = errors.New("secretbox: key must be 32 bytes")
+	// ErrCiphertext 密文被篡改或不是用该密钥加密的
+	ErrCiphertext = errors.New("secretbox: message authentication failed")
+)
+
+// Box 使用同一个密钥加密和解密
+type Box struct {
+	aead cipher.AEAD
+}
+
+// New 用32字节的密钥创建Box
+func New(key []byte) (*Box, error) {
+	if len(key) != KeySize {
+		return nil, ErrKeySize
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Box{aead: aead}, nil
+}
+
+// NewFromBase64 用base64编码的密钥创建Box
+func NewFromBase64(encoded string) (*Box, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return New(key)
+}
+
+// Seal 加密plaintext，返回base64编码的随机nonce和密文
+func (b *Box) Seal(plaintext []byte) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b.aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+// Open 解密Seal的结果
+func (b *Box) Open(sealed string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	size := b.aead.NonceSize()
+	if len(data) < size {
+		return nil, ErrCiphertext
+	}
+	plaintext, err := b.aead.Open(nil, data[:size], data[size:], nil)
+	if err != nil {
+		return nil, ErrCiphertext
+	}
+	return plaintext, nil
+}
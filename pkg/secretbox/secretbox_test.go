@@ -0,0 +1,34 @@
+package secretbox
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, KeySize)
+	box, err := NewFromBase64(base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := box.Seal([]byte("totp secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := box.Seal([]byte("totp secret"))
+	if sealed == again {
+		t.Error("sealing twice should use different nonces")
+	}
+	if plaintext, err := box.Open(sealed); err != nil || string(plaintext) != "totp secret" {
+		t.Errorf("Open = %q, %v", plaintext, err)
+	}
+
+	other, _ := New(bytes.Repeat([]byte{8}, KeySize))
+	if _, err := other.Open(sealed); err != ErrCiphertext {
+		t.Errorf("Open with another key = %v, want ErrCiphertext", err)
+	}
+	if _, err := New([]byte("short")); err != ErrKeySize {
+		t.Errorf("New(short) = %v, want ErrKeySize", err)
+	}
+}
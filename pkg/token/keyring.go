@@ -0,0 +1,278 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// 支持的签名算法
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmES256 = "ES256"
+)
+
+var (
+	// ErrNoSigningKey 密钥环中没有可用于签名的密钥
+	ErrNoSigningKey = errors.New("token: no signing key available")
+	// ErrUnknownKey token的kid不在密钥环中，可能已被轮换清理
+	ErrUnknownKey = errors.New("token: unknown key id")
+)
+
+// JWKSMaxAge /.well-known/jwks.json 允许下游服务缓存的时间
+const JWKSMaxAge = 5 * time.Minute
+
+// Key 密钥环中的一个签名密钥。ActiveFrom之前只发布在JWKS中用于校验，
+// 之后才用于签名，为零时加入密钥环后立即用于签名
+type Key struct {
+	ID         string
+	Algorithm  string
+	CreatedAt  time.Time
+	ActiveFrom time.Time
+	Private    crypto.Signer
+}
+
+// KeyRing 签名密钥环。已生效的最新密钥用于签名，较旧的密钥在被清理前仍可用于校验，
+// 这样轮换密钥时已签发的token不会立即失效
+type KeyRing struct {
+	algorithm string
+
+	mu   sync.RWMutex
+	keys []*Key
+}
+
+// JWK JWKS中的一个公钥
+type JWK struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet /.well-known/jwks.json 返回的公钥集合
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewKeyRing 创建使用algorithm签名的空密钥环
+func NewKeyRing(algorithm string) (*KeyRing, error) {
+	if algorithm != AlgorithmRS256 && algorithm != AlgorithmES256 {
+		return nil, fmt.Errorf("token: unsupported signing algorithm %q", algorithm)
+	}
+	return &KeyRing{algorithm: algorithm}, nil
+}
+
+// Algorithm 返回密钥环的签名算法
+func (r *KeyRing) Algorithm() string {
+	return r.algorithm
+}
+
+// GenerateKey 生成一个新的密钥并加入密钥环，从activeFrom开始成为签名用的密钥
+func (r *KeyRing) GenerateKey(now, activeFrom time.Time) (*Key, error) {
+	var private crypto.Signer
+	var err error
+	switch r.algorithm {
+	case AlgorithmRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgorithmES256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	key := &Key{ID: hex.EncodeToString(id), Algorithm: r.algorithm, CreatedAt: now, ActiveFrom: activeFrom, Private: private}
+	r.Add(key)
+	return key, nil
+}
+
+// Add 把密钥加入密钥环，kid已存在时忽略
+func (r *KeyRing) Add(key *Key) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, k := range r.keys {
+		if k.ID == key.ID {
+			return
+		}
+	}
+	r.keys = append(r.keys, key)
+	sort.SliceStable(r.keys, func(i, j int) bool {
+		return r.keys[i].CreatedAt.After(r.keys[j].CreatedAt)
+	})
+}
+
+// Prune 删除在before之前创建的密钥，但保留最新的密钥和签名用的密钥，返回被删除的kid
+func (r *KeyRing) Prune(before time.Time) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	active := r.active(time.Now())
+	var removed []string
+	kept := r.keys[:0]
+	for i, k := range r.keys {
+		if i > 0 && k != active && k.CreatedAt.Before(before) {
+			removed = append(removed, k.ID)
+			continue
+		}
+		kept = append(kept, k)
+	}
+	r.keys = kept
+	return removed
+}
+
+// Active 返回签名用的密钥，即已经生效的最新密钥
+func (r *KeyRing) Active() *Key {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.active(time.Now())
+}
+
+// Latest 返回最新创建的密钥，可能还没有生效
+func (r *KeyRing) Latest() *Key {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.keys) == 0 {
+		return nil
+	}
+	return r.keys[0]
+}
+
+// active 返回在now时已经生效的最新密钥，调用时需持有锁
+func (r *KeyRing) active(now time.Time) *Key {
+	for _, k := range r.keys {
+		if !k.ActiveFrom.After(now) {
+			return k
+		}
+	}
+	return nil
+}
+
+// Lookup 按kid查找密钥
+func (r *KeyRing) Lookup(kid string) (*Key, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, k := range r.keys {
+		if k.ID == kid {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+// Sign 用签名用的密钥签名，并在header中写入kid
+func (r *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	key := r.Active()
+	if key == nil {
+		return "", ErrNoSigningKey
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// Parse 按header中的kid找到公钥并校验token，返回其中的声明
+func (r *KeyRing) Parse(tokenString string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	if err := r.ParseClaims(tokenString, claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// ParseClaims 与Parse相同，但把声明解析到claims中
+func (r *KeyRing) ParseClaims(tokenString string, claims jwt.Claims) error {
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := r.Lookup(kid)
+		if !ok {
+			return nil, ErrUnknownKey
+		}
+		// 防止用其他算法（如把公钥当作HS256的secret）伪造token
+		if token.Method.Alg() != key.Algorithm {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return key.Private.Public(), nil
+	})
+	return err
+}
+
+// JWKS 返回密钥环中全部公钥，包括还没有生效的密钥，供其他服务离线校验token
+func (r *KeyRing) JWKS() JWKSet {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	set := JWKSet{Keys: []JWK{}}
+	for _, k := range r.keys {
+		jwk := JWK{Kid: k.ID, Alg: k.Algorithm, Use: "sig"}
+		switch public := k.Private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (public.Curve.Params().BitSize + 7) / 8
+			jwk.Kty = "EC"
+			jwk.Crv = public.Curve.Params().Name
+			jwk.X = base64.RawURLEncoding.EncodeToString(padded(public.X.Bytes(), size))
+			jwk.Y = base64.RawURLEncoding.EncodeToString(padded(public.Y.Bytes(), size))
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// MarshalPrivateKey 把私钥编码为PKCS#8 PEM，用于持久化
+func MarshalPrivateKey(key *Key) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key.Private)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// UnmarshalPrivateKey 从PKCS#8 PEM还原密钥
+func UnmarshalPrivateKey(id, algorithm string, createdAt time.Time, encoded string) (*Key, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return nil, fmt.Errorf("token: key %s is not PEM encoded", id)
+	}
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("token: key %s cannot sign", id)
+	}
+	return &Key{ID: id, Algorithm: algorithm, CreatedAt: createdAt, Private: signer}, nil
+}
+
+// padded 在b前补0到size字节，JWK要求EC坐标为定长
+func padded(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	out := make([]byte, size)
+	copy(out[size-len(b):], b)
+	return out
+}
@@ -0,0 +1,158 @@
+package token
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func newTestRing(t *testing.T, algorithm string) *KeyRing {
+	ring, err := NewKeyRing(algorithm)
+	if err != nil {
+		t.Fatalf("NewKeyRing(%s): %v", algorithm, err)
+	}
+	if _, err := ring.GenerateKey(time.Now(), time.Time{}); err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	return ring
+}
+
+func TestKeyRingSignAndParse(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmRS256, AlgorithmES256} {
+		ring := newTestRing(t, algorithm)
+		signed, err := ring.Sign(jwt.MapClaims{"username": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+		if err != nil {
+			t.Fatalf("%s: Sign: %v", algorithm, err)
+		}
+		token, _, err := new(jwt.Parser).ParseUnverified(signed, jwt.MapClaims{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.Header["kid"] != ring.Active().ID || token.Header["alg"] != algorithm {
+			t.Errorf("%s: header = %v", algorithm, token.Header)
+		}
+		claims, err := ring.Parse(signed)
+		if err != nil || claims["username"] != "alice" {
+			t.Errorf("%s: Parse = %v, %v", algorithm, claims, err)
+		}
+	}
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	ring := newTestRing(t, AlgorithmRS256)
+	old := ring.Active()
+	signed, err := ring.Sign(jwt.MapClaims{"username": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := ring.GenerateKey(old.CreatedAt.Add(time.Hour), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ring.Active() != rotated {
+		t.Error("the newest key should be used for signing after rotation")
+	}
+	if _, err := ring.Parse(signed); err != nil {
+		t.Errorf("a token signed before rotation should still verify: %v", err)
+	}
+	if got := len(ring.JWKS().Keys); got != 2 {
+		t.Errorf("JWKS has %d keys, want 2", got)
+	}
+
+	if removed := ring.Prune(rotated.CreatedAt); len(removed) != 1 || removed[0] != old.ID {
+		t.Errorf("Prune = %v, want [%s]", removed, old.ID)
+	}
+	if _, err := ring.Parse(signed); err == nil {
+		t.Error("a token signed with a pruned key should not verify")
+	}
+	// 最新的密钥不会被清理
+	if removed := ring.Prune(time.Now().Add(time.Hour)); len(removed) != 0 || ring.Active() != rotated {
+		t.Errorf("Prune removed the active key: %v", removed)
+	}
+}
+
+func TestKeyRingRejectsForgedTokens(t *testing.T) {
+	ring := newTestRing(t, AlgorithmRS256)
+	other := newTestRing(t, AlgorithmRS256)
+	forged, _ := other.Sign(jwt.MapClaims{"username": "mallory"})
+	if _, err := ring.Parse(forged); err == nil {
+		t.Error("a token signed by another key ring should not verify")
+	}
+
+	// 用公钥作为HS256的secret伪造token
+	public, err := x509.MarshalPKIXPublicKey(ring.Active().Private.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"username": "mallory"})
+	hs.Header["kid"] = ring.Active().ID
+	confused, _ := hs.SignedString(public)
+	if _, err := ring.Parse(confused); err == nil {
+		t.Error("an HS256 token signed with the public key should not verify")
+	}
+
+	expired, _ := ring.Sign(jwt.MapClaims{"username": "alice", "exp": time.Now().Add(-time.Minute).Unix()})
+	if _, err := ring.Parse(expired); err == nil {
+		t.Error("an expired token should not verify")
+	}
+}
+
+func TestKeyRoundTrip(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmRS256, AlgorithmES256} {
+		ring := newTestRing(t, algorithm)
+		key := ring.Active()
+		encoded, err := MarshalPrivateKey(key)
+		if err != nil {
+			t.Fatalf("%s: MarshalPrivateKey: %v", algorithm, err)
+		}
+		restored, err := UnmarshalPrivateKey(key.ID, key.Algorithm, key.CreatedAt, encoded)
+		if err != nil {
+			t.Fatalf("%s: UnmarshalPrivateKey: %v", algorithm, err)
+		}
+		// 另一个实例读取同一个密钥后可以校验本实例签发的token
+		replica, _ := NewKeyRing(algorithm)
+		replica.Add(restored)
+		signed, _ := ring.Sign(jwt.MapClaims{"username": "alice"})
+		if _, err := replica.Parse(signed); err != nil {
+			t.Errorf("%s: replica Parse: %v", algorithm, err)
+		}
+	}
+	if _, err := NewKeyRing("HS256"); err == nil {
+		t.Error("NewKeyRing(HS256) should fail")
+	}
+}
+
+func TestKeyRingPendingKey(t *testing.T) {
+	ring := newTestRing(t, AlgorithmRS256)
+	old := ring.Active()
+	now := time.Now()
+	pending, err := ring.GenerateKey(now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ring.Active() != old || ring.Latest() != pending {
+		t.Errorf("Active = %s, Latest = %s, want %s and %s", ring.Active().ID, ring.Latest().ID, old.ID, pending.ID)
+	}
+	signed, err := ring.Sign(jwt.MapClaims{"username": "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _ := jwt.Parse(signed, nil)
+	if parsed == nil || parsed.Header["kid"] != old.ID {
+		t.Error("a key was used for signing before it became active")
+	}
+	published := false
+	for _, jwk := range ring.JWKS().Keys {
+		published = published || jwk.Kid == pending.ID
+	}
+	if !published {
+		t.Error("the pending key is not published in JWKS")
+	}
+	// 新密钥生效前，签名用的旧密钥不会被清理
+	if removed := ring.Prune(now.Add(time.Minute)); len(removed) != 0 {
+		t.Errorf("Prune removed %v before the new key became active", removed)
+	}
+}
@@ -0,0 +1,57 @@
+package token
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// refreshTokenPrefix 刷新token的前缀，便于与API key和日志中的其他字符串区分
+const refreshTokenPrefix = "gopa_rt_"
+
+var (
+	// ErrRefreshExpired 刷新token已过期
+	ErrRefreshExpired = errors.New("refresh token has expired")
+	// ErrRefreshRevoked 刷新token已被吊销
+	ErrRefreshRevoked = errors.New("refresh token has been revoked")
+	// ErrRefreshReused 刷新token已经使用过，可能已经泄露
+	ErrRefreshReused = errors.New("refresh token has already been used")
+)
+
+// RefreshToken 新签发的刷新token。Raw只返回给客户端一次，服务端只保存Hash
+type RefreshToken struct {
+	Raw       string
+	Hash      string
+	ExpiresAt time.Time
+}
+
+// NewRefreshToken 生成一个新的刷新token
+func (s *Service) NewRefreshToken() (*RefreshToken, error) {
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	raw := refreshTokenPrefix + id
+	return &RefreshToken{Raw: raw, Hash: HashRefreshToken(raw), ExpiresAt: s.now().Add(s.refreshTimeout)}, nil
+}
+
+// HashRefreshToken 返回刷新token的SHA-256摘要，用于保存和查找
+func HashRefreshToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckRefresh 判断服务端保存的刷新token在now是否还能使用。
+// 返回ErrRefreshReused时调用方应吊销整个登录
+func CheckRefresh(usedAt, revokedAt *time.Time, expiresAt, now time.Time) error {
+	switch {
+	case revokedAt != nil:
+		return ErrRefreshRevoked
+	case usedAt != nil:
+		return ErrRefreshReused
+	case !now.Before(expiresAt):
+		return ErrRefreshExpired
+	}
+	return nil
+}
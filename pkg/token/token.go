@@ -1,95 +1,196 @@
+// Package token 签发和校验GOPA的token。
+// Service是唯一的token实现，在启动时创建一次并注入到路由中
 package token
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
-	"fmt"
+	"strings"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
-	"github.com/spf13/viper"
 )
 
+// 未配置时token和刷新token的有效期
+const (
+	DefaultTimeout        = time.Hour
+	DefaultRefreshTimeout = 7 * 24 * time.Hour
+	// ChallengeTimeout 密码验证通过后完成两步验证的期限
+	ChallengeTimeout = 5 * time.Minute
+)
+
+// AudienceMFA 两步验证的临时token的aud，只能用于完成登录
+const AudienceMFA = "gopa-mfa"
+
 var (
 	// ErrMissingHeader means the `Authorization` header was empty.
-	ErrMissingHeader = errors.New("The length of the `Authorization` header is zero.")
+	ErrMissingHeader = errors.New("auth header is empty")
+	// ErrInvalidHeader Authorization请求头不是 Bearer <token> 的格式
+	ErrInvalidHeader = errors.New("auth header is invalid")
+	// ErrMissingExp token中没有过期时间
+	ErrMissingExp = errors.New("missing exp field")
+	// ErrChallenge token是两步验证的临时token，不能访问API
+	ErrChallenge = errors.New("two-factor authentication is not completed")
+	// ErrNotChallenge token不是两步验证的临时token
+	ErrNotChallenge = errors.New("not a two-factor authentication token")
 )
 
-// Context is the context of the JSON web token.
-type Context struct {
-	ID       uint64
-	Username string
+// Claims GOPA token中的声明。
+// IssuedAt为用户登录的时间，刷新token时保持不变，用于按用户吊销；
+// OrigIssuedAt为本token签发的时间；Session为本次登录的编号，对应服务端保存的刷新token
+type Claims struct {
+	Username       string `json:"username"`
+	Group          string `json:"group"`
+	Role           string `json:"role"`
+	OrigIssuedAt   int64  `json:"orig_iat"`
+	Session        string `json:"sid,omitempty"`
+	ServiceAccount bool   `json:"service_account,omitempty"`
+	APIKeyID       uint64 `json:"api_key_id,omitempty"`
+	// MFA 登录时是否通过了两步验证
+	MFA bool `json:"mfa,omitempty"`
+	jwt.StandardClaims
+}
+
+// Config token的有效期配置
+type Config struct {
+	// Timeout 签发的token的有效期
+	Timeout time.Duration
+	// RefreshTimeout 刷新token的有效期，每次刷新后重新计算
+	RefreshTimeout time.Duration
 }
 
-// secretFunc validates the secret format.
-func secretFunc(secret string) jwt.Keyfunc {
-	return func(token *jwt.Token) (interface{}, error) {
-		// Make sure the `alg` is what we except.
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, jwt.ErrSignatureInvalid
-		}
+// Service 负责token的声明格式、签名、校验和刷新
+type Service struct {
+	ring           *KeyRing
+	timeout        time.Duration
+	refreshTimeout time.Duration
+	now            func() time.Time
+}
 
-		return []byte(secret), nil
+// NewService 创建使用ring签名的token服务，未配置的有效期使用默认值
+func NewService(ring *KeyRing, conf Config) *Service {
+	if conf.Timeout <= 0 {
+		conf.Timeout = DefaultTimeout
 	}
+	if conf.RefreshTimeout <= 0 {
+		conf.RefreshTimeout = DefaultRefreshTimeout
+	}
+	return &Service{ring: ring, timeout: conf.Timeout, refreshTimeout: conf.RefreshTimeout, now: time.Now}
 }
 
-// Parse validates the token with the specified secret,
-// and returns the context if the token was valid.
-func Parse(tokenString string, secret string) (*Context, error) {
-	ctx := &Context{}
+// KeyRing 返回签名用的密钥环
+func (s *Service) KeyRing() *KeyRing {
+	return s.ring
+}
 
-	// Parse the token.
-	token, err := jwt.Parse(tokenString, secretFunc(secret))
+// Issue 为用户登录签发一个新的token，session为本次登录的编号
+func (s *Service) Issue(username, group, role, session string) (string, *Claims, error) {
+	return s.Refresh(Claims{
+		Username: username,
+		Group:    group,
+		Role:     role,
+		Session:  session,
+		StandardClaims: jwt.StandardClaims{
+			IssuedAt: s.now().Unix(),
+		},
+	})
+}
 
-	// Parse error.
+// Refresh 以新的jti和有效期签发claims，登录时间和Session保持不变
+func (s *Service) Refresh(claims Claims) (string, *Claims, error) {
+	jti, err := randomID()
 	if err != nil {
-		return ctx, err
-
-		// Read the token if it's valid.
-	} else if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		ctx.ID = uint64(claims["id"].(float64))
-		ctx.Username = claims["username"].(string)
-		return ctx, nil
+		return "", nil, err
+	}
+	claims.Id = jti
+	return s.sign(&claims, s.now())
+}
 
-		// Other errors.
-	} else {
-		return ctx, err
+// IssueChallenge 为密码验证通过、还需要两步验证的用户签发临时token
+func (s *Service) IssueChallenge(username string) (string, error) {
+	jti, err := randomID()
+	if err != nil {
+		return "", err
 	}
+	now := s.now()
+	return s.ring.Sign(&Claims{
+		Username:     username,
+		OrigIssuedAt: now.Unix(),
+		StandardClaims: jwt.StandardClaims{
+			Audience:  AudienceMFA,
+			Id:        jti,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(ChallengeTimeout).Unix(),
+		},
+	})
 }
 
-// ParseRequest gets the token from the header and
-// pass it to the Parse function to parses the token.
-func ParseRequest(c *gin.Context) (*Context, error) {
-	header := c.Request.Header.Get("Authorization")
+// Parse 校验token的签名和有效期，返回其中的声明。两步验证的临时token会被拒绝
+func (s *Service) Parse(tokenString string) (*Claims, error) {
+	claims, err := s.parse(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Audience == AudienceMFA {
+		return nil, ErrChallenge
+	}
+	return claims, nil
+}
 
-	// Load the jwt secret from config
-	secret := viper.GetString("service.jwtSecret")
+// ParseChallenge 校验两步验证的临时token
+func (s *Service) ParseChallenge(tokenString string) (*Claims, error) {
+	claims, err := s.parse(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Audience != AudienceMFA {
+		return nil, ErrNotChallenge
+	}
+	return claims, nil
+}
 
-	if len(header) == 0 {
-		return &Context{}, ErrMissingHeader
+func (s *Service) parse(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	if err := s.ring.ParseClaims(tokenString, claims); err != nil {
+		return nil, err
+	}
+	if claims.ExpiresAt == 0 {
+		return nil, ErrMissingExp
 	}
+	return claims, nil
+}
 
-	var t string
-	// Parse the header to get the token part.
-	fmt.Sscanf(header, "Bearer %s", &t)
-	return Parse(t, secret)
+// ParseRequest 从请求头 Authorization: Bearer <token> 中读取并校验token
+func (s *Service) ParseRequest(c *gin.Context) (*Claims, error) {
+	header := c.GetHeader("Authorization")
+	if header == "" {
+		return nil, ErrMissingHeader
+	}
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return nil, ErrInvalidHeader
+	}
+	return s.Parse(parts[1])
 }
 
-// Sign signs the context with the specified secret.
-func Sign(ctx *gin.Context, c Context, secret string) (tokenString string, err error) {
-	// Load the jwt secret from the Gin config if the secret isn't specified.
-	if secret == "" {
-		secret = viper.GetString("service.jwtSecret")
+// sign 设置本次签发的时间和过期时间并签名
+func (s *Service) sign(claims *Claims, now time.Time) (string, *Claims, error) {
+	claims.OrigIssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(s.timeout).Unix()
+	signed, err := s.ring.Sign(claims)
+	if err != nil {
+		return "", nil, err
 	}
-	// The token content.
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":       c.ID,
-		"username": c.Username,
-		"nbf":      time.Now().Unix(),
-		"iat":      time.Now().Unix(),
-	})
-	// Sign the token with the specified secret.
-	tokenString, err = token.SignedString([]byte(secret))
+	return signed, claims, nil
+}
 
-	return
+// randomID 返回16字节随机数的十六进制表示，用作jti
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
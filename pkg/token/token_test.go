@@ -0,0 +1,225 @@
+package token
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+func newTestService(t *testing.T) *Service {
+	return NewService(newTestRing(t, AlgorithmES256), Config{Timeout: time.Hour, RefreshTimeout: 24 * time.Hour})
+}
+
+// at 把Service的当前时间固定为now
+func at(s *Service, now time.Time) {
+	s.now = func() time.Time { return now }
+}
+
+func TestServiceParse(t *testing.T) {
+	s := newTestService(t)
+	other := newTestService(t)
+	start := time.Now()
+
+	cases := []struct {
+		name  string
+		token func() string
+		ok    bool
+	}{
+		{"valid", func() string {
+			signed, _, _ := s.Issue("alice", "ops", "admin", "s1")
+			return signed
+		}, true},
+		{"expired", func() string {
+			at(s, start.Add(-2*time.Hour))
+			defer at(s, start)
+			signed, _, _ := s.Issue("alice", "ops", "admin", "s1")
+			return signed
+		}, false},
+		{"bad signature", func() string {
+			signed, _, _ := other.Issue("alice", "ops", "admin", "s1")
+			return signed
+		}, false},
+		{"tampered payload", func() string {
+			signed, _, _ := s.Issue("alice", "ops", "admin", "s1")
+			forged, _, _ := s.Issue("mallory", "ops", "admin", "s1")
+			return signed[:len(signed)-10] + forged[len(forged)-10:]
+		}, false},
+		{"missing exp", func() string {
+			signed, _ := s.ring.Sign(&Claims{Username: "alice"})
+			return signed
+		}, false},
+		{"mfa challenge", func() string {
+			signed, _ := s.IssueChallenge("alice")
+			return signed
+		}, false},
+		{"none algorithm", func() string {
+			unsigned := jwt.NewWithClaims(jwt.SigningMethodNone, &Claims{
+				Username:       "alice",
+				StandardClaims: jwt.StandardClaims{ExpiresAt: start.Add(time.Hour).Unix()},
+			})
+			signed, _ := unsigned.SignedString(jwt.UnsafeAllowNoneSignatureType)
+			return signed
+		}, false},
+	}
+	for _, c := range cases {
+		at(s, start)
+		claims, err := s.Parse(c.token())
+		if c.ok && (err != nil || claims.Username != "alice" || claims.Group != "ops" || claims.Role != "admin") {
+			t.Errorf("%s: Parse = %+v, %v", c.name, claims, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%s: Parse should fail", c.name)
+		}
+	}
+}
+
+func TestServiceParseRequest(t *testing.T) {
+	s := newTestService(t)
+	signed, _, err := s.Issue("alice", "ops", "admin", "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		header string
+		err    error
+	}{
+		{"bearer", "Bearer " + signed, nil},
+		{"missing", "", ErrMissingHeader},
+		{"wrong scheme", "Basic " + signed, ErrInvalidHeader},
+		{"no token", "Bearer", ErrInvalidHeader},
+	}
+	for _, c := range cases {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest("GET", "/", nil)
+		if c.header != "" {
+			ctx.Request.Header.Set("Authorization", c.header)
+		}
+		if _, err := s.ParseRequest(ctx); err != c.err {
+			t.Errorf("%s: ParseRequest error = %v, want %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestServiceRefresh(t *testing.T) {
+	s := newTestService(t)
+	start := time.Now()
+	at(s, start)
+	_, issued, err := s.Issue("alice", "ops", "admin", "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		// 刷新时距登录的时间
+		after time.Duration
+		role  string
+	}{
+		{"before expiry", 30 * time.Minute, "admin"},
+		{"after expiry", 3 * time.Hour, "admin"},
+		{"role changed", 5 * time.Hour, "guest"},
+	}
+	for _, c := range cases {
+		at(s, start.Add(c.after))
+		previous := *issued
+		previous.Role = c.role
+		signed, claims, err := s.Refresh(previous)
+		if err != nil {
+			t.Fatalf("%s: Refresh: %v", c.name, err)
+		}
+		// 刷新后jti和过期时间重新生成，登录时间和Session不变
+		if claims.Id == issued.Id || claims.IssuedAt != issued.IssuedAt || claims.Session != "s1" {
+			t.Errorf("%s: claims = %+v, issued %+v", c.name, claims, issued)
+		}
+		if want := start.Add(c.after).Add(time.Hour).Unix(); claims.ExpiresAt != want {
+			t.Errorf("%s: exp = %d, want %d", c.name, claims.ExpiresAt, want)
+		}
+		if parsed, err := s.Parse(signed); err != nil || parsed.Role != c.role {
+			t.Errorf("%s: refreshed token does not parse: %+v, %v", c.name, parsed, err)
+		}
+	}
+}
+
+func TestServiceChallenge(t *testing.T) {
+	s := newTestService(t)
+	start := time.Now()
+	challenge := func(ago time.Duration) string {
+		at(s, start.Add(-ago))
+		defer at(s, start)
+		signed, err := s.IssueChallenge("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	signed, _, _ := s.Issue("alice", "ops", "admin", "s1")
+	cases := []struct {
+		name  string
+		token string
+		err   bool
+	}{
+		{"challenge", challenge(time.Minute), false},
+		{"expired challenge", challenge(ChallengeTimeout + time.Second), true},
+		{"access token", signed, true},
+	}
+	for _, c := range cases {
+		claims, err := s.ParseChallenge(c.token)
+		if (err != nil) != c.err {
+			t.Errorf("%s: ParseChallenge = %+v, %v", c.name, claims, err)
+		}
+		if err == nil && claims.Username != "alice" {
+			t.Errorf("%s: username = %s", c.name, claims.Username)
+		}
+	}
+}
+
+func TestCheckRefresh(t *testing.T) {
+	now := time.Now()
+	earlier := now.Add(-time.Minute)
+	cases := []struct {
+		name      string
+		usedAt    *time.Time
+		revokedAt *time.Time
+		expiresAt time.Time
+		err       error
+	}{
+		{"active", nil, nil, now.Add(time.Hour), nil},
+		{"expired", nil, nil, now, ErrRefreshExpired},
+		{"reused", &earlier, nil, now.Add(time.Hour), ErrRefreshReused},
+		{"revoked", nil, &earlier, now.Add(time.Hour), ErrRefreshRevoked},
+		{"revoked after reuse", &earlier, &earlier, now.Add(time.Hour), ErrRefreshRevoked},
+	}
+	for _, c := range cases {
+		if err := CheckRefresh(c.usedAt, c.revokedAt, c.expiresAt, now); err != c.err {
+			t.Errorf("%s: CheckRefresh = %v, want %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestNewRefreshToken(t *testing.T) {
+	s := newTestService(t)
+	now := time.Now()
+	at(s, now)
+	first, err := s.NewRefreshToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := s.NewRefreshToken()
+	if first.Raw == second.Raw || first.Hash != HashRefreshToken(first.Raw) || first.Hash == first.Raw {
+		t.Errorf("refresh tokens = %+v, %+v", first, second)
+	}
+	if !first.ExpiresAt.Equal(now.Add(24 * time.Hour)) {
+		t.Errorf("ExpiresAt = %v", first.ExpiresAt)
+	}
+}
+
+func TestNewServiceDefaults(t *testing.T) {
+	s := NewService(nil, Config{})
+	if s.timeout != DefaultTimeout || s.refreshTimeout != DefaultRefreshTimeout {
+		t.Errorf("defaults = %v, %v", s.timeout, s.refreshTimeout)
+	}
+}
@@ -0,0 +1,102 @@
+// Package totp 实现RFC 6238基于时间的一次性密码，使用HMAC-SHA1、30秒步长和6位数字，
+// 与常见的身份验证器应用兼容。所有函数都以传入的时间计算，便于离线测试
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Period 每个密码的有效时间
+	Period = 30 * time.Second
+	// Digits 密码的位数
+	Digits = 6
+	// SecretSize 生成的密钥长度，RFC 4226建议至少160位
+	SecretSize = 20
+	// Skew 校验时前后各允许的步数，容忍客户端时钟的偏差
+	Skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret 生成一个随机的密钥
+func NewSecret() ([]byte, error) {
+	secret := make([]byte, SecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// EncodeSecret 把密钥编码为身份验证器应用使用的base32字符串
+func EncodeSecret(secret []byte) string {
+	return encoding.EncodeToString(secret)
+}
+
+// DecodeSecret 解码base32的密钥，忽略空格和大小写
+func DecodeSecret(encoded string) ([]byte, error) {
+	return encoding.DecodeString(strings.ToUpper(strings.Replace(encoded, " ", "", -1)))
+}
+
+// URI 返回用于生成二维码的otpauth地址
+func URI(issuer, account string, secret []byte) string {
+	v := url.Values{}
+	v.Set("secret", EncodeSecret(secret))
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(Digits))
+	v.Set("period", fmt.Sprint(int(Period/time.Second)))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// Step 返回t所在的步数
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code 返回步数step的密码，digits为位数
+func Code(secret []byte, step int64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// Generate 返回t时的密码
+func Generate(secret []byte, t time.Time) string {
+	return Code(secret, Step(t), Digits)
+}
+
+// Validate 校验t时输入的密码，前后允许Skew步的偏差。
+// 通过时返回匹配的步数，调用方应记录该步数并拒绝不大于它的步数，防止同一个密码被重放
+func Validate(secret []byte, code string, t time.Time) (int64, bool) {
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != Digits {
+		return 0, false
+	}
+	current := Step(t)
+	for step := current - Skew; step <= current+Skew; step++ {
+		if subtle.ConstantTimeCompare([]byte(Code(secret, step, Digits)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,71 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 附录B中SHA1的测试向量
+func TestCodeRFC6238(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, c := range cases {
+		if got := Code(secret, Step(time.Unix(c.unix, 0)), 8); got != c.code {
+			t.Errorf("Code(%d) = %s, want %s", c.unix, got, c.code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	cases := []struct {
+		name string
+		code string
+		ok   bool
+	}{
+		{"current", Generate(secret, now), true},
+		{"previous step", Generate(secret, now.Add(-Period)), true},
+		{"next step", Generate(secret, now.Add(Period)), true},
+		{"two steps ago", Generate(secret, now.Add(-2*Period)), false},
+		{"spaces", Generate(secret, now)[:3] + " " + Generate(secret, now)[3:], true},
+		{"wrong length", "12345", false},
+		{"wrong code", "000000", false},
+	}
+	for _, c := range cases {
+		step, ok := Validate(secret, c.code, now)
+		if ok != c.ok {
+			t.Errorf("%s: Validate(%q) = %v, want %v", c.name, c.code, ok, c.ok)
+		}
+		if ok && (step < Step(now)-Skew || step > Step(now)+Skew) {
+			t.Errorf("%s: step = %d", c.name, step)
+		}
+	}
+}
+
+func TestSecretEncoding(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := EncodeSecret(secret)
+	decoded, err := DecodeSecret(strings.ToLower(encoded))
+	if err != nil || string(decoded) != string(secret) {
+		t.Errorf("DecodeSecret(%s) = %x, %v", encoded, decoded, err)
+	}
+	uri := URI("GOPA", "alice", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/GOPA:alice?") || !strings.Contains(uri, "secret="+encoded) {
+		t.Errorf("URI = %s", uri)
+	}
+}
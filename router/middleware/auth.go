@@ -9,6 +9,7 @@ import (
 	"github.com/open-policy-agent/opa/rego"
 	"gopa/config"
 	"gopa/handler"
+	"gopa/pkg/notify"
 	"gopa/util"
 )
 
@@ -39,7 +40,7 @@ func GetPermission() gin.HandlerFunc {
 			context.Next()
 			return
 		}
-		regoFileResult, err := util.FetchRegoByPath(mongoPath)
+		regoFileResult, err := util.FetchPolicyByPath(mongoPath)
 		if err != nil {
 			msg := fmt.Sprintf("no rules specified for [%s]", referer)
 			handler.SendResponse403(context, errors.New(msg), nil)
@@ -48,7 +49,7 @@ func GetPermission() gin.HandlerFunc {
 		}
 		module := regoFileResult.Content
 		arguments := regoFileResult.Arguments
-		form := util.BuildForm(context, arguments)
+		form, err := util.BuildForm(context, arguments)
 		if err != nil {
 			handler.SendResponse403(context, err, nil)
 			context.Abort()
@@ -68,6 +69,13 @@ func GetPermission() gin.HandlerFunc {
 		if results.Allowed() {
 			context.Next()
 		} else {
+			if notify.IsPrivileged(referer) {
+				notify.Send(notify.Event{
+					Kind:    notify.DecisionDenied,
+					Project: context.GetHeader("project"),
+					Text:    fmt.Sprintf("%s as %s", referer, context.GetHeader("role")),
+				})
+			}
 			handler.SendResponse403(context, errors.New("rejected"), nil)
 			context.Abort()
 			return
@@ -75,7 +83,6 @@ func GetPermission() gin.HandlerFunc {
 	}
 }
 
-
 // Watch 监听对应文件夹的文件内容变化，并作出
 // 相应响应
 func Watch() {
@@ -110,4 +117,3 @@ func Watch() {
 	}
 	<-done
 }
-
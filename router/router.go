@@ -8,6 +8,8 @@ import (
 	m "gopa/gorm"
 	"gopa/handler/api"
 	"gopa/handler/sd"
+	"gopa/pkg/lockout"
+	"gopa/pkg/token"
 	"gopa/router/middleware"
 	"net/http"
 )
@@ -19,7 +21,7 @@ func InitEngine() *gin.Engine {
 }
 
 // Load loads the middlewares, routes, handler.
-func Load(g *gin.Engine, mw ...gin.HandlerFunc) *gin.Engine {
+func Load(g *gin.Engine, tokens *token.Service, limiter *lockout.Limiter, mw ...gin.HandlerFunc) *gin.Engine {
 	// Middlewares.
 	g.Use(gin.Recovery())
 	g.Use(middleware.NoCache)
@@ -42,13 +44,28 @@ func Load(g *gin.Engine, mw ...gin.HandlerFunc) *gin.Engine {
 		svcdRouter.GET("/cpu", sd.CPUCheck)
 		svcdRouter.GET("/ram", sd.RAMCheck)
 	}
+	// 配置和连接池中有各个服务的地址和用户，只有管理员可以查看
+	svcdAdmin := svcdRouter.Group("", api.APIKeyAuth(api.Authenticate(tokens)), api.RejectRevokedTokens())
+	{
+		svcdAdmin.GET("/config", api.RequireAdmin("sd.config"), sd.ConfigCheck)
+		svcdAdmin.GET("/db", api.RequireAdmin("sd.db"), sd.DBCheck)
+	}
+	// 供其他服务离线校验token的公钥
+	g.GET("/.well-known/jwks.json", api.Jwks(tokens))
 	gapi := g.Group("/api")
 	// 登录接口
-	gapi.POST("sso-login", api.JwtAuth().LoginHandler)
-	gapi.GET("sso-logout", api.JwtAuth().LogoutHandler)
+	gapi.POST("sso-login", api.Login(tokens, limiter))
+	gapi.GET("sso-logout", api.Logout(tokens))
+	gapi.POST("refresh_token", api.RefreshToken(tokens))
+	// 两步验证的登录
+	gapi.POST("mfa/enroll", api.MfaLoginEnroll(tokens))
+	gapi.POST("mfa/verify", api.MfaLoginVerify(tokens, limiter))
+	// OIDC授权码登录
+	gapi.GET("oidc/login", api.OidcLogin)
+	gapi.GET("oidc/callback", api.OidcCallback(tokens))
 	// GOPA 第一版API
 	v1 := gapi.Group("/v1")
-	v1.Use(api.JwtAuth().MiddlewareFunc())
+	v1.Use(api.APIKeyAuth(api.Authenticate(tokens)), api.RejectRevokedTokens())
 	// 管理组的API
 	v1.GET("auth", api.Auth)
 	groupAPIs := v1.Group("/project")
@@ -56,6 +73,7 @@ func Load(g *gin.Engine, mw ...gin.HandlerFunc) *gin.Engine {
 		groupAPIs.GET("/list", api.ProjectsList)
 		groupAPIs.POST("/add", api.ProjectAdd)
 		groupAPIs.POST("/delete", api.ProjectDelete)
+		groupAPIs.POST("/provision", api.ProjectProvision)
 	}
 	// 管理角色的API
 	roleAPIs := v1.Group("/role")
@@ -63,6 +81,9 @@ func Load(g *gin.Engine, mw ...gin.HandlerFunc) *gin.Engine {
 		roleAPIs.GET("/list", api.RolesList)
 		roleAPIs.POST("/add", api.RoleAdd)
 		roleAPIs.POST("/delete", api.RoleDelete)
+		roleAPIs.POST("/update", api.RoleUpdate)
+		roleAPIs.GET("/graph", api.RoleGraphList)
+		roleAPIs.GET("/permissions", api.RolePermissionList)
 	}
 	// 管理组内角色的API
 	projectRolesAPIs := v1.Group("/projectRole")
@@ -78,6 +99,25 @@ func Load(g *gin.Engine, mw ...gin.HandlerFunc) *gin.Engine {
 		userAPIs.POST("/add", api.UserAdd)
 		userAPIs.POST("/delete", api.UserDelete)
 		userAPIs.POST("/update", api.UserUpdate)
+		userAPIs.POST("/revokeSessions", api.RevokeSessions)
+		userAPIs.GET("/sessions", api.SessionList)
+		userAPIs.POST("/sessions/revoke", api.SessionRevoke)
+	}
+	// 两步验证
+	mfaAPIs := v1.Group("/mfa")
+	{
+		mfaAPIs.POST("/enroll", api.MfaEnroll)
+		mfaAPIs.POST("/confirm", api.MfaConfirm)
+		mfaAPIs.POST("/disable", api.MfaDisable)
+		mfaAPIs.POST("/recoveryCodes", api.MfaRecoveryCodes)
+		mfaAPIs.POST("/reset", api.MfaReset)
+		mfaAPIs.POST("/require", api.MfaRequire)
+	}
+	// 登录失败的限制
+	lockoutAPIs := v1.Group("/lockout")
+	{
+		lockoutAPIs.GET("/list", api.LockoutList(limiter))
+		lockoutAPIs.POST("/unlock", api.LockoutUnlock(limiter))
 	}
 	// 管理策略文件的API
 	regoAPIs := v1.Group("/rego")
@@ -102,6 +142,46 @@ func Load(g *gin.Engine, mw ...gin.HandlerFunc) *gin.Engine {
 		projectResourcesAPIs.POST("/update", api.ProjectResourceUpdate)
 		projectResourcesAPIs.POST("/delete", api.ProjectResourceDelete)
 	}
+	// 申请加入组以及审批的API
+	accessRequestAPIs := v1.Group("/accessRequest")
+	{
+		accessRequestAPIs.GET("/list", api.AccessRequestList)
+		accessRequestAPIs.POST("/add", api.AccessRequestAdd)
+		accessRequestAPIs.POST("/approve", api.AccessRequestApprove)
+		accessRequestAPIs.POST("/deny", api.AccessRequestDeny)
+	}
+	// 管理webhook订阅以及投递记录的API
+	webhookAPIs := v1.Group("/webhook")
+	{
+		webhookAPIs.GET("/list", api.WebhookList)
+		webhookAPIs.POST("/add", api.WebhookAdd)
+		webhookAPIs.POST("/delete", api.WebhookDelete)
+		webhookAPIs.GET("/deliveries", api.WebhookDeliveryList)
+		webhookAPIs.POST("/redeliver", api.WebhookRedeliver)
+	}
+	// 服务账号以及API key
+	serviceAccountAPIs := v1.Group("/serviceAccount")
+	{
+		serviceAccountAPIs.GET("/list", api.ServiceAccountList)
+		serviceAccountAPIs.POST("/add", api.ServiceAccountAdd)
+		serviceAccountAPIs.POST("/delete", api.ServiceAccountDelete)
+		serviceAccountAPIs.GET("/key/list", api.APIKeyList)
+		serviceAccountAPIs.POST("/key/add", api.APIKeyAdd)
+		serviceAccountAPIs.POST("/key/revoke", api.APIKeyRevoke)
+		serviceAccountAPIs.POST("/key/rotate", api.APIKeyRotate)
+	}
+	// 在一个事务中执行多个管理操作，只允许管理员调用
+	v1.POST("batch", api.RequireAdmin("batch"), api.Batch)
+	// LDAP组同步
+	ldapAPIs := v1.Group("/ldap")
+	{
+		ldapAPIs.POST("/sync", api.LdapSync)
+	}
+	// 根据project_resources生成的RBAC策略
+	rbacAPIs := v1.Group("/rbac")
+	{
+		rbacAPIs.GET("/preview", api.RbacPreviewRego)
+	}
 
 	v2 := gapi.Group("/v2")
 	{
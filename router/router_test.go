@@ -0,0 +1,965 @@
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopa/config"
+	"gopa/gorm"
+	"gopa/handler"
+	"gopa/model"
+	"gopa/pkg/auth"
+	"gopa/pkg/errno"
+	"gopa/pkg/notify"
+	"gopa/pkg/token"
+	"gopa/service"
+	"gopa/util"
+)
+
+// newTestServer 使用内存存储启动完整的API，不依赖MySQL、MongoDB和LDAP
+func newTestServer(t *testing.T) *gin.Engine {
+	t.Helper()
+	conf := &model.SysConfig{}
+	conf.Service.Addr = ":0"
+	conf.Log.Dir = t.TempDir()
+	conf.Gorm.DBType = gorm.DBTypeMemory
+	conf.Gorm.TablePrefix = "test_"
+	conf.Auth.Providers = []string{auth.ProviderLocal}
+	conf.Auth.AdminProjects = []string{"ops"}
+	if err := config.Validate(conf); err != nil {
+		t.Fatal(err)
+	}
+	config.Reload(conf, "test")
+	if err := gorm.Setup(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	password, err := auth.Encrypt("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gorm.Entities.Members().Create(model.GopaMembers{Username: "admin", Project: "ops", Role: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	if res := gorm.DB.Self.Create(&model.GopaCredentials{Username: "admin", Provider: model.CredentialLocal, Password: password}); res.Error != nil {
+		t.Fatal(res.Error)
+	}
+
+	ring, err := service.InitSigningKeys("", time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	g := gin.New()
+	Load(g, token.NewService(ring, token.Config{}), service.NewLoginLimiter(model.LoginLockout{}))
+	return g
+}
+
+// call 发送JSON请求，返回状态码和响应中的data
+func call(t *testing.T, g *gin.Engine, method, path, bearer string, body interface{}) (int, json.RawMessage) {
+	t.Helper()
+	code, raw := send(t, g, method, path, bearer, body)
+	var resp struct {
+		handler.Response
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		t.Fatalf("%s %s: %v in %s", method, path, err, raw)
+	}
+	return code, resp.Data
+}
+
+// send 发送JSON请求，返回状态码和响应
+func send(t *testing.T, g *gin.Engine, method, path, bearer string, body interface{}) (int, []byte) {
+	t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &payload)
+	req.Header.Set("Content-Type", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, req)
+	return w.Code, w.Body.Bytes()
+}
+
+func TestAPIWithMemoryStorage(t *testing.T) {
+	g := newTestServer(t)
+
+	code, data := send(t, g, http.MethodPost, "/api/sso-login", "", gin.H{"username": "admin", "password": "s3cret"})
+	var login struct {
+		Token string `json:"token"`
+	}
+	if code != http.StatusOK || json.Unmarshal(data, &login) != nil || login.Token == "" {
+		t.Fatalf("login = %d %s", code, data)
+	}
+
+	if code, data := call(t, g, http.MethodPost, "/api/v1/project/add", login.Token, gin.H{"project_name": "infra"}); code != http.StatusOK {
+		t.Fatalf("project add = %d %s", code, data)
+	}
+	code, raw := send(t, g, http.MethodPost, "/api/v1/project/add", login.Token, gin.H{"project_name": "infra"})
+	var dup handler.Response
+	if code != http.StatusBadRequest || json.Unmarshal(raw, &dup) != nil || dup.Code != errno.ErrProjectExists.Code {
+		t.Errorf("duplicate project add = %d %s", code, raw)
+	}
+	if code, data := call(t, g, http.MethodGet, "/api/v1/project/list", login.Token, nil); code != http.StatusOK || !strings.Contains(string(data), "infra") {
+		t.Errorf("project list = %d %s", code, data)
+	}
+
+	rego := gin.H{"method": "GET", "path": "/api/v1/demo.rego", "name": "demo", "content": "package api.v1.demo\n\nallow {\n\tinput.role == \"admin\"\n}\n"}
+	if code, data := call(t, g, http.MethodPost, "/api/v1/rego/add", login.Token, rego); code != http.StatusOK {
+		t.Fatalf("rego add = %d %s", code, data)
+	}
+	var document model.RegoDocument
+	code, data = call(t, g, http.MethodGet, "/api/v1/rego/list?filepath=/api/v1/demo.rego", login.Token, nil)
+	if code != http.StatusOK || json.Unmarshal(data, &document) != nil || len(document.Arguments) != 1 || document.Arguments[0] != "role" {
+		t.Errorf("rego get = %d %s", code, data)
+	}
+	if code, data := call(t, g, http.MethodPost, "/api/v1/rego/update", login.Token, gin.H{"path": "/api/v1/demo.rego", "content": "package api.v1.demo\n"}); code != http.StatusOK || string(data) != "1" {
+		t.Errorf("rego update = %d %s", code, data)
+	}
+	if code, data := call(t, g, http.MethodPost, "/api/v1/rego/delete", login.Token, gin.H{"path": "/api/v1/demo.rego"}); code != http.StatusOK || string(data) != "1" {
+		t.Errorf("rego delete = %d %s", code, data)
+	}
+	if code, _ := call(t, g, http.MethodGet, "/api/v1/rego/list?filepath=/api/v1/demo.rego", login.Token, nil); code != http.StatusBadRequest {
+		t.Errorf("deleted rego get = %d, want 400", code)
+	}
+
+	resource := gin.H{"resource_name": "/api/v1/demo", "project_name": "infra", "role_name": "admin"}
+	if code, data := call(t, g, http.MethodPost, "/api/v1/projectResource/add", login.Token, resource); code != http.StatusOK {
+		t.Fatalf("project resource add = %d %s", code, data)
+	}
+	if code, data := call(t, g, http.MethodPost, "/api/v1/projectResource/delete", login.Token, resource); code != http.StatusOK || string(data) != "1" {
+		t.Errorf("project resource delete = %d %s", code, data)
+	}
+	if code, data := call(t, g, http.MethodPost, "/api/v1/projectResource/delete", login.Token, gin.H{"resource_name": "/api/v1/demo"}); code != http.StatusBadRequest {
+		t.Errorf("project resource delete without project and role = %d %s, want 400", code, data)
+	}
+}
+
+func TestTablePrefix(t *testing.T) {
+	g := newTestServer(t)
+	for _, table := range []string{"test_gopa_projects", "test_gopa_members", "test_rego_documents", "test_gopa_schema_migrations"} {
+		if !gorm.DB.Self.Migrator().HasTable(table) {
+			t.Errorf("table %s does not exist", table)
+		}
+	}
+	if gorm.DB.Self.Migrator().HasTable("gopa_projects") {
+		t.Error("table gopa_projects was created without the prefix")
+	}
+
+	if code, raw := send(t, g, http.MethodGet, "/sd/db", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("/sd/db without a token = %d %s, want 401", code, raw)
+	}
+	code, raw := send(t, g, http.MethodGet, "/sd/db", login(t, g), nil)
+	var stats struct {
+		Status             string `json:"status"`
+		MaxOpenConnections int    `json:"max_open_connections"`
+	}
+	if code != http.StatusOK || json.Unmarshal(raw, &stats) != nil || stats.Status != "OK" || stats.MaxOpenConnections != 1 {
+		t.Errorf("/sd/db = %d %s", code, raw)
+	}
+}
+
+// login 以newTestServer中的管理员登录，返回token
+func login(t *testing.T, g *gin.Engine) string {
+	t.Helper()
+	return loginAs(t, g, "admin", "s3cret")
+}
+
+// loginAs 以username登录，返回token
+func loginAs(t *testing.T, g *gin.Engine, username, password string) string {
+	t.Helper()
+	_, data := send(t, g, http.MethodPost, "/api/sso-login", "", gin.H{"username": username, "password": password})
+	var login struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(data, &login); err != nil || login.Token == "" {
+		t.Fatalf("login = %s", data)
+	}
+	return login.Token
+}
+
+// countMembers 返回满足query的授权数
+func countMembers(query gorm.MemberQuery) int {
+	members, _ := gorm.Entities.Members().Find(query)
+	return len(members)
+}
+
+// countResources 返回满足query的资源授权数
+func countResources(query gorm.ResourceQuery) int {
+	resources, _ := gorm.Entities.Resources().Find(query)
+	return len(resources)
+}
+
+// countProjectRoles 返回组内的角色数
+func countProjectRoles(project string) int {
+	projectRoles, _ := gorm.Entities.Projects().ListRoles()
+	n := 0
+	for _, projectRole := range projectRoles {
+		if projectRole.ProjectName == project {
+			n++
+		}
+	}
+	return n
+}
+
+func TestProvisionAndBatch(t *testing.T) {
+	g := newTestServer(t)
+	token := login(t, g)
+
+	provision := gin.H{
+		"project_name": "payments",
+		"roles":        []string{"dev", "ops"},
+		"members":      []gin.H{{"username": "alice", "role": "dev"}, {"username": "bob", "role": "ops"}},
+		"resources":    []gin.H{{"resource_name": "/api/v1/pay", "role_name": "dev"}},
+	}
+	if code, data := call(t, g, http.MethodPost, "/api/v1/project/provision", token, provision); code != http.StatusOK {
+		t.Fatalf("provision = %d %s", code, data)
+	}
+	if n := countMembers(gorm.MemberQuery{Project: "payments"}); n != 2 {
+		t.Errorf("payments has %d members, want 2", n)
+	}
+
+	// 第3步的成员重复，前面创建的组和角色都要回滚
+	batch := gin.H{"operations": []gin.H{
+		{"op": "project.add", "form": gin.H{"project_name": "billing"}},
+		{"op": "projectRole.add", "form": gin.H{"to_project": "billing", "role_name": "dev"}},
+		{"op": "user.add", "form": gin.H{"username": "carol", "project": "billing", "role": "dev"}},
+		{"op": "user.add", "form": gin.H{"username": "carol", "project": "billing", "role": "dev"}},
+	}}
+	code, raw := send(t, g, http.MethodPost, "/api/v1/batch", token, batch)
+	var failed struct {
+		handler.Response
+		Data struct {
+			Index int    `json:"index"`
+			Op    string `json:"op"`
+		} `json:"data"`
+	}
+	if code != http.StatusBadRequest || json.Unmarshal(raw, &failed) != nil ||
+		failed.Code != errno.ErrMemberExists.Code || failed.Data.Index != 3 || failed.Data.Op != "user.add" {
+		t.Errorf("failing batch = %d %s", code, raw)
+	}
+	if exists, _ := gorm.Entities.Projects().Exists("billing"); exists {
+		t.Error("project billing was not rolled back")
+	}
+	if n := countProjectRoles("billing"); n != 0 {
+		t.Error("project role billing/dev was not rolled back")
+	}
+
+	batch["operations"] = []gin.H{{"op": "project.rename", "form": gin.H{}}}
+	if code, raw := send(t, g, http.MethodPost, "/api/v1/batch", token, batch); code != http.StatusBadRequest || !strings.Contains(string(raw), "project.rename") {
+		t.Errorf("unknown op = %d %s", code, raw)
+	}
+	batch["operations"] = []gin.H{
+		{"op": "project.add", "form": gin.H{"project_name": "billing"}},
+		{"op": "user.add", "form": gin.H{"username": "carol", "project": "billing", "role": "dev"}},
+	}
+	code, data := call(t, g, http.MethodPost, "/api/v1/batch", token, batch)
+	var results []struct {
+		Op           string `json:"op"`
+		RowsAffected int64  `json:"rows_affected"`
+	}
+	if code != http.StatusOK || json.Unmarshal(data, &results) != nil || len(results) != 2 || results[1].RowsAffected != 1 {
+		t.Errorf("batch = %d %s", code, data)
+	}
+}
+
+func TestBatchUpdatesAndDeletes(t *testing.T) {
+	g := newTestServer(t)
+	token := login(t, g)
+	for _, role := range []string{"dev", "ops"} {
+		if code, data := call(t, g, http.MethodPost, "/api/v1/role/add", token, gin.H{"role_name": role}); code != http.StatusOK {
+			t.Fatalf("role add = %d %s", code, data)
+		}
+	}
+	setup := gin.H{"operations": []gin.H{
+		{"op": "project.add", "form": gin.H{"project_name": "billing"}},
+		{"op": "projectRole.add", "form": gin.H{"to_project": "billing", "role_name": "dev"}},
+		{"op": "user.add", "form": gin.H{"username": "carol", "project": "billing", "role": "dev"}},
+		{"op": "user.add", "form": gin.H{"username": "dave", "project": "billing", "role": "dev"}},
+		{"op": "projectResource.add", "form": gin.H{"resource_name": "/api/v1/bill", "project_name": "billing", "role_name": "dev"}},
+	}}
+	if code, data := call(t, g, http.MethodPost, "/api/v1/batch", token, setup); code != http.StatusOK {
+		t.Fatalf("batch = %d %s", code, data)
+	}
+
+	// 最后一步的版本不对，前面的修改和删除都要回滚
+	operations := []gin.H{
+		{"op": "user.update", "form": gin.H{"username": "carol", "role": "ops"}},
+		{"op": "projectResource.update", "form": gin.H{"resource_name": "/api/v1/bill", "role_name": "ops"}},
+		{"op": "user.delete", "form": gin.H{"username": "dave"}},
+		{"op": "projectResource.delete", "form": gin.H{"resource_name": "/api/v1/bill", "project_name": "billing", "role_name": "ops"}},
+		{"op": "projectRole.delete", "form": gin.H{"project_name": "billing", "role_name": "dev"}},
+		{"op": "project.delete", "form": gin.H{"project_name": "billing"}},
+	}
+	stale := append([]gin.H{}, operations[:5]...)
+	stale = append(stale, gin.H{"op": "user.update", "form": gin.H{"username": "carol", "role": "dev", "version": 9}})
+	code, raw := send(t, g, http.MethodPost, "/api/v1/batch", token, gin.H{"operations": stale})
+	var failed struct {
+		handler.Response
+		Data struct {
+			Index int    `json:"index"`
+			Op    string `json:"op"`
+		} `json:"data"`
+	}
+	if code != http.StatusConflict || json.Unmarshal(raw, &failed) != nil ||
+		failed.Code != errno.ErrVersionConflict.Code || failed.Data.Index != 5 || failed.Data.Op != "user.update" {
+		t.Errorf("stale batch = %d %s", code, raw)
+	}
+	if n := countMembers(gorm.MemberQuery{Username: "carol", Role: "dev"}); n != 1 {
+		t.Error("update of carol was not rolled back")
+	}
+	if n := countMembers(gorm.MemberQuery{Username: "dave"}); n != 1 {
+		t.Error("delete of dave was not rolled back")
+	}
+	if n := countResources(gorm.ResourceQuery{Router: "/api/v1/bill", Role: "dev"}); n != 1 {
+		t.Error("grant of /api/v1/bill was not rolled back")
+	}
+
+	code, data := call(t, g, http.MethodPost, "/api/v1/batch", token, gin.H{"operations": operations})
+	var results []struct {
+		Op           string `json:"op"`
+		RowsAffected int64  `json:"rows_affected"`
+	}
+	if code != http.StatusOK || json.Unmarshal(data, &results) != nil || len(results) != len(operations) {
+		t.Fatalf("batch = %d %s", code, data)
+	}
+	for i, result := range results {
+		if result.RowsAffected != 1 {
+			t.Errorf("operation %d %s affected %d rows, want 1", i, result.Op, result.RowsAffected)
+		}
+	}
+	if n := countMembers(gorm.MemberQuery{Username: "carol", Role: "ops"}); n != 1 {
+		t.Error("carol was not moved to ops")
+	}
+	if n := countMembers(gorm.MemberQuery{Username: "dave"}); n != 0 {
+		t.Error("dave was not deleted")
+	}
+	if n := countResources(gorm.ResourceQuery{Router: "/api/v1/bill"}); n != 0 {
+		t.Error("grant of /api/v1/bill was not deleted")
+	}
+	if exists, _ := gorm.Entities.Projects().Exists("billing"); exists {
+		t.Error("project billing was not deleted")
+	}
+
+	if code, data := call(t, g, http.MethodPost, "/api/v1/user/add", token,
+		gin.H{"username": "bob", "password": "hunter2", "project": "ops", "role": "developer"}); code != http.StatusOK {
+		t.Fatalf("user add = %d %s", code, data)
+	}
+	bob := loginAs(t, g, "bob", "hunter2")
+	if code, raw := send(t, g, http.MethodPost, "/api/v1/batch", bob, setup); code != http.StatusForbidden {
+		t.Errorf("batch by a non admin = %d %s, want 403", code, raw)
+	}
+}
+
+func TestOptimisticConcurrency(t *testing.T) {
+	g := newTestServer(t)
+	token := login(t, g)
+	sendMatch := func(path, ifMatch string, body interface{}) (int, handler.Response) {
+		var payload bytes.Buffer
+		json.NewEncoder(&payload).Encode(body)
+		req := httptest.NewRequest(http.MethodPost, path, &payload)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		var resp handler.Response
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	rego := gin.H{"method": "GET", "path": "/api/v1/demo.rego", "name": "demo", "content": "package api.v1.demo\n"}
+	if code, data := call(t, g, http.MethodPost, "/api/v1/rego/add", token, rego); code != http.StatusOK {
+		t.Fatalf("rego add = %d %s", code, data)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/rego/list?filepath=/api/v1/demo.rego", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, req)
+	etag := w.Header().Get("ETag")
+	if etag != `"1"` {
+		t.Fatalf("rego ETag = %q, want \"1\"", etag)
+	}
+	update := gin.H{"path": "/api/v1/demo.rego", "content": "package api.v1.demo\n\ndefault allow = false\n"}
+	if code, resp := sendMatch("/api/v1/rego/update", etag, update); code != http.StatusOK {
+		t.Fatalf("rego update = %d %+v", code, resp)
+	}
+	update["content"] = "package api.v1.demo\n\ndefault allow = true\n"
+	if code, resp := sendMatch("/api/v1/rego/update", etag, update); code != http.StatusConflict || resp.Code != errno.ErrVersionConflict.Code {
+		t.Errorf("stale rego update = %d %+v, want 409", code, resp)
+	}
+	update["version"] = 2
+	if code, resp := sendMatch("/api/v1/rego/update", "", update); code != http.StatusOK {
+		t.Errorf("rego update with version = %d %+v", code, resp)
+	}
+
+	if code, data := call(t, g, http.MethodPost, "/api/v1/user/add", token, gin.H{"username": "alice", "project": "ops", "role": "dev"}); code != http.StatusOK {
+		t.Fatalf("user add = %d %s", code, data)
+	}
+	_, data := call(t, g, http.MethodGet, "/api/v1/user/list", token, nil)
+	if !strings.Contains(string(data), `"version":1`) {
+		t.Errorf("user list has no version: %s", data)
+	}
+	move := gin.H{"username": "alice", "role": "ops", "version": 1}
+	if code, resp := sendMatch("/api/v1/user/update", "", move); code != http.StatusOK {
+		t.Fatalf("user update = %d %+v", code, resp)
+	}
+	move["role"] = "admin"
+	if code, resp := sendMatch("/api/v1/user/update", "", move); code != http.StatusConflict || resp.Code != errno.ErrVersionConflict.Code {
+		t.Errorf("stale user update = %d %+v, want 409", code, resp)
+	}
+	if code, resp := sendMatch("/api/v1/user/update", `"x"`, move); code != http.StatusBadRequest {
+		t.Errorf("user update with a bad If-Match = %d %+v, want 400", code, resp)
+	}
+	if code, resp := sendMatch("/api/v1/user/update", `"0"`, move); code != http.StatusConflict {
+		t.Errorf("user update with If-Match 0 = %d %+v, want 409", code, resp)
+	}
+
+	// 其他修改也会增加版本
+	if code, data := call(t, g, http.MethodPost, "/api/v1/role/add", token, gin.H{"role_name": "dev"}); code != http.StatusOK {
+		t.Fatalf("role add = %d %s", code, data)
+	}
+	if code, resp := sendMatch("/api/v1/mfa/require", "", gin.H{"role_name": "dev", "mfa_required": true}); code != http.StatusOK {
+		t.Fatalf("mfa require = %d %+v", code, resp)
+	}
+	roles, _ := gorm.Entities.Roles().List()
+	for _, role := range roles {
+		if role.RoleName == "dev" && role.Version != 2 {
+			t.Errorf("role version after mfa require = %d, want 2", role.Version)
+		}
+	}
+}
+
+func TestAccessRequestNotifications(t *testing.T) {
+	texts := make(chan string, 20)
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg struct {
+			Text string `json:"text"`
+		}
+		json.NewDecoder(r.Body).Decode(&msg)
+		texts <- msg.Text
+		w.Write([]byte("ok"))
+	}))
+	defer slack.Close()
+	g := newTestServer(t)
+	notify.Init(model.NotifyService{Slack: model.SlackNotify{Enabled: true, WebhookURL: slack.URL + "/hooks/default"}})
+	defer notify.Init(model.NotifyService{})
+	// 跳过添加成员等其他事件的通知
+	expect := func(want string) {
+		t.Helper()
+		for {
+			select {
+			case text := <-texts:
+				if !strings.HasPrefix(text, "[GOPA] accessRequest.") {
+					continue
+				}
+				if text != want {
+					t.Errorf("notification = %q, want %q", text, want)
+				}
+				return
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no notification, want %q", want)
+			}
+		}
+	}
+
+	admin := login(t, g)
+	for _, step := range []struct {
+		path string
+		form gin.H
+	}{
+		{"/api/v1/project/add", gin.H{"project_name": "infra"}},
+		{"/api/v1/role/add", gin.H{"role_name": "admin"}},
+		{"/api/v1/role/add", gin.H{"role_name": "developer"}},
+		{"/api/v1/user/add", gin.H{"username": "admin", "project": "infra", "role": "admin"}},
+		{"/api/v1/user/add", gin.H{"username": "bob", "password": "hunter2", "project": "ops", "role": "developer"}},
+	} {
+		if code, data := call(t, g, http.MethodPost, step.path, admin, step.form); code != http.StatusOK {
+			t.Fatalf("%s = %d %s", step.path, code, data)
+		}
+	}
+
+	bob := loginAs(t, g, "bob", "hunter2")
+	request := gin.H{"project": "infra", "role": "developer", "justification": "on call"}
+	if code, data := call(t, g, http.MethodPost, "/api/v1/accessRequest/add", bob, request); code != http.StatusOK || string(data) != "1" {
+		t.Fatalf("access request add = %d %s", code, data)
+	}
+	expect("[GOPA] accessRequest.created in project infra by bob: request #1 for bob as developer: on call")
+	if code, data := call(t, g, http.MethodPost, "/api/v1/accessRequest/approve", admin, gin.H{"id": 1, "comment": "ok"}); code != http.StatusOK {
+		t.Fatalf("access request approve = %d %s", code, data)
+	}
+	expect("[GOPA] accessRequest.approved in project infra by admin: request #1 for bob as developer: ok")
+
+	request["role"] = "admin"
+	if code, data := call(t, g, http.MethodPost, "/api/v1/accessRequest/add", bob, request); code != http.StatusOK {
+		t.Fatalf("access request add = %d %s", code, data)
+	}
+	expect("[GOPA] accessRequest.created in project infra by bob: request #2 for bob as admin: on call")
+	if code, data := call(t, g, http.MethodPost, "/api/v1/accessRequest/deny", admin, gin.H{"id": 2, "comment": "no"}); code != http.StatusOK {
+		t.Fatalf("access request deny = %d %s", code, data)
+	}
+	expect("[GOPA] accessRequest.denied in project infra by admin: request #2 for bob as admin: no")
+}
+
+func TestServiceAccountGrants(t *testing.T) {
+	g := newTestServer(t)
+	admin := login(t, g)
+	code, raw := send(t, g, http.MethodPost, "/api/v1/serviceAccount/add", admin, gin.H{"name": "admin"})
+	var taken handler.Response
+	if code != http.StatusBadRequest || json.Unmarshal(raw, &taken) != nil || taken.Code != errno.ErrServiceAccountName.Code {
+		t.Errorf("service account named after a user = %d %s", code, raw)
+	}
+	for _, step := range []struct {
+		path string
+		form gin.H
+	}{
+		{"/api/v1/serviceAccount/add", gin.H{"name": "ci"}},
+		{"/api/v1/user/add", gin.H{"username": "ci", "project": "ops", "role": "deployer"}},
+	} {
+		if code, data := call(t, g, http.MethodPost, step.path, admin, step.form); code != http.StatusOK {
+			t.Fatalf("%s = %d %s", step.path, code, data)
+		}
+	}
+	code, data := call(t, g, http.MethodPost, "/api/v1/serviceAccount/key/add", admin, gin.H{"service_account": "ci", "project": "ops", "role": "deployer"})
+	var created struct {
+		Key string `json:"key"`
+	}
+	if code != http.StatusOK || json.Unmarshal(data, &created) != nil || created.Key == "" {
+		t.Fatalf("key add = %d %s", code, data)
+	}
+	withKey := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/project/list", nil)
+		req.Header.Set("X-Api-Key", created.Key)
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := withKey(); code != http.StatusOK {
+		t.Fatalf("request with the key = %d", code)
+	}
+
+	// 删除授权后key不再可用
+	gorm.Entities.Members().DeleteUser("ci")
+	if code := withKey(); code != http.StatusForbidden {
+		t.Errorf("request with the key after the grant was removed = %d, want 403", code)
+	}
+}
+
+func TestLogoutRevokesToken(t *testing.T) {
+	g := newTestServer(t)
+	token := login(t, g)
+	if code, data := call(t, g, http.MethodGet, "/api/v1/project/list", token, nil); code != http.StatusOK {
+		t.Fatalf("project list = %d %s", code, data)
+	}
+	if code, raw := send(t, g, http.MethodGet, "/api/sso-logout", token, nil); code != http.StatusOK {
+		t.Fatalf("logout = %d %s", code, raw)
+	}
+	if code, raw := send(t, g, http.MethodGet, "/api/v1/project/list", token, nil); code != http.StatusUnauthorized {
+		t.Errorf("project list after logout = %d %s, want 401", code, raw)
+	}
+	if token := login(t, g); token == "" {
+		t.Error("cannot log in again after logout")
+	}
+}
+
+func TestLockoutRequiresAdmin(t *testing.T) {
+	g := newTestServer(t)
+	admin := login(t, g)
+	if code, data := call(t, g, http.MethodPost, "/api/v1/user/add", admin,
+		gin.H{"username": "bob", "password": "hunter2", "project": "ops", "role": "developer"}); code != http.StatusOK {
+		t.Fatalf("user add = %d %s", code, data)
+	}
+	bob := loginAs(t, g, "bob", "hunter2")
+	unlock := gin.H{"username": "carol"}
+	code, raw := send(t, g, http.MethodPost, "/api/v1/lockout/unlock", bob, unlock)
+	var denied handler.Response
+	if code != http.StatusForbidden || json.Unmarshal(raw, &denied) != nil || denied.Code != errno.ErrAdminForbidden.Code {
+		t.Errorf("unlock by a non admin = %d %s, want 403", code, raw)
+	}
+	if code, raw := send(t, g, http.MethodGet, "/api/v1/lockout/list", bob, nil); code != http.StatusForbidden {
+		t.Errorf("list by a non admin = %d %s, want 403", code, raw)
+	}
+	if code, data := call(t, g, http.MethodPost, "/api/v1/lockout/unlock", admin, unlock); code != http.StatusOK {
+		t.Errorf("unlock by an admin = %d %s", code, data)
+	}
+	if code, data := call(t, g, http.MethodGet, "/api/v1/lockout/list", admin, nil); code != http.StatusOK {
+		t.Errorf("list by an admin = %d %s", code, data)
+	}
+}
+
+func TestMFARequiredAfterLogin(t *testing.T) {
+	g := newTestServer(t)
+	admin := login(t, g)
+	for _, step := range []struct {
+		path string
+		form gin.H
+	}{
+		{"/api/v1/role/add", gin.H{"role_name": "developer"}},
+		{"/api/v1/user/add", gin.H{"username": "bob", "password": "hunter2", "project": "ops", "role": "developer"}},
+	} {
+		if code, data := call(t, g, http.MethodPost, step.path, admin, step.form); code != http.StatusOK {
+			t.Fatalf("%s = %d %s", step.path, code, data)
+		}
+	}
+	_, raw := send(t, g, http.MethodPost, "/api/sso-login", "", gin.H{"username": "bob", "password": "hunter2"})
+	var session struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(raw, &session); err != nil || session.RefreshToken == "" {
+		t.Fatalf("login = %s", raw)
+	}
+
+	require := gin.H{"role_name": "developer", "mfa_required": true}
+	if code, raw := send(t, g, http.MethodPost, "/api/v1/mfa/require", session.Token, require); code != http.StatusForbidden {
+		t.Errorf("mfa require by a non admin = %d %s, want 403", code, raw)
+	}
+	if code, raw := send(t, g, http.MethodPost, "/api/v1/mfa/reset", session.Token, gin.H{"username": "admin"}); code != http.StatusForbidden {
+		t.Errorf("mfa reset by a non admin = %d %s, want 403", code, raw)
+	}
+	if code, data := call(t, g, http.MethodPost, "/api/v1/mfa/require", admin, require); code != http.StatusOK {
+		t.Fatalf("mfa require = %d %s", code, data)
+	}
+
+	// 登录时没有通过两步验证的登录不能再刷新
+	code, raw := send(t, g, http.MethodPost, "/api/refresh_token", "", gin.H{"refresh_token": session.RefreshToken})
+	var refused struct {
+		Message string `json:"message"`
+	}
+	if code != http.StatusUnauthorized || json.Unmarshal(raw, &refused) != nil || refused.Message != errno.ErrMFASession.Message {
+		t.Errorf("refresh after mfa became required = %d %s, want 401", code, raw)
+	}
+	_, raw = send(t, g, http.MethodPost, "/api/sso-login", "", gin.H{"username": "bob", "password": "hunter2"})
+	var challenge struct {
+		MfaRequired bool   `json:"mfa_required"`
+		Token       string `json:"token"`
+	}
+	if err := json.Unmarshal(raw, &challenge); err != nil || !challenge.MfaRequired || challenge.Token != "" {
+		t.Errorf("login after mfa became required = %s", raw)
+	}
+}
+
+func TestConfigCheckRequiresAdmin(t *testing.T) {
+	g := newTestServer(t)
+	admin := login(t, g)
+	if code, data := call(t, g, http.MethodPost, "/api/v1/user/add", admin,
+		gin.H{"username": "bob", "password": "hunter2", "project": "ops", "role": "developer"}); code != http.StatusOK {
+		t.Fatalf("user add = %d %s", code, data)
+	}
+	bob := loginAs(t, g, "bob", "hunter2")
+	for _, c := range []struct {
+		name   string
+		bearer string
+		code   int
+	}{
+		{"anonymous", "", http.StatusUnauthorized},
+		{"non admin", bob, http.StatusForbidden},
+		{"admin", admin, http.StatusOK},
+	} {
+		if code, raw := send(t, g, http.MethodGet, "/sd/config", c.bearer, nil); code != c.code {
+			t.Errorf("/sd/config as %s = %d %s, want %d", c.name, code, raw, c.code)
+		}
+	}
+}
+
+func TestUserUpdateWithTwoGrants(t *testing.T) {
+	g := newTestServer(t)
+	token := login(t, g)
+	for _, grant := range []gin.H{
+		{"username": "alice", "project": "ops", "role": "dev"},
+		{"username": "alice", "project": "infra", "role": "dev"},
+	} {
+		if code, data := call(t, g, http.MethodPost, "/api/v1/user/add", token, grant); code != http.StatusOK {
+			t.Fatalf("user add = %d %s", code, data)
+		}
+	}
+	roles := func() map[string]string {
+		members, _ := gorm.Entities.Members().Find(gorm.MemberQuery{Username: "alice"})
+		got := map[string]string{}
+		for _, m := range members {
+			got[m.Project] = m.Role
+		}
+		return got
+	}
+
+	if code, data := call(t, g, http.MethodPost, "/api/v1/user/update", token, gin.H{"username": "alice", "role": "ops"}); code != http.StatusBadRequest {
+		t.Errorf("update without choosing a grant = %d %s, want 400", code, data)
+	}
+	move := gin.H{"username": "alice", "old_project": "infra", "old_role": "dev", "role": "ops"}
+	if code, data := call(t, g, http.MethodPost, "/api/v1/user/update", token, move); code != http.StatusOK {
+		t.Fatalf("user update = %d %s", code, data)
+	}
+	if got := roles(); got["ops"] != "dev" || got["infra"] != "ops" {
+		t.Errorf("grants after update = %v, want ops:dev infra:ops", got)
+	}
+	code, raw := send(t, g, http.MethodPost, "/api/v1/user/update", token, move)
+	var missing handler.Response
+	if code != http.StatusBadRequest || json.Unmarshal(raw, &missing) != nil || missing.Code != errno.ErrMemberNotFound.Code {
+		t.Errorf("update of a moved grant = %d %s, want ErrMemberNotFound", code, raw)
+	}
+
+	found, _ := gorm.Entities.Members().Find(gorm.MemberQuery{Username: "alice", Project: "ops"})
+	if len(found) != 1 {
+		t.Fatalf("grants of alice in ops = %+v", found)
+	}
+	member := found[0]
+	if code, data := call(t, g, http.MethodPost, "/api/v1/user/update", token,
+		gin.H{"username": "alice", "id": member.ID, "role": "admin", "version": member.Version}); code != http.StatusOK {
+		t.Fatalf("user update by id = %d %s", code, data)
+	}
+	if got := roles(); got["ops"] != "admin" || got["infra"] != "ops" {
+		t.Errorf("grants after update by id = %v, want ops:admin infra:ops", got)
+	}
+}
+
+func TestProjectResourceUpdateWithTwoGrants(t *testing.T) {
+	g := newTestServer(t)
+	token := login(t, g)
+	for _, step := range []struct {
+		path string
+		form gin.H
+	}{
+		{"/api/v1/project/add", gin.H{"project_name": "infra"}},
+		{"/api/v1/role/add", gin.H{"role_name": "dev"}},
+		{"/api/v1/projectResource/add", gin.H{"resource_name": "/api/v1/pay", "project_name": "ops", "role_name": "dev"}},
+		{"/api/v1/projectResource/add", gin.H{"resource_name": "/api/v1/pay", "project_name": "ops", "role_name": "admin"}},
+	} {
+		if code, data := call(t, g, http.MethodPost, step.path, token, step.form); code != http.StatusOK {
+			t.Fatalf("%s = %d %s", step.path, code, data)
+		}
+	}
+	update := gin.H{"resource_name": "/api/v1/pay", "project_name": "infra", "role_name": "dev"}
+	if code, data := call(t, g, http.MethodPost, "/api/v1/projectResource/update", token, update); code != http.StatusBadRequest {
+		t.Errorf("update without choosing a grant = %d %s, want 400", code, data)
+	}
+	update["old_project_name"], update["old_role_name"] = "ops", "dev"
+	if code, data := call(t, g, http.MethodPost, "/api/v1/projectResource/update", token, update); code != http.StatusOK || string(data) != "1" {
+		t.Fatalf("project resource update = %d %s", code, data)
+	}
+	grants, _ := gorm.Entities.Resources().Find(gorm.ResourceQuery{Router: "/api/v1/pay"})
+	if len(grants) != 2 || grants[0].ProjectName != "infra" || grants[0].Version != 2 || grants[1].ProjectName != "ops" || grants[1].Version != 1 {
+		t.Errorf("grants after update = %+v", grants)
+	}
+}
+
+func TestProjectResourceUpdateKeepsOmittedFields(t *testing.T) {
+	g := newTestServer(t)
+	token := login(t, g)
+	for _, step := range []struct {
+		path string
+		form gin.H
+	}{
+		{"/api/v1/project/add", gin.H{"project_name": "infra"}},
+		{"/api/v1/role/add", gin.H{"role_name": "dev"}},
+		{"/api/v1/projectResource/add", gin.H{"resource_name": "/api/v1/pay", "project_name": "ops", "role_name": "admin"}},
+	} {
+		if code, data := call(t, g, http.MethodPost, step.path, token, step.form); code != http.StatusOK {
+			t.Fatalf("%s = %d %s", step.path, code, data)
+		}
+	}
+	grant := func() model.ProjectResources {
+		grants, _ := gorm.Entities.Resources().Find(gorm.ResourceQuery{Router: "/api/v1/pay"})
+		if len(grants) == 0 {
+			return model.ProjectResources{}
+		}
+		return grants[0]
+	}
+	for _, c := range []struct {
+		form gin.H
+		code int
+	}{
+		{gin.H{"resource_name": "/api/v1/pay", "project_name": "nope"}, errno.ErrProjectNotFound.Code},
+		{gin.H{"resource_name": "/api/v1/pay", "role_name": "nope"}, errno.ErrRoleNotFound.Code},
+		{gin.H{"resource_name": "/api/v1/pay"}, errno.ErrValidation.Code},
+	} {
+		code, raw := send(t, g, http.MethodPost, "/api/v1/projectResource/update", token, c.form)
+		var resp handler.Response
+		if code != http.StatusBadRequest || json.Unmarshal(raw, &resp) != nil || resp.Code != c.code {
+			t.Errorf("update %v = %d %s, want 400 with code %d", c.form, code, raw, c.code)
+		}
+	}
+	if got := grant(); got.ProjectName != "ops" || got.RoleName != "admin" || got.Version != 1 {
+		t.Errorf("grant after refused updates = %+v", got)
+	}
+
+	if code, data := call(t, g, http.MethodPost, "/api/v1/projectResource/update", token, gin.H{"resource_name": "/api/v1/pay", "role_name": "dev"}); code != http.StatusOK {
+		t.Fatalf("role update = %d %s", code, data)
+	}
+	if got := grant(); got.ProjectName != "ops" || got.RoleName != "dev" {
+		t.Errorf("grant after a role update = %+v, want ops/dev", got)
+	}
+	if code, data := call(t, g, http.MethodPost, "/api/v1/projectResource/update", token, gin.H{"resource_name": "/api/v1/pay", "project_name": "infra"}); code != http.StatusOK {
+		t.Fatalf("project update = %d %s", code, data)
+	}
+	if got := grant(); got.ProjectName != "infra" || got.RoleName != "dev" || got.Version != 3 {
+		t.Errorf("grant after a project update = %+v, want infra/dev at version 3", got)
+	}
+}
+
+func TestRevokeSessionsRequiresAdmin(t *testing.T) {
+	g := newTestServer(t)
+	admin := login(t, g)
+	if code, data := call(t, g, http.MethodPost, "/api/v1/user/add", admin,
+		gin.H{"username": "bob", "password": "hunter2", "project": "ops", "role": "developer"}); code != http.StatusOK {
+		t.Fatalf("user add = %d %s", code, data)
+	}
+	bob := loginAs(t, g, "bob", "hunter2")
+	if code, raw := send(t, g, http.MethodPost, "/api/v1/user/revokeSessions", bob, gin.H{"username": "admin"}); code != http.StatusForbidden {
+		t.Errorf("revoking the sessions of another user = %d %s, want 403", code, raw)
+	}
+	if code, data := call(t, g, http.MethodGet, "/api/v1/project/list", admin, nil); code != http.StatusOK {
+		t.Errorf("admin token after a refused revocation = %d %s", code, data)
+	}
+	if code, data := call(t, g, http.MethodPost, "/api/v1/user/revokeSessions", bob, gin.H{"username": "bob"}); code != http.StatusOK {
+		t.Errorf("revoking own sessions = %d %s", code, data)
+	}
+	if code, data := call(t, g, http.MethodPost, "/api/v1/user/revokeSessions", admin, gin.H{"username": "bob"}); code != http.StatusOK {
+		t.Errorf("revoking sessions as an admin = %d %s", code, data)
+	}
+}
+
+func TestReservedRegoRequiresAdmin(t *testing.T) {
+	g := newTestServer(t)
+	admin := login(t, g)
+	if code, data := call(t, g, http.MethodPost, "/api/v1/user/add", admin,
+		gin.H{"username": "bob", "password": "hunter2", "project": "ops", "role": "developer"}); code != http.StatusOK {
+		t.Fatalf("user add = %d %s", code, data)
+	}
+	bob := loginAs(t, g, "bob", "hunter2")
+	allowAll := "package gopa.admin\n\ndefault allow = true\n"
+	for _, path := range []string{"/gopa/admin.rego", "gopa/admin.rego", "/api/../gopa/admin.rego"} {
+		rego := gin.H{"method": "POST", "path": path, "name": "admin", "content": allowAll}
+		if code, raw := send(t, g, http.MethodPost, "/api/v1/rego/add", bob, rego); code != http.StatusForbidden {
+			t.Errorf("rego add of %s by a non admin = %d %s, want 403", path, code, raw)
+		}
+	}
+	if code, raw := send(t, g, http.MethodPost, "/api/v1/lockout/unlock", bob, gin.H{"username": "carol"}); code != http.StatusForbidden {
+		t.Errorf("unlock after a refused policy upload = %d %s, want 403", code, raw)
+	}
+	demo := gin.H{"method": "GET", "path": "/api/v1/demo.rego", "name": "demo", "content": "package api.v1.demo\n"}
+	if code, data := call(t, g, http.MethodPost, "/api/v1/rego/add", bob, demo); code != http.StatusOK {
+		t.Errorf("rego add of an application route = %d %s", code, data)
+	}
+
+	if code, data := call(t, g, http.MethodPost, "/api/v1/rego/add", admin,
+		gin.H{"method": "POST", "path": "/gopa/admin.rego", "name": "admin", "content": util.DefaultAdminRego}); code != http.StatusOK {
+		t.Fatalf("rego add by an admin = %d %s", code, data)
+	}
+	if code, raw := send(t, g, http.MethodPost, "/api/v1/rego/update", bob, gin.H{"path": "/gopa/admin.rego", "content": allowAll}); code != http.StatusForbidden {
+		t.Errorf("rego update by a non admin = %d %s, want 403", code, raw)
+	}
+	if code, raw := send(t, g, http.MethodPost, "/api/v1/rego/delete", bob, gin.H{"path": "/gopa/admin.rego"}); code != http.StatusForbidden {
+		t.Errorf("rego delete by a non admin = %d %s, want 403", code, raw)
+	}
+	if code, data := call(t, g, http.MethodPost, "/api/v1/rego/delete", admin, gin.H{"path": "/gopa/admin.rego"}); code != http.StatusOK || string(data) != "1" {
+		t.Errorf("rego delete by an admin = %d %s", code, data)
+	}
+}
+
+func TestAccessReviewRegoRequiresAdmin(t *testing.T) {
+	g := newTestServer(t)
+	admin := login(t, g)
+	for _, step := range []struct {
+		path string
+		form gin.H
+	}{
+		{"/api/v1/project/add", gin.H{"project_name": "infra"}},
+		{"/api/v1/role/add", gin.H{"role_name": "developer"}},
+		{"/api/v1/user/add", gin.H{"username": "bob", "password": "hunter2", "project": "ops", "role": "developer"}},
+	} {
+		if code, data := call(t, g, http.MethodPost, step.path, admin, step.form); code != http.StatusOK {
+			t.Fatalf("%s = %d %s", step.path, code, data)
+		}
+	}
+	bob := loginAs(t, g, "bob", "hunter2")
+	allowAll := gin.H{"method": "POST", "path": "/gopa/access-request/review.rego", "name": "review",
+		"content": "package gopa.access_request.review\n\ndefault allow = true\n"}
+	if code, raw := send(t, g, http.MethodPost, "/api/v1/rego/add", bob, allowAll); code != http.StatusForbidden {
+		t.Errorf("review policy add by a non admin = %d %s, want 403", code, raw)
+	}
+	request := gin.H{"project": "infra", "role": "developer", "justification": "on call"}
+	if code, data := call(t, g, http.MethodPost, "/api/v1/accessRequest/add", bob, request); code != http.StatusOK {
+		t.Fatalf("access request add = %d %s", code, data)
+	}
+	code, raw := send(t, g, http.MethodPost, "/api/v1/accessRequest/approve", bob, gin.H{"id": 1})
+	var denied handler.Response
+	if code != http.StatusForbidden || json.Unmarshal(raw, &denied) != nil || denied.Code != errno.ErrAccessReviewForbidden.Code {
+		t.Errorf("approving own request = %d %s, want 403", code, raw)
+	}
+
+	if code, data := call(t, g, http.MethodPost, "/api/v1/rego/add", admin,
+		gin.H{"method": "POST", "path": "/gopa/access-request/review.rego", "name": "review", "content": util.DefaultAccessReviewRego}); code != http.StatusOK {
+		t.Fatalf("review policy add by an admin = %d %s", code, data)
+	}
+	if code, raw := send(t, g, http.MethodPost, "/api/v1/rego/update", bob,
+		gin.H{"path": "/gopa/access-request/review.rego", "content": allowAll["content"]}); code != http.StatusForbidden {
+		t.Errorf("review policy update by a non admin = %d %s, want 403", code, raw)
+	}
+}
+
+func TestLocalPasswordRequiresAdmin(t *testing.T) {
+	g := newTestServer(t)
+	admin := login(t, g)
+	if code, data := call(t, g, http.MethodPost, "/api/v1/user/add", admin,
+		gin.H{"username": "bob", "password": "hunter2", "project": "ops", "role": "developer"}); code != http.StatusOK {
+		t.Fatalf("user add = %d %s", code, data)
+	}
+	bob := loginAs(t, g, "bob", "hunter2")
+	takeover := gin.H{"username": "admin", "password": "mine", "project": "ops", "role": "guest"}
+	if code, raw := send(t, g, http.MethodPost, "/api/v1/user/add", bob, takeover); code != http.StatusForbidden {
+		t.Errorf("setting the password of another user = %d %s, want 403", code, raw)
+	}
+	provision := gin.H{"project_name": "web", "members": []gin.H{{"username": "admin", "password": "mine", "role": "dev"}}}
+	if code, raw := send(t, g, http.MethodPost, "/api/v1/project/provision", bob, provision); code != http.StatusForbidden {
+		t.Errorf("provisioning a member with a password = %d %s, want 403", code, raw)
+	}
+	if code, _ := send(t, g, http.MethodPost, "/api/sso-login", "", gin.H{"username": "admin", "password": "mine"}); code != http.StatusUnauthorized {
+		t.Error("logged in with a password set by a non admin")
+	}
+
+	// 密码保存在一条凭据上，之后添加的授权不影响登录
+	for _, form := range []gin.H{
+		{"username": "carol", "password": "first", "project": "ops", "role": "developer"},
+		{"username": "carol", "password": "second", "project": "ops", "role": "tester"},
+		{"username": "carol", "project": "ops", "role": "viewer"},
+	} {
+		if code, data := call(t, g, http.MethodPost, "/api/v1/user/add", admin, form); code != http.StatusOK {
+			t.Fatalf("user add = %d %s", code, data)
+		}
+	}
+	var credentials []model.GopaCredentials
+	gorm.DB.Self.Where("username = ?", "carol").Find(&credentials)
+	if len(credentials) != 1 {
+		t.Errorf("carol has %d credentials, want 1", len(credentials))
+	}
+	loginAs(t, g, "carol", "second")
+	if code, _ := send(t, g, http.MethodPost, "/api/sso-login", "", gin.H{"username": "carol", "password": "first"}); code != http.StatusUnauthorized {
+		t.Error("logged in with a replaced password")
+	}
+
+	gorm.DB.Self.Create(&model.GopaCredentials{Username: "dave", Provider: model.CredentialOIDC})
+	gorm.Entities.Members().Create(model.GopaMembers{Username: "erin", Project: "ops", Role: "developer", Source: model.MemberSourceLdap})
+	for _, username := range []string{"dave", "erin"} {
+		code, raw := send(t, g, http.MethodPost, "/api/v1/user/add", admin,
+			gin.H{"username": username, "password": "local", "project": "ops", "role": "tester"})
+		var refused handler.Response
+		if code != http.StatusBadRequest || json.Unmarshal(raw, &refused) != nil || refused.Code != errno.ErrExternalUser.Code {
+			t.Errorf("setting a local password for %s = %d %s, want 400", username, code, raw)
+		}
+	}
+}
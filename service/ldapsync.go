@@ -0,0 +1,326 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopa/config"
+	"gopa/gorm"
+	"gopa/model"
+	"gopa/pkg/auth"
+	"gopa/pkg/ldap"
+	"gopa/pkg/logger"
+	"gopa/util"
+	goldap "gopkg.in/ldap.v2"
+	g "gorm.io/gorm"
+)
+
+// 未配置时LDAP同步使用的查询参数
+const (
+	DefaultLdapUserSearchFilter  = "(objectClass=person)"
+	DefaultLdapUsernameAttribute = "uid"
+	DefaultLdapGroupAttribute    = "cn"
+)
+
+// LdapSyncActor LDAP同步写审计日志时使用的操作者
+const LdapSyncActor = "gopa-ldap-sync"
+
+// LdapDirectory LDAP中的全部用户以及每个用户所属的组
+type LdapDirectory map[string][]string
+
+// LdapSyncChange 同步对某个用户在某个组内授权的一次修改
+type LdapSyncChange struct {
+	Username     string `json:"username"`
+	Project      string `json:"project"`
+	Role         string `json:"role"`
+	PreviousRole string `json:"previous_role,omitempty"`
+}
+
+// LdapSyncReport 一次同步的结果。DryRun为true时只计算差异，不修改数据库。
+// Missing为GOPA中存在但LDAP中已不存在的用户
+type LdapSyncReport struct {
+	DryRun   bool             `json:"dry_run"`
+	SyncedAt time.Time        `json:"synced_at"`
+	Users    int              `json:"users"`
+	Created  []LdapSyncChange `json:"created"`
+	Updated  []LdapSyncChange `json:"updated"`
+	Disabled []LdapSyncChange `json:"disabled"`
+	Missing  []string         `json:"missing"`
+}
+
+// ldapSyncMu 保证同一时刻只有一次同步在执行
+var ldapSyncMu sync.Mutex
+
+// LdapSyncer 按配置的间隔定期同步LDAP，interval为0时不做定时同步
+func LdapSyncer(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		report, err := SyncLdap(false)
+		if err != nil {
+			logger.RuntimeEmit("service.LdapSyncer", "", err.Error(), false)
+			continue
+		}
+		logger.MetricsEmit("service.LdapSyncer", "",
+			fmt.Sprintf("ldap sync: %d created, %d updated, %d disabled, %d missing",
+				len(report.Created), len(report.Updated), len(report.Disabled), len(report.Missing)), true)
+	}
+}
+
+// SyncLdap 读取LDAP的用户和组，按配置的映射创建、更新或停用gopa_members中
+// 来源为ldap的授权。手动添加的授权不会被修改
+func SyncLdap(dryRun bool) (*LdapSyncReport, error) {
+	ldapSyncMu.Lock()
+	defer ldapSyncMu.Unlock()
+
+	conf := config.GetConfig().LdapClient
+	pool := ldap.Ensure(conf)
+	directory, err := ReadLdapDirectory(pool, conf)
+	if err != nil {
+		return nil, err
+	}
+	members, err := gorm.Entities.Members().Find(gorm.MemberQuery{})
+	if err != nil {
+		return nil, err
+	}
+	report := PlanLdapSync(directory, conf.Sync.Mappings, conf.SyncInitRoleID, members)
+	report.DryRun = dryRun
+	report.SyncedAt = time.Now()
+	if dryRun {
+		return &report, nil
+	}
+	if err := applyLdapSync(report, members, conf.SyncInitPassword); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// ReadLdapDirectory 以BindDN的身份查询全部用户，并通过GroupFilter查询每个用户所属的组
+func ReadLdapDirectory(pool *ldap.Pool, conf model.LdapClient) (LdapDirectory, error) {
+	filter := conf.Sync.UserSearchFilter
+	if filter == "" {
+		filter = DefaultLdapUserSearchFilter
+	}
+	usernameAttribute := conf.Sync.UsernameAttribute
+	if usernameAttribute == "" {
+		usernameAttribute = DefaultLdapUsernameAttribute
+	}
+	groupAttribute := conf.Sync.GroupAttribute
+	if groupAttribute == "" {
+		groupAttribute = DefaultLdapGroupAttribute
+	}
+
+	sr, err := pool.Search(goldap.NewSearchRequest(
+		conf.Base,
+		goldap.ScopeWholeSubtree, goldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		[]string{usernameAttribute},
+		nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	directory := LdapDirectory{}
+	for _, entry := range sr.Entries {
+		username := entry.GetAttributeValue(usernameAttribute)
+		if username == "" {
+			continue
+		}
+		directory[username] = nil
+		if conf.GroupFilter == "" {
+			continue
+		}
+		groups, err := pool.Search(goldap.NewSearchRequest(
+			conf.Base,
+			goldap.ScopeWholeSubtree, goldap.NeverDerefAliases, 0, 0, false,
+			fmt.Sprintf(conf.GroupFilter, goldap.EscapeFilter(username)),
+			[]string{groupAttribute},
+			nil,
+		))
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range groups.Entries {
+			if name := group.GetAttributeValue(groupAttribute); name != "" {
+				directory[username] = append(directory[username], name)
+			}
+		}
+	}
+	return directory, nil
+}
+
+// memberKey 用户在某个组内的授权
+type memberKey struct {
+	username string
+	project  string
+}
+
+// PlanLdapSync 计算把members同步为directory需要做的修改。
+// 同一用户通过多个LDAP组映射到同一个GOPA组时，以mappings中靠前的映射为准；
+// 用户不属于任何映射的组时，initRole不为空则授予guest组的initRole角色
+func PlanLdapSync(directory LdapDirectory, mappings []model.LdapGroupMapping, initRole string, members []model.GopaMembers) LdapSyncReport {
+	desired := map[memberKey]string{}
+	for username, groups := range directory {
+		granted := false
+		for _, mapping := range mappings {
+			if !containsString(groups, mapping.Group) {
+				continue
+			}
+			key := memberKey{username, mapping.Project}
+			if _, ok := desired[key]; !ok {
+				desired[key] = mapping.Role
+			}
+			granted = true
+		}
+		if !granted && initRole != "" {
+			desired[memberKey{username, "guest"}] = initRole
+		}
+	}
+
+	synced := map[memberKey]model.GopaMembers{}
+	manual := map[memberKey]bool{}
+	usernames := map[string]bool{}
+	for _, member := range members {
+		key := memberKey{member.Username, member.Project}
+		if member.Source == model.MemberSourceLdap {
+			synced[key] = member
+		} else {
+			manual[key] = true
+		}
+		usernames[member.Username] = true
+	}
+
+	report := LdapSyncReport{Users: len(directory)}
+	for key, role := range desired {
+		change := LdapSyncChange{Username: key.username, Project: key.project, Role: role}
+		if member, ok := synced[key]; ok {
+			if member.Disabled || member.Role != role {
+				change.PreviousRole = member.Role
+				report.Updated = append(report.Updated, change)
+			}
+			continue
+		}
+		if !manual[key] {
+			report.Created = append(report.Created, change)
+		}
+	}
+	for key, member := range synced {
+		if _, ok := desired[key]; !ok && !member.Disabled {
+			report.Disabled = append(report.Disabled, LdapSyncChange{Username: key.username, Project: key.project, Role: member.Role})
+		}
+	}
+	for username := range usernames {
+		if _, ok := directory[username]; !ok {
+			report.Missing = append(report.Missing, username)
+		}
+	}
+
+	sortChanges(report.Created)
+	sortChanges(report.Updated)
+	sortChanges(report.Disabled)
+	sort.Strings(report.Missing)
+	return report
+}
+
+// initLocalPassword 为同步创建的用户设置初始的本地密码，用户已经有凭据时不修改
+func initLocalPassword(tx *g.DB, username, hashed string) error {
+	var total int64
+	if res := tx.Model(&model.GopaCredentials{}).Where("username = ?", username).Count(&total); res.Error != nil || total > 0 {
+		return res.Error
+	}
+	return tx.Create(&model.GopaCredentials{Username: username, Provider: model.CredentialLocal, Password: hashed}).Error
+}
+
+// applyLdapSync 在一个事务内执行report中的修改，并为每一条修改写入审计日志
+func applyLdapSync(report LdapSyncReport, members []model.GopaMembers, initPassword string) error {
+	password := ""
+	if initPassword != "" && len(report.Created) > 0 {
+		hashed, err := auth.Encrypt(initPassword)
+		if err != nil {
+			return err
+		}
+		password = hashed
+	}
+	ids := map[memberKey]uint64{}
+	for _, member := range members {
+		if member.Source == model.MemberSourceLdap {
+			ids[memberKey{member.Username, member.Project}] = member.ID
+		}
+	}
+
+	enabled, disabled := false, true
+	err := gorm.Entities.Transaction(func(tx gorm.EntityStore) error {
+		for _, change := range report.Created {
+			member := model.GopaMembers{
+				Username: change.Username,
+				Project:  change.Project,
+				Role:     change.Role,
+				Source:   model.MemberSourceLdap,
+			}
+			if err := tx.Members().Create(member); err != nil {
+				return err
+			}
+			if password == "" {
+				continue
+			}
+			if err := initLocalPassword(tx.DB(), change.Username, password); err != nil {
+				return err
+			}
+		}
+		for _, change := range report.Updated {
+			id := ids[memberKey{change.Username, change.Project}]
+			if _, err := tx.Members().Update(id, gorm.AnyVersion, gorm.MemberUpdate{Role: change.Role, Disabled: &enabled}); err != nil {
+				return err
+			}
+		}
+		for _, change := range report.Disabled {
+			id := ids[memberKey{change.Username, change.Project}]
+			if _, err := tx.Members().Update(id, gorm.AnyVersion, gorm.MemberUpdate{Disabled: &disabled}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, change := range report.Created {
+		util.Audit(LdapSyncActor, "member.synced", change.Username, fmt.Sprintf("granted %s/%s", change.Project, change.Role))
+	}
+	for _, change := range report.Updated {
+		util.Audit(LdapSyncActor, "member.synced", change.Username,
+			fmt.Sprintf("changed %s/%s to %s/%s", change.Project, change.PreviousRole, change.Project, change.Role))
+	}
+	for _, change := range report.Disabled {
+		util.Audit(LdapSyncActor, "member.disabled", change.Username, fmt.Sprintf("disabled %s/%s", change.Project, change.Role))
+	}
+	if len(report.Missing) > 0 {
+		util.Audit(LdapSyncActor, "member.missing", strings.Join(report.Missing, ","), "users no longer exist in LDAP")
+	}
+	return nil
+}
+
+func sortChanges(changes []LdapSyncChange) {
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Username != changes[j].Username {
+			return changes[i].Username < changes[j].Username
+		}
+		return changes[i].Project < changes[j].Project
+	})
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
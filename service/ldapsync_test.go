@@ -0,0 +1,75 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"gopa/model"
+)
+
+func TestPlanLdapSync(t *testing.T) {
+	directory := LdapDirectory{
+		"alice": {"eng", "ops"},
+		"bob":   {"eng"},
+		"carol": {"sales"},
+		"dave":  nil,
+	}
+	mappings := []model.LdapGroupMapping{
+		{Group: "ops", Project: "infra", Role: "admin"},
+		{Group: "eng", Project: "infra", Role: "developer"},
+		{Group: "eng", Project: "data", Role: "viewer"},
+		{Group: "sales", Project: "crm", Role: "editor"},
+	}
+	members := []model.GopaMembers{
+		// 映射后的角色变了
+		{BaseModel: model.BaseModel{ID: 1}, Username: "alice", Project: "infra", Role: "developer", Source: model.MemberSourceLdap},
+		// 已同步且未变化
+		{BaseModel: model.BaseModel{ID: 2}, Username: "bob", Project: "infra", Role: "developer", Source: model.MemberSourceLdap},
+		// 手动添加的授权不会被覆盖
+		{BaseModel: model.BaseModel{ID: 3}, Username: "bob", Project: "data", Role: "admin"},
+		// 已停用的授权重新出现在LDAP组中
+		{BaseModel: model.BaseModel{ID: 4}, Username: "carol", Project: "crm", Role: "editor", Source: model.MemberSourceLdap, Disabled: true},
+		// 不再属于映射的组
+		{BaseModel: model.BaseModel{ID: 5}, Username: "carol", Project: "infra", Role: "developer", Source: model.MemberSourceLdap},
+		// 已从LDAP删除的用户
+		{BaseModel: model.BaseModel{ID: 6}, Username: "erin", Project: "infra", Role: "admin", Source: model.MemberSourceLdap},
+		{BaseModel: model.BaseModel{ID: 7}, Username: "root", Project: "admin", Role: "admin"},
+	}
+
+	report := PlanLdapSync(directory, mappings, "guest", members)
+
+	if report.Users != 4 {
+		t.Errorf("Users = %d, want 4", report.Users)
+	}
+	wantCreated := []LdapSyncChange{
+		{Username: "alice", Project: "data", Role: "viewer"},
+		{Username: "dave", Project: "guest", Role: "guest"},
+	}
+	if !reflect.DeepEqual(report.Created, wantCreated) {
+		t.Errorf("Created = %+v, want %+v", report.Created, wantCreated)
+	}
+	wantUpdated := []LdapSyncChange{
+		{Username: "alice", Project: "infra", Role: "admin", PreviousRole: "developer"},
+		{Username: "carol", Project: "crm", Role: "editor", PreviousRole: "editor"},
+	}
+	if !reflect.DeepEqual(report.Updated, wantUpdated) {
+		t.Errorf("Updated = %+v, want %+v", report.Updated, wantUpdated)
+	}
+	wantDisabled := []LdapSyncChange{
+		{Username: "carol", Project: "infra", Role: "developer"},
+		{Username: "erin", Project: "infra", Role: "admin"},
+	}
+	if !reflect.DeepEqual(report.Disabled, wantDisabled) {
+		t.Errorf("Disabled = %+v, want %+v", report.Disabled, wantDisabled)
+	}
+	if want := []string{"erin", "root"}; !reflect.DeepEqual(report.Missing, want) {
+		t.Errorf("Missing = %v, want %v", report.Missing, want)
+	}
+}
+
+func TestPlanLdapSyncWithoutInitRole(t *testing.T) {
+	report := PlanLdapSync(LdapDirectory{"dave": nil}, nil, "", nil)
+	if len(report.Created) != 0 || len(report.Missing) != 0 {
+		t.Errorf("report = %+v, want no changes", report)
+	}
+}
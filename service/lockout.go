@@ -0,0 +1,121 @@
+package service
+
+import (
+	"time"
+
+	"gopa/gorm"
+	"gopa/model"
+	"gopa/pkg/lockout"
+	"gopa/pkg/logger"
+	g "gorm.io/gorm"
+)
+
+// 登录失败记录保存的位置
+const (
+	LockoutStoreMemory   = "memory"
+	LockoutStoreDatabase = "database"
+)
+
+// NewLoginLimiter 按配置创建登录失败的限制
+func NewLoginLimiter(conf model.LoginLockout) *lockout.Limiter {
+	var store lockout.Store = lockout.NewMemoryStore()
+	if conf.Store == LockoutStoreDatabase {
+		store = LockoutStore{}
+	}
+	return lockout.New(store, lockout.Config{
+		MaxFailures:   conf.MaxFailures,
+		IPMaxFailures: conf.IPMaxFailures,
+		BaseDelay:     time.Duration(conf.BaseDelay) * time.Second,
+		MaxDelay:      time.Duration(conf.MaxDelay) * time.Second,
+		Duration:      time.Duration(conf.Duration) * time.Second,
+	})
+}
+
+// LockoutPruner 定期清理不再限制登录的失败记录
+func LockoutPruner(limiter *lockout.Limiter, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultGrantReapInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if err := limiter.Prune(now); err != nil {
+			logger.RuntimeEmit("service.LockoutPruner", "", err.Error(), false)
+		}
+	}
+}
+
+// LockoutStore 把登录失败记录保存在数据库中，由多个实例共用
+type LockoutStore struct{}
+
+// Get 返回key的失败记录
+func (LockoutStore) Get(key string) (lockout.Entry, error) {
+	var row model.GopaLoginFailures
+	res := gorm.DB.Self.Where("subject = ?", key).Limit(1).Find(&row)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return lockout.Entry{Key: key}, res.Error
+	}
+	return lockoutEntry(row), nil
+}
+
+// Increment 在数据库中原子地把key的失败次数加一，多个实例同时失败时不会丢失计数。
+// 记录不存在时创建，同时创建时由唯一索引拒绝后重新加一
+func (s LockoutStore) Increment(key string, now, resetBefore time.Time) (lockout.Entry, error) {
+	db := gorm.DB.Self
+	for attempt := 0; ; attempt++ {
+		res := db.Model(&model.GopaLoginFailures{}).Where("subject = ?", key).Updates(map[string]interface{}{
+			"failures": g.Expr("CASE WHEN (locked_until IS NULL OR locked_until <= ?) AND last_failure_at <= ? THEN 1 ELSE failures + 1 END",
+				now, resetBefore),
+			"last_failure_at": now,
+		})
+		if res.Error != nil {
+			return lockout.Entry{Key: key}, res.Error
+		}
+		if res.RowsAffected > 0 {
+			return s.Get(key)
+		}
+		res = db.Create(&model.GopaLoginFailures{Subject: key, Failures: 1, LastFailureAt: now})
+		if res.Error == nil {
+			return lockout.Entry{Key: key, Failures: 1, LastFailure: now}, nil
+		}
+		if !gorm.IsDuplicate(res.Error) || attempt > 0 {
+			return lockout.Entry{Key: key}, res.Error
+		}
+	}
+}
+
+// Lock 把key锁定到until
+func (LockoutStore) Lock(key string, until time.Time) error {
+	return gorm.DB.Self.Model(&model.GopaLoginFailures{}).Where("subject = ?", key).Update("locked_until", until).Error
+}
+
+// Delete 删除失败记录
+func (LockoutStore) Delete(key string) error {
+	return gorm.DB.Self.Unscoped().Where("subject = ?", key).Delete(&model.GopaLoginFailures{}).Error
+}
+
+// List 返回全部失败记录
+func (LockoutStore) List() ([]lockout.Entry, error) {
+	var rows []model.GopaLoginFailures
+	if res := gorm.DB.Self.Find(&rows); res.Error != nil {
+		return nil, res.Error
+	}
+	entries := make([]lockout.Entry, 0, len(rows))
+	for _, row := range rows {
+		entries = append(entries, lockoutEntry(row))
+	}
+	return entries, nil
+}
+
+// Prune 删除最后一次失败在before之前的记录
+func (LockoutStore) Prune(before time.Time) error {
+	return gorm.DB.Self.Unscoped().Where("last_failure_at < ?", before).Delete(&model.GopaLoginFailures{}).Error
+}
+
+func lockoutEntry(row model.GopaLoginFailures) lockout.Entry {
+	entry := lockout.Entry{Key: row.Subject, Failures: row.Failures, LastFailure: row.LastFailureAt}
+	if row.LockedUntil != nil {
+		entry.LockedUntil = *row.LockedUntil
+	}
+	return entry
+}
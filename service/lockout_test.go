@@ -0,0 +1,45 @@
+package service
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"gopa/pkg/lockout"
+)
+
+func TestLockoutStoreIncrement(t *testing.T) {
+	setupTestDB(t)
+	store := LockoutStore{}
+	now := time.Now()
+	key := lockout.UserKey("alice")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.Increment(key, now, now.Add(-time.Minute)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if entry, err := store.Get(key); err != nil || entry.Failures != 10 {
+		t.Fatalf("after 10 concurrent failures Get = %+v, %v", entry, err)
+	}
+
+	// 锁定中的记录继续计数，锁定结束且超过重新计数的时间后从1开始
+	if err := store.Lock(key, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	later := now.Add(2 * time.Minute)
+	if entry, err := store.Increment(key, later, later.Add(-time.Minute)); err != nil || entry.Failures != 11 {
+		t.Errorf("Increment while locked = %+v, %v, want 11 failures", entry, err)
+	}
+	later = now.Add(2 * time.Hour)
+	entry, err := store.Increment(key, later, later.Add(-time.Minute))
+	if err != nil || entry.Failures != 1 || !entry.LastFailure.Equal(later) {
+		t.Errorf("Increment after the lock expired = %+v, %v, want 1 failure", entry, err)
+	}
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"gopa/gorm"
+	"gopa/model"
+	"gopa/pkg/logger"
+	"gopa/util"
+)
+
+// DefaultGrantReapInterval 未配置时清理过期临时授权的间隔
+const DefaultGrantReapInterval = time.Minute
+
+// GrantReaper 定期删除已过期的临时授权，并为每一条删除的授权写入审计日志。
+// 同时清理已经过期、不再需要保留的token吊销记录和刷新token
+func GrantReaper(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultGrantReapInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if _, err := ReapExpiredGrants(now); err != nil {
+			logger.RuntimeEmit("service.GrantReaper", "", err.Error(), false)
+		}
+		if err := PruneRevokedTokens(now); err != nil {
+			logger.RuntimeEmit("service.GrantReaper", "", err.Error(), false)
+		}
+		if err := PruneRefreshTokens(now); err != nil {
+			logger.RuntimeEmit("service.GrantReaper", "", err.Error(), false)
+		}
+	}
+}
+
+// PruneRevokedTokens 删除在now之前已经过期的token的吊销记录
+func PruneRevokedTokens(now time.Time) error {
+	return gorm.DB.Self.Unscoped().Where("expires_at <= ?", now).Delete(&model.GopaRevokedTokens{}).Error
+}
+
+// PruneRefreshTokens 删除在now之前已经过期的刷新token。
+// 已使用的刷新token在过期前保留，用于发现重复使用
+func PruneRefreshTokens(now time.Time) error {
+	return gorm.DB.Self.Unscoped().Where("expires_at <= ?", now).Delete(&model.GopaRefreshTokens{}).Error
+}
+
+// ReapExpiredGrants 删除在now之前过期的授权，返回删除的条数
+func ReapExpiredGrants(now time.Time) (int, error) {
+	members := gorm.Entities.Members()
+	expired, err := members.Find(gorm.MemberQuery{ExpiredAt: now})
+	if err != nil {
+		return 0, err
+	}
+	reaped := 0
+	for _, member := range expired {
+		if _, err := members.Delete(member.ID); err != nil {
+			return reaped, err
+		}
+		reaped++
+		util.Audit("gopa-reaper", "member.expired", member.Username,
+			fmt.Sprintf("grant %s/%s expired at %s", member.Project, member.Role, member.ExpiresAt.Format(time.RFC3339)))
+	}
+	return reaped, nil
+}
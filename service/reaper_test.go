@@ -0,0 +1,51 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"gopa/gorm"
+	"gopa/model"
+)
+
+// setupTestDB 使用内存数据库和内存中的rego文件存储
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	conf := &model.SysConfig{}
+	conf.Gorm.DBType = gorm.DBTypeMemory
+	if err := gorm.Setup(conf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReapExpiredGrants(t *testing.T) {
+	setupTestDB(t)
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	for _, member := range []model.GopaMembers{
+		{Username: "alice", Project: "infra", Role: "admin"},
+		{Username: "bob", Project: "infra", Role: "admin", ExpiresAt: &past},
+		{Username: "bob", Project: "data", Role: "viewer", ExpiresAt: &future},
+		{Username: "carol", Project: "infra", Role: "admin", ExpiresAt: &now},
+	} {
+		gorm.Entities.Members().Create(member)
+	}
+
+	reaped, err := ReapExpiredGrants(now)
+	if err != nil || reaped != 2 {
+		t.Fatalf("ReapExpiredGrants = %d, %v, want 2", reaped, err)
+	}
+	left, _ := gorm.Entities.Members().Find(gorm.MemberQuery{})
+	if len(left) != 2 || left[0].Username != "alice" || left[1].Project != "data" {
+		t.Errorf("remaining grants = %+v", left)
+	}
+	var audits []model.GopaAuditLogs
+	gorm.DB.Self.Where("action = ?", "member.expired").Order("id").Find(&audits)
+	if len(audits) != 2 || audits[0].Target != "bob" || audits[1].Target != "carol" {
+		t.Errorf("audit logs = %+v", audits)
+	}
+
+	if reaped, err := ReapExpiredGrants(now); err != nil || reaped != 0 {
+		t.Errorf("second ReapExpiredGrants = %d, %v, want 0", reaped, err)
+	}
+}
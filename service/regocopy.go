@@ -0,0 +1,32 @@
+package service
+
+import (
+	"gopa/gorm"
+)
+
+// CopyRegos 把from中的全部rego文件复制到to。to中已经存在的路径不会覆盖，
+// 所以中断后可以重新执行
+func CopyRegos(from, to gorm.RegoStore) (copied, skipped int, err error) {
+	documents, err := from.List()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, document := range documents {
+		_, err := to.Get(document.Path)
+		if err == nil {
+			skipped++
+			continue
+		}
+		if err != gorm.ErrRegoNotFound {
+			return copied, skipped, err
+		}
+		if err := to.Insert(document); err == gorm.ErrRegoExists {
+			skipped++
+			continue
+		} else if err != nil {
+			return copied, skipped, err
+		}
+		copied++
+	}
+	return copied, skipped, nil
+}
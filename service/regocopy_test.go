@@ -0,0 +1,36 @@
+package service
+
+import (
+	"testing"
+
+	"gopa/gorm"
+	"gopa/model"
+)
+
+func TestCopyRegos(t *testing.T) {
+	from := gorm.NewMemoryRegoStore()
+	to := gorm.NewMemoryRegoStore()
+	for _, path := range []string{"/api/a.rego", "/api/b.rego"} {
+		if err := from.Insert(model.RegoDocument{Path: path, Content: "package from"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := to.Insert(model.RegoDocument{Path: "/api/b.rego", Content: "package to"}); err != nil {
+		t.Fatal(err)
+	}
+
+	copied, skipped, err := CopyRegos(from, to)
+	if err != nil || copied != 1 || skipped != 1 {
+		t.Fatalf("CopyRegos = %d, %d, %v; want 1 copied and 1 skipped", copied, skipped, err)
+	}
+	if document, _ := to.Get("/api/b.rego"); document.Content != "package to" {
+		t.Errorf("existing document overwritten: %q", document.Content)
+	}
+	if document, err := to.Get("/api/a.rego"); err != nil || document.Content != "package from" {
+		t.Errorf("copied document = %+v, %v", document, err)
+	}
+
+	if copied, skipped, _ := CopyRegos(from, to); copied != 0 || skipped != 2 {
+		t.Errorf("second run = %d copied, %d skipped; want everything skipped", copied, skipped)
+	}
+}
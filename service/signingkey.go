@@ -0,0 +1,166 @@
+package service
+
+import (
+	"strings"
+	"time"
+
+	"gopa/gorm"
+	"gopa/model"
+	"gopa/pkg/logger"
+	"gopa/pkg/secretbox"
+	"gopa/pkg/token"
+)
+
+// DefaultJwtKeyRotation 未配置时轮换签名密钥的间隔
+const DefaultJwtKeyRotation = 7 * 24 * time.Hour
+
+// signingKeyCheckInterval 检查是否需要轮换、以及读取其他实例生成的密钥的间隔
+const signingKeyCheckInterval = time.Minute
+
+// signingKeyPublishDelay 轮换生成的新密钥先只在JWKS中发布，这段时间后才用于签名。
+// 此时下游服务缓存的JWKS已经过期，其他实例也已经读取到新密钥，用新密钥签发的token都能校验
+const signingKeyPublishDelay = token.JWKSMaxAge + signingKeyCheckInterval
+
+// pemPrefix 未加密保存的私钥以PEM的开头标记开始
+const pemPrefix = "-----BEGIN"
+
+// InitSigningKeys 从数据库读取签名密钥创建密钥环，没有可用的密钥时生成一个。
+// 私钥用box加密后保存，box为nil时不加密，只用于关系数据保存在内存中的情况
+func InitSigningKeys(algorithm string, rotation time.Duration, box *secretbox.Box) (*token.KeyRing, error) {
+	if rotation <= 0 {
+		rotation = DefaultJwtKeyRotation
+	}
+	if algorithm == "" {
+		algorithm = token.AlgorithmRS256
+	}
+	ring, err := token.NewKeyRing(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if err := ReloadSigningKeys(ring, box); err != nil {
+		return nil, err
+	}
+	if ring.Active() == nil {
+		if _, err := RotateSigningKey(ring, box, time.Now(), rotation); err != nil {
+			return nil, err
+		}
+	}
+	return ring, nil
+}
+
+// SigningKeyRotator 定期读取其他实例生成的密钥，并在最新的密钥创建超过rotation后轮换
+func SigningKeyRotator(ring *token.KeyRing, box *secretbox.Box, rotation time.Duration) {
+	if rotation <= 0 {
+		rotation = DefaultJwtKeyRotation
+	}
+	ticker := time.NewTicker(signingKeyCheckInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if err := ReloadSigningKeys(ring, box); err != nil {
+			logger.RuntimeEmit("service.SigningKeyRotator", "", err.Error(), false)
+			continue
+		}
+		// 其他实例轮换时删除的旧密钥也从本实例的密钥环中移除
+		ring.Prune(now.Add(-2 * rotation))
+		if latest := ring.Latest(); latest != nil && now.Sub(latest.CreatedAt) < rotation {
+			continue
+		}
+		key, err := RotateSigningKey(ring, box, now, rotation)
+		if err != nil {
+			logger.RuntimeEmit("service.SigningKeyRotator", "", err.Error(), false)
+			continue
+		}
+		logger.MetricsEmit("service.SigningKeyRotator", "", "rotated signing key to "+key.ID, true)
+	}
+}
+
+// RotateSigningKey 生成并保存新的签名密钥，删除创建时间早于两个rotation的旧密钥。
+// 新密钥在signingKeyPublishDelay之后才用于签名，密钥环中没有可用于签名的密钥时立即使用。
+// 旧密钥至少保留一个rotation，保证轮换前签发的token在过期前仍能校验
+func RotateSigningKey(ring *token.KeyRing, box *secretbox.Box, now time.Time, rotation time.Duration) (*token.Key, error) {
+	active := ring.Active()
+	var activeFrom time.Time
+	if active != nil {
+		activeFrom = now.Add(signingKeyPublishDelay)
+	}
+	key, err := ring.GenerateKey(now, activeFrom)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := sealPrivateKey(box, key)
+	if err != nil {
+		return nil, err
+	}
+	db := gorm.DB.Self
+	stored := model.GopaSigningKeys{Kid: key.ID, Algorithm: key.Algorithm, PrivateKey: encoded}
+	stored.CreatedAt = now
+	if active != nil {
+		stored.ActiveFrom = &activeFrom
+	}
+	if res := db.Create(&stored); res.Error != nil {
+		return nil, res.Error
+	}
+	// 新密钥生效前仍在签名的密钥不能删除
+	cutoff := now.Add(-2 * rotation)
+	if active != nil && active.CreatedAt.Before(cutoff) {
+		cutoff = active.CreatedAt
+	}
+	ring.Prune(cutoff)
+	if res := db.Unscoped().Where("created_at < ?", cutoff).Delete(&model.GopaSigningKeys{}); res.Error != nil {
+		return nil, res.Error
+	}
+	return key, nil
+}
+
+// ReloadSigningKeys 把数据库中算法与密钥环一致、且尚未加入的密钥加入密钥环。
+// 未加密保存的旧密钥在配置了box时加密后重新保存
+func ReloadSigningKeys(ring *token.KeyRing, box *secretbox.Box) error {
+	var stored []model.GopaSigningKeys
+	if res := gorm.DB.Self.Where("algorithm = ?", ring.Algorithm()).Find(&stored); res.Error != nil {
+		return res.Error
+	}
+	for _, s := range stored {
+		if _, ok := ring.Lookup(s.Kid); ok {
+			continue
+		}
+		encoded := s.PrivateKey
+		plaintext := strings.HasPrefix(encoded, pemPrefix)
+		if !plaintext {
+			if box == nil {
+				return secretbox.ErrCiphertext
+			}
+			opened, err := box.Open(encoded)
+			if err != nil {
+				return err
+			}
+			encoded = string(opened)
+		}
+		key, err := token.UnmarshalPrivateKey(s.Kid, s.Algorithm, s.CreatedAt, encoded)
+		if err != nil {
+			return err
+		}
+		if s.ActiveFrom != nil {
+			key.ActiveFrom = *s.ActiveFrom
+		}
+		if plaintext && box != nil {
+			sealed, err := sealPrivateKey(box, key)
+			if err != nil {
+				return err
+			}
+			if res := gorm.DB.Self.Model(&model.GopaSigningKeys{}).Where("id = ?", s.ID).Update("private_key", sealed); res.Error != nil {
+				return res.Error
+			}
+		}
+		ring.Add(key)
+	}
+	return nil
+}
+
+// sealPrivateKey 把key的私钥编码为PEM，box不为nil时加密
+func sealPrivateKey(box *secretbox.Box, key *token.Key) (string, error) {
+	encoded, err := token.MarshalPrivateKey(key)
+	if err != nil || box == nil {
+		return encoded, err
+	}
+	return box.Seal([]byte(encoded))
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gopa/gorm"
+	"gopa/model"
+	"gopa/pkg/secretbox"
+	"gopa/pkg/token"
+)
+
+func TestSigningKeysEncrypted(t *testing.T) {
+	setupTestDB(t)
+	box, err := secretbox.New([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring, err := InitSigningKeys("", time.Hour, box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := ring.Active()
+	var stored model.GopaSigningKeys
+	gorm.DB.Self.Where("kid = ?", active.ID).First(&stored)
+	if strings.Contains(stored.PrivateKey, "PRIVATE KEY") {
+		t.Fatalf("private key is stored in plaintext: %s", stored.PrivateKey)
+	}
+
+	// 其他实例用同一个密钥读取
+	other, _ := token.NewKeyRing(token.AlgorithmRS256)
+	if err := ReloadSigningKeys(other, box); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := other.Lookup(active.ID); !ok {
+		t.Errorf("key %s was not loaded", active.ID)
+	}
+	wrong, _ := secretbox.New([]byte("fedcba9876543210fedcba9876543210"))
+	other, _ = token.NewKeyRing(token.AlgorithmRS256)
+	if err := ReloadSigningKeys(other, wrong); err == nil {
+		t.Error("ReloadSigningKeys with a wrong key should fail")
+	}
+
+	// 未加密保存的旧密钥读取后加密
+	legacy, err := other.GenerateKey(time.Now(), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, _ := token.MarshalPrivateKey(legacy)
+	gorm.DB.Self.Create(&model.GopaSigningKeys{Kid: legacy.ID, Algorithm: legacy.Algorithm, PrivateKey: encoded})
+	other, _ = token.NewKeyRing(token.AlgorithmRS256)
+	if err := ReloadSigningKeys(other, box); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := other.Lookup(legacy.ID); !ok {
+		t.Errorf("legacy key %s was not loaded", legacy.ID)
+	}
+	gorm.DB.Self.Where("kid = ?", legacy.ID).First(&stored)
+	if strings.HasPrefix(stored.PrivateKey, pemPrefix) {
+		t.Error("legacy key was not encrypted after reload")
+	}
+}
+
+func TestRotatedKeyPublishedBeforeSigning(t *testing.T) {
+	setupTestDB(t)
+	ring, err := InitSigningKeys("", time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := ring.Active()
+	now := time.Now()
+	rotated, err := RotateSigningKey(ring, nil, now, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(signingKeyPublishDelay); !rotated.ActiveFrom.Equal(want) {
+		t.Errorf("ActiveFrom = %v, want %v", rotated.ActiveFrom, want)
+	}
+	if ring.Active() != first {
+		t.Error("the rotated key signs before the cached JWKS of other services expire")
+	}
+
+	// 其他实例读取到新密钥后同样先只用于校验
+	other, _ := token.NewKeyRing(token.AlgorithmRS256)
+	if err := ReloadSigningKeys(other, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := other.Lookup(rotated.ID); !ok {
+		t.Fatalf("key %s was not loaded", rotated.ID)
+	}
+	if active := other.Active(); active == nil || active.ID != first.ID {
+		t.Errorf("other instance signs with %v, want %s", active, first.ID)
+	}
+
+	gorm.DB.Self.Model(&model.GopaSigningKeys{}).Where("kid = ?", rotated.ID).Update("active_from", now.Add(-time.Second))
+	other, _ = token.NewKeyRing(token.AlgorithmRS256)
+	if err := ReloadSigningKeys(other, nil); err != nil {
+		t.Fatal(err)
+	}
+	if active := other.Active(); active == nil || active.ID != rotated.ID {
+		t.Errorf("other instance signs with %v after the delay, want %s", active, rotated.ID)
+	}
+}
@@ -0,0 +1,202 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopa/config"
+	"gopa/gorm"
+	"gopa/model"
+	"gopa/pkg/logger"
+)
+
+// 管理API产生的事件类型为 <资源>.<动作>
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+
+	ResourceProject         = "project"
+	ResourceRole            = "role"
+	ResourceMember          = "member"
+	ResourceApplication     = "application"
+	ResourceProjectResource = "projectResource"
+	ResourceRego            = "rego"
+	ResourceServiceAccount  = "serviceAccount"
+	ResourceAPIKey          = "apiKey"
+)
+
+// webhook投递使用的请求头
+const (
+	HeaderEvent     = "X-Gopa-Event"
+	HeaderDelivery  = "X-Gopa-Delivery"
+	HeaderSignature = "X-Gopa-Signature"
+)
+
+// 未配置时的webhook投递参数
+const (
+	DefaultWebhookMaxAttempts = 5
+	DefaultWebhookBackoff     = 2 * time.Second
+	DefaultWebhookTimeout     = 10 * time.Second
+)
+
+// sleep 重试前的等待，测试中替换以免真正等待
+var sleep = time.Sleep
+
+// WebhookEvent 投递给订阅方的事件内容
+type WebhookEvent struct {
+	Event      string      `json:"event"`
+	Actor      string      `json:"actor"`
+	OccurredAt time.Time   `json:"occurred_at"`
+	Data       interface{} `json:"data"`
+}
+
+// Publish 把resource上的action事件投递给所有订阅了该事件的webhook，
+// 每个订阅方各生成一条投递记录，并在后台带重试地投递
+func Publish(resource, action, actor string, data interface{}) {
+	event := resource + "." + action
+	var hooks []model.GopaWebhooks
+	if res := gorm.DB.Self.Where("enabled = ?", true).Find(&hooks); res.Error != nil {
+		logger.RuntimeEmit("service.Publish", "", res.Error.Error(), false)
+		return
+	}
+	payload, err := json.Marshal(WebhookEvent{
+		Event:      event,
+		Actor:      actor,
+		OccurredAt: time.Now(),
+		Data:       data,
+	})
+	if err != nil {
+		logger.RuntimeEmit("service.Publish", "", err.Error(), false)
+		return
+	}
+	for _, hook := range hooks {
+		if !Subscribed(hook.Events, event) {
+			continue
+		}
+		delivery := model.GopaWebhookDeliveries{
+			WebhookID: hook.ID,
+			Event:     event,
+			Payload:   string(payload),
+			Status:    model.DeliveryPending,
+		}
+		if res := gorm.DB.Self.Create(&delivery); res.Error != nil {
+			logger.RuntimeEmit("service.Publish", "", res.Error.Error(), false)
+			continue
+		}
+		go Deliver(hook, delivery)
+	}
+}
+
+// Subscribed 判断逗号分隔的订阅列表events是否包含event。
+// 支持*以及project.*这样的通配
+func Subscribed(events, event string) bool {
+	for _, pattern := range strings.Split(events, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "*" || pattern == event {
+			return true
+		}
+		if strings.HasSuffix(pattern, ".*") && strings.HasPrefix(event, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Deliver 投递一条记录，失败时按指数退避重试，
+// 超过最大次数后把该记录标记为死信
+func Deliver(hook model.GopaWebhooks, delivery model.GopaWebhookDeliveries) {
+	maxAttempts, backoff, timeout := webhookSettings()
+	client := &http.Client{Timeout: timeout}
+	for delivery.Attempts < maxAttempts {
+		if delivery.Attempts > 0 {
+			sleep(backoff << uint(delivery.Attempts-1))
+		}
+		delivery.Attempts++
+		code, err := Send(client, hook.URL, hook.Secret, delivery)
+		delivery.ResponseCode = code
+		if err == nil {
+			now := time.Now()
+			delivery.Status = model.DeliveryDelivered
+			delivery.LastError = ""
+			delivery.DeliveredAt = &now
+			saveDelivery(delivery)
+			return
+		}
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= maxAttempts {
+			delivery.Status = model.DeliveryDead
+		}
+		saveDelivery(delivery)
+	}
+}
+
+// Send 对payload签名并发送一次，返回订阅方的HTTP状态码。
+// 非2xx的状态码视为失败
+func Send(client *http.Client, url, secret string, delivery model.GopaWebhookDeliveries) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderDelivery, strconv.FormatUint(delivery.ID, 10))
+	req.Header.Set(HeaderSignature, Sign(secret, body))
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign 返回body的HMAC-SHA256签名，格式为 sha256=<hex>。
+// 订阅方用同一个secret计算签名并比较即可校验事件来源
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// saveDelivery 保存投递结果
+func saveDelivery(delivery model.GopaWebhookDeliveries) {
+	res := gorm.DB.Self.Model(&model.GopaWebhookDeliveries{}).Where("id = ?", delivery.ID).Updates(map[string]interface{}{
+		"status":        delivery.Status,
+		"attempts":      delivery.Attempts,
+		"response_code": delivery.ResponseCode,
+		"last_error":    delivery.LastError,
+		"delivered_at":  delivery.DeliveredAt,
+	})
+	if res.Error != nil {
+		logger.RuntimeEmit("service.saveDelivery", "", res.Error.Error(), false)
+	}
+}
+
+// webhookSettings 返回配置的投递参数，未配置的使用默认值
+func webhookSettings() (int, time.Duration, time.Duration) {
+	maxAttempts, backoff, timeout := DefaultWebhookMaxAttempts, DefaultWebhookBackoff, DefaultWebhookTimeout
+	if conf := config.GetConfig(); conf != nil {
+		if conf.Webhook.MaxAttempts > 0 {
+			maxAttempts = conf.Webhook.MaxAttempts
+		}
+		if conf.Webhook.Backoff > 0 {
+			backoff = time.Duration(conf.Webhook.Backoff) * time.Second
+		}
+		if conf.Webhook.Timeout > 0 {
+			timeout = time.Duration(conf.Webhook.Timeout) * time.Second
+		}
+	}
+	return maxAttempts, backoff, timeout
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopa/config"
+	"gopa/gorm"
+	"gopa/model"
+)
+
+func TestSubscribed(t *testing.T) {
+	cases := []struct {
+		events string
+		event  string
+		want   bool
+	}{
+		{"*", "rego.updated", true},
+		{"project.created, rego.updated", "rego.updated", true},
+		{"rego.*", "rego.deleted", true},
+		{"rego.*", "role.deleted", false},
+		{"project.created", "project.deleted", false},
+		{"", "project.created", false},
+	}
+	for _, c := range cases {
+		if got := Subscribed(c.events, c.event); got != c.want {
+			t.Errorf("Subscribed(%q, %q) = %v, want %v", c.events, c.event, got, c.want)
+		}
+	}
+}
+
+func TestSend(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(HeaderSignature) != Sign("s3cret", body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get(HeaderEvent) != "rego.updated" || r.Header.Get(HeaderDelivery) != "42" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	delivery := model.GopaWebhookDeliveries{Event: "rego.updated", Payload: `{"event":"rego.updated"}`}
+	delivery.ID = 42
+	if code, err := Send(server.Client(), server.URL, "s3cret", delivery); err != nil || code != http.StatusOK {
+		t.Errorf("Send() = %d, %v", code, err)
+	}
+	if code, err := Send(server.Client(), server.URL, "wrong", delivery); err == nil || code != http.StatusUnauthorized {
+		t.Errorf("Send() with a wrong secret = %d, %v", code, err)
+	}
+	status = http.StatusServiceUnavailable
+	if _, err := Send(server.Client(), server.URL, "s3cret", delivery); err == nil {
+		t.Error("Send() should fail on a 503 response")
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	setupTestDB(t)
+	conf := &model.SysConfig{}
+	conf.Webhook.MaxAttempts = 3
+	conf.Webhook.Backoff = 1
+	config.Reload(conf, "test")
+	var waits []time.Duration
+	sleep = func(d time.Duration) { waits = append(waits, d) }
+	defer func() { sleep = time.Sleep }()
+
+	// 前failures次返回503，签名不对时返回401
+	failures := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(HeaderSignature) != Sign("s3cret", body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	hook := model.GopaWebhooks{URL: server.URL, Secret: "s3cret", Events: "*", Enabled: true}
+	deliver := func(hook model.GopaWebhooks) model.GopaWebhookDeliveries {
+		t.Helper()
+		delivery := model.GopaWebhookDeliveries{Event: "rego.updated", Payload: `{"event":"rego.updated"}`, Status: model.DeliveryPending}
+		if res := gorm.DB.Self.Create(&delivery); res.Error != nil {
+			t.Fatal(res.Error)
+		}
+		waits = nil
+		Deliver(hook, delivery)
+		var saved model.GopaWebhookDeliveries
+		gorm.DB.Self.First(&saved, delivery.ID)
+		return saved
+	}
+
+	failures = 2
+	saved := deliver(hook)
+	if saved.Status != model.DeliveryDelivered || saved.Attempts != 3 || saved.ResponseCode != http.StatusNoContent || saved.DeliveredAt == nil {
+		t.Errorf("retried delivery = %+v", saved)
+	}
+	if want := []time.Duration{time.Second, 2 * time.Second}; !reflect.DeepEqual(waits, want) {
+		t.Errorf("backoff = %v, want %v", waits, want)
+	}
+
+	failures = 5
+	saved = deliver(hook)
+	if saved.Status != model.DeliveryDead || saved.Attempts != 3 || saved.ResponseCode != http.StatusServiceUnavailable || saved.LastError == "" {
+		t.Errorf("dead delivery = %+v", saved)
+	}
+
+	failures = 0
+	hook.Secret = "wrong"
+	saved = deliver(hook)
+	if saved.Status != model.DeliveryDead || saved.ResponseCode != http.StatusUnauthorized {
+		t.Errorf("delivery with a wrong signature = %+v", saved)
+	}
+}
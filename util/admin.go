@@ -0,0 +1,65 @@
+package util
+
+import (
+	"path"
+	"strings"
+
+	"gopa/config"
+)
+
+// ReservedRoutePrefix GOPA自身的策略路由的前缀，如管理策略和访问申请的审批策略。
+// 这些路由下的rego文件只有管理员可以修改
+const ReservedRoutePrefix = "/gopa/"
+
+// AdminRoute 管理操作使用的策略路由，如清除两步验证、解除登录限制和查看配置，
+// 管理员在Mongo中添加该路由的rego文件即可覆盖默认策略
+const AdminRoute = "/gopa/admin"
+
+// DefaultAdminProject 未配置auth.adminProjects时，管理员所在的组
+const DefaultAdminProject = "admin"
+
+// DefaultAdminRego 默认的管理策略：调用者在配置的管理组中拥有admin角色(包括继承)
+const DefaultAdminRego = `package gopa.admin
+
+default allow = false
+
+allow {
+	membership := input.memberships[_]
+	membership.roles[_] == "admin"
+	membership.project == input.admin_projects[_]
+}
+`
+
+// CanAdminister 根据GOPA策略判断username能否对target执行管理操作action。
+// 只有在没有配置管理策略时才使用默认策略，查询策略出错时返回错误
+func CanAdminister(username, action string, target map[string]interface{}) (bool, error) {
+	module, err := policyModule(AdminRoute, DefaultAdminRego)
+	if err != nil {
+		return false, err
+	}
+	memberships, err := activeMemberships(username)
+	if err != nil {
+		return false, err
+	}
+	input := map[string]interface{}{
+		"username":       username,
+		"memberships":    memberships,
+		"admin_projects": adminProjects(),
+		"action":         action,
+		"target":         target,
+	}
+	return evalPolicy(AdminRoute, module, input)
+}
+
+// IsReservedRoute 判断rego文件的路径是否在ReservedRoutePrefix下
+func IsReservedRoute(p string) bool {
+	return strings.HasPrefix(path.Clean("/"+p), ReservedRoutePrefix)
+}
+
+// adminProjects 返回配置的管理组
+func adminProjects() []string {
+	if conf := config.GetConfig(); conf != nil && len(conf.Auth.AdminProjects) > 0 {
+		return conf.Auth.AdminProjects
+	}
+	return []string{DefaultAdminProject}
+}
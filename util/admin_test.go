@@ -0,0 +1,60 @@
+package util
+
+import (
+	"testing"
+
+	"gopa/gorm"
+	"gopa/model"
+)
+
+func TestCanAdminister(t *testing.T) {
+	setupTestDB(t)
+	InvalidateRoleGraph()
+	gorm.Entities.Members().Create(model.GopaMembers{Username: "alice", Project: DefaultAdminProject, Role: "admin"})
+	gorm.Entities.Members().Create(model.GopaMembers{Username: "bob", Project: DefaultAdminProject, Role: "developer"})
+	gorm.Entities.Members().Create(model.GopaMembers{Username: "carol", Project: "infra", Role: "admin"})
+	cases := []struct {
+		username string
+		allowed  bool
+	}{
+		{"alice", true},
+		{"bob", false},
+		{"carol", false},
+		{"dave", false},
+	}
+	for _, c := range cases {
+		allowed, err := CanAdminister(c.username, "lockout.unlock", nil)
+		if err != nil {
+			t.Fatalf("%s: %v", c.username, err)
+		}
+		if allowed != c.allowed {
+			t.Errorf("CanAdminister(%s) = %v, want %v", c.username, allowed, c.allowed)
+		}
+	}
+
+	gorm.Regos = failingRegoStore{gorm.Regos}
+	if allowed, err := CanAdminister("alice", "lockout.unlock", nil); err == nil || allowed {
+		t.Errorf("CanAdminister with the store down = %v, %v, want false and an error", allowed, err)
+	}
+}
+
+func TestIsReservedRoute(t *testing.T) {
+	cases := []struct {
+		path     string
+		reserved bool
+	}{
+		{BuildPath(AdminRoute), true},
+		{BuildPath(AccessReviewRoute), true},
+		{"gopa/admin.rego", true},
+		{"//gopa/admin.rego", true},
+		{"/api/../gopa/access-request/review.rego", true},
+		{"/api/v1/demo.rego", false},
+		{"/gopa.rego", false},
+		{"/gopax/admin.rego", false},
+	}
+	for _, c := range cases {
+		if got := IsReservedRoute(c.path); got != c.reserved {
+			t.Errorf("IsReservedRoute(%q) = %v, want %v", c.path, got, c.reserved)
+		}
+	}
+}
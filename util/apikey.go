@@ -0,0 +1,47 @@
+package util
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"gopa/model"
+)
+
+// API key的格式为 gopa_<64位十六进制随机数>
+const (
+	APIKeyPrefix    = "gopa_"
+	apiKeyShownSize = len(APIKeyPrefix) + 8
+)
+
+// GenerateAPIKey 生成一个新的API key，返回key本身以及用于展示的前缀。
+// key只在创建时返回一次，数据库中只保存HashAPIKey的结果
+func GenerateAPIKey() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	key := APIKeyPrefix + hex.EncodeToString(b)
+	return key, key[:apiKeyShownSize], nil
+}
+
+// HashAPIKey 返回key的SHA-256哈希。key是高熵的随机数，不需要加盐
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// LooksLikeAPIKey 判断字符串是否为GenerateAPIKey生成的格式
+func LooksLikeAPIKey(key string) bool {
+	return strings.HasPrefix(key, APIKeyPrefix) && len(key) == len(APIKeyPrefix)+64
+}
+
+// APIKeyActive 判断key在now时刻是否可用：未被吊销且未过期
+func APIKeyActive(key model.GopaAPIKeys, now time.Time) bool {
+	if key.RevokedAt != nil && !key.RevokedAt.After(now) {
+		return false
+	}
+	return key.ExpiresAt == nil || key.ExpiresAt.After(now)
+}
@@ -0,0 +1,50 @@
+package util
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gopa/model"
+)
+
+func TestGenerateAPIKey(t *testing.T) {
+	key, prefix, err := GenerateAPIKey()
+	if err != nil {
+		t.Fatalf("GenerateAPIKey: %v", err)
+	}
+	if !LooksLikeAPIKey(key) || !strings.HasPrefix(key, prefix) || len(prefix) != len(APIKeyPrefix)+8 {
+		t.Errorf("GenerateAPIKey = %q, %q", key, prefix)
+	}
+	other, _, _ := GenerateAPIKey()
+	if other == key {
+		t.Error("GenerateAPIKey returned the same key twice")
+	}
+	if HashAPIKey(key) != HashAPIKey(key) || HashAPIKey(key) == HashAPIKey(other) || strings.Contains(HashAPIKey(key), key) {
+		t.Error("HashAPIKey should be deterministic and differ between keys")
+	}
+	if LooksLikeAPIKey("Bearer eyJhbGciOiJIUzI1NiJ9") {
+		t.Error("a JWT should not look like an API key")
+	}
+}
+
+func TestAPIKeyActive(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	cases := []struct {
+		name string
+		key  model.GopaAPIKeys
+		want bool
+	}{
+		{"no expiry", model.GopaAPIKeys{}, true},
+		{"not yet expired", model.GopaAPIKeys{ExpiresAt: &future}, true},
+		{"expired", model.GopaAPIKeys{ExpiresAt: &past}, false},
+		{"revoked", model.GopaAPIKeys{RevokedAt: &past}, false},
+		{"in rotation grace period", model.GopaAPIKeys{RevokedAt: &future}, true},
+	}
+	for _, c := range cases {
+		if got := APIKeyActive(c.key, now); got != c.want {
+			t.Errorf("%s: APIKeyActive = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
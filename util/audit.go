@@ -0,0 +1,20 @@
+package util
+
+import (
+	"gopa/gorm"
+	"gopa/model"
+	"gopa/pkg/logger"
+)
+
+// Audit 写入一条审计日志，写入失败时记录到runtime日志
+func Audit(actor, action, target, detail string) {
+	entry := model.GopaAuditLogs{
+		Actor:  actor,
+		Action: action,
+		Target: target,
+		Detail: detail,
+	}
+	if res := gorm.DB.Self.Create(&entry); res.Error != nil {
+		logger.RuntimeEmit("util.Audit", "", res.Error.Error(), false)
+	}
+}
@@ -0,0 +1,67 @@
+package util
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIP 返回请求的来源IP。只有直接连接的地址属于trustedProxies时才读取X-Forwarded-For，
+// 并从右向左跳过可信的代理，返回第一个不可信的地址；否则返回直接连接的地址。
+// trustedProxies为IP或CIDR，客户端自己添加的X-Forwarded-For不会被采用
+func ClientIP(r *http.Request, trustedProxies []string) string {
+	remote, _, err := net.SplitHostPort(strings.TrimSpace(r.RemoteAddr))
+	if err != nil {
+		remote = strings.TrimSpace(r.RemoteAddr)
+	}
+	trusted := parseProxies(trustedProxies)
+	if !containsIP(trusted, net.ParseIP(remote)) {
+		return remote
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		if !containsIP(trusted, ip) {
+			return ip.String()
+		}
+	}
+	return remote
+}
+
+// parseProxies 把IP或CIDR解析为网段，无法解析的忽略
+func parseProxies(proxies []string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				continue
+			}
+			if ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			nets = append(nets, network)
+		}
+	}
+	return nets
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range nets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package util
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies := []string{"10.0.0.0/8", "192.168.1.1"}
+	cases := []struct {
+		name      string
+		remote    string
+		forwarded string
+		want      string
+	}{
+		{"direct", "203.0.113.7:5000", "", "203.0.113.7"},
+		{"spoofed header from a direct client", "203.0.113.7:5000", "1.2.3.4", "203.0.113.7"},
+		{"through a trusted proxy", "10.0.0.5:5000", "203.0.113.7", "203.0.113.7"},
+		{"client prepended a fake hop", "10.0.0.5:5000", "1.2.3.4, 203.0.113.7", "203.0.113.7"},
+		{"chain of trusted proxies", "192.168.1.1:5000", "203.0.113.7, 10.1.1.1", "203.0.113.7"},
+		{"trusted proxy without header", "10.0.0.5:5000", "", "10.0.0.5"},
+		{"garbage header", "10.0.0.5:5000", "not-an-ip", "10.0.0.5"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if got := ClientIP(r, proxies); got != c.want {
+			t.Errorf("%s: ClientIP = %s, want %s", c.name, got, c.want)
+		}
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.5:5000"
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	if got := ClientIP(r, nil); got != "10.0.0.5" {
+		t.Errorf("ClientIP without trusted proxies = %s, want 10.0.0.5", got)
+	}
+}
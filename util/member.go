@@ -0,0 +1,26 @@
+package util
+
+import (
+	"time"
+
+	"gopa/gorm"
+)
+
+// HasActiveGrant 判断用户在now时刻是否有project或其上级组下role的有效授权。
+// 没有授权记录、授权已过期、尚未生效或已停用时都返回false
+func HasActiveGrant(username, project, role string, now time.Time) (bool, error) {
+	tree, err := FetchProjectTree()
+	if err != nil {
+		return false, err
+	}
+	active, err := gorm.Entities.Members().Find(gorm.MemberQuery{
+		Username: username,
+		Projects: tree.Ancestors(project),
+		Role:     role,
+		ActiveAt: now,
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(active) > 0, nil
+}
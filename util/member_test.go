@@ -0,0 +1,56 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"gopa/gorm"
+	"gopa/model"
+)
+
+func TestHasActiveGrant(t *testing.T) {
+	setupTestDB(t)
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	for _, member := range []model.GopaMembers{
+		{Username: "alice", Project: "infra", Role: "admin"},
+		{Username: "bob", Project: "infra", Role: "admin", ExpiresAt: &past},
+		{Username: "carol", Project: "infra", Role: "admin", ValidFrom: &future},
+		{Username: "dave", Project: "infra", Role: "admin", Disabled: true},
+		{Username: "erin", Project: "infra", Role: "admin", ValidFrom: &past, ExpiresAt: &future},
+		{Username: "frank", Project: "infra-cloud", Role: "admin"},
+	} {
+		gorm.Entities.Members().Create(member)
+	}
+	gorm.Entities.Projects().Create(model.GopaProjects{ProjectName: "infra"})
+	gorm.Entities.Projects().Create(model.GopaProjects{ProjectName: "infra-cloud", ParentProject: "infra"})
+
+	cases := []struct {
+		username, project, role string
+		want                    bool
+	}{
+		{"alice", "infra", "admin", true},
+		{"alice", "infra-cloud", "admin", true},
+		{"bob", "infra-cloud", "admin", false},
+		{"frank", "infra-cloud", "admin", true},
+		{"frank", "infra", "admin", false},
+		{"alice", "infra", "developer", false},
+		{"alice", "data", "admin", false},
+		{"bob", "infra", "admin", false},
+		{"carol", "infra", "admin", false},
+		{"dave", "infra", "admin", false},
+		{"erin", "infra", "admin", true},
+		{"nobody", "infra", "admin", false},
+	}
+	for _, c := range cases {
+		got, err := HasActiveGrant(c.username, c.project, c.role, now)
+		if err != nil || got != c.want {
+			t.Errorf("HasActiveGrant(%s, %s, %s) = %v, %v, want %v", c.username, c.project, c.role, got, err, c.want)
+		}
+	}
+
+	gorm.Entities = failingEntityStore{gorm.Entities}
+	if got, err := HasActiveGrant("alice", "infra", "admin", now); got || err == nil {
+		t.Errorf("HasActiveGrant with the store down = %v, %v, want false and an error", got, err)
+	}
+}
@@ -0,0 +1,101 @@
+package util
+
+import (
+	"sort"
+
+	"gopa/gorm"
+)
+
+// ProjectTree 组的层级关系，key为组名，value为它的父组，顶层组的父组为空
+type ProjectTree map[string]string
+
+// ProjectNode 以树形结构返回组时的节点
+type ProjectNode struct {
+	ProjectName string         `json:"project_name"`
+	Children    []*ProjectNode `json:"children"`
+}
+
+// FetchProjectTree 从存储中读取全部组及其父组
+func FetchProjectTree() (ProjectTree, error) {
+	projects, err := gorm.Entities.Projects().List()
+	if err != nil {
+		return nil, err
+	}
+	tree := ProjectTree{}
+	for _, project := range projects {
+		tree[project.ProjectName] = project.ParentProject
+	}
+	return tree, nil
+}
+
+// Ancestors 返回project以及它的全部上级组，project本身排在第一位
+func (t ProjectTree) Ancestors(project string) []string {
+	result := []string{project}
+	for parent := t[project]; parent != "" && !contains(result, parent); parent = t[parent] {
+		result = append(result, parent)
+	}
+	return result
+}
+
+// Descendants 返回project以及它的全部下级组
+func (t ProjectTree) Descendants(project string) []string {
+	var result []string
+	for name := range t {
+		if contains(t.Ancestors(name), project) {
+			result = append(result, name)
+		}
+	}
+	if !contains(result, project) {
+		result = append(result, project)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Children 返回project的直接下级组
+func (t ProjectTree) Children(project string) []string {
+	var result []string
+	for name, parent := range t {
+		if parent == project && name != project {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Nodes 把组的层级关系转换成从顶层组开始的树
+func (t ProjectTree) Nodes() []*ProjectNode {
+	var build func(name string, seen []string) *ProjectNode
+	build = func(name string, seen []string) *ProjectNode {
+		node := &ProjectNode{ProjectName: name, Children: []*ProjectNode{}}
+		for _, child := range t.Children(name) {
+			if !contains(seen, child) {
+				node.Children = append(node.Children, build(child, append(seen, child)))
+			}
+		}
+		return node
+	}
+	roots := []*ProjectNode{}
+	for _, name := range t.Children("") {
+		roots = append(roots, build(name, []string{name}))
+	}
+	// 父组不存在的组也作为顶层组返回
+	for name, parent := range t {
+		if _, ok := t[parent]; parent != "" && !ok {
+			roots = append(roots, build(name, []string{name}))
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].ProjectName < roots[j].ProjectName })
+	return roots
+}
+
+// EffectiveProjects 返回project以及它的全部上级组。
+// 上级组的成员和授权对下级组同样生效。读取层级关系出错时，只返回project本身
+func EffectiveProjects(project string) []string {
+	tree, err := FetchProjectTree()
+	if err != nil {
+		return []string{project}
+	}
+	return tree.Ancestors(project)
+}
@@ -0,0 +1,25 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProjectTree(t *testing.T) {
+	tree := ProjectTree{
+		"infra":           "",
+		"infra-cloud":     "infra",
+		"infra-cloud-k8s": "infra-cloud",
+		"data":            "",
+	}
+	if got := tree.Ancestors("infra-cloud-k8s"); !reflect.DeepEqual(got, []string{"infra-cloud-k8s", "infra-cloud", "infra"}) {
+		t.Errorf("Ancestors(infra-cloud-k8s) = %v", got)
+	}
+	if got := tree.Descendants("infra"); !reflect.DeepEqual(got, []string{"infra", "infra-cloud", "infra-cloud-k8s"}) {
+		t.Errorf("Descendants(infra) = %v", got)
+	}
+	nodes := tree.Nodes()
+	if len(nodes) != 2 || nodes[1].ProjectName != "infra" || nodes[1].Children[0].Children[0].ProjectName != "infra-cloud-k8s" {
+		t.Errorf("Nodes() = %+v", nodes)
+	}
+}
@@ -0,0 +1,99 @@
+package util
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopa/gorm"
+	"gopa/model"
+)
+
+// GeneratedRegoHeader 自动生成的策略文件的首行注释
+const GeneratedRegoHeader = "# generated by GOPA from project_resources"
+
+// projectRole 组和角色的组合，用于生成策略文件时去重
+type projectRole struct {
+	Project string
+	Role    string
+}
+
+// FetchPolicyByPath 根据path返回该路由生效的策略文件。
+// 优先使用Mongo中手写的rego文件；如果没有，则根据
+// project_resources表中的授权记录生成一份RBAC策略。
+// 查询rego文件出错时直接返回错误，不能用生成的策略代替手写的策略
+func FetchPolicyByPath(path string) (model.RegoDocument, error) {
+	document, err := FetchRegoByPath(path)
+	if err != gorm.ErrRegoNotFound {
+		return document, err
+	}
+	generated, genErr := GenerateRego(strings.TrimSuffix(path, ".rego"))
+	if genErr != nil {
+		// 返回Mongo的查询错误，和之前没有策略文件时的行为保持一致
+		return document, err
+	}
+	return generated, nil
+}
+
+// GenerateRego 根据该路由的资源授权记录
+// 生成一份rego策略文件。如果该路由没有任何授权记录，返回错误
+func GenerateRego(route string) (model.RegoDocument, error) {
+	resources, err := gorm.Entities.Resources().Find(gorm.ResourceQuery{Router: route})
+	if err != nil {
+		return model.RegoDocument{}, err
+	}
+	if len(resources) == 0 {
+		return model.RegoDocument{}, fmt.Errorf("no project resources granted on [%s]", route)
+	}
+	var grants []projectRole
+	for _, resource := range resources {
+		grant := projectRole{Project: resource.ProjectName, Role: resource.RoleName}
+		if !containsGrant(grants, grant) {
+			grants = append(grants, grant)
+		}
+	}
+	content := renderRBACRego(route, grants)
+	return model.RegoDocument{
+		Method:    "",
+		Path:      BuildPath(route),
+		Name:      "generated",
+		Content:   content,
+		Arguments: []string{"project", "role"},
+	}, nil
+}
+
+// renderRBACRego 把路由和授权的组、角色渲染成rego文本。
+// 包名和BuildQuery生成的查询保持一致。组和角色通过input.projects
+// 和input.roles匹配，因此被授权组的下级组、继承了被授权角色的角色同样可以访问
+func renderRBACRego(route string, grants []projectRole) string {
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].Project != grants[j].Project {
+			return grants[i].Project < grants[j].Project
+		}
+		return grants[i].Role < grants[j].Role
+	})
+	query := BuildQuery(route, false)
+	pkg := strings.TrimSuffix(strings.TrimPrefix(query, "data."), ".allow")
+
+	var b strings.Builder
+	b.WriteString(GeneratedRegoHeader + "\n")
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+	b.WriteString("default allow = false\n")
+	for _, grant := range grants {
+		b.WriteString("\nallow {\n")
+		fmt.Fprintf(&b, "\tinput.projects[_] == %q\n", grant.Project)
+		fmt.Fprintf(&b, "\tinput.roles[_] == %q\n", grant.Role)
+		b.WriteString("}\n")
+	}
+	return b.String()
+}
+
+// containsGrant 判断grant在不在list里
+func containsGrant(list []projectRole, grant projectRole) bool {
+	for _, element := range list {
+		if element == grant {
+			return true
+		}
+	}
+	return false
+}
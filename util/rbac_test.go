@@ -0,0 +1,70 @@
+package util
+
+import (
+	ctx "context"
+	"testing"
+
+	"github.com/open-policy-agent/opa/rego"
+	"gopa/gorm"
+	"gopa/model"
+)
+
+func TestRenderRBACRego(t *testing.T) {
+	route := "/perf-server/api/v1/bus/latestData"
+	content := renderRBACRego(route, []projectRole{
+		{Project: "infra", Role: "admin"},
+		{Project: "infra-cloud", Role: "developer"},
+	})
+	cases := []struct {
+		projects []string
+		roles    []string
+		allowed  bool
+	}{
+		{[]string{"infra"}, []string{"admin"}, true},
+		{[]string{"infra-cloud", "infra"}, []string{"admin"}, true},
+		{[]string{"infra-cloud"}, []string{"developer"}, true},
+		{[]string{"infra-cloud"}, []string{"admin", "developer"}, true},
+		{[]string{"infra"}, []string{"developer"}, false},
+		{[]string{"guest"}, []string{"guest"}, false},
+	}
+	for _, c := range cases {
+		query := rego.New(
+			rego.Query(BuildQuery(route, false)),
+			rego.Module(BuildPath(route), content),
+			rego.Input(map[string]interface{}{"projects": c.projects, "roles": c.roles}),
+		)
+		results, err := query.Eval(ctx.Background())
+		if err != nil {
+			t.Fatalf("eval generated rego: %v\n%s", err, content)
+		}
+		if results.Allowed() != c.allowed {
+			t.Errorf("%v/%v: allowed = %v, want %v", c.projects, c.roles, results.Allowed(), c.allowed)
+		}
+	}
+}
+
+func TestFetchPolicyByPath(t *testing.T) {
+	setupTestDB(t)
+	route := "/api/v1/pay"
+	gorm.Entities.Resources().Create(model.ProjectResources{
+		GopaProjectRoles: model.GopaProjectRoles{ProjectName: "payments", RoleName: "dev"},
+		ResourceRouter:   route,
+	})
+	document, err := FetchPolicyByPath(BuildPath(route))
+	if err != nil || document.Name != "generated" {
+		t.Fatalf("policy without a rego document = %+v, %v; want the generated policy", document, err)
+	}
+
+	handwritten := model.RegoDocument{Path: BuildPath(route), Name: "pay", Content: "package api.v1.pay\n"}
+	if err := gorm.Regos.Insert(handwritten); err != nil {
+		t.Fatal(err)
+	}
+	if document, err := FetchPolicyByPath(BuildPath(route)); err != nil || document.Name != "pay" {
+		t.Errorf("policy with a rego document = %+v, %v; want the handwritten one", document, err)
+	}
+
+	gorm.Regos = failingRegoStore{gorm.Regos}
+	if _, err := FetchPolicyByPath(BuildPath(route)); err != errStoreDown {
+		t.Errorf("policy while the store is down = %v, want the store error", err)
+	}
+}
@@ -0,0 +1,98 @@
+package util
+
+import (
+	ctx "context"
+	"time"
+
+	"github.com/open-policy-agent/opa/rego"
+	"gopa/gorm"
+	"gopa/model"
+)
+
+// AccessReviewRoute 审批访问申请时使用的策略路由，
+// 管理员在Mongo中添加该路由的rego文件即可覆盖默认策略
+const AccessReviewRoute = "/gopa/access-request/review"
+
+// DefaultAccessReviewRego 默认的审批策略：审批人在申请的组或其上级组中
+// 拥有admin角色(包括继承)，且不能审批自己的申请
+const DefaultAccessReviewRego = `package gopa.access_request.review
+
+default allow = false
+
+allow {
+	input.username != input.requester
+	membership := input.memberships[_]
+	membership.roles[_] == "admin"
+	membership.project == input.target_projects[_]
+}
+`
+
+// CanReviewAccessRequest 根据GOPA策略判断username能否审批request。
+// 只有在没有配置审批策略时才使用默认策略，查询策略出错时返回错误
+func CanReviewAccessRequest(username string, request model.GopaAccessRequests) (bool, error) {
+	module, err := policyModule(AccessReviewRoute, DefaultAccessReviewRego)
+	if err != nil {
+		return false, err
+	}
+	memberships, err := activeMemberships(username)
+	if err != nil {
+		return false, err
+	}
+	input := map[string]interface{}{
+		"username":        username,
+		"requester":       request.Username,
+		"memberships":     memberships,
+		"target_project":  request.Project,
+		"target_projects": EffectiveProjects(request.Project),
+		"target_role":     request.Role,
+	}
+	return evalPolicy(AccessReviewRoute, module, input)
+}
+
+// policyModule 返回route的策略，没有配置时返回defaultModule
+func policyModule(route, defaultModule string) (string, error) {
+	document, err := FetchRegoByPath(BuildPath(route))
+	switch err {
+	case nil:
+		return document.Content, nil
+	case gorm.ErrRegoNotFound:
+		return defaultModule, nil
+	default:
+		return "", err
+	}
+}
+
+// activeMemberships 返回username当前有效的授权，roles为包括继承在内的全部角色
+func activeMemberships(username string) ([]map[string]interface{}, error) {
+	members, err := gorm.Entities.Members().Find(gorm.MemberQuery{Username: username, ActiveAt: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	var memberships []map[string]interface{}
+	for _, member := range members {
+		roles, err := EffectiveRoles(member.Role)
+		if err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, map[string]interface{}{
+			"project": member.Project,
+			"role":    member.Role,
+			"roles":   roles,
+		})
+	}
+	return memberships, nil
+}
+
+// evalPolicy 使用route的策略module对input进行判断
+func evalPolicy(route, module string, input map[string]interface{}) (bool, error) {
+	query := rego.New(
+		rego.Query(BuildQuery(route, false)),
+		rego.Module(BuildPath(route), module),
+		rego.Input(input),
+	)
+	results, err := query.Eval(ctx.Background())
+	if err != nil {
+		return false, err
+	}
+	return results.Allowed(), nil
+}
@@ -0,0 +1,55 @@
+package util
+
+import (
+	"testing"
+
+	"gopa/gorm"
+	"gopa/model"
+)
+
+func TestDefaultAccessReviewRego(t *testing.T) {
+	admin := map[string]interface{}{"project": "infra", "roles": []string{"admin", "developer"}}
+	developer := map[string]interface{}{"project": "infra", "roles": []string{"developer"}}
+	cases := []struct {
+		name        string
+		username    string
+		memberships []map[string]interface{}
+		allowed     bool
+	}{
+		{"admin of parent project", "alice", []map[string]interface{}{admin}, true},
+		{"developer only", "alice", []map[string]interface{}{developer}, false},
+		{"no memberships", "alice", nil, false},
+		{"self approval", "bob", []map[string]interface{}{admin}, false},
+	}
+	for _, c := range cases {
+		allowed, err := evalPolicy(AccessReviewRoute, DefaultAccessReviewRego, map[string]interface{}{
+			"username":        c.username,
+			"requester":       "bob",
+			"memberships":     c.memberships,
+			"target_project":  "infra-cloud",
+			"target_projects": []string{"infra-cloud", "infra"},
+			"target_role":     "developer",
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if allowed != c.allowed {
+			t.Errorf("%s: allowed = %v, want %v", c.name, allowed, c.allowed)
+		}
+	}
+}
+
+func TestCanReviewAccessRequest(t *testing.T) {
+	setupTestDB(t)
+	InvalidateRoleGraph()
+	gorm.Entities.Members().Create(model.GopaMembers{Username: "alice", Project: "infra", Role: "admin"})
+	request := model.GopaAccessRequests{Username: "bob", Project: "infra", Role: "developer"}
+	if allowed, err := CanReviewAccessRequest("alice", request); err != nil || !allowed {
+		t.Errorf("CanReviewAccessRequest with the default policy = %v, %v, want true", allowed, err)
+	}
+
+	gorm.Regos = failingRegoStore{gorm.Regos}
+	if allowed, err := CanReviewAccessRequest("alice", request); err == nil || allowed {
+		t.Errorf("CanReviewAccessRequest with the store down = %v, %v, want false and an error", allowed, err)
+	}
+}
@@ -0,0 +1,61 @@
+package util
+
+import (
+	"time"
+
+	"gopa/gorm"
+	"gopa/model"
+)
+
+// RevokeToken 吊销一个token，expiresAt为该token本身的过期时间
+func RevokeToken(jti, username string, expiresAt time.Time, reason string) error {
+	return gorm.DB.Self.Create(&model.GopaRevokedTokens{
+		JTI:       jti,
+		Username:  username,
+		Reason:    reason,
+		ExpiresAt: expiresAt,
+	}).Error
+}
+
+// RevokeUserTokens 使用户在此之前签发的全部token和刷新token失效
+func RevokeUserTokens(username, reason string) error {
+	now := time.Now()
+	db := gorm.DB.Self
+	res := db.Model(&model.GopaRefreshTokens{}).Where("username = ? AND revoked_at IS NULL", username).Update("revoked_at", now)
+	if res.Error != nil {
+		return res.Error
+	}
+	res = db.Model(&model.GopaTokenCutoffs{}).Where("username = ?", username).
+		Updates(map[string]interface{}{"revoked_before": now, "reason": reason})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected > 0 {
+		return nil
+	}
+	return db.Create(&model.GopaTokenCutoffs{Username: username, RevokedBefore: now, Reason: reason}).Error
+}
+
+// TokenRevoked 判断username在issuedAt签发、编号为jti的token是否已被吊销。
+// 没有jti的旧token只按用户的吊销时间判断。查询出错时返回错误，调用方应拒绝该token
+func TokenRevoked(jti, username string, issuedAt time.Time) (bool, error) {
+	db := gorm.DB.Self
+	if jti != "" {
+		var total int64
+		if res := db.Model(&model.GopaRevokedTokens{}).Where("jti = ?", jti).Count(&total); res.Error != nil {
+			return false, res.Error
+		}
+		if total > 0 {
+			return true, nil
+		}
+	}
+	var cutoff model.GopaTokenCutoffs
+	res := db.Where("username = ?", username).Limit(1).Find(&cutoff)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return false, nil
+	}
+	return issuedAt.Unix() < cutoff.RevokedBefore.Unix(), nil
+}
@@ -0,0 +1,55 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"gopa/gorm"
+)
+
+func TestTokenRevoked(t *testing.T) {
+	setupTestDB(t)
+	issued := time.Now().Add(-time.Minute)
+	if revoked, err := TokenRevoked("jti-1", "alice", issued); err != nil || revoked {
+		t.Fatalf("TokenRevoked before revocation = %v, %v", revoked, err)
+	}
+
+	if err := RevokeToken("jti-1", "alice", time.Now().Add(time.Hour), "logout"); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, err := TokenRevoked("jti-1", "alice", issued); err != nil || !revoked {
+		t.Errorf("TokenRevoked(jti-1) = %v, %v, want true", revoked, err)
+	}
+	if revoked, err := TokenRevoked("jti-2", "alice", issued); err != nil || revoked {
+		t.Errorf("TokenRevoked(jti-2) = %v, %v, want false", revoked, err)
+	}
+
+	// 用户的吊销时间之前签发的token全部失效，之后签发的不受影响
+	if err := RevokeUserTokens("alice", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, err := TokenRevoked("jti-2", "alice", issued); err != nil || !revoked {
+		t.Errorf("TokenRevoked issued before the cutoff = %v, %v, want true", revoked, err)
+	}
+	if revoked, err := TokenRevoked("", "alice", issued); err != nil || !revoked {
+		t.Errorf("TokenRevoked without jti issued before the cutoff = %v, %v, want true", revoked, err)
+	}
+	if revoked, err := TokenRevoked("jti-3", "alice", time.Now().Add(time.Minute)); err != nil || revoked {
+		t.Errorf("TokenRevoked issued after the cutoff = %v, %v, want false", revoked, err)
+	}
+	if revoked, err := TokenRevoked("jti-2", "bob", issued); err != nil || revoked {
+		t.Errorf("TokenRevoked for another user = %v, %v, want false", revoked, err)
+	}
+
+	sqlDB, err := gorm.DB.Self.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.Close()
+	if _, err := TokenRevoked("jti-2", "bob", issued); err == nil {
+		t.Error("TokenRevoked with the database closed should return an error")
+	}
+	if _, err := TokenRevoked("", "bob", issued); err == nil {
+		t.Error("TokenRevoked without jti with the database closed should return an error")
+	}
+}
@@ -0,0 +1,151 @@
+package util
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopa/gorm"
+)
+
+// RoleGraph 角色继承图，key为角色名，value为它直接继承的父角色
+type RoleGraph map[string][]string
+
+// FetchRoleGraph 从存储中读取全部角色及其继承关系
+func FetchRoleGraph() (RoleGraph, error) {
+	roles, err := gorm.Entities.Roles().List()
+	if err != nil {
+		return nil, err
+	}
+	parents, err := gorm.Entities.Roles().ListParents()
+	if err != nil {
+		return nil, err
+	}
+	graph := RoleGraph{}
+	for _, role := range roles {
+		if _, ok := graph[role.RoleName]; !ok {
+			graph[role.RoleName] = nil
+		}
+	}
+	for _, edge := range parents {
+		if !contains(graph[edge.RoleName], edge.ParentRoleName) {
+			graph[edge.RoleName] = append(graph[edge.RoleName], edge.ParentRoleName)
+		}
+	}
+	return graph, nil
+}
+
+// Ancestors 返回role以及它直接或间接继承的全部角色，role本身排在第一位
+func (g RoleGraph) Ancestors(role string) []string {
+	result := []string{role}
+	queue := []string{role}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, parent := range g[current] {
+			if !contains(result, parent) {
+				result = append(result, parent)
+				queue = append(queue, parent)
+			}
+		}
+	}
+	return result
+}
+
+// Inheritors 返回role以及直接或间接继承了role的全部角色
+func (g RoleGraph) Inheritors(role string) []string {
+	var result []string
+	for name := range g {
+		if contains(g.Ancestors(name), role) {
+			result = append(result, name)
+		}
+	}
+	if !contains(result, role) {
+		result = append(result, role)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// FindCycle 假设把role的父角色替换为parents，检查继承图中是否会出现环。
+// 如果出现环，返回环上的角色路径，否则返回nil
+func (g RoleGraph) FindCycle(role string, parents []string) []string {
+	next := RoleGraph{}
+	for name, edges := range g {
+		next[name] = edges
+	}
+	next[role] = parents
+	for _, parent := range parents {
+		if path := next.pathTo(parent, role, []string{role}); path != nil {
+			return path
+		}
+	}
+	return nil
+}
+
+// pathTo 沿父角色方向从from查找到to的路径
+func (g RoleGraph) pathTo(from, to string, path []string) []string {
+	path = append(path, from)
+	if from == to {
+		return path
+	}
+	for _, parent := range g[from] {
+		if contains(path[1:], parent) {
+			continue
+		}
+		if found := g.pathTo(parent, to, path); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// roleGraphTTL 缓存的角色继承图的有效期。本实例修改角色后立即失效，
+// 其他实例修改的角色最多延迟这么久生效
+const roleGraphTTL = 10 * time.Second
+
+// roleGraphCache 鉴权时使用的角色继承图，避免每次鉴权都读取全部角色
+var roleGraphCache struct {
+	sync.Mutex
+	graph    RoleGraph
+	loadedAt time.Time
+}
+
+// CachedRoleGraph 返回缓存的角色继承图，超过roleGraphTTL后重新读取
+func CachedRoleGraph() (RoleGraph, error) {
+	roleGraphCache.Lock()
+	defer roleGraphCache.Unlock()
+	if roleGraphCache.graph != nil && time.Since(roleGraphCache.loadedAt) < roleGraphTTL {
+		return roleGraphCache.graph, nil
+	}
+	graph, err := FetchRoleGraph()
+	if err != nil {
+		return nil, err
+	}
+	roleGraphCache.graph = graph
+	roleGraphCache.loadedAt = time.Now()
+	return graph, nil
+}
+
+// InvalidateRoleGraph 修改角色或继承关系后清空缓存的角色继承图
+func InvalidateRoleGraph() {
+	roleGraphCache.Lock()
+	defer roleGraphCache.Unlock()
+	roleGraphCache.graph = nil
+}
+
+// EffectiveRoles 返回role以及它继承的全部角色。
+// 读取继承关系出错时返回错误，调用方应拒绝鉴权
+func EffectiveRoles(role string) ([]string, error) {
+	graph, err := CachedRoleGraph()
+	if err != nil {
+		return nil, err
+	}
+	return graph.Ancestors(role), nil
+}
+
+// FormatRolePath 把环上的角色路径格式化成 a -> b -> a 的形式
+func FormatRolePath(path []string) string {
+	return strings.Join(path, " -> ")
+}
@@ -0,0 +1,59 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+
+	"gopa/gorm"
+	"gopa/model"
+)
+
+func TestRoleGraph(t *testing.T) {
+	graph := RoleGraph{
+		"admin":     {"developer"},
+		"developer": {"guest"},
+		"guest":     nil,
+		"auditor":   {"guest"},
+	}
+	if got := graph.Ancestors("admin"); !reflect.DeepEqual(got, []string{"admin", "developer", "guest"}) {
+		t.Errorf("Ancestors(admin) = %v", got)
+	}
+	if got := graph.Inheritors("guest"); !reflect.DeepEqual(got, []string{"admin", "auditor", "developer", "guest"}) {
+		t.Errorf("Inheritors(guest) = %v", got)
+	}
+	if cycle := graph.FindCycle("auditor", []string{"admin"}); cycle != nil {
+		t.Errorf("FindCycle(auditor -> admin) = %v, want nil", cycle)
+	}
+	if cycle := graph.FindCycle("guest", []string{"admin"}); !reflect.DeepEqual(cycle, []string{"guest", "admin", "developer", "guest"}) {
+		t.Errorf("FindCycle(guest -> admin) = %v", cycle)
+	}
+	if cycle := graph.FindCycle("admin", []string{"admin"}); !reflect.DeepEqual(cycle, []string{"admin", "admin"}) {
+		t.Errorf("FindCycle(admin -> admin) = %v", cycle)
+	}
+}
+
+func TestEffectiveRoles(t *testing.T) {
+	setupTestDB(t)
+	InvalidateRoleGraph()
+	gorm.Entities.Roles().Create(model.GopaRoles{RoleName: "admin"}, nil)
+	gorm.Entities.Roles().Create(model.GopaRoles{RoleName: "developer"}, nil)
+	if got, err := EffectiveRoles("admin"); err != nil || !reflect.DeepEqual(got, []string{"admin"}) {
+		t.Fatalf("EffectiveRoles(admin) = %v, %v", got, err)
+	}
+
+	// 缓存失效前看不到新的继承关系
+	gorm.Entities.Roles().ReplaceParents("admin", []string{"developer"}, gorm.AnyVersion)
+	if got, _ := EffectiveRoles("admin"); !reflect.DeepEqual(got, []string{"admin"}) {
+		t.Errorf("EffectiveRoles(admin) before invalidation = %v", got)
+	}
+	InvalidateRoleGraph()
+	if got, _ := EffectiveRoles("admin"); !reflect.DeepEqual(got, []string{"admin", "developer"}) {
+		t.Errorf("EffectiveRoles(admin) after invalidation = %v", got)
+	}
+
+	gorm.Entities = failingEntityStore{gorm.Entities}
+	InvalidateRoleGraph()
+	if got, err := EffectiveRoles("admin"); err == nil {
+		t.Errorf("EffectiveRoles(admin) with the store down = %v, want an error", got)
+	}
+}
@@ -0,0 +1,39 @@
+package util
+
+import (
+	"time"
+
+	"gopa/gorm"
+	"gopa/model"
+)
+
+// ActiveRefreshTokens 返回用户每个登录当前可用的刷新token，最近刷新的在前
+func ActiveRefreshTokens(username string, now time.Time) ([]model.GopaRefreshTokens, error) {
+	var tokens []model.GopaRefreshTokens
+	res := gorm.DB.Self.Where("username = ? AND used_at IS NULL AND revoked_at IS NULL AND expires_at > ?", username, now).
+		Order("id desc").Find(&tokens)
+	return tokens, res.Error
+}
+
+// RevokeSession 吊销一次登录的全部刷新token，以及其中仍未过期的token
+func RevokeSession(session, reason string) error {
+	now := time.Now()
+	db := gorm.DB.Self
+	var tokens []model.GopaRefreshTokens
+	if res := db.Where("session = ?", session).Find(&tokens); res.Error != nil {
+		return res.Error
+	}
+	res := db.Model(&model.GopaRefreshTokens{}).Where("session = ? AND revoked_at IS NULL", session).Update("revoked_at", now)
+	if res.Error != nil {
+		return res.Error
+	}
+	for _, t := range tokens {
+		if t.AccessJTI == "" || !t.AccessExpiresAt.After(now) {
+			continue
+		}
+		if err := RevokeToken(t.AccessJTI, t.Username, t.AccessExpiresAt, reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"errors"
+	"testing"
+
+	"gopa/gorm"
+	"gopa/model"
+)
+
+// setupTestDB 使用内存数据库和内存中的rego文件存储
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	conf := &model.SysConfig{}
+	conf.Gorm.DBType = gorm.DBTypeMemory
+	if err := gorm.Setup(conf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failingRegoStore 每次查询都失败的rego文件存储，模拟MongoDB不可用
+type failingRegoStore struct {
+	gorm.RegoStore
+}
+
+var errStoreDown = errors.New("store is down")
+
+func (failingRegoStore) Get(string) (model.RegoDocument, error) {
+	return model.RegoDocument{}, errStoreDown
+}
+
+// failingEntityStore 读取组、角色和授权时都失败的实体存储，模拟数据库不可用
+type failingEntityStore struct {
+	gorm.EntityStore
+}
+
+func (failingEntityStore) Projects() gorm.ProjectRepository { return failingProjects{} }
+func (failingEntityStore) Roles() gorm.RoleRepository       { return failingRoles{} }
+func (failingEntityStore) Members() gorm.MemberRepository   { return failingMembers{} }
+
+type failingProjects struct{ gorm.ProjectRepository }
+
+func (failingProjects) List() ([]model.GopaProjects, error) { return nil, errStoreDown }
+
+type failingRoles struct{ gorm.RoleRepository }
+
+func (failingRoles) List() ([]model.GopaRoles, error) { return nil, errStoreDown }
+
+type failingMembers struct{ gorm.MemberRepository }
+
+func (failingMembers) Find(gorm.MemberQuery) ([]model.GopaMembers, error) { return nil, errStoreDown }
@@ -7,7 +7,6 @@ import (
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/pkg/errors"
 	"github.com/teris-io/shortid"
-	"go.mongodb.org/mongo-driver/bson"
 	"gopa/gorm"
 	"gopa/model"
 	"path/filepath"
@@ -46,7 +45,6 @@ func BuildQuery(referer string, general bool) string {
 	return query
 }
 
-
 // BuildPath 根据referer参数
 // 构建OPA请求的mongo路径，用于查询mongo中的策略文件
 // 如：/perf-server/api/v1/bus/latestData.rego
@@ -56,20 +54,29 @@ func BuildPath(referer string) string {
 	return mongoPath
 }
 
-
 // BuildForm 根据请求头内的参数
 // 构建请求OPA权限接口的表单
-// 如果没有对应参数，该方法返回错误信息
-func BuildForm(context *gin.Context, params []string) map[string]interface{} {
+// 表单中的roles字段为role及其继承的全部角色，
+// projects字段为project及其全部上级组。读取角色继承关系出错时返回错误
+func BuildForm(context *gin.Context, params []string) (map[string]interface{}, error) {
 	input := map[string]interface{}{}
 	for _, argument := range params {
 		arg := context.GetHeader(argument)
 		input[argument] = arg
 	}
-	return input
+	if role := context.GetHeader("role"); role != "" {
+		roles, err := EffectiveRoles(role)
+		if err != nil {
+			return nil, err
+		}
+		input["roles"] = roles
+	}
+	if project := context.GetHeader("project"); project != "" {
+		input["projects"] = EffectiveProjects(project)
+	}
+	return input, nil
 }
 
-
 // ArgumentsParser 根据用户添加的rego策略文件内容
 // 解析出input字段名并返回
 func ArgumentsParser(fileContent string) []string {
@@ -97,15 +104,9 @@ func contains(list []string, elem string) bool {
 	return false
 }
 
-
-// FetchRegoByPath 根据path返回Mongo数据库中的rego文件
+// FetchRegoByPath 根据path返回保存的rego文件
 func FetchRegoByPath(path string) (model.RegoDocument, error) {
-	var result model.RegoDocument
-	filter := bson.D{{"path", path}}
-	//print("请求mongo路径：", path)
-	collection := gorm.Collections.RegoCollection
-	err := collection.FindOne(ctx.TODO(), filter).Decode(&result)
-	return result, err
+	return gorm.Regos.Get(path)
 }
 
 // GeneralMatch 从referer的最高项开始向下查询，确认该用户
@@ -127,7 +128,10 @@ func GeneralMatch(context *gin.Context, context1 ctx.Context, path string) (bool
 		}
 		module := document.Content
 		arguments := document.Arguments
-		form := BuildForm(context, arguments)
+		form, err := BuildForm(context, arguments)
+		if err != nil {
+			return false, err
+		}
 		query := rego.New(
 			rego.Query(evalQuery),
 			rego.Module(root, module),
@@ -145,4 +149,4 @@ func GeneralMatch(context *gin.Context, context1 ctx.Context, path string) (bool
 	}
 	fmt.Printf("路径 [%s] 下没有通配权限\n", path)
 	return false, nil
-}
\ No newline at end of file
+}